@@ -17,6 +17,8 @@ type Backend interface {
 	AdvanceFrame(checksum uint32) error
 	DisconnectPlayer(handle PlayerHandle) error
 	GetNetworkStats(handle PlayerHandle) (protocol.NetworkStats, error)
+	GetSessionStats() (SessionStats, error)
+	GetPlayerStatus(handle PlayerHandle) (PlayerStatus, error)
 	SetFrameDelay(player PlayerHandle, delay int) error
 	SetDisconnectTimeout(timeout int) error
 	SetDisconnectNotifyStart(timeout int) error
@@ -0,0 +1,73 @@
+package ggpo
+
+import "hash/fnv"
+
+/*
+An alternative to Session for games that can serialize their state. Instead of
+keeping its own map of state IDs, the game hands the library a byte slice and
+gets the same bytes back when it's time to roll back. The library hashes the
+saved bytes, so the game doesn't have to compute checksums for desync
+detection either. Wrap it with NewBufferedSession to use it as a Session.
+*/
+type BufferedSession interface {
+	SaveGameState() []byte
+	LoadGameState(state []byte)
+	AdvanceFrame(flags int)
+	OnEvent(info *Event)
+}
+
+// Stores a BufferedSession's saved states in a pool of buffers indexed by state ID.
+type BufferedSessionAdapter struct {
+	session BufferedSession
+	states  [][]byte
+}
+
+func NewBufferedSession(session BufferedSession) *BufferedSessionAdapter {
+	return &BufferedSessionAdapter{session: session}
+}
+
+/*
+Copies the game's state into the buffer for stateID, reusing the buffer's
+memory from earlier saves, and returns its checksum.
+*/
+func (b *BufferedSessionAdapter) SaveGameState(stateID int) int {
+	for len(b.states) <= stateID {
+		b.states = append(b.states, nil)
+	}
+	b.states[stateID] = append(b.states[stateID][:0], b.session.SaveGameState()...)
+	return int(Checksum(b.states[stateID]))
+}
+
+func (b *BufferedSessionAdapter) LoadGameState(stateID int) {
+	b.session.LoadGameState(b.State(stateID))
+}
+
+func (b *BufferedSessionAdapter) AdvanceFrame(flags int) {
+	b.session.AdvanceFrame(flags)
+}
+
+func (b *BufferedSessionAdapter) OnEvent(info *Event) {
+	b.session.OnEvent(info)
+}
+
+// The saved bytes for stateID. They're overwritten the next time that ID is saved.
+func (b *BufferedSessionAdapter) State(stateID int) []byte {
+	if stateID < 0 || stateID >= len(b.states) {
+		return nil
+	}
+	return b.states[stateID]
+}
+
+// Whether AdvanceFrame(DefaultChecksum) takes the checksum from saving the
+// state, which only a BufferedSession's checksums are meant for.
+func usesSavedChecksums(session Session) bool {
+	_, ok := session.(*BufferedSessionAdapter)
+	return ok
+}
+
+// The checksum used for saved states, a 32 bit FNV-1a hash.
+func Checksum(state []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(state)
+	return h.Sum32()
+}
@@ -0,0 +1,138 @@
+package ggpo_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/assemblaj/ggpo"
+)
+
+// A game whose whole state is a frame counter and the last input seen.
+type counterGame struct {
+	backend   ggpo.Backend
+	frame     byte
+	lastInput byte
+	saves     int
+	// when set, every save is different so replays never match
+	nondeterministic bool
+}
+
+func (c *counterGame) SaveGameState() []byte {
+	c.saves++
+	if c.nondeterministic {
+		return []byte{c.frame, c.lastInput, byte(c.saves)}
+	}
+	return []byte{c.frame, c.lastInput}
+}
+
+func (c *counterGame) LoadGameState(state []byte) {
+	c.frame = state[0]
+	c.lastInput = state[1]
+}
+
+func (c *counterGame) AdvanceFrame(flags int) {
+	var disconnectFlags int
+	vals, err := c.backend.SyncInput(&disconnectFlags)
+	if err == nil {
+		c.frame++
+		c.lastInput = vals[0][0]
+		c.backend.AdvanceFrame(ggpo.DefaultChecksum)
+	}
+}
+
+func (c *counterGame) OnEvent(info *ggpo.Event) {}
+
+func TestBufferedSessionSaveLoad(t *testing.T) {
+	game := counterGame{frame: 3, lastInput: 7}
+	session := ggpo.NewBufferedSession(&game)
+
+	checksum := session.SaveGameState(2)
+	if uint32(checksum) != ggpo.Checksum([]byte{3, 7}) {
+		t.Errorf("expected the checksum of the saved bytes but got %d", checksum)
+	}
+	if !bytes.Equal(session.State(2), []byte{3, 7}) {
+		t.Errorf("expected state 2 to hold %v but got %v", []byte{3, 7}, session.State(2))
+	}
+
+	game.frame = 10
+	session.SaveGameState(0)
+	session.LoadGameState(2)
+	if game.frame != 3 || game.lastInput != 7 {
+		t.Errorf("Loading state 2 should have restored frame 3, got frame %d input %d", game.frame, game.lastInput)
+	}
+	if session.State(5) != nil {
+		t.Errorf("A state that was never saved should be nil.")
+	}
+}
+
+func runBufferedSyncTest(game *counterGame, frames int) {
+	session := ggpo.NewBufferedSession(game)
+	player := ggpo.NewLocalPlayer(20, 1)
+	stb := ggpo.NewSyncTest(session, 1, 4, 1, true)
+	game.backend = &stb
+	var handle ggpo.PlayerHandle
+	stb.AddPlayer(&player, &handle)
+	for i := 0; i < frames; i++ {
+		stb.Idle(0)
+		if stb.AddLocalInput(handle, []byte{byte(i)}, 1) == nil {
+			game.AdvanceFrame(0)
+		}
+	}
+}
+
+func TestBufferedSessionSyncTest(t *testing.T) {
+	game := counterGame{}
+	runBufferedSyncTest(&game, 10)
+	if game.frame != 10 {
+		t.Errorf("expected the game to be at frame 10 but it's at %d", game.frame)
+	}
+}
+
+func TestBufferedSessionSyncTestDesync(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("The sync test should catch states that differ when replayed.")
+		}
+	}()
+	game := counterGame{nondeterministic: true}
+	runBufferedSyncTest(&game, 10)
+}
+
+// A plain Session around the adapter, so the library can't tell it's buffered.
+type unbufferedSession struct {
+	*ggpo.BufferedSessionAdapter
+}
+
+// Only a BufferedSession gets the saved state's checksum for DefaultChecksum.
+func TestBufferedSessionDefaultChecksum(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		game := counterGame{}
+		var session ggpo.Session = ggpo.NewBufferedSession(&game)
+		if !buffered {
+			session = unbufferedSession{ggpo.NewBufferedSession(&game)}
+		}
+		stb := ggpo.NewSyncTest(session, 1, 4, 1, true)
+		game.backend = &stb
+		var recording bytes.Buffer
+		stb.SetReplayRecording(&recording, nil)
+		player := ggpo.NewLocalPlayer(20, 1)
+		var handle ggpo.PlayerHandle
+		stb.AddPlayer(&player, &handle)
+		for i := 0; i < 70; i++ {
+			stb.Idle(0)
+			if stb.AddLocalInput(handle, []byte{byte(i)}, 1) == nil {
+				game.AdvanceFrame(0)
+			}
+		}
+		data, err := ggpo.LoadReplay(&recording)
+		if err != nil {
+			t.Fatalf("Error when loading the replay: %s", err)
+		}
+		if buffered && len(data.Checksums) == 0 {
+			t.Errorf("expected a BufferedSession's checksums to be recorded")
+		}
+		if !buffered && len(data.Checksums) != 0 {
+			t.Errorf("expected no checksums for a Session passing DefaultChecksum, got %v", data.Checksums)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+A headless relay server for ggpo.Relay clients.
+
+	ggpo-server [-log] <port> <input size> <player ip:port>...
+
+Players are numbered in the order they're given. A client with several local
+players is listed once for each of them. The server exits once every player has
+left.
+*/
+package main
+
+import (
+	"flag"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/assemblaj/ggpo"
+)
+
+type peerAddress struct {
+	ip   string
+	port int
+}
+
+func getPeerAddress(address string) peerAddress {
+	peerIPSlice := strings.Split(address, ":")
+	if len(peerIPSlice) < 2 {
+		log.Fatalf("Please enter IP as ip:port, got %s", address)
+	}
+	peerPort, err := strconv.Atoi(peerIPSlice[1])
+	if err != nil {
+		log.Fatalf("Please enter integer port, got %s", peerIPSlice[1])
+	}
+	return peerAddress{
+		ip:   peerIPSlice[0],
+		port: peerPort,
+	}
+}
+
+func main() {
+	logs := flag.Bool("log", false, "print log messages")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 3 {
+		log.Fatal("Must enter <port> <input size> <player ip:port>...")
+	}
+	localPort, err := strconv.Atoi(args[0])
+	if err != nil {
+		log.Fatal("Please enter integer port")
+	}
+	inputSize, err := strconv.Atoi(args[1])
+	if err != nil {
+		log.Fatal("Please enter integer input size")
+	}
+	if *logs {
+		ggpo.EnableLogs()
+	}
+
+	addresses := args[2:]
+	server := ggpo.NewRelayServer(localPort, len(addresses), inputSize)
+	server.InitializeConnection()
+	for i, address := range addresses {
+		remote := getPeerAddress(address)
+		player := ggpo.NewRemotePlayer(inputSize, i+1, remote.ip, remote.port)
+		var handle ggpo.PlayerHandle
+		err := server.AddPlayer(&player, &handle)
+		if err != nil {
+			log.Fatalf("Could not add player %d at %s: %s", i+1, address, err)
+		}
+	}
+	server.Start()
+	log.Printf("Relaying for %d players on port %d", len(addresses), localPort)
+
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := server.Idle(0)
+		if err != nil {
+			log.Fatalf("Relaying failed: %s", err)
+		}
+		if allLeft(&server, len(addresses)) {
+			log.Printf("Every player has left")
+			server.Close()
+			return
+		}
+	}
+}
+
+func allLeft(server *ggpo.RelayServer, numPlayers int) bool {
+	for num := 1; num <= numPlayers; num++ {
+		status, err := server.GetPlayerStatus(ggpo.PlayerHandle(num))
+		if err != nil || status.State != ggpo.PlayerStateDisconnected {
+			return false
+		}
+	}
+	return true
+}
@@ -1,8 +1,23 @@
 package ggpo
 
+import "time"
+
 const (
-	MaxPlayers             = 4
+	MaxPlayers             = 8
 	MaxPredictionFrames    = 8
+	MaxPredictionWindow    = 30
+	MaxChecksumDistance    = 32
 	MaxSpectators          = 32
 	SpectatorInputInterval = 4
+	FrameRate              = 60
 )
+
+// FramesFromDuration converts a duration into a number of frames at FrameRate,
+// rounding up so that a non-zero duration is never shorter than requested.
+func FramesFromDuration(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	frameDuration := time.Second / FrameRate
+	return int((d + frameDuration - 1) / frameDuration)
+}
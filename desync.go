@@ -0,0 +1,68 @@
+package ggpo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// What a Peer does when its checksum for a frame doesn't match another peer's.
+type DesyncPolicy int
+
+const (
+	// Raise EventCodeDesync and keep going, the default.
+	DesyncPolicyNotify DesyncPolicy = iota
+	// Don't compare checksums at all.
+	DesyncPolicyIgnore
+	// Raise EventCodeDesync, then fail every further call with
+	// ErrorCodeDesynchronized.
+	DesyncPolicyHalt
+	// Raise EventCodeDesync, then load the authority's state for that frame
+	// and resimulate from it.
+	DesyncPolicyResync
+)
+
+// The default StateDiffer. Without knowing the layout of the state it can only
+// report which byte ranges differ.
+type ByteDiffer struct{}
+
+func (b ByteDiffer) DiffStates(local []byte, remote []byte) []string {
+	var diff []string
+	if len(local) != len(remote) {
+		diff = append(diff, fmt.Sprintf("size differs: %d local, %d remote", len(local), len(remote)))
+	}
+	size := len(local)
+	if len(remote) < size {
+		size = len(remote)
+	}
+	for i := 0; i < size; i++ {
+		if local[i] == remote[i] {
+			continue
+		}
+		start := i
+		for i < size && local[i] != remote[i] {
+			i++
+		}
+		diff = append(diff, fmt.Sprintf("bytes %d-%d differ", start, i-1))
+	}
+	return diff
+}
+
+// Writes both sides of a desync report to dir and returns the file names.
+func writeDesyncReport(dir string, frame int, player PlayerHandle, local []byte, remote []byte) (string, string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", "", err
+	}
+	localFile := filepath.Join(dir, fmt.Sprintf("desync-%d-local.bin", frame))
+	remoteFile := filepath.Join(dir, fmt.Sprintf("desync-%d-player%d.bin", frame, player))
+	err = os.WriteFile(localFile, local, 0644)
+	if err != nil {
+		return "", "", err
+	}
+	err = os.WriteFile(remoteFile, remote, 0644)
+	if err != nil {
+		return "", "", err
+	}
+	return localFile, remoteFile, nil
+}
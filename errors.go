@@ -1,6 +1,10 @@
 package ggpo
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/assemblaj/ggpo/internal/util"
+)
 
 type Error struct {
 	Code ErrorCode
@@ -28,8 +32,20 @@ const (
 	ErrorCodePlayerDisconnected  ErrorCode = 9
 	ErrorCodeTooManySpectators   ErrorCode = 10
 	ErrorCodeInvalidRequest      ErrorCode = 11
+	ErrorCodeDesynchronized      ErrorCode = 12
+	ErrorCodeInvalidInput        ErrorCode = 13
+	ErrorCodeStateNotFound       ErrorCode = 14
+	ErrorCodeInvalidReplay       ErrorCode = 15
+	ErrorCodeInputNotReady       ErrorCode = 16 // Lockstep is still waiting on a player's input
 )
 
 func Success(result ErrorCode) bool {
 	return result == ErrorCodeSuccess
 }
+
+// Logs the internal error behind a failure, since the returned Error only
+// carries its code.
+func newError(code ErrorCode, name string, err error) Error {
+	util.Log.Printf("%s: %s\n", name, err)
+	return Error{Code: code, Name: name}
+}
@@ -13,6 +13,11 @@ const (
 	EventCodeConnectionResumed     EventCode = 1007
 	EventCodeSyncTestDesync        EventCode = 1008
 	EventCodeDesync                EventCode = 1009
+	EventCodeSpectatorResync       EventCode = 1010
+	EventCodeDesyncReport          EventCode = 1011
+	EventCodeResynchronized        EventCode = 1012
+	EventCodeInputDelayAgreed      EventCode = 1013
+	EventCodeMismatchedPeer        EventCode = 1014 // another resync authority or protocol version
 )
 
 // the original had a union a named struct for each event type,
@@ -22,14 +27,20 @@ const (
 type Event struct {
 	Code                   EventCode
 	Player                 PlayerHandle
-	Count                  int     // synchronizing
-	Total                  int     // synchronizing
-	FramesAhead            float32 // timesync
-	TimeSyncPeriodInFrames int     // timesync
-	DisconnectTimeout      int     // connection interrupted
-	CurrentState           int     // SyncTestDesync
-	LastVerified           int     // SyncTestDesync
-	NumFrameOfDesync       int     // Desync
-	LocalChecksum          int     // Desync
-	RemoteChecksum         int     // Desync
+	Count                  int            // synchronizing
+	Total                  int            // synchronizing
+	FramesAhead            float32        // timesync
+	TimeSyncPeriodInFrames int            // timesync
+	DisconnectTimeout      int            // connection interrupted
+	CurrentState           int            // SyncTestDesync
+	LastVerified           int            // SyncTestDesync
+	NumFrameOfDesync       int            // Desync
+	LocalChecksum          int            // Desync
+	RemoteChecksum         int            // Desync
+	MinorityPlayers        []PlayerHandle // Desync
+	Frame                  int            // SpectatorResync, DesyncReport, Resynchronized, InputDelayAgreed
+	DiffFields             []string       // DesyncReport
+	LocalStateFile         string         // DesyncReport
+	RemoteStateFile        string         // DesyncReport
+	InputDelay             int            // InputDelayAgreed
 }
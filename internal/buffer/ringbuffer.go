@@ -19,8 +19,8 @@ func NewRingBuffer[T any](capacity int) RingBuffer[T] {
 
 func (r *RingBuffer[T]) Front() (T, error) {
 	var element T
-	if r.size == r.capacity {
-		return element, errors.New("ggpo RingBuffer Front : r.size == capacity")
+	if r.size == 0 {
+		return element, errors.New("ggpo RingBuffer Front : r.size == 0")
 	}
 	element = r.elements[r.tail]
 	return element, nil
@@ -35,11 +35,9 @@ func (r *RingBuffer[T]) Item(i int) (T, error) {
 	return element, nil
 }
 
-// hmm this fails if its at its max size
-// seems to not make sense
 func (r *RingBuffer[T]) Pop() error {
-	if r.size == r.capacity {
-		return errors.New("ggpo RingBuffer Pop : r.size == r.capacity")
+	if r.size == 0 {
+		return errors.New("ggpo RingBuffer Pop : r.size == 0")
 	}
 	r.tail = (r.tail + 1) % r.capacity
 	r.size--
@@ -47,8 +45,8 @@ func (r *RingBuffer[T]) Pop() error {
 }
 
 func (r *RingBuffer[T]) Push(element T) error {
-	if r.size == r.capacity-1 {
-		return errors.New("ggpo RingBuffer Push : r.size == r.capacity -1 ")
+	if r.size == r.capacity {
+		return errors.New("ggpo RingBuffer Push : r.size == r.capacity")
 	}
 	r.elements[r.head] = element
 	r.head = (r.head + 1) % r.capacity
@@ -60,9 +58,6 @@ func (r *RingBuffer[T]) Size() int {
 	return r.size
 }
 
-// It's supposed to be size == 0,  I have no idea why it's been making it to <1 but it's been
-// breaking me code
-// - me considering checking for r <= 0
 func (r *RingBuffer[T]) Empty() bool {
-	return r.size <= 0
+	return r.size == 0
 }
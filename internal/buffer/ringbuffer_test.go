@@ -95,3 +95,33 @@ func TestRingBufferItemError(t *testing.T) {
 		t.Errorf("Trying to get an item larger than the size of the buffer should be an error.")
 	}
 }
+
+func TestRingBufferFull(t *testing.T) {
+	rb := buffer.NewRingBuffer[int](3)
+	for i := 0; i < 3; i++ {
+		err := rb.Push(i)
+		if err != nil {
+			t.Fatalf("Pushing %d of 3 shouldn't be an error: %s", i+1, err)
+		}
+	}
+	val, err := rb.Front()
+	if err != nil || val != 0 {
+		t.Errorf("expected the front of a full buffer to be 0, got %d (%v)", val, err)
+	}
+	err = rb.Pop()
+	if err != nil {
+		t.Errorf("Popping a full buffer shouldn't be an error: %s", err)
+	}
+}
+
+func TestRingBufferEmptyError(t *testing.T) {
+	rb := buffer.NewRingBuffer[int](3)
+	_, err := rb.Front()
+	if err == nil {
+		t.Errorf("Getting the front of an empty buffer should be an error.")
+	}
+	err = rb.Pop()
+	if err == nil {
+		t.Errorf("Popping an empty buffer should be an error.")
+	}
+}
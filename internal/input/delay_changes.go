@@ -0,0 +1,76 @@
+package input
+
+// A frame delay that takes effect from Frame on.
+type DelayChange struct {
+	Frame int
+	Delay int
+}
+
+/*
+Frame delay changes in frame order. A second change for a frame replaces the
+first, so hearing of the same change twice is harmless.
+*/
+type DelayChanges []DelayChange
+
+// Adds the change in frame order, returning false if it was already there.
+func (c *DelayChanges) Add(frame int, delay int) bool {
+	changes := *c
+	at := len(changes)
+	for at > 0 && changes[at-1].Frame >= frame {
+		at--
+	}
+	if at < len(changes) && changes[at].Frame == frame {
+		if changes[at].Delay == delay {
+			return false
+		}
+		changes[at].Delay = delay
+		return true
+	}
+	changes = append(changes, DelayChange{})
+	copy(changes[at+1:], changes[at:])
+	changes[at] = DelayChange{Frame: frame, Delay: delay}
+	*c = changes
+	return true
+}
+
+// The delay in effect at frame, or delay if no change has taken effect by then.
+func (c DelayChanges) At(frame int, delay int) int {
+	for _, change := range c {
+		if change.Frame > frame {
+			break
+		}
+		delay = change.Delay
+	}
+	return delay
+}
+
+// Removes the changes that have taken effect by frame and returns the delay
+// they leave, or delay if none have.
+func (c *DelayChanges) Apply(frame int, delay int) int {
+	changes := *c
+	for len(changes) > 0 && changes[0].Frame <= frame {
+		delay = changes[0].Delay
+		changes = changes[1:]
+	}
+	*c = changes
+	return delay
+}
+
+// Drops the changes superseded by frame, keeping the one in effect there so
+// At still answers for it and every frame after.
+func (c *DelayChanges) Prune(frame int) {
+	changes := *c
+	drop := 0
+	for drop+1 < len(changes) && changes[drop+1].Frame <= frame {
+		drop++
+	}
+	*c = append(changes[:0], changes[drop:]...)
+}
+
+// The latest change, false if there is none.
+func (c DelayChanges) Last() (DelayChange, bool) {
+	if len(c) == 0 {
+		return DelayChange{}, false
+	}
+	return c[len(c)-1], true
+}
@@ -0,0 +1,40 @@
+package input_test
+
+import (
+	"testing"
+
+	"github.com/assemblaj/ggpo/internal/input"
+)
+
+func TestDelayChanges(t *testing.T) {
+	var changes input.DelayChanges
+	if !changes.Add(20, 4) || !changes.Add(10, 2) || !changes.Add(30, 6) {
+		t.Fatalf("expected new changes to be added")
+	}
+	if changes.Add(20, 4) {
+		t.Errorf("expected a repeated change to be ignored")
+	}
+	if !changes.Add(20, 5) {
+		t.Errorf("expected a change for the same frame to replace the first")
+	}
+	for frame, want := range map[int]int{0: 1, 10: 2, 25: 5, 30: 6} {
+		if got := changes.At(frame, 1); got != want {
+			t.Errorf("expected delay %d at frame %d, got %d", want, frame, got)
+		}
+	}
+
+	changes.Prune(25)
+	if len(changes) != 2 || changes[0].Frame != 20 {
+		t.Errorf("expected pruning to keep the change in effect and the ones after it, got %v", changes)
+	}
+	if got := changes.At(27, 1); got != 5 {
+		t.Errorf("expected delay 5 at frame 27 after pruning, got %d", got)
+	}
+
+	if got := changes.Apply(29, 1); got != 5 || len(changes) != 1 {
+		t.Errorf("expected applying to frame 29 to leave delay 5 and one change, got %d and %v", got, changes)
+	}
+	if last, ok := changes.Last(); !ok || last.Frame != 30 || last.Delay != 6 {
+		t.Errorf("expected the last change to be 6 at frame 30, got %v", last)
+	}
+}
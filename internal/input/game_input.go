@@ -10,9 +10,7 @@ import (
 )
 
 const (
-	GameInputMaxBytes   = 9
-	GameInputMaxPlayers = 2
-	NullFrame           = -1
+	NullFrame = -1
 )
 
 type GameInput struct {
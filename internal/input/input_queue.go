@@ -1,6 +1,7 @@
 package input
 
 import (
+	"bytes"
 	"errors"
 
 	"github.com/assemblaj/ggpo/internal/util"
@@ -9,8 +10,15 @@ import (
 const (
 	InputQueueLength = 128
 	DefaultInputSize = 4
+	PredictorHistory = 8
 )
 
+// Predictor guesses a player's input for a frame that hasn't arrived yet from
+// up to PredictorHistory of their most recent confirmed inputs, oldest first.
+type Predictor interface {
+	PredictInput(frame int, recent [][]byte) []byte
+}
+
 type InputQueue struct {
 	id         int
 	head       int
@@ -24,14 +32,27 @@ type InputQueue struct {
 	lastFrameRequested  int
 
 	frameDelay int
+	// Delay changes waiting for their frame in frame order, see ScheduleFrameDelay
+	delayChanges DelayChanges
 
 	inputs     []GameInput
 	prediction GameInput
+
+	// With a predictor every predicted frame can differ, so each guess is
+	// kept until the real input arrives to check it against.
+	predictor   Predictor
+	predictions map[int][]byte
 }
 
-func NewInputQueue(id int, inputSize int) InputQueue {
+// queueLength defaults to InputQueueLength. Sessions with a long prediction
+// window need more room between the last confirmed frame and the newest one.
+func NewInputQueue(id int, inputSize int, queueLength ...int) InputQueue {
 	var err error
-	inputs := make([]GameInput, InputQueueLength)
+	length := InputQueueLength
+	if len(queueLength) > 0 && queueLength[0] > 0 {
+		length = queueLength[0]
+	}
+	inputs := make([]GameInput, length)
 	for i, _ := range inputs {
 		defaultInput := make([]byte, inputSize)
 		inputs[i], err = NewGameInput(-1, defaultInput, inputSize)
@@ -86,7 +107,7 @@ func (i *InputQueue) DiscardConfirmedFrames(frame int) error {
 			return errors.New("ggpo: InputQueue discardConfirmedFrames: offet < 0")
 		}
 
-		i.tail = (i.tail + offset) % InputQueueLength
+		i.tail = (i.tail + offset) % len(i.inputs)
 		i.length -= offset
 	}
 
@@ -107,6 +128,9 @@ func (i *InputQueue) ResetPrediction(frame int) error {
 	i.prediction.Frame = NullFrame
 	i.firstIncorrectFrame = NullFrame
 	i.lastFrameRequested = NullFrame
+	for frame := range i.predictions {
+		delete(i.predictions, frame)
+	}
 	return nil
 }
 
@@ -115,7 +139,7 @@ func (i *InputQueue) GetConfirmedInput(requestedFrame int, input *GameInput) (bo
 		return false, errors.New("ggpo: InputQueue GetConfirmedInput : i.firstIncorrectFrame != NullFrame && requestedFrame >")
 	}
 
-	offset := requestedFrame % InputQueueLength
+	offset := requestedFrame % len(i.inputs)
 	if i.inputs[offset].Frame != requestedFrame {
 		return false, nil
 	}
@@ -138,7 +162,7 @@ func (i *InputQueue) GetInput(requestedFrame int, input *GameInput) (bool, error
 		offset := requestedFrame - i.inputs[i.tail].Frame
 
 		if offset < i.length {
-			offset = (offset + i.tail) % InputQueueLength
+			offset = (offset + i.tail) % len(i.inputs)
 			if i.inputs[offset].Frame != requestedFrame {
 				return false, errors.New("ggpo: InputQueue GetInput : i.inputs[offset].Frame != requestedFrame")
 			}
@@ -155,8 +179,8 @@ func (i *InputQueue) GetInput(requestedFrame int, input *GameInput) (bool, error
 			i.prediction.Erase()
 		} else {
 			util.Log.Printf("basing new prediction frame from previously added frame (queue entry:%d, frame:%d).\n",
-				previousFrame(i.head), i.inputs[previousFrame(i.head)].Frame)
-			i.prediction = i.inputs[previousFrame(i.head)]
+				i.previousFrame(i.head), i.inputs[i.previousFrame(i.head)].Frame)
+			i.prediction = i.inputs[i.previousFrame(i.head)]
 		}
 		i.prediction.Frame++
 	}
@@ -166,6 +190,10 @@ func (i *InputQueue) GetInput(requestedFrame int, input *GameInput) (bool, error
 	}
 	*input = i.prediction
 	input.Frame = requestedFrame
+	if i.predictor != nil {
+		input.Bits = i.predictor.PredictInput(requestedFrame, i.recentInputs())
+		i.predictions[requestedFrame] = input.Bits
+	}
 	util.Log.Printf("returning prediction frame number %d (%d).\n", input.Frame, i.prediction.Frame)
 
 	return false, nil
@@ -180,14 +208,18 @@ func (i *InputQueue) AddInput(input *GameInput) error {
 		return errors.New("ggpo : InputQueue AddInput : !(i.lastUserAddedFrame == NullFrame || input.Frame == i.lastUserAddedFrame+1)")
 	}
 	i.lastUserAddedFrame = input.Frame
+	i.frameDelay = i.delayChanges.Apply(input.Frame, i.frameDelay)
 
 	newFrame, err = i.AdvanceQueueHead(input.Frame)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if newFrame != NullFrame {
-		i.AddDelayedInputToQueue(input, newFrame)
+		err = i.AddDelayedInputToQueue(input, newFrame)
+		if err != nil {
+			return err
+		}
 	}
 
 	input.Frame = newFrame
@@ -201,15 +233,15 @@ func (i *InputQueue) AddDelayedInputToQueue(input *GameInput, frameNumber int) e
 	if !(i.lastAddedFrame == NullFrame || frameNumber == i.lastAddedFrame+1) {
 		return errors.New("ggpo: InputQueue AddDelayedInputToQueue : i.lastAddedFrame != NullFrame && frameNumber != i.lastAddedFrame+1")
 	}
-	if !(frameNumber == 0 || i.inputs[previousFrame(i.head)].Frame == frameNumber-1) {
-		return errors.New("ggpo: InputQueue AddDelayedInputToQueue : frameNumber != 0 && i.inputs[previousFrame(i.head)].Frame == frameNumber-1")
+	if !(frameNumber == 0 || i.inputs[i.previousFrame(i.head)].Frame == frameNumber-1) {
+		return errors.New("ggpo: InputQueue AddDelayedInputToQueue : frameNumber != 0 && i.inputs[i.previousFrame(i.head)].Frame == frameNumber-1")
 	}
 	/*
 	 *	Add the frame to the back of the queue
 	 */
 	i.inputs[i.head] = *input
 	i.inputs[i.head].Frame = frameNumber
-	i.head = (i.head + 1) % InputQueueLength
+	i.head = (i.head + 1) % len(i.inputs)
 	i.length++
 	i.firstFrame = false
 
@@ -218,9 +250,18 @@ func (i *InputQueue) AddDelayedInputToQueue(input *GameInput, frameNumber int) e
 		if frameNumber != i.prediction.Frame {
 			return errors.New("ggpo: InputQueue AddDelayedInputToQueue : frameNumber != i.prediction.Frame")
 		}
-		equal, err := i.prediction.Equal(input, true)
-		if err != nil {
-			panic(err)
+		var equal bool
+		var err error
+		if i.predictor != nil {
+			// A frame that was never handed out can't have been mispredicted.
+			predicted, ok := i.predictions[frameNumber]
+			equal = !ok || bytes.Equal(predicted, input.Bits)
+			delete(i.predictions, frameNumber)
+		} else {
+			equal, err = i.prediction.Equal(input, true)
+			if err != nil {
+				return err
+			}
 		}
 		if i.firstIncorrectFrame == NullFrame && !equal {
 			util.Log.Printf("frame %d does not match prediction.  marking error.\n", frameNumber)
@@ -235,7 +276,7 @@ func (i *InputQueue) AddDelayedInputToQueue(input *GameInput, frameNumber int) e
 		}
 	}
 
-	if i.length > InputQueueLength {
+	if i.length > len(i.inputs) {
 		return errors.New("ggpo: InputQueue AddDelayedInputToQueue : i.length > InputQueueLength")
 	}
 	return nil
@@ -248,7 +289,7 @@ func (i *InputQueue) AdvanceQueueHead(frame int) (int, error) {
 	if i.firstFrame {
 		expectedFrame = 0
 	} else {
-		expectedFrame = i.inputs[previousFrame(i.head)].Frame + 1
+		expectedFrame = i.inputs[i.previousFrame(i.head)].Frame + 1
 	}
 
 	frame += i.frameDelay
@@ -261,23 +302,23 @@ func (i *InputQueue) AdvanceQueueHead(frame int) (int, error) {
 	for expectedFrame < frame {
 		util.Log.Printf("Adding padding frame %d to account for change in frame delay.\n",
 			expectedFrame)
-		lastFrame := i.inputs[previousFrame(i.head)]
+		lastFrame := i.inputs[i.previousFrame(i.head)]
 		err := i.AddDelayedInputToQueue(&lastFrame, expectedFrame)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 		expectedFrame++
 	}
 
-	if !(frame == 0 || frame == i.inputs[previousFrame(i.head)].Frame+1) {
-		return 0, errors.New("ggpo: InputQueue AdvanceQueueHead : frame != 0 && frame != i.inputs[previousFrame(i.head)].Frame+")
+	if !(frame == 0 || frame == i.inputs[i.previousFrame(i.head)].Frame+1) {
+		return 0, errors.New("ggpo: InputQueue AdvanceQueueHead : frame != 0 && frame != i.inputs[i.previousFrame(i.head)].Frame+")
 	}
 	return frame, nil
 }
 
-func previousFrame(offset int) int {
+func (i *InputQueue) previousFrame(offset int) int {
 	if offset == 0 {
-		return InputQueueLength - 1
+		return len(i.inputs) - 1
 	} else {
 		return offset - 1
 	}
@@ -287,6 +328,57 @@ func (i *InputQueue) SetFrameDelay(delay int) {
 	i.frameDelay = delay
 }
 
+/*
+Switches to a new delay once input for frame is added, rather than right away,
+so every peer can make the switch on the same frame. Growing the delay repeats
+the last input over the frames it skips and shrinking it drops the inputs that
+would land on frames already queued, so every frame still gets exactly one
+input. Changes wait their turn in frame order; a second one for the same frame
+replaces the first.
+*/
+func (i *InputQueue) ScheduleFrameDelay(frame int, delay int) {
+	i.delayChanges.Add(frame, delay)
+}
+
+func (i *InputQueue) FrameDelay() int {
+	return i.frameDelay
+}
+
+// Replaces "repeat the last confirmed input" with p. A nil p restores the default.
+func (i *InputQueue) SetPredictor(p Predictor) {
+	i.predictor = p
+	i.predictions = make(map[int][]byte)
+}
+
+func (i *InputQueue) Predictor() Predictor {
+	return i.predictor
+}
+
+// The most recent confirmed inputs still in the queue, oldest first.
+func (i *InputQueue) recentInputs() [][]byte {
+	var recent [][]byte
+	if i.lastAddedFrame == NullFrame {
+		return recent
+	}
+	first := util.Max(0, i.lastAddedFrame-PredictorHistory+1)
+	for frame := first; frame <= i.lastAddedFrame; frame++ {
+		in := i.inputs[frame%len(i.inputs)]
+		if in.Frame == frame {
+			recent = append(recent, in.Bits)
+		}
+	}
+	return recent
+}
+
+// Whether the input for frame has already been thrown away by
+// DiscardConfirmedFrames.
+func (i *InputQueue) Discarded(frame int) bool {
+	if i.length == 0 {
+		return frame <= i.lastAddedFrame
+	}
+	return frame < i.inputs[i.tail].Frame
+}
+
 func (i *InputQueue) Length() int {
 	return i.length
 }
@@ -103,3 +103,117 @@ func TestInputQueueDiscardConfirmedFramesNegative(t *testing.T) {
 		t.Errorf("DiscardConfirmedFrames should throw an error when the frame number passed is negative.")
 	}
 }
+
+// Predicts the last confirmed input counting down by one each frame.
+type decayPredictor struct{}
+
+func (d decayPredictor) PredictInput(frame int, recent [][]byte) []byte {
+	if len(recent) == 0 {
+		return []byte{0}
+	}
+	return []byte{recent[len(recent)-1][0] - 1}
+}
+
+func TestInputQueuePredictor(t *testing.T) {
+	queue := input.NewInputQueue(0, 1)
+	queue.SetPredictor(decayPredictor{})
+	first, _ := input.NewGameInput(0, []byte{5}, 1)
+	queue.AddInput(&first)
+
+	var predicted input.GameInput
+	confirmed, err := queue.GetInput(1, &predicted)
+	if err != nil || confirmed {
+		t.Errorf("expected a prediction for frame 1, got confirmed %t err %v", confirmed, err)
+	}
+	if predicted.Bits[0] != 4 {
+		t.Errorf("expected the predictor's guess of 4 but got %d", predicted.Bits[0])
+	}
+	second, _ := input.NewGameInput(1, []byte{4}, 1)
+	queue.AddInput(&second)
+	if queue.FirstIncorrectFrame() != input.NullFrame {
+		t.Errorf("A correct prediction shouldn't be marked incorrect.")
+	}
+
+	queue.GetInput(2, &predicted)
+	if predicted.Bits[0] != 3 {
+		t.Errorf("expected the predictor's guess of 3 but got %d", predicted.Bits[0])
+	}
+	third, _ := input.NewGameInput(2, []byte{7}, 1)
+	queue.AddInput(&third)
+	if queue.FirstIncorrectFrame() != 2 {
+		t.Errorf("expected frame 2 to be marked incorrect but got %d", queue.FirstIncorrectFrame())
+	}
+}
+
+func TestInputQueueScheduleFrameDelay(t *testing.T) {
+	queue := input.NewInputQueue(0, 1)
+	queue.SetFrameDelay(2)
+	queue.ScheduleFrameDelay(5, 4)
+	added := make(map[int]int)
+	for frame := 0; frame < 20; frame++ {
+		if frame == 8 {
+			// only takes effect from frame 10, after the first change
+			queue.ScheduleFrameDelay(10, 1)
+		}
+		in, _ := input.NewGameInput(frame, []byte{byte(frame)}, 1)
+		err := queue.AddInput(&in)
+		if err != nil {
+			t.Fatalf("Error when adding input for frame %d: %s", frame, err)
+		}
+		added[frame] = in.Frame
+	}
+
+	if queue.LastConfirmedFrame() != 20 {
+		t.Fatalf("expected the last confirmed frame to be 20 but got %d", queue.LastConfirmedFrame())
+	}
+	for frame := 0; frame <= 20; frame++ {
+		var in input.GameInput
+		ok, err := queue.GetConfirmedInput(frame, &in)
+		if err != nil || !ok {
+			t.Fatalf("Frame %d should have an input after the delay changes.", frame)
+		}
+	}
+	// Growing by two repeats input 4 on the frames it skips.
+	for _, frame := range []int{7, 8} {
+		var in input.GameInput
+		queue.GetConfirmedInput(frame, &in)
+		if in.Bits[0] != 4 {
+			t.Errorf("expected frame %d to repeat input 4 but it has %d", frame, in.Bits[0])
+		}
+	}
+	if added[5] != 9 {
+		t.Errorf("expected input 5 to land on frame 9 but it landed on %d", added[5])
+	}
+	// Shrinking by three drops the inputs that would land on frames 11-13.
+	for _, frame := range []int{10, 11, 12} {
+		if added[frame] != input.NullFrame {
+			t.Errorf("expected input %d to be dropped but it landed on frame %d", frame, added[frame])
+		}
+	}
+	if added[13] != 14 || queue.FrameDelay() != 1 {
+		t.Errorf("expected input 13 to land on frame 14 with a delay of 1, got frame %d and delay %d", added[13], queue.FrameDelay())
+	}
+}
+
+func TestInputQueueScheduleFrameDelayQueued(t *testing.T) {
+	queue := input.NewInputQueue(0, 1)
+	queue.SetFrameDelay(2)
+	// both are waiting at once, and out of order
+	queue.ScheduleFrameDelay(10, 1)
+	queue.ScheduleFrameDelay(5, 4)
+	added := make(map[int]int)
+	for frame := 0; frame < 20; frame++ {
+		in, _ := input.NewGameInput(frame, []byte{byte(frame)}, 1)
+		err := queue.AddInput(&in)
+		if err != nil {
+			t.Fatalf("Error when adding input for frame %d: %s", frame, err)
+		}
+		added[frame] = in.Frame
+		if frame == 7 && queue.FrameDelay() != 4 {
+			t.Errorf("expected the first change to be in effect on frame 7, got a delay of %d", queue.FrameDelay())
+		}
+	}
+	if added[5] != 9 || added[12] != input.NullFrame || added[13] != 14 || queue.FrameDelay() != 1 {
+		t.Errorf("expected both changes to take effect in order, got inputs landing on %v", added)
+	}
+}
@@ -11,7 +11,14 @@ import (
 
 const (
 	MaxCompressedBits = 4096
-	UDPMsgMaxPlayers  = 4
+	// Input messages carry a connect status for each player in the session,
+	// up to this many.
+	UDPMsgMaxPlayers = 8
+	// Serialized states in desync reports are split into chunks of this size.
+	DesyncReportChunkSize = 1024
+	// Sent in sync requests and bumped whenever the wire format changes, so
+	// peers that can't understand each other refuse to synchronize.
+	ProtocolVersion = 1
 )
 
 const (
@@ -29,6 +36,11 @@ func init() {
 	gob.Register(&InputPacket{})
 	gob.Register(&InputAckPacket{})
 	gob.Register(&KeepAlivePacket{})
+	gob.Register(&InputRetransmitRequestPacket{})
+	gob.Register(&InputRetransmitPacket{})
+	gob.Register(&DesyncReportPacket{})
+	gob.Register(&InputDelayPacket{})
+	gob.Register(&InputDelayChangePacket{})
 }
 
 type UDPMessage interface {
@@ -51,6 +63,11 @@ const (
 	QualityReplyMsg
 	KeepAliveMsg
 	InputAckMsg
+	InputRetransmitRequestMsg
+	InputRetransmitMsg
+	DesyncReportMsg
+	InputDelayMsg
+	InputDelayChangeMsg
 )
 
 type UdpConnectStatus struct {
@@ -110,12 +127,16 @@ func (u *UDPHeader) FromBytes(buffer []byte) {
 	u.HeaderType = buffer[4]
 }
 
+// ResyncAuthority is the sender's desync resync authority, 0 for none, which
+// every peer has to agree on.
 type SyncRequestPacket struct {
 	MessageHeader    UDPHeader
 	RandomRequest    uint32
 	RemoteMagic      uint16
 	RemoteEndpoint   uint8
 	RemoteInputDelay uint8
+	ResyncAuthority  uint8
+	ProtocolVersion  uint8
 }
 
 func (s *SyncRequestPacket) Type() UDPMessageType { return SyncRequestMsg }
@@ -130,6 +151,8 @@ func (s *SyncRequestPacket) PacketSize() int {
 	sum += int(unsafe.Sizeof(s.RemoteMagic))
 	sum += int(unsafe.Sizeof(s.RemoteEndpoint))
 	sum += int(unsafe.Sizeof(s.RemoteInputDelay))
+	sum += int(unsafe.Sizeof(s.ResyncAuthority))
+	sum += int(unsafe.Sizeof(s.ProtocolVersion))
 	return sum
 }
 func (s *SyncRequestPacket) String() string {
@@ -142,11 +165,15 @@ func (s *SyncRequestPacket) ToBytes() []byte {
 	binary.BigEndian.PutUint16(buf[9:11], s.RemoteMagic)
 	buf[11] = s.RemoteEndpoint
 	buf[12] = s.RemoteInputDelay
+	buf[13] = s.ResyncAuthority
+	buf[14] = s.ProtocolVersion
 	return buf
 }
 
 func (s *SyncRequestPacket) FromBytes(buffer []byte) error {
-	if len(buffer) < s.PacketSize() {
+	// A request from before the version was sent is a byte short, and reads
+	// as version 0 so it can still be refused.
+	if len(buffer) < s.PacketSize()-1 {
 		return errors.New("invalid packet")
 	}
 	s.MessageHeader.FromBytes(buffer)
@@ -154,12 +181,19 @@ func (s *SyncRequestPacket) FromBytes(buffer []byte) error {
 	s.RemoteMagic = binary.BigEndian.Uint16(buffer[9:11])
 	s.RemoteEndpoint = buffer[11]
 	s.RemoteInputDelay = buffer[12]
+	s.ResyncAuthority = buffer[13]
+	s.ProtocolVersion = 0
+	if len(buffer) >= s.PacketSize() {
+		s.ProtocolVersion = buffer[14]
+	}
 	return nil
 }
 
+// Carries the ResyncAuthority too, in case it changed after the sender's last request.
 type SyncReplyPacket struct {
-	MessageHeader UDPHeader
-	RandomReply   uint32
+	MessageHeader   UDPHeader
+	RandomReply     uint32
+	ResyncAuthority uint8
 }
 
 func (s *SyncReplyPacket) Type() UDPMessageType { return SyncReplyMsg }
@@ -171,6 +205,7 @@ func (s *SyncReplyPacket) SetHeader(magicNumber uint16, sequenceNumber uint16) {
 func (s *SyncReplyPacket) PacketSize() int {
 	sum := s.MessageHeader.Size()
 	sum += int(unsafe.Sizeof(s.RandomReply))
+	sum += int(unsafe.Sizeof(s.ResyncAuthority))
 	return sum
 }
 func (s *SyncReplyPacket) String() string { return fmt.Sprintf("sync-reply (%d).\n", s.RandomReply) }
@@ -179,6 +214,7 @@ func (s *SyncReplyPacket) ToBytes() []byte {
 	buf := make([]byte, s.PacketSize())
 	copy(buf, s.MessageHeader.ToBytes())
 	binary.BigEndian.PutUint32(buf[5:9], s.RandomReply)
+	buf[9] = s.ResyncAuthority
 	return buf
 }
 
@@ -188,6 +224,7 @@ func (s *SyncReplyPacket) FromBytes(buffer []byte) error {
 	}
 	s.MessageHeader.FromBytes(buffer)
 	s.RandomReply = binary.BigEndian.Uint32(buffer[5:9])
+	s.ResyncAuthority = buffer[9]
 	return nil
 }
 
@@ -299,7 +336,7 @@ func (i *InputPacket) PacketSize() int {
 	size += int(unsafe.Sizeof(i.Checksum))
 	size += int(unsafe.Sizeof(i.NumBits))
 	size += int(unsafe.Sizeof(i.InputSize))
-	size += 1 // will store total
+	size += 2 // will store total, which can be more than a byte with many frames pending
 	size += len(i.Bits)
 	//size += 1 // will store total
 	return size
@@ -330,8 +367,8 @@ func (i *InputPacket) ToBytes() []byte {
 	offset += 2
 	buf[offset] = i.InputSize
 	offset++
-	buf[offset] = byte(len(i.Bits))
-	offset++
+	binary.BigEndian.PutUint16(buf[offset:], uint16(len(i.Bits)))
+	offset += 2
 	copy(buf[offset:offset+len(i.Bits)], i.Bits)
 	offset += len(i.Bits)
 	/*
@@ -350,11 +387,19 @@ func (i *InputPacket) FromBytes(buffer []byte) error {
 	}
 
 	i.MessageHeader.FromBytes(buffer)
-	totalConnectionStatus := buffer[5]
+	totalConnectionStatus := int(buffer[5])
+	if totalConnectionStatus > UDPMsgMaxPlayers {
+		return errors.New("invalid packet")
+	}
 	i.PeerConnectStatus = make([]UdpConnectStatus, totalConnectionStatus)
-	pcsSize := i.PeerConnectStatus[0].Size()
+	var status UdpConnectStatus
+	pcsSize := status.Size()
+	// the connect statuses weren't part of the size checked above
+	if len(buffer) < i.PacketSize() {
+		return errors.New("invalid packet")
+	}
 	offset := 6
-	for p := 0; p < int(totalConnectionStatus); p++ {
+	for p := 0; p < totalConnectionStatus; p++ {
 		i.PeerConnectStatus[p].FromBytes(buffer[offset : offset+pcsSize])
 		offset += pcsSize
 	}
@@ -374,8 +419,11 @@ func (i *InputPacket) FromBytes(buffer []byte) error {
 	offset += 2
 	i.InputSize = buffer[offset]
 	offset++
-	totalBits := buffer[offset]
-	offset++
+	totalBits := binary.BigEndian.Uint16(buffer[offset : offset+2])
+	offset += 2
+	if len(buffer) < offset+int(totalBits) {
+		return errors.New("invalid packet")
+	}
 	i.Bits = make([]byte, totalBits)
 	copy(i.Bits, buffer[offset:offset+int(totalBits)])
 	offset += int(totalBits)
@@ -457,6 +505,289 @@ func (k *KeepAlivePacket) FromBytes(buffer []byte) error {
 	return nil
 }
 
+// Sent by a spectator that has lost confirmed frames it hasn't played yet, or
+// by a Lockstep peer missing input from a player who left.
+type InputRetransmitRequestPacket struct {
+	MessageHeader UDPHeader
+	StartFrame    uint32
+	NumFrames     uint16
+	// The player asked for, for Lockstep; spectators get every player
+	Queue uint8
+}
+
+func (i *InputRetransmitRequestPacket) Type() UDPMessageType { return InputRetransmitRequestMsg }
+func (i *InputRetransmitRequestPacket) Header() UDPHeader    { return i.MessageHeader }
+func (i *InputRetransmitRequestPacket) SetHeader(magicNumber uint16, sequenceNumber uint16) {
+	i.MessageHeader.Magic = magicNumber
+	i.MessageHeader.SequenceNumber = sequenceNumber
+}
+func (i *InputRetransmitRequestPacket) PacketSize() int {
+	sum := i.MessageHeader.Size()
+	sum += int(unsafe.Sizeof(i.StartFrame))
+	sum += int(unsafe.Sizeof(i.NumFrames))
+	sum += int(unsafe.Sizeof(i.Queue))
+	return sum
+}
+
+func (i *InputRetransmitRequestPacket) ToBytes() []byte {
+	buf := make([]byte, i.PacketSize())
+	copy(buf, i.MessageHeader.ToBytes())
+	binary.BigEndian.PutUint32(buf[5:9], i.StartFrame)
+	binary.BigEndian.PutUint16(buf[9:11], i.NumFrames)
+	buf[11] = i.Queue
+	return buf
+}
+
+func (i *InputRetransmitRequestPacket) FromBytes(buffer []byte) error {
+	if len(buffer) < i.PacketSize() {
+		return errors.New("invalid packet")
+	}
+	i.MessageHeader.FromBytes(buffer)
+	i.StartFrame = binary.BigEndian.Uint32(buffer[5:9])
+	i.NumFrames = binary.BigEndian.Uint16(buffer[9:11])
+	i.Queue = buffer[11]
+	return nil
+}
+
+func (i *InputRetransmitRequestPacket) String() string {
+	return fmt.Sprintf("input-retransmit-request %d (+ %d frames, queue %d).\n", i.StartFrame, i.NumFrames, i.Queue)
+}
+
+// The host's answer to an InputRetransmitRequestPacket. Bits holds consecutive
+// frames of InputSize bytes starting at StartFrame. Unavailable is set when
+// the host no longer has StartFrame in its history.
+type InputRetransmitPacket struct {
+	MessageHeader UDPHeader
+	StartFrame    uint32
+	InputSize     uint16
+	Unavailable   bool
+	Queue         uint8
+	Bits          []byte
+}
+
+func (i *InputRetransmitPacket) Type() UDPMessageType { return InputRetransmitMsg }
+func (i *InputRetransmitPacket) Header() UDPHeader    { return i.MessageHeader }
+func (i *InputRetransmitPacket) SetHeader(magicNumber uint16, sequenceNumber uint16) {
+	i.MessageHeader.Magic = magicNumber
+	i.MessageHeader.SequenceNumber = sequenceNumber
+}
+func (i *InputRetransmitPacket) PacketSize() int {
+	sum := i.MessageHeader.Size()
+	sum += int(unsafe.Sizeof(i.StartFrame))
+	sum += int(unsafe.Sizeof(i.InputSize))
+	sum += int(unsafe.Sizeof(i.Unavailable))
+	sum += int(unsafe.Sizeof(i.Queue))
+	sum += Int16size // will store total
+	sum += len(i.Bits)
+	return sum
+}
+
+func (i *InputRetransmitPacket) ToBytes() []byte {
+	buf := make([]byte, i.PacketSize())
+	copy(buf, i.MessageHeader.ToBytes())
+	binary.BigEndian.PutUint32(buf[5:9], i.StartFrame)
+	binary.BigEndian.PutUint16(buf[9:11], i.InputSize)
+	if i.Unavailable {
+		buf[11] = 1
+	}
+	buf[12] = i.Queue
+	binary.BigEndian.PutUint16(buf[13:15], uint16(len(i.Bits)))
+	copy(buf[15:], i.Bits)
+	return buf
+}
+
+func (i *InputRetransmitPacket) FromBytes(buffer []byte) error {
+	if len(buffer) < i.PacketSize() {
+		return errors.New("invalid packet")
+	}
+	i.MessageHeader.FromBytes(buffer)
+	i.StartFrame = binary.BigEndian.Uint32(buffer[5:9])
+	i.InputSize = binary.BigEndian.Uint16(buffer[9:11])
+	i.Unavailable = buffer[11] == 1
+	i.Queue = buffer[12]
+	totalBits := int(binary.BigEndian.Uint16(buffer[13:15]))
+	if len(buffer) < 15+totalBits {
+		return errors.New("invalid packet")
+	}
+	i.Bits = make([]byte, totalBits)
+	copy(i.Bits, buffer[15:15+totalBits])
+	return nil
+}
+
+func (i *InputRetransmitPacket) String() string {
+	return fmt.Sprintf("input-retransmit %d (%d bytes, unavailable %t).\n", i.StartFrame, len(i.Bits), i.Unavailable)
+}
+
+// One chunk of the serialized state a peer had at a frame whose checksum didn't
+// match. Offset is where Data goes in a state of Total bytes. Acked chunks carry
+// no Data, they tell the sender the chunk at Offset arrived.
+type DesyncReportPacket struct {
+	MessageHeader UDPHeader
+	Frame         uint32
+	Offset        uint32
+	Total         uint32
+	Acked         bool
+	Data          []byte
+}
+
+func (d *DesyncReportPacket) Type() UDPMessageType { return DesyncReportMsg }
+func (d *DesyncReportPacket) Header() UDPHeader    { return d.MessageHeader }
+func (d *DesyncReportPacket) SetHeader(magicNumber uint16, sequenceNumber uint16) {
+	d.MessageHeader.Magic = magicNumber
+	d.MessageHeader.SequenceNumber = sequenceNumber
+}
+func (d *DesyncReportPacket) PacketSize() int {
+	sum := d.MessageHeader.Size()
+	sum += int(unsafe.Sizeof(d.Frame))
+	sum += int(unsafe.Sizeof(d.Offset))
+	sum += int(unsafe.Sizeof(d.Total))
+	sum += int(unsafe.Sizeof(d.Acked))
+	sum += Int16size // will store len(Data)
+	sum += len(d.Data)
+	return sum
+}
+
+func (d *DesyncReportPacket) ToBytes() []byte {
+	buf := make([]byte, d.PacketSize())
+	copy(buf, d.MessageHeader.ToBytes())
+	binary.BigEndian.PutUint32(buf[5:9], d.Frame)
+	binary.BigEndian.PutUint32(buf[9:13], d.Offset)
+	binary.BigEndian.PutUint32(buf[13:17], d.Total)
+	if d.Acked {
+		buf[17] = 1
+	}
+	binary.BigEndian.PutUint16(buf[18:20], uint16(len(d.Data)))
+	copy(buf[20:], d.Data)
+	return buf
+}
+
+func (d *DesyncReportPacket) FromBytes(buffer []byte) error {
+	if len(buffer) < d.PacketSize() {
+		return errors.New("invalid packet")
+	}
+	d.MessageHeader.FromBytes(buffer)
+	d.Frame = binary.BigEndian.Uint32(buffer[5:9])
+	d.Offset = binary.BigEndian.Uint32(buffer[9:13])
+	d.Total = binary.BigEndian.Uint32(buffer[13:17])
+	d.Acked = buffer[17] == 1
+	size := int(binary.BigEndian.Uint16(buffer[18:20]))
+	if len(buffer) < 20+size {
+		return errors.New("invalid packet")
+	}
+	d.Data = make([]byte, size)
+	copy(d.Data, buffer[20:20+size])
+	return nil
+}
+
+func (d *DesyncReportPacket) String() string {
+	return fmt.Sprintf("desync-report %d (%d-%d of %d bytes, acked %t).\n", d.Frame, d.Offset, int(d.Offset)+len(d.Data), d.Total, d.Acked)
+}
+
+// An endpoint's proposed input delay. Acked tells the receiver that its own
+// proposal already arrived, so it can stop resending it.
+type InputDelayPacket struct {
+	MessageHeader UDPHeader
+	Delay         uint8
+	Acked         bool
+}
+
+func (i *InputDelayPacket) Type() UDPMessageType { return InputDelayMsg }
+func (i *InputDelayPacket) Header() UDPHeader    { return i.MessageHeader }
+func (i *InputDelayPacket) SetHeader(magicNumber uint16, sequenceNumber uint16) {
+	i.MessageHeader.Magic = magicNumber
+	i.MessageHeader.SequenceNumber = sequenceNumber
+}
+func (i *InputDelayPacket) PacketSize() int {
+	sum := i.MessageHeader.Size()
+	sum += int(unsafe.Sizeof(i.Delay))
+	sum += int(unsafe.Sizeof(i.Acked))
+	return sum
+}
+
+func (i *InputDelayPacket) ToBytes() []byte {
+	buf := make([]byte, i.PacketSize())
+	copy(buf, i.MessageHeader.ToBytes())
+	buf[5] = i.Delay
+	if i.Acked {
+		buf[6] = 1
+	}
+	return buf
+}
+
+func (i *InputDelayPacket) FromBytes(buffer []byte) error {
+	if len(buffer) < i.PacketSize() {
+		return errors.New("invalid packet")
+	}
+	i.MessageHeader.FromBytes(buffer)
+	i.Delay = buffer[5]
+	i.Acked = buffer[6] == 1
+	return nil
+}
+
+func (i *InputDelayPacket) String() string {
+	return fmt.Sprintf("input-delay %d (acked: %t).\n", i.Delay, i.Acked)
+}
+
+// Proposes a new input delay for a player from Frame on, or with Commit set,
+// makes a proposal the peer acked final. Acked confirms that it arrived.
+type InputDelayChangePacket struct {
+	MessageHeader UDPHeader
+	Frame         uint32
+	// The queue of the player whose delay changes
+	Player uint8
+	Delay  uint8
+	Acked  bool
+	Commit bool
+}
+
+func (i *InputDelayChangePacket) Type() UDPMessageType { return InputDelayChangeMsg }
+func (i *InputDelayChangePacket) Header() UDPHeader    { return i.MessageHeader }
+func (i *InputDelayChangePacket) SetHeader(magicNumber uint16, sequenceNumber uint16) {
+	i.MessageHeader.Magic = magicNumber
+	i.MessageHeader.SequenceNumber = sequenceNumber
+}
+func (i *InputDelayChangePacket) PacketSize() int {
+	sum := i.MessageHeader.Size()
+	sum += int(unsafe.Sizeof(i.Frame))
+	sum += int(unsafe.Sizeof(i.Player))
+	sum += int(unsafe.Sizeof(i.Delay))
+	sum += int(unsafe.Sizeof(i.Acked))
+	sum += int(unsafe.Sizeof(i.Commit))
+	return sum
+}
+
+func (i *InputDelayChangePacket) ToBytes() []byte {
+	buf := make([]byte, i.PacketSize())
+	copy(buf, i.MessageHeader.ToBytes())
+	binary.BigEndian.PutUint32(buf[5:9], i.Frame)
+	buf[9] = i.Player
+	buf[10] = i.Delay
+	if i.Acked {
+		buf[11] = 1
+	}
+	if i.Commit {
+		buf[12] = 1
+	}
+	return buf
+}
+
+func (i *InputDelayChangePacket) FromBytes(buffer []byte) error {
+	if len(buffer) < i.PacketSize() {
+		return errors.New("invalid packet")
+	}
+	i.MessageHeader.FromBytes(buffer)
+	i.Frame = binary.BigEndian.Uint32(buffer[5:9])
+	i.Player = buffer[9]
+	i.Delay = buffer[10]
+	i.Acked = buffer[11] == 1
+	i.Commit = buffer[12] == 1
+	return nil
+}
+
+func (i *InputDelayChangePacket) String() string {
+	return fmt.Sprintf("input-delay-change %d for player %d at frame %d (acked: %t, commit: %t).\n", i.Delay, i.Player, i.Frame, i.Acked, i.Commit)
+}
+
 func NewUDPMessage(t UDPMessageType) UDPMessage {
 	header := UDPHeader{HeaderType: uint8(t)}
 	var msg UDPMessage
@@ -479,6 +810,21 @@ func NewUDPMessage(t UDPMessageType) UDPMessage {
 	case InputMsg:
 		msg = &InputPacket{
 			MessageHeader: header}
+	case InputRetransmitRequestMsg:
+		msg = &InputRetransmitRequestPacket{
+			MessageHeader: header}
+	case InputRetransmitMsg:
+		msg = &InputRetransmitPacket{
+			MessageHeader: header}
+	case DesyncReportMsg:
+		msg = &DesyncReportPacket{
+			MessageHeader: header}
+	case InputDelayMsg:
+		msg = &InputDelayPacket{
+			MessageHeader: header}
+	case InputDelayChangeMsg:
+		msg = &InputDelayChangePacket{
+			MessageHeader: header}
 	case KeepAliveMsg:
 		fallthrough
 	default:
@@ -566,6 +912,41 @@ func DecodeMessageBinary(buffer []byte) (UDPMessage, error) {
 			return nil, err
 		}
 		return &keepAlivePacket, nil
+	case InputRetransmitRequestMsg:
+		var retransmitRequestPacket InputRetransmitRequestPacket
+		err = retransmitRequestPacket.FromBytes(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &retransmitRequestPacket, nil
+	case InputRetransmitMsg:
+		var retransmitPacket InputRetransmitPacket
+		err = retransmitPacket.FromBytes(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &retransmitPacket, nil
+	case DesyncReportMsg:
+		var desyncReportPacket DesyncReportPacket
+		err = desyncReportPacket.FromBytes(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &desyncReportPacket, nil
+	case InputDelayMsg:
+		var inputDelayPacket InputDelayPacket
+		err = inputDelayPacket.FromBytes(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &inputDelayPacket, nil
+	case InputDelayChangeMsg:
+		var inputDelayChangePacket InputDelayChangePacket
+		err = inputDelayChangePacket.FromBytes(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &inputDelayChangePacket, nil
 	default:
 		return nil, errors.New("message not recognized")
 	}
@@ -94,6 +94,8 @@ func TestEncodeDecodeSyncRequestPacket(t *testing.T) {
 	want.RandomRequest = 23
 	want.RemoteEndpoint = 24
 	want.RemoteMagic = 9000
+	want.ResyncAuthority = 2
+	want.ProtocolVersion = messages.ProtocolVersion
 
 	buf := want.ToBytes()
 
@@ -102,12 +104,19 @@ func TestEncodeDecodeSyncRequestPacket(t *testing.T) {
 	if got != *want {
 		t.Errorf("expected '%#v' but got '%#v'", want, got)
 	}
+
+	old := messages.SyncRequestPacket{ProtocolVersion: 9}
+	err := old.FromBytes(buf[:len(buf)-1])
+	if err != nil || old.ProtocolVersion != 0 {
+		t.Errorf("expected a request without a version to read as version 0, got %d (%v)", old.ProtocolVersion, err)
+	}
 }
 
 func TestEncodeDecodeSyncReplyPacket(t *testing.T) {
 	packet := messages.NewUDPMessage(messages.SyncReplyMsg)
 	want := packet.(*messages.SyncReplyPacket)
 	want.RandomReply = 23
+	want.ResyncAuthority = 2
 
 	buf := want.ToBytes()
 
@@ -171,6 +180,104 @@ func TestEncodeDecodeKeepAlivePacket(t *testing.T) {
 		t.Errorf("expected '%#v' but got '%#v'", want, got)
 	}
 }
+func TestEncodeDecodeInputRetransmitRequestPacket(t *testing.T) {
+	packet := messages.NewUDPMessage(messages.InputRetransmitRequestMsg)
+	want := packet.(*messages.InputRetransmitRequestPacket)
+	want.StartFrame = 4000
+	want.NumFrames = 32
+	want.Queue = 2
+
+	buf := want.ToBytes()
+
+	got := messages.InputRetransmitRequestPacket{}
+	got.FromBytes(buf)
+	if got != *want {
+		t.Errorf("expected '%#v' but got '%#v'", want, got)
+	}
+}
+
+func TestEncodeDecodeInputRetransmitPacket(t *testing.T) {
+	packet := messages.NewUDPMessage(messages.InputRetransmitMsg)
+	want := packet.(*messages.InputRetransmitPacket)
+	want.StartFrame = 12
+	want.InputSize = 8
+	want.Queue = 3
+	want.Bits = []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	buf := want.ToBytes()
+
+	got := messages.InputRetransmitPacket{}
+	err := got.FromBytes(buf)
+	if err != nil {
+		t.Errorf("Error decoding retransmit packet %s", err)
+	}
+	if got.StartFrame != want.StartFrame || got.InputSize != want.InputSize || got.Unavailable != want.Unavailable || got.Queue != want.Queue {
+		t.Errorf("expected '%#v' but got '%#v'", want, got)
+	}
+	if !bytes.Equal(got.Bits, want.Bits) {
+		t.Errorf("expected Bits Slice '%#v' but got '%#v'", want.Bits, got.Bits)
+	}
+}
+
+func TestEncodeDecodeDesyncReportPacket(t *testing.T) {
+	packet := messages.NewUDPMessage(messages.DesyncReportMsg)
+	want := packet.(*messages.DesyncReportPacket)
+	want.Frame = 340
+	want.Offset = 1024
+	want.Total = 1030
+	want.Acked = true
+	want.Data = []byte{1, 2, 3, 4, 5, 6}
+
+	buf := want.ToBytes()
+
+	got, err := messages.DecodeMessageBinary(buf)
+	if err != nil {
+		t.Errorf("Error decoding desync report packet %s", err)
+	}
+	report := got.(*messages.DesyncReportPacket)
+	if report.Frame != want.Frame || report.Offset != want.Offset || report.Total != want.Total || report.Acked != want.Acked {
+		t.Errorf("expected '%#v' but got '%#v'", want, report)
+	}
+	if !bytes.Equal(report.Data, want.Data) {
+		t.Errorf("expected Data Slice '%#v' but got '%#v'", want.Data, report.Data)
+	}
+}
+
+func TestEncodeDecodeInputDelayPacket(t *testing.T) {
+	packet := messages.NewUDPMessage(messages.InputDelayMsg)
+	want := packet.(*messages.InputDelayPacket)
+	want.Delay = 3
+	want.Acked = true
+
+	got, err := messages.DecodeMessageBinary(want.ToBytes())
+	if err != nil {
+		t.Errorf("Error decoding input delay packet %s", err)
+	}
+	delay := got.(*messages.InputDelayPacket)
+	if delay.Delay != want.Delay || delay.Acked != want.Acked {
+		t.Errorf("expected '%#v' but got '%#v'", want, delay)
+	}
+}
+
+func TestEncodeDecodeInputDelayChangePacket(t *testing.T) {
+	packet := messages.NewUDPMessage(messages.InputDelayChangeMsg)
+	want := packet.(*messages.InputDelayChangePacket)
+	want.Frame = 1234
+	want.Player = 2
+	want.Delay = 4
+	want.Acked = true
+	want.Commit = true
+
+	got, err := messages.DecodeMessageBinary(want.ToBytes())
+	if err != nil {
+		t.Errorf("Error decoding input delay change packet %s", err)
+	}
+	change := got.(*messages.InputDelayChangePacket)
+	if *change != *want {
+		t.Errorf("expected '%#v' but got '%#v'", want, change)
+	}
+}
+
 func TestEncodeInput(t *testing.T) {
 	packet := messages.NewUDPMessage(messages.InputMsg)
 	want := packet.(*messages.InputPacket)
@@ -104,3 +104,62 @@ func NewFakeMultiplePeerConnection(remoteHandler []transport.MessageHandler, loc
 	f.localIP = localIP
 	return f
 }
+
+/*
+Connects any number of handlers by port. Messages go through ToBytes and
+DecodeMessageBinary on the way like they would over a socket, and links to a
+port can be cut to make it drop off the network.
+*/
+type FakeMesh struct {
+	handlers map[int]transport.MessageHandler
+	cut      map[int]bool
+	cutLinks map[[2]int]bool
+}
+
+func NewFakeMesh() *FakeMesh {
+	return &FakeMesh{
+		handlers: make(map[int]transport.MessageHandler),
+		cut:      make(map[int]bool),
+		cutLinks: make(map[[2]int]bool),
+	}
+}
+
+func (m *FakeMesh) Connect(handler transport.MessageHandler, port int, ip string) FakeMeshConnection {
+	m.handlers[port] = handler
+	return FakeMeshConnection{mesh: m, localPort: port, localIP: ip}
+}
+
+// Stops everything to and from port.
+func (m *FakeMesh) Cut(port int) {
+	m.cut[port] = true
+}
+
+// Stops everything sent from one port to another, leaving the other way open.
+func (m *FakeMesh) CutLink(from int, to int) {
+	m.cutLinks[[2]int{from, to}] = true
+}
+
+type FakeMeshConnection struct {
+	mesh      *FakeMesh
+	localPort int
+	localIP   string
+}
+
+func (f *FakeMeshConnection) SendTo(msg messages.UDPMessage, remoteIp string, remotePort int) {
+	handler, ok := f.mesh.handlers[remotePort]
+	if !ok || f.mesh.cut[f.localPort] || f.mesh.cut[remotePort] || f.mesh.cutLinks[[2]int{f.localPort, remotePort}] {
+		return
+	}
+	buf := msg.ToBytes()
+	decoded, err := messages.DecodeMessageBinary(buf)
+	if err != nil {
+		panic(err)
+	}
+	handler.HandleMessage(f.localIP, f.localPort, decoded, len(buf))
+}
+
+func (f *FakeMeshConnection) Read(messageChan chan transport.MessageChannelItem) {
+}
+
+func (f *FakeMeshConnection) Close() {
+}
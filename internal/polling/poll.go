@@ -19,7 +19,7 @@ type Poll struct {
 }
 
 type Poller interface {
-	RegisterLoop(sink PollSink, cookie []byte)
+	RegisterLoop(sink PollSink, cookie []byte) error
 	Pump(timeFunc ...FuncTimeType) bool
 }
 
@@ -40,14 +40,11 @@ func NewPoll() Poll {
 	}
 }
 
-func (p *Poll) RegisterLoop(sink PollSink, cookie []byte) {
-	err := p.loopSinks.PushBack(
+func (p *Poll) RegisterLoop(sink PollSink, cookie []byte) error {
+	return p.loopSinks.PushBack(
 		PollSinkCb{
 			sink:   sink,
 			cookie: cookie})
-	if err != nil {
-		panic(err)
-	}
 }
 
 func (p *Poll) Pump(timeFunc ...FuncTimeType) bool {
@@ -58,7 +55,7 @@ func (p *Poll) Pump(timeFunc ...FuncTimeType) bool {
 	for i := 0; i < p.loopSinks.Size(); i++ {
 		cb, err := p.loopSinks.Get(i)
 		if err != nil {
-			panic(err)
+			break
 		}
 		if len(timeFunc) != 0 {
 			finished = !(cb.sink.OnLoopPoll(timeFunc[0]) || finished)
@@ -32,17 +32,16 @@ func (f FakeFalseSink) OnLoopPoll(timeFunc polling.FuncTimeType) bool {
 	return false
 }
 
-func TestRegisterollPanic(t *testing.T) {
+func TestRegisterLoopFull(t *testing.T) {
 	poll := polling.NewPoll()
 	maxSinks := 16
 	sink := NewFakeSink()
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic when attempting to add more than the max static buffer of sinks.")
-		}
-	}()
-	for i := 0; i < maxSinks+1; i++ {
-		poll.RegisterLoop(&sink, nil)
+	var err error
+	for i := 0; i < maxSinks+1 && err == nil; i++ {
+		err = poll.RegisterLoop(&sink, nil)
+	}
+	if err == nil {
+		t.Errorf("No error when attempting to add more than the max static buffer of sinks.")
 	}
 }
 
@@ -3,6 +3,7 @@ package protocol
 import (
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"time"
 
@@ -27,6 +28,11 @@ const (
 	NetworkStatsInterval   = 1000
 	UDPShutdownTimer       = 5000
 	MaxSeqDistance         = 1 << 15
+	// 32 chunks, so a report fits in the send queue alongside regular traffic.
+	MaxDesyncReportSize = 32 * messages.DesyncReportChunkSize
+	// How long, in ms, a desync report is resent or waited on before giving up.
+	DesyncReportTimeout = 10000
+	MaxAutoInputDelay   = 6
 )
 
 type UdpProtocol struct {
@@ -47,11 +53,12 @@ type UdpProtocol struct {
 	sendQueue         buffer.RingBuffer[QueueEntry]
 
 	// Stats
-	roundTripTime  int64
-	packetsSent    int
-	bytesSent      int
-	kbpsSent       int
-	statsStartTime int64
+	roundTripTime     int64
+	roundTripMeasured bool
+	packetsSent       int
+	bytesSent         int
+	kbpsSent          int
+	statsStartTime    int64
 
 	// The State Machine
 	localConnectStatus *[]messages.UdpConnectStatus
@@ -75,6 +82,7 @@ type UdpProtocol struct {
 	disconnectTimeout     int64
 	disconnectNotifyStart int64
 	disconnectNotifySent  bool
+	failure               error // why the endpoint gave up, see fail
 
 	nextSendSeq uint16
 	nextRecvSeq uint16
@@ -87,6 +95,56 @@ type UdpProtocol struct {
 
 	RemoteChecksumsThisFrame util.OrderedMap[int, uint32]
 	RemoteChecksums          util.OrderedMap[int, uint32]
+
+	// Desync reports being reassembled, and the ones we sent that aren't all
+	// acked yet, by frame
+	desyncReports     map[int]*desyncReport
+	sentDesyncReports map[int]*sentDesyncReport
+
+	// Automatic input delay, agreed on with the peer after synchronizing
+	autoInputDelay      bool
+	handshakeRoundTrips int64
+	handshakeSamples    int64
+	localInputDelay     int
+	remoteInputDelay    int
+	inputDelayAcked     bool
+	inputDelayAgreed    bool
+	lastInputDelaySend  int64
+
+	// The player handle each side resyncs from after a desync, 0 for none
+	resyncAuthority       int
+	remoteResyncAuthority int
+	// Set once the peer turned out to speak another protocol version
+	protocolMismatched bool
+
+	// Mid-match input delay changes: our proposals, resent until the peer acks
+	// them, and the commits that make them final, resent the same way
+	delayProposals      []delayChange
+	delayCommits        []delayChange
+	lastDelayChangeSend int64
+}
+
+type delayChange struct {
+	player int
+	input.DelayChange
+	acked bool
+}
+
+// Received chunks are marked so resent ones aren't counted twice. A finished
+// report is kept until it expires, to ack chunks resent after it completed.
+type desyncReport struct {
+	state    []byte
+	chunks   []bool
+	received int
+	done     bool
+	started  int64
+}
+
+type sentDesyncReport struct {
+	state    []byte
+	acked    []bool
+	started  int64
+	lastSend int64
 }
 
 type NetworkStats struct {
@@ -121,6 +179,12 @@ type UdpProtocolEvent struct {
 	Total             int             // for synchronizing
 	Count             int             //
 	DisconnectTimeout int             // network interrupted
+	Frame             int             // for retransmit messages and input delay changes
+	Inputs            []input.GameInput
+	Unavailable       bool
+	State             []byte // for desync reports
+	InputDelay        int    // input delay agreed or scheduled
+	Player            int    // the queue an input delay change or retransmit is for
 }
 
 func (upe UdpProtocolEvent) Type() UdpProtocolEventType {
@@ -155,6 +219,24 @@ func (upe UdpProtocolEvent) String() string {
 	case NetworkResumedEvent:
 		str += "NetworkResumed"
 		break
+	case RetransmitRequestEvent:
+		str += "RetransmitRequest"
+		break
+	case RetransmitEvent:
+		str += "Retransmit"
+		break
+	case DesyncReportEvent:
+		str += "DesyncReport"
+		break
+	case InputDelayAgreedEvent:
+		str += "InputDelayAgreed"
+		break
+	case InputDelayChangeEvent:
+		str += "InputDelayChange"
+		break
+	case ProtocolMismatchEvent:
+		str += "ProtocolMismatch"
+		break
 	}
 	str += ").\n"
 	return str
@@ -171,6 +253,12 @@ const (
 	DisconnectedEvent
 	NetworkInterruptedEvent
 	NetworkResumedEvent
+	RetransmitRequestEvent
+	RetransmitEvent
+	DesyncReportEvent
+	InputDelayAgreedEvent
+	InputDelayChangeEvent
+	ProtocolMismatchEvent
 )
 
 type UdpProtocolState int
@@ -185,6 +273,7 @@ const (
 type UdpProtocolStateInfo struct {
 	roundTripRemaining uint32 // sync
 	random             uint32
+	syncRequestTime    int64
 
 	lastQualityReportTime    int64 // running
 	lastNetworkStatsInterval int64
@@ -225,7 +314,11 @@ func NewUdpProtocol(connection transport.Connection, queue int, ip string, port
 			break
 		}
 	}
-	peerConnectStatus := make([]messages.UdpConnectStatus, messages.UDPMsgMaxPlayers)
+	// one per player, the same as the statuses we send; spectators don't track any
+	var peerConnectStatus []messages.UdpConnectStatus
+	if status != nil {
+		peerConnectStatus = make([]messages.UdpConnectStatus, len(*status))
+	}
 	for i := 0; i < len(peerConnectStatus); i++ {
 		peerConnectStatus[i].LastFrame = -1
 	}
@@ -250,6 +343,10 @@ func NewUdpProtocol(connection transport.Connection, queue int, ip string, port
 		lastAckedInput:           lastAckedInput,
 		RemoteChecksums:          util.NewOrderedMap[int, uint32](16),
 		RemoteChecksumsThisFrame: util.NewOrderedMap[int, uint32](16),
+		desyncReports:            make(map[int]*desyncReport),
+		sentDesyncReports:        make(map[int]*sentDesyncReport),
+		localInputDelay:          -1,
+		remoteInputDelay:         -1,
 	}
 	//poll.RegisterLoop(&protocol, nil)
 	return protocol
@@ -288,9 +385,12 @@ func (u *UdpProtocol) OnLoopPoll(timeFunc polling.FuncTimeType) bool {
 
 	var nextInterval int64
 
+	if u.failure != nil && !u.disconnectEventSent {
+		u.fail(u.failure)
+	}
 	err := u.PumpSendQueue()
 	if err != nil {
-		panic(err)
+		u.fail(err)
 	}
 
 	switch u.currentState {
@@ -311,7 +411,7 @@ func (u *UdpProtocol) OnLoopPoll(timeFunc polling.FuncTimeType) bool {
 				u.lastRecievedInput.Frame, u.lastSentInput.Frame)
 			err := u.SendPendingOutput()
 			if err != nil {
-				panic(err)
+				u.fail(err)
 			}
 			u.state.lastInputPacketRecvTime = now
 		}
@@ -331,6 +431,25 @@ func (u *UdpProtocol) OnLoopPoll(timeFunc polling.FuncTimeType) bool {
 			u.state.lastNetworkStatsInterval = now
 		}
 
+		if u.autoInputDelay && !u.inputDelayAcked && u.lastInputDelaySend+RunningRetryInterval < now {
+			u.SendInputDelay(false)
+			u.lastInputDelaySend = now
+		}
+
+		if u.lastDelayChangeSend+RunningRetryInterval < now {
+			for _, change := range u.delayProposals {
+				if !change.acked {
+					u.sendInputDelayChange(change, false, false)
+				}
+			}
+			for _, change := range u.delayCommits {
+				u.sendInputDelayChange(change, false, true)
+			}
+			u.lastDelayChangeSend = now
+		}
+
+		u.pollDesyncReports(now)
+
 		if u.lastSendTime > 0 && u.lastSendTime+KeepAliveInterval < now {
 			util.Log.Println("Sending keep alive packet")
 			msg := messages.NewUDPMessage(messages.KeepAliveMsg)
@@ -382,7 +501,7 @@ func (u *UdpProtocol) SendPendingOutput() error {
 		// bits = msg.Input.Bits
 		input, err := u.pendingOutput.Front()
 		if err != nil {
-			panic(err)
+			return err
 		}
 		inputMsg.StartFrame = uint32(input.Frame)
 		inputMsg.InputSize = uint8(input.Size)
@@ -393,10 +512,10 @@ func (u *UdpProtocol) SendPendingOutput() error {
 
 		for j = 0; j < u.pendingOutput.Size(); j++ {
 			current, err := u.pendingOutput.Item(j)
-			inputMsg.Checksum = current.Checksum
 			if err != nil {
-				panic(err)
+				return err
 			}
+			inputMsg.Checksum = current.Checksum
 			inputMsg.Bits = append(inputMsg.Bits, current.Bits...)
 			last = current // might get rid of this
 			u.lastSentInput = current
@@ -417,6 +536,7 @@ func (u *UdpProtocol) SendPendingOutput() error {
 		inputMsg.PeerConnectStatus = make([]messages.UdpConnectStatus, len(*u.localConnectStatus))
 		copy(inputMsg.PeerConnectStatus, *u.localConnectStatus)
 	} else {
+		// spectators don't know the player count, so cover every slot
 		inputMsg.PeerConnectStatus = make([]messages.UdpConnectStatus, messages.UDPMsgMaxPlayers)
 	}
 
@@ -436,29 +556,143 @@ func (u *UdpProtocol) SendInputAck() {
 	u.SendMsg(inputAck)
 }
 
+// Asks the remote end to resend numFrames confirmed frames of queue starting
+// at startFrame. Spectators ask for every player and pass 0.
+func (u *UdpProtocol) SendRetransmitRequest(queue int, startFrame int, numFrames int) {
+	msg := messages.NewUDPMessage(messages.InputRetransmitRequestMsg)
+	request := msg.(*messages.InputRetransmitRequestPacket)
+	request.Queue = uint8(queue)
+	request.StartFrame = uint32(startFrame)
+	request.NumFrames = uint16(numFrames)
+	u.SendMsg(request)
+}
+
+// Answers a retransmit request. An empty inputs slice tells the remote end the
+// frames it asked for are no longer available.
+func (u *UdpProtocol) SendRetransmit(queue int, startFrame int, inputs []input.GameInput) {
+	msg := messages.NewUDPMessage(messages.InputRetransmitMsg)
+	retransmit := msg.(*messages.InputRetransmitPacket)
+	retransmit.Queue = uint8(queue)
+	retransmit.StartFrame = uint32(startFrame)
+	if len(inputs) == 0 {
+		retransmit.Unavailable = true
+	} else {
+		retransmit.InputSize = uint16(inputs[0].Size)
+		for _, in := range inputs {
+			retransmit.Bits = append(retransmit.Bits, in.Bits...)
+		}
+	}
+	u.SendMsg(retransmit)
+}
+
+/*
+Sends the serialized state we had at frame, in as many chunks as it takes.
+Chunks are resent until the peer acks them, for up to DesyncReportTimeout.
+States over MaxDesyncReportSize aren't sent at all, as the peer couldn't diff
+a state that was cut short.
+*/
+func (u *UdpProtocol) SendDesyncReport(frame int, state []byte) error {
+	if len(state) > MaxDesyncReportSize {
+		return fmt.Errorf("ggpo UdpProtocol SendDesyncReport: the state for frame %d is %d bytes, over the %d byte limit",
+			frame, len(state), MaxDesyncReportSize)
+	}
+	now := time.Now().UnixMilli()
+	report := &sentDesyncReport{
+		state:    state,
+		acked:    make([]bool, desyncReportChunks(len(state))),
+		started:  now,
+		lastSend: now,
+	}
+	u.sentDesyncReports[frame] = report
+	u.sendDesyncReportChunks(frame, report)
+	return nil
+}
+
+// A state of size bytes takes at least one chunk, even when it's empty.
+func desyncReportChunks(size int) int {
+	return util.Max(1, (size+messages.DesyncReportChunkSize-1)/messages.DesyncReportChunkSize)
+}
+
+func (u *UdpProtocol) sendDesyncReportChunks(frame int, report *sentDesyncReport) {
+	for i, acked := range report.acked {
+		if acked {
+			continue
+		}
+		offset := i * messages.DesyncReportChunkSize
+		end := util.Min(offset+messages.DesyncReportChunkSize, len(report.state))
+		u.sendDesyncReportChunk(frame, len(report.state), offset, report.state[offset:end], false)
+	}
+}
+
+func (u *UdpProtocol) sendDesyncReportChunk(frame int, total int, offset int, data []byte, acked bool) {
+	msg := messages.NewUDPMessage(messages.DesyncReportMsg)
+	chunk := msg.(*messages.DesyncReportPacket)
+	chunk.Frame = uint32(frame)
+	chunk.Offset = uint32(offset)
+	chunk.Total = uint32(total)
+	chunk.Acked = acked
+	chunk.Data = data
+	u.SendMsg(chunk)
+}
+
+// Resends the chunks of our reports that haven't been acked and drops reports,
+// sent or received, that have been around for longer than DesyncReportTimeout.
+func (u *UdpProtocol) pollDesyncReports(now int64) {
+	for frame, report := range u.sentDesyncReports {
+		if report.started+DesyncReportTimeout < now {
+			util.Log.Printf("Gave up on sending the desync report for frame %d.\n", frame)
+			delete(u.sentDesyncReports, frame)
+		} else if report.lastSend+RunningRetryInterval < now {
+			u.sendDesyncReportChunks(frame, report)
+			report.lastSend = now
+		}
+	}
+	for frame, report := range u.desyncReports {
+		if report.started+DesyncReportTimeout < now {
+			if !report.done {
+				util.Log.Printf("Gave up on the desync report for frame %d, got %d of %d chunks.\n",
+					frame, report.received, len(report.chunks))
+			}
+			delete(u.desyncReports, frame)
+		}
+	}
+}
+
 func (u *UdpProtocol) GetEvent() (*UdpProtocolEvent, error) {
 	if u.eventQueue.Size() == 0 {
 		return nil, errors.New("ggpo UdpProtocol GetEvent:no events")
 	}
 	e, err := u.eventQueue.Front()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	err = u.eventQueue.Pop()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	return &e, nil
 }
 
-func (u *UdpProtocol) QueueEvent(evt *UdpProtocolEvent) {
+// Fails once the backend has let the event queue fill up without polling it.
+func (u *UdpProtocol) QueueEvent(evt *UdpProtocolEvent) error {
 	util.Log.Printf("Queueing event %s", *evt)
 	err := u.eventQueue.Push(*evt)
-	// if there's no more room left in the queue, make room.
 	if err != nil {
-		//u.eventQueue.Pop()
-		//u.eventQueue.Push(*evt)
-		panic(err)
+		util.Log.Printf("Dropping event %s: %s\n", *evt, err)
+	}
+	return err
+}
+
+/*
+Drops the peer rather than taking the whole session down when the endpoint
+can't go on, say it sent a message we can't make sense of or stopped acking
+our input. If the event queue is full the disconnect is raised on a later poll.
+*/
+func (u *UdpProtocol) fail(err error) {
+	util.Log.Printf("Disconnecting endpoint: %s\n", err)
+	u.failure = err
+	if !u.disconnectEventSent && u.QueueEvent(&UdpProtocolEvent{eventType: DisconnectedEvent}) == nil {
+		u.disconnectEventSent = true
 	}
 }
 
@@ -473,6 +707,9 @@ func (u *UdpProtocol) SendSyncRequest() {
 	syncRequest := msg.(*messages.SyncRequestPacket)
 	syncRequest.RandomRequest = u.state.random
 	syncRequest.RemoteInputDelay = uint8(u.timesync.FrameDelay2)
+	syncRequest.ProtocolVersion = messages.ProtocolVersion
+	syncRequest.ResyncAuthority = uint8(u.resyncAuthority)
+	u.state.syncRequestTime = time.Now().UnixMilli()
 	u.SendMsg(syncRequest)
 }
 
@@ -484,24 +721,33 @@ func (u *UdpProtocol) SendMsg(msg messages.UDPMessage) {
 	msg.SetHeader(u.magicNumber, u.nextSendSeq)
 	u.nextSendSeq++
 	if u.peerAddress == "" {
-		panic("peerAdress empty, why?")
+		util.Log.Printf("Dropping %s: no peer address\n", msg)
+		return
 	}
-	var err error
-	err = u.sendQueue.Push(NewQueEntry(
+	// a full queue loses the message like the network would, and whatever
+	// needs resending is resent
+	err := u.sendQueue.Push(NewQueEntry(
 		time.Now().UnixMilli(), u.peerAddress, u.peerPort, msg))
 	if err != nil {
-		panic(err)
+		util.Log.Printf("Dropping %s: %s\n", msg, err)
 	}
 
 	err = u.PumpSendQueue()
 	if err != nil {
-		panic(err)
+		u.fail(err)
 	}
 }
 
 func (u *UdpProtocol) OnInput(msg messages.UDPMessage, length int) (bool, error) {
 	inputMessage := msg.(*messages.InputPacket)
 
+	// Whatever the remote sends us is untrusted, so check the packet can be
+	// read before acting on any of it.
+	if len(inputMessage.Bits) > 0 &&
+		(inputMessage.InputSize == 0 || len(inputMessage.Bits)%int(inputMessage.InputSize) != 0) {
+		return false, errors.New("ggpo UdpProtocol OnInput: len(inputMessage.Bits) isn't a multiple of inputMessage.InputSize")
+	}
+
 	// If a disconnect is requested, go ahead and disconnect now.
 	disconnectRequested := inputMessage.DisconectRequested
 	if disconnectRequested {
@@ -516,7 +762,18 @@ func (u *UdpProtocol) OnInput(msg messages.UDPMessage, length int) (bool, error)
 		// update the peer connection status if this peer is still considered to be part
 		// of the network
 		remoteStatus := inputMessage.PeerConnectStatus
+		if len(remoteStatus) < len(u.peerConnectStatus) {
+			return false, errors.New("ggpo UdpProtocol OnInput: len(remoteStatus) < len(u.peerConnectStatus)")
+		}
 		for i := 0; i < len(u.peerConnectStatus); i++ {
+			// with more than two players a disconnect can be moved back to an earlier
+			// frame once a peer hears someone else lost the player sooner
+			if remoteStatus[i].Disconnected {
+				if !u.peerConnectStatus[i].Disconnected || remoteStatus[i].LastFrame < u.peerConnectStatus[i].LastFrame {
+					u.peerConnectStatus[i] = remoteStatus[i]
+				}
+				continue
+			}
 			if remoteStatus[i].LastFrame < u.peerConnectStatus[i].LastFrame {
 				return false, errors.New("ggpo UdpProtocol OnInput: remoteStatus[i].LastFrame < u.peerConnectStatus[i].LastFrame")
 			}
@@ -546,16 +803,21 @@ func (u *UdpProtocol) OnInput(msg messages.UDPMessage, length int) (bool, error)
 			if currentFrame != uint32(u.lastRecievedInput.Frame)+1 {
 				return false, errors.New("ggpo UdpProtocol OnInput: currentFrame != uint32(u.lastRecievedInput.Frame) +1")
 			}
-			u.lastRecievedInput.Bits = inputMessage.Bits[offset : offset+int(inputMessage.InputSize)]
-			u.lastRecievedInput.Frame = int(currentFrame)
-			u.lastRecievedInput.Checksum = inputMessage.Checksum
+			received := u.lastRecievedInput
+			received.Bits = inputMessage.Bits[offset : offset+int(inputMessage.InputSize)]
+			received.Frame = int(currentFrame)
+			received.Checksum = inputMessage.Checksum
 			evt := UdpProtocolEvent{
 				eventType: InputEvent,
-				Input:     u.lastRecievedInput,
+				Input:     received,
+			}
+			// with no room for the frame it's left unacked, so it comes again
+			if u.QueueEvent(&evt) != nil {
+				break
 			}
+			u.lastRecievedInput = received
 			u.state.lastInputPacketRecvTime = time.Now().UnixMilli()
 			util.Log.Printf("Sending frame %d to emu queue %d.\n", u.lastRecievedInput.Frame, u.queue)
-			u.QueueEvent(&evt)
 			u.SendInputAck()
 		} else {
 			util.Log.Printf("Skipping past frame:(%d) current is %d.\n", currentFrame, u.lastRecievedInput.Frame)
@@ -570,43 +832,39 @@ func (u *UdpProtocol) OnInput(msg messages.UDPMessage, length int) (bool, error)
 	}
 
 	// Get rid of our buffered input
+	err := u.discardAckedOutput(inputMessage.AckFrame)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Drops pending output the remote end has acked, every frame before ackFrame.
+func (u *UdpProtocol) discardAckedOutput(ackFrame int32) error {
 	for u.pendingOutput.Size() > 0 {
 		input, err := u.pendingOutput.Front()
 		if err != nil {
-			panic(err)
+			return err
 		}
-		if int32(input.Frame) < inputMessage.AckFrame {
-			util.Log.Printf("Throwing away pending output frame %d\n", input.Frame)
-			u.lastAckedInput = input
-			err := u.pendingOutput.Pop()
-			if err != nil {
-				panic(err)
-			}
-		} else {
+		if int32(input.Frame) >= ackFrame {
 			break
 		}
+		util.Log.Printf("Throwing away pending output frame %d\n", input.Frame)
+		u.lastAckedInput = input
+		err = u.pendingOutput.Pop()
+		if err != nil {
+			return err
+		}
 	}
-	return true, nil
+	return nil
 }
 
 func (u *UdpProtocol) OnInputAck(msg messages.UDPMessage, len int) (bool, error) {
 	inputAck := msg.(*messages.InputAckPacket)
 	// Get rid of our buffered input
-	for u.pendingOutput.Size() > 0 {
-		input, err := u.pendingOutput.Front()
-		if err != nil {
-			panic(err)
-		}
-		if int32(input.Frame) < inputAck.AckFrame {
-			util.Log.Printf("Throwing away pending output frame %d\n", input.Frame)
-			u.lastAckedInput = input
-			err = u.pendingOutput.Pop()
-			if err != nil {
-				panic(err)
-			}
-		} else {
-			break
-		}
+	err := u.discardAckedOutput(inputAck.AckFrame)
+	if err != nil {
+		return false, err
 	}
 	return true, nil
 }
@@ -625,6 +883,282 @@ func (u *UdpProtocol) OnQualityReport(msg messages.UDPMessage, len int) (bool, e
 func (u *UdpProtocol) OnQualityReply(msg messages.UDPMessage, len int) (bool, error) {
 	qualityReply := msg.(*messages.QualityReplyPacket)
 	u.roundTripTime = time.Now().UnixMilli() - int64(qualityReply.Pong)
+	u.roundTripMeasured = true
+	return true, nil
+}
+
+// The round trip time of the last connection quality report, false before the
+// first one comes back.
+func (u *UdpProtocol) RoundTripTime() (int64, bool) {
+	return u.roundTripTime, u.roundTripMeasured
+}
+
+func (u *UdpProtocol) OnInputRetransmitRequest(msg messages.UDPMessage, len int) (bool, error) {
+	request := msg.(*messages.InputRetransmitRequestPacket)
+	u.QueueEvent(&UdpProtocolEvent{
+		eventType: RetransmitRequestEvent,
+		Player:    int(request.Queue),
+		Frame:     int(request.StartFrame),
+		Count:     int(request.NumFrames),
+	})
+	return true, nil
+}
+
+func (u *UdpProtocol) OnInputRetransmit(msg messages.UDPMessage, length int) (bool, error) {
+	retransmit := msg.(*messages.InputRetransmitPacket)
+	evt := UdpProtocolEvent{
+		eventType:   RetransmitEvent,
+		Player:      int(retransmit.Queue),
+		Frame:       int(retransmit.StartFrame),
+		Unavailable: retransmit.Unavailable,
+	}
+	size := int(retransmit.InputSize)
+	if !retransmit.Unavailable {
+		if size == 0 || len(retransmit.Bits)%size != 0 {
+			return false, errors.New("ggpo UdpProtocol OnInputRetransmit: bits are not a multiple of the input size")
+		}
+		frame := evt.Frame
+		for offset := 0; offset < len(retransmit.Bits); offset += size {
+			evt.Inputs = append(evt.Inputs, input.GameInput{
+				Frame: frame,
+				Size:  size,
+				Bits:  retransmit.Bits[offset : offset+size],
+			})
+			frame++
+		}
+	}
+	u.QueueEvent(&evt)
+	return true, nil
+}
+
+func (u *UdpProtocol) OnDesyncReport(msg messages.UDPMessage, length int) (bool, error) {
+	chunk := msg.(*messages.DesyncReportPacket)
+	frame := int(chunk.Frame)
+	total := int(chunk.Total)
+	offset := int(chunk.Offset)
+	if chunk.Acked {
+		report, ok := u.sentDesyncReports[frame]
+		if ok && len(report.state) == total && offset%messages.DesyncReportChunkSize == 0 &&
+			offset/messages.DesyncReportChunkSize < len(report.acked) {
+			report.acked[offset/messages.DesyncReportChunkSize] = true
+			for _, acked := range report.acked {
+				if !acked {
+					return true, nil
+				}
+			}
+			delete(u.sentDesyncReports, frame)
+		}
+		return true, nil
+	}
+	// every chunk but the last one is full, which is what the bitmap relies on
+	if total > MaxDesyncReportSize || offset%messages.DesyncReportChunkSize != 0 ||
+		offset/messages.DesyncReportChunkSize >= desyncReportChunks(total) ||
+		len(chunk.Data) != util.Min(messages.DesyncReportChunkSize, total-offset) {
+		return false, errors.New("ggpo UdpProtocol OnDesyncReport: chunk lies outside the state")
+	}
+	report, ok := u.desyncReports[frame]
+	if !ok || len(report.state) != total {
+		report = &desyncReport{
+			state:   make([]byte, total),
+			chunks:  make([]bool, desyncReportChunks(total)),
+			started: time.Now().UnixMilli(),
+		}
+		u.desyncReports[frame] = report
+	}
+	u.sendDesyncReportChunk(frame, total, offset, nil, true)
+	index := offset / messages.DesyncReportChunkSize
+	if report.done || report.chunks[index] {
+		return true, nil
+	}
+	copy(report.state[offset:], chunk.Data)
+	report.chunks[index] = true
+	report.received++
+	if report.received == len(report.chunks) {
+		report.done = true
+		u.QueueEvent(&UdpProtocolEvent{
+			eventType: DesyncReportEvent,
+			Frame:     frame,
+			State:     report.state,
+		})
+	}
+	return true, nil
+}
+
+// Sets the player handle we resync from after a desync, 0 for none, which is
+// sent to the peer while synchronizing.
+func (u *UdpProtocol) SetResyncAuthority(handle int) {
+	u.resyncAuthority = handle
+}
+
+// The resync authority the peer sent while synchronizing.
+func (u *UdpProtocol) RemoteResyncAuthority() int {
+	return u.remoteResyncAuthority
+}
+
+/*
+Makes this endpoint agree on an input delay with its peer once synchronized,
+picked from the round trip time measured during the handshake. Must be set
+before synchronizing finishes.
+*/
+func (u *UdpProtocol) SetAutoInputDelay(enabled bool) {
+	u.autoInputDelay = enabled
+}
+
+// Whether the endpoint is still waiting on its peer's input delay proposal.
+func (u *UdpProtocol) InputDelayAgreed() bool {
+	return !u.autoInputDelay || u.inputDelayAgreed
+}
+
+// The larger of both proposals, so either peer lands on the same delay.
+func (u *UdpProtocol) AgreedInputDelay() int {
+	return util.Max(u.localInputDelay, u.remoteInputDelay)
+}
+
+/*
+Hides half the one-way latency behind input delay and leaves the other half to
+rollback, trading a little responsiveness for shallower rollbacks.
+*/
+func InputDelayForRoundTrip(roundTrip int64) int {
+	frames := int(math.Ceil(float64(roundTrip) / 4 * 60 / 1000))
+	return util.Min(frames, MaxAutoInputDelay)
+}
+
+func (u *UdpProtocol) SendInputDelay(acked bool) {
+	msg := messages.NewUDPMessage(messages.InputDelayMsg)
+	inputDelay := msg.(*messages.InputDelayPacket)
+	inputDelay.Delay = uint8(u.localInputDelay)
+	inputDelay.Acked = acked
+	u.SendMsg(inputDelay)
+}
+
+func (u *UdpProtocol) OnInputDelay(msg messages.UDPMessage, len int) (bool, error) {
+	inputDelay := msg.(*messages.InputDelayPacket)
+	if !u.autoInputDelay {
+		// A peer with a fixed delay proposes that, so the other side can still
+		// settle on a value.
+		u.localInputDelay = u.timesync.FrameDelay2
+		if !inputDelay.Acked {
+			u.SendInputDelay(true)
+		}
+		return true, nil
+	}
+	u.remoteInputDelay = int(inputDelay.Delay)
+	if inputDelay.Acked {
+		u.inputDelayAcked = true
+	} else if u.localInputDelay >= 0 {
+		u.SendInputDelay(true)
+	}
+	u.checkInputDelayAgreed()
+	return true, nil
+}
+
+func (u *UdpProtocol) checkInputDelayAgreed() {
+	if u.inputDelayAgreed || u.localInputDelay < 0 || u.remoteInputDelay < 0 {
+		return
+	}
+	u.inputDelayAgreed = true
+	u.timesync.RemoteFrameDelay = u.AgreedInputDelay()
+	util.Log.Printf("Agreed on an input delay of %d frames.\n", u.AgreedInputDelay())
+	u.QueueEvent(&UdpProtocolEvent{
+		eventType:  InputDelayAgreedEvent,
+		InputDelay: u.AgreedInputDelay(),
+	})
+}
+
+/*
+Proposes that the player in queue player switches to delay frames of input
+delay from frame on, resending until the peer acks it. The change only takes
+effect once CommitInputDelay makes it final; several can be in flight at once.
+*/
+func (u *UdpProtocol) ProposeInputDelay(player int, frame int, delay int) {
+	change := delayChange{player: player, DelayChange: input.DelayChange{Frame: frame, Delay: delay}}
+	u.delayProposals = append(u.delayProposals, change)
+	u.sendInputDelayChange(change, false, false)
+}
+
+// Whether the peer acked the proposal, see ProposeInputDelay.
+func (u *UdpProtocol) InputDelayAcked(player int, frame int, delay int) bool {
+	for _, change := range u.delayProposals {
+		if change.player == player && change.Frame == frame && change.Delay == delay {
+			return change.acked
+		}
+	}
+	return false
+}
+
+// Drops every proposal for player that hasn't been committed, e.g. ones the
+// peer didn't ack in time.
+func (u *UdpProtocol) WithdrawInputDelay(player int) {
+	kept := u.delayProposals[:0]
+	for _, change := range u.delayProposals {
+		if change.player != player {
+			kept = append(kept, change)
+		}
+	}
+	u.delayProposals = kept
+}
+
+// Makes an acked proposal final, resending until the peer acks the commit.
+func (u *UdpProtocol) CommitInputDelay(player int, frame int, delay int) {
+	change := delayChange{player: player, DelayChange: input.DelayChange{Frame: frame, Delay: delay}}
+	for i, proposal := range u.delayProposals {
+		if proposal.player == player && proposal.DelayChange == change.DelayChange {
+			u.delayProposals = append(u.delayProposals[:i], u.delayProposals[i+1:]...)
+			break
+		}
+	}
+	u.delayCommits = append(u.delayCommits, change)
+	u.sendInputDelayChange(change, false, true)
+}
+
+func (u *UdpProtocol) sendInputDelayChange(change delayChange, acked bool, commit bool) {
+	msg := messages.NewUDPMessage(messages.InputDelayChangeMsg)
+	packet := msg.(*messages.InputDelayChangePacket)
+	packet.Player = uint8(change.player)
+	packet.Frame = uint32(change.Frame)
+	packet.Delay = uint8(change.Delay)
+	packet.Acked = acked
+	packet.Commit = commit
+	u.SendMsg(packet)
+}
+
+func (u *UdpProtocol) OnInputDelayChange(msg messages.UDPMessage, len int) (bool, error) {
+	packet := msg.(*messages.InputDelayChangePacket)
+	change := delayChange{
+		player:      int(packet.Player),
+		DelayChange: input.DelayChange{Frame: int(packet.Frame), Delay: int(packet.Delay)},
+	}
+	if packet.Acked {
+		pending := u.delayProposals
+		if packet.Commit {
+			pending = u.delayCommits
+		}
+		for i := range pending {
+			if pending[i].player != change.player || pending[i].DelayChange != change.DelayChange {
+				continue
+			}
+			if packet.Commit {
+				u.delayCommits = append(u.delayCommits[:i], u.delayCommits[i+1:]...)
+			} else {
+				pending[i].acked = true
+			}
+			break
+		}
+		return true, nil
+	}
+	// Acks get lost too, so every copy is acked. A proposal needs nothing
+	// more from us; a commit is raised again each time, and applying the
+	// same change twice does nothing.
+	u.sendInputDelayChange(change, true, packet.Commit)
+	if !packet.Commit {
+		return true, nil
+	}
+	u.QueueEvent(&UdpProtocolEvent{
+		eventType:  InputDelayChangeEvent,
+		Player:     change.player,
+		Frame:      change.Frame,
+		InputDelay: change.Delay,
+	})
 	return true, nil
 }
 
@@ -668,7 +1202,7 @@ func (u *UdpProtocol) PumpSendQueue() error {
 	for !u.sendQueue.Empty() {
 		entry, err = u.sendQueue.Front()
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		if u.sendLatency > 0 {
@@ -677,6 +1211,11 @@ func (u *UdpProtocol) PumpSendQueue() error {
 				break
 			}
 		}
+		// popped before sending, since a reply can come back and pump the queue again before SendTo returns
+		err = u.sendQueue.Pop()
+		if err != nil {
+			return err
+		}
 		if u.ooPercent > 0 && u.ooPacket.msg == nil && ((rand.Int() % 100) < u.ooPercent) {
 			delay := rand.Int63() % (u.sendLatency*10 + 1000)
 			util.Log.Printf("creating rogue oop (seq: %d  delay: %d)\n",
@@ -691,10 +1230,6 @@ func (u *UdpProtocol) PumpSendQueue() error {
 			u.connection.SendTo(entry.msg, entry.destIp, entry.destPort)
 			// would delete the udpmsg here
 		}
-		err := u.sendQueue.Pop()
-		if err != nil {
-			panic(err)
-		}
 	}
 	if u.ooPacket.msg != nil && u.ooPacket.sendTime < time.Now().UnixMilli() {
 		util.Log.Printf("sending rogue oop!")
@@ -709,7 +1244,7 @@ func (u *UdpProtocol) ClearSendQueue() {
 		// i'd manually delete the QueueEntry in a language where I could
 		err := u.sendQueue.Pop()
 		if err != nil {
-			panic(err)
+			break
 		}
 	}
 }
@@ -735,18 +1270,17 @@ func (u *UdpProtocol) SendInput(input *input.GameInput) {
 			// check to see if this is a good time to adjust for the rift
 			u.timesync.AdvanceFrames(input, u.localFrameAdvantage, u.remoteFrameAdvantage)
 
-			// Save this input packet.
+			// Save this input packet. Once the remote end goes this long
+			// without acking any, it's given up on.
 			err := u.pendingOutput.Push(*input)
-			// if for whatever reason the capacity is full, pop off the end of the buffer and try again
 			if err != nil {
-				//u.pendingOutput.Pop()
-				//u.pendingOutput.Push(*input)
-				panic(err)
+				u.fail(err)
+				return
 			}
 		}
 		err := u.SendPendingOutput()
 		if err != nil {
-			panic(err)
+			u.fail(err)
 		}
 	}
 }
@@ -794,10 +1328,23 @@ func (u *UdpProtocol) OnInvalid(msg messages.UDPMessage, len int) (bool, error)
 
 func (u *UdpProtocol) OnSyncRequest(msg messages.UDPMessage, len int) (bool, error) {
 	request := msg.(*messages.SyncRequestPacket)
+	if request.ProtocolVersion != messages.ProtocolVersion {
+		// Left unanswered, so neither side synchronizes; the mismatch is only
+		// raised once however often the peer asks.
+		if !u.protocolMismatched {
+			util.Log.Printf("Refusing to synchronize with a peer on protocol version %d, we're on %d.\n",
+				request.ProtocolVersion, messages.ProtocolVersion)
+			u.protocolMismatched = true
+			u.QueueEvent(&UdpProtocolEvent{eventType: ProtocolMismatchEvent})
+		}
+		return true, nil
+	}
 	reply := messages.NewUDPMessage(messages.SyncReplyMsg)
 	syncReply := reply.(*messages.SyncReplyPacket)
 	syncReply.RandomReply = request.RandomRequest
+	syncReply.ResyncAuthority = uint8(u.resyncAuthority)
 	u.timesync.RemoteFrameDelay = int(request.RemoteInputDelay)
+	u.remoteResyncAuthority = int(request.ResyncAuthority)
 	u.SendMsg(syncReply)
 	return true, nil
 }
@@ -815,7 +1362,12 @@ func (u *UdpProtocol) OnMsg(msg messages.UDPMessage, length int) {
 		u.OnQualityReport,
 		u.OnQualityReply,
 		u.OnKeepAlive,
-		u.OnInputAck}
+		u.OnInputAck,
+		u.OnInputRetransmitRequest,
+		u.OnInputRetransmit,
+		u.OnDesyncReport,
+		u.OnInputDelay,
+		u.OnInputDelayChange}
 
 	// filter out messages that don't match what we expect
 	seq := msg.Header().SequenceNumber
@@ -841,7 +1393,10 @@ func (u *UdpProtocol) OnMsg(msg messages.UDPMessage, length int) {
 		handled, err = table[int(msg.Header().HeaderType)](msg, length)
 	}
 	if err != nil {
-		panic(err)
+		// A peer sending messages we can't make sense of gets dropped rather
+		// than taking the whole session down with it.
+		u.fail(err)
+		return
 	}
 
 	if handled {
@@ -869,12 +1424,16 @@ func (u *UdpProtocol) OnSyncReply(msg messages.UDPMessage, length int) (bool, er
 		return false, nil
 	}
 
+	u.remoteResyncAuthority = int(syncReply.ResyncAuthority)
 	if !u.connected {
 		u.QueueEvent(&UdpProtocolEvent{
 			eventType: ConnectedEvent})
 		u.connected = true
 	}
 
+	u.handshakeRoundTrips += time.Now().UnixMilli() - u.state.syncRequestTime
+	u.handshakeSamples++
+
 	util.Log.Printf("Checking sync state (%d round trips remaining).\n", u.state.roundTripRemaining)
 	u.state.roundTripRemaining--
 	if u.state.roundTripRemaining == 0 {
@@ -885,6 +1444,11 @@ func (u *UdpProtocol) OnSyncReply(msg messages.UDPMessage, length int) (bool, er
 		u.currentState = RunningState
 		u.lastRecievedInput.Frame = -1
 		u.remoteMagicNumber = msg.Header().Magic
+		if u.autoInputDelay {
+			u.localInputDelay = InputDelayForRoundTrip(u.handshakeRoundTrips / u.handshakeSamples)
+			u.SendInputDelay(u.remoteInputDelay >= 0)
+			u.checkInputDelayAgreed()
+		}
 	} else {
 		evt := UdpProtocolEvent{
 			eventType: SynchronizingEvent,
@@ -909,3 +1473,20 @@ func (u *UdpProtocol) IsSynchronized() bool {
 func (u *UdpProtocol) IsRunning() bool {
 	return u.currentState == RunningState
 }
+
+func (u *UdpProtocol) IsDisconnected() bool {
+	return u.currentState == DisconnectedState
+}
+
+// Whether the peer has gone quiet for longer than the disconnect notify start.
+func (u *UdpProtocol) IsInterrupted() bool {
+	return u.currentState == RunningState && u.disconnectNotifySent
+}
+
+// Milliseconds left before the peer times out, -1 if it can't right now.
+func (u *UdpProtocol) TimeUntilDisconnect(now int64) int64 {
+	if u.currentState != RunningState || u.disconnectTimeout <= 0 {
+		return -1
+	}
+	return util.Max(0, u.lastRecvTime+u.disconnectTimeout-now)
+}
@@ -1,6 +1,7 @@
 package protocol_test
 
 import (
+	"bytes"
 	"strconv"
 	"testing"
 	"time"
@@ -163,6 +164,7 @@ func TestUDPProtocolOnSyncRequest(t *testing.T) {
 	portStr := strconv.Itoa(peerPort)
 	msg := messages.NewUDPMessage(messages.SyncRequestMsg)
 	syncRequestPacket := msg.(*messages.SyncRequestPacket)
+	syncRequestPacket.ProtocolVersion = messages.ProtocolVersion
 
 	endpoint.OnSyncRequest(syncRequestPacket, syncRequestPacket.PacketSize())
 
@@ -177,6 +179,35 @@ func TestUDPProtocolOnSyncRequest(t *testing.T) {
 	}
 }
 
+func TestUDPProtocolOnSyncRequestVersionMismatch(t *testing.T) {
+	connectStatus := []messages.UdpConnectStatus{
+		{Disconnected: false, LastFrame: 20},
+		{Disconnected: false, LastFrame: 22},
+	}
+	connection := mocks.NewFakeConnection()
+	peerAdress := "127.2.1.1"
+	peerPort := 7001
+	endpoint := protocol.NewUdpProtocol(&connection, 0, peerAdress, peerPort, &connectStatus)
+	msg := messages.NewUDPMessage(messages.SyncRequestMsg)
+	syncRequestPacket := msg.(*messages.SyncRequestPacket)
+	syncRequestPacket.ProtocolVersion = messages.ProtocolVersion + 1
+
+	for i := 0; i < 2; i++ {
+		endpoint.OnSyncRequest(syncRequestPacket, syncRequestPacket.PacketSize())
+	}
+
+	if msgs := connection.SendMap[peerAdress+":"+strconv.Itoa(peerPort)]; len(msgs) != 0 {
+		t.Errorf("A peer on another protocol version shouldn't get a sync reply, got %v", msgs)
+	}
+	evt, err := endpoint.GetEvent()
+	if err != nil || evt.Type() != protocol.ProtocolMismatchEvent {
+		t.Fatalf("expected a protocol mismatch event, got %v (%v)", evt, err)
+	}
+	if _, err := endpoint.GetEvent(); err == nil {
+		t.Errorf("The mismatch should only be raised once.")
+	}
+}
+
 func TestUDPProtocolGetPeerConnectStatus(t *testing.T) {
 	connectStatus := []messages.UdpConnectStatus{
 		{Disconnected: false, LastFrame: 20},
@@ -282,7 +313,7 @@ func TestUDPProtocolOnQualityReply(t *testing.T) {
 	}
 }
 
-func TestUDPProtocolQueEventPanic(t *testing.T) {
+func TestUDPProtocolQueueEventFull(t *testing.T) {
 	connectStatus := []messages.UdpConnectStatus{
 		{Disconnected: false, LastFrame: 20},
 		{Disconnected: false, LastFrame: 22},
@@ -293,13 +324,14 @@ func TestUDPProtocolQueEventPanic(t *testing.T) {
 	endpoint := protocol.NewUdpProtocol(&connection, 0, peerAdress, peerPort, &connectStatus)
 	event := protocol.UdpProtocolEvent{}
 	capcity := 64
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic when QueEvent attempted to add an event higher than the capacity.")
+	for i := 0; i < capcity; i++ {
+		err := endpoint.QueueEvent(&event)
+		if err != nil {
+			t.Fatalf("Queueing event %d of %d shouldn't be an error: %s", i+1, capcity, err)
 		}
-	}()
-	for i := 0; i < capcity+1; i++ {
-		endpoint.QueueEvent(&event)
+	}
+	if endpoint.QueueEvent(&event) == nil {
+		t.Errorf("Queueing an event past the capacity should be an error.")
 	}
 }
 
@@ -454,7 +486,7 @@ func TestUDPProtocolHeartbeatGameInput(t *testing.T) {
 
 }
 
-func TestUDPProtocolOnInputDefaultPanic(t *testing.T) {
+func TestUDPProtocolOnInputDefaultError(t *testing.T) {
 	connectStatus := []messages.UdpConnectStatus{
 		{Disconnected: false, LastFrame: 20},
 		{Disconnected: false, LastFrame: 22},
@@ -490,15 +522,13 @@ func TestUDPProtocolOnInputDefaultPanic(t *testing.T) {
 	}
 	msg = messages.NewUDPMessage(messages.InputMsg)
 	inputPacket := msg.(*messages.InputPacket)
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic when OnInput recieved a completely empty input packet.")
-		}
-	}()
-	endpoint.OnInput(inputPacket, inputPacket.PacketSize())
+	_, err := endpoint.OnInput(inputPacket, inputPacket.PacketSize())
+	if err == nil {
+		t.Errorf("The code returned no error when OnInput recieved a completely empty input packet.")
+	}
 }
 
-func TestUDPProtocolOnInputPanicWithNonEqualConnectStatus(t *testing.T) {
+func TestUDPProtocolOnInputErrorWithNonEqualConnectStatus(t *testing.T) {
 	connectStatus := []messages.UdpConnectStatus{
 		{Disconnected: false, LastFrame: 20},
 		{Disconnected: false, LastFrame: 22},
@@ -534,13 +564,11 @@ func TestUDPProtocolOnInputPanicWithNonEqualConnectStatus(t *testing.T) {
 	}
 	msg = messages.NewUDPMessage(messages.InputMsg)
 	inputPacket := msg.(*messages.InputPacket)
-	inputPacket.PeerConnectStatus = connectStatus
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic when OnInput recieved a packet with number of connect statuses not equal to its own.")
-		}
-	}()
-	endpoint.OnInput(inputPacket, inputPacket.PacketSize())
+	inputPacket.PeerConnectStatus = connectStatus[:1]
+	_, err := endpoint.OnInput(inputPacket, inputPacket.PacketSize())
+	if err == nil {
+		t.Errorf("The code returned no error when OnInput recieved a packet with fewer connect statuses than its own.")
+	}
 }
 
 func TestUDPProtocolOnInputAfterSynchronizeCharacterization(t *testing.T) {
@@ -581,12 +609,10 @@ func TestUDPProtocolOnInputAfterSynchronizeCharacterization(t *testing.T) {
 	inputPacket := msg.(*messages.InputPacket)
 	inputPacket.PeerConnectStatus = make([]messages.UdpConnectStatus, 4)
 	inputPacket.Bits = []byte{1, 2, 3, 4}
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic when OnInput recieved a packet without its imput size set")
-		}
-	}()
-	endpoint.OnInput(inputPacket, inputPacket.PacketSize())
+	_, err := endpoint.OnInput(inputPacket, inputPacket.PacketSize())
+	if err == nil {
+		t.Errorf("The code returned no error when OnInput recieved a packet without its imput size set")
+	}
 }
 
 func TestUDPProtocolOnInputAfterSynchronize(t *testing.T) {
@@ -855,8 +881,10 @@ func TestUDPProtocolHeartBeatCharacterization(t *testing.T) {
 	connection := mocks.NewFakeP2PConnection(&f, peerPort, peerAdress)
 	endpoint := protocol.NewUdpProtocol(&connection, 0, peerAdress, port2, &connectStatus)
 
+	// a peer that disagrees on the number of players
+	shortStatus := connectStatus[:1]
 	connection2 := mocks.NewFakeP2PConnection(&f2, port2, peerAdress)
-	endpoint2 := protocol.NewUdpProtocol(&connection2, 0, peerAdress, peerPort, &connectStatus)
+	endpoint2 := protocol.NewUdpProtocol(&connection2, 0, peerAdress, peerPort, &shortStatus)
 	f2.Endpoint = &endpoint
 	f.Endpoint = &endpoint2
 
@@ -871,15 +899,21 @@ func TestUDPProtocolHeartBeatCharacterization(t *testing.T) {
 		endpoint2.OnLoopPoll(advance)
 	}
 
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic when OnInput recieved a connection status with length < 4")
-		}
-	}()
-
 	for i := 0; i < 10; i++ {
 		endpoint2.OnLoopPoll(advance)
 	}
+
+	disconnected := false
+	for {
+		evt, err := endpoint.GetEvent()
+		if err != nil {
+			break
+		}
+		disconnected = disconnected || evt.Type() == protocol.DisconnectedEvent
+	}
+	if !disconnected {
+		t.Errorf("The endpoint wasn't disconnected when OnInput recieved a connection status shorter than its own")
+	}
 }
 
 func TestUDPProtocolHeartBeat(t *testing.T) {
@@ -938,3 +972,158 @@ func TestUDPProtocolHeartBeat(t *testing.T) {
 	}
 
 }
+
+func TestInputDelayForRoundTrip(t *testing.T) {
+	cases := map[int64]int{0: 0, 10: 1, 100: 2, 200: 3, 1000: protocol.MaxAutoInputDelay}
+	for roundTrip, want := range cases {
+		got := protocol.InputDelayForRoundTrip(roundTrip)
+		if got != want {
+			t.Errorf("expected a round trip of %dms to get %d frames of input delay but got %d", roundTrip, want, got)
+		}
+	}
+}
+
+func TestUDPProtocolSendInputUnacked(t *testing.T) {
+	connectStatus := []messages.UdpConnectStatus{
+		{Disconnected: false, LastFrame: 20},
+		{Disconnected: false, LastFrame: 22},
+	}
+	connection := mocks.NewFakeConnection()
+	peerAdress := "127.2.1.1"
+	peerPort := 7001
+	endpoint := protocol.NewUdpProtocol(&connection, 0, peerAdress, peerPort, &connectStatus)
+
+	endpoint.Synchronize()
+	msg := messages.NewUDPMessage(messages.SyncReplyMsg)
+	syncReply := msg.(*messages.SyncReplyPacket)
+	for i := 0; i < protocol.NumSyncPackets; i++ {
+		syncReply.RandomReply = connection.LastSentMessage.(*messages.SyncRequestPacket).RandomRequest
+		endpoint.OnSyncReply(syncReply, syncReply.PacketSize())
+	}
+	if !endpoint.IsRunning() {
+		t.Fatalf("expected the endpoint to be running after synchronizing")
+	}
+	for _, err := endpoint.GetEvent(); err == nil; _, err = endpoint.GetEvent() {
+	}
+
+	// the remote end never acks, so pending output fills up
+	capacity := 64
+	for frame := 0; frame <= capacity; frame++ {
+		in := input.GameInput{Frame: frame, Size: 4, Bits: []byte{1, 2, 3, 4}}
+		endpoint.SendInput(&in)
+	}
+	evt, err := endpoint.GetEvent()
+	if err != nil || evt.Type() != protocol.DisconnectedEvent {
+		t.Fatalf("expected a disconnect once pending output is full, got %v (%v)", evt, err)
+	}
+	if _, err = endpoint.GetEvent(); err == nil {
+		t.Errorf("expected the disconnect to be raised once")
+	}
+}
+
+// Counts the desync report chunks sent since the first skip messages, acks or not.
+func sentDesyncChunks(connection *mocks.FakeConnection, skip int, acked bool) int {
+	count := 0
+	for _, msg := range connection.SendMap["127.2.1.1:7001"][skip:] {
+		if chunk, ok := msg.(*messages.DesyncReportPacket); ok && chunk.Acked == acked {
+			count++
+		}
+	}
+	return count
+}
+
+func TestUDPProtocolDesyncReportChunks(t *testing.T) {
+	connectStatus := []messages.UdpConnectStatus{
+		{Disconnected: false, LastFrame: 20},
+		{Disconnected: false, LastFrame: 22},
+	}
+	connection := mocks.NewFakeConnection()
+	endpoint := protocol.NewUdpProtocol(&connection, 0, "127.2.1.1", 7001, &connectStatus)
+	endpoint.Synchronize()
+	msg := messages.NewUDPMessage(messages.SyncReplyMsg)
+	syncReply := msg.(*messages.SyncReplyPacket)
+	for i := 0; i < protocol.NumSyncPackets; i++ {
+		syncReply.RandomReply = connection.LastSentMessage.(*messages.SyncRequestPacket).RandomRequest
+		endpoint.OnSyncReply(syncReply, syncReply.PacketSize())
+	}
+	for _, err := endpoint.GetEvent(); err == nil; _, err = endpoint.GetEvent() {
+	}
+
+	state := make([]byte, 2*messages.DesyncReportChunkSize+100)
+	for i := range state {
+		state[i] = byte(i)
+	}
+	chunk := func(frame int, index int) *messages.DesyncReportPacket {
+		offset := index * messages.DesyncReportChunkSize
+		end := offset + messages.DesyncReportChunkSize
+		if end > len(state) {
+			end = len(state)
+		}
+		return &messages.DesyncReportPacket{Frame: uint32(frame), Offset: uint32(offset), Total: uint32(len(state)), Data: state[offset:end]}
+	}
+
+	// resent chunks aren't counted twice
+	sent := len(connection.SendMap["127.2.1.1:7001"])
+	for _, index := range []int{0, 0, 1, 1} {
+		endpoint.OnDesyncReport(chunk(10, index), 0)
+	}
+	if _, err := endpoint.GetEvent(); err == nil {
+		t.Fatalf("expected no report before every chunk arrived")
+	}
+	if acks := sentDesyncChunks(&connection, sent, true); acks != 4 {
+		t.Errorf("expected every chunk to be acked, got %d acks", acks)
+	}
+	endpoint.OnDesyncReport(chunk(10, 2), 0)
+	endpoint.OnDesyncReport(chunk(10, 2), 0)
+	evt, err := endpoint.GetEvent()
+	if err != nil || evt.Type() != protocol.DesyncReportEvent || !bytes.Equal(evt.State, state) {
+		t.Fatalf("expected the reassembled report, got %v (%v)", evt, err)
+	}
+	if _, err := endpoint.GetEvent(); err == nil {
+		t.Errorf("expected a chunk resent after the report was complete to be ignored")
+	}
+
+	// a report that never completes expires
+	endpoint.OnDesyncReport(chunk(20, 0), 0)
+	later := func() int64 {
+		return time.Now().UnixMilli() + protocol.DesyncReportTimeout + 1
+	}
+	endpoint.OnLoopPoll(later)
+	endpoint.OnDesyncReport(chunk(20, 1), 0)
+	endpoint.OnDesyncReport(chunk(20, 2), 0)
+	if _, err := endpoint.GetEvent(); err == nil {
+		t.Errorf("expected the chunk from before the timeout to have been dropped")
+	}
+
+	// our own chunks are resent until they're acked
+	if endpoint.SendDesyncReport(30, make([]byte, protocol.MaxDesyncReportSize+1)) == nil {
+		t.Errorf("Sending a report over MaxDesyncReportSize should be an error.")
+	}
+	err = endpoint.SendDesyncReport(30, state)
+	if err != nil {
+		t.Fatalf("Error when sending a desync report: %s", err)
+	}
+	for index := 0; index < 2; index++ {
+		ack := chunk(30, index)
+		ack.Acked = true
+		ack.Data = nil
+		endpoint.OnDesyncReport(ack, 0)
+	}
+	retry := func() int64 {
+		return time.Now().UnixMilli() + protocol.RunningRetryInterval + 1
+	}
+	sent = len(connection.SendMap["127.2.1.1:7001"])
+	endpoint.OnLoopPoll(retry)
+	if resent := sentDesyncChunks(&connection, sent, false); resent != 1 {
+		t.Errorf("expected the one unacked chunk to be resent, got %d", resent)
+	}
+	ack := chunk(30, 2)
+	ack.Acked = true
+	ack.Data = nil
+	endpoint.OnDesyncReport(ack, 0)
+	sent = len(connection.SendMap["127.2.1.1:7001"])
+	endpoint.OnLoopPoll(retry)
+	if resent := sentDesyncChunks(&connection, sent, false); resent != 0 {
+		t.Errorf("expected nothing to be resent once every chunk is acked, got %d", resent)
+	}
+}
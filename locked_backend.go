@@ -0,0 +1,138 @@
+package ggpo
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/assemblaj/ggpo/internal/polling"
+	"github.com/assemblaj/ggpo/internal/protocol"
+	"github.com/assemblaj/ggpo/transport"
+)
+
+/*
+Makes a Backend safe to use from several goroutines, e.g. sampling input on one
+and simulating on another, by holding a lock for every call. Session callbacks
+run while the simulating goroutine holds the lock; calls they make back into the
+LockedBackend, like SyncInput while rolling back, come from the goroutine that
+holds it and go straight through.
+*/
+type LockedBackend struct {
+	mu      sync.Mutex
+	backend Backend
+	// the goroutine holding mu, 0 when nobody does
+	owner uint64
+}
+
+func NewLockedBackend(backend Backend) *LockedBackend {
+	return &LockedBackend{backend: backend}
+}
+
+/*
+Takes the lock, unless the calling goroutine already holds it because this is a
+session callback calling back in, and returns what releases it.
+*/
+func (l *LockedBackend) lock() func() {
+	id := goroutineID()
+	if atomic.LoadUint64(&l.owner) == id {
+		return func() {}
+	}
+	l.mu.Lock()
+	atomic.StoreUint64(&l.owner, id)
+	return func() {
+		atomic.StoreUint64(&l.owner, 0)
+		l.mu.Unlock()
+	}
+}
+
+// The calling goroutine's id, from the "goroutine N [running]:" line its stack starts with.
+func goroutineID() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	fields := bytes.Fields(buf[:n])
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
+
+// Runs f with the lock held, for calls Backend doesn't cover such as Peer's setters.
+func (l *LockedBackend) Do(f func(backend Backend) error) error {
+	defer l.lock()()
+	return f(l.backend)
+}
+
+func (l *LockedBackend) Idle(timeout int, timeFunc ...polling.FuncTimeType) error {
+	defer l.lock()()
+	return l.backend.Idle(timeout, timeFunc...)
+}
+
+func (l *LockedBackend) AddPlayer(player *Player, handle *PlayerHandle) error {
+	defer l.lock()()
+	return l.backend.AddPlayer(player, handle)
+}
+
+func (l *LockedBackend) AddLocalInput(player PlayerHandle, values []byte, size int) error {
+	defer l.lock()()
+	return l.backend.AddLocalInput(player, values, size)
+}
+
+func (l *LockedBackend) SyncInput(disconnectFlags *int) ([][]byte, error) {
+	defer l.lock()()
+	return l.backend.SyncInput(disconnectFlags)
+}
+
+func (l *LockedBackend) AdvanceFrame(checksum uint32) error {
+	defer l.lock()()
+	return l.backend.AdvanceFrame(checksum)
+}
+
+func (l *LockedBackend) DisconnectPlayer(handle PlayerHandle) error {
+	defer l.lock()()
+	return l.backend.DisconnectPlayer(handle)
+}
+
+func (l *LockedBackend) GetNetworkStats(handle PlayerHandle) (protocol.NetworkStats, error) {
+	defer l.lock()()
+	return l.backend.GetNetworkStats(handle)
+}
+
+func (l *LockedBackend) GetSessionStats() (SessionStats, error) {
+	defer l.lock()()
+	return l.backend.GetSessionStats()
+}
+
+func (l *LockedBackend) GetPlayerStatus(handle PlayerHandle) (PlayerStatus, error) {
+	defer l.lock()()
+	return l.backend.GetPlayerStatus(handle)
+}
+
+func (l *LockedBackend) SetFrameDelay(player PlayerHandle, delay int) error {
+	defer l.lock()()
+	return l.backend.SetFrameDelay(player, delay)
+}
+
+func (l *LockedBackend) SetDisconnectTimeout(timeout int) error {
+	defer l.lock()()
+	return l.backend.SetDisconnectTimeout(timeout)
+}
+
+func (l *LockedBackend) SetDisconnectNotifyStart(timeout int) error {
+	defer l.lock()()
+	return l.backend.SetDisconnectNotifyStart(timeout)
+}
+
+func (l *LockedBackend) Close() error {
+	defer l.lock()()
+	return l.backend.Close()
+}
+
+func (l *LockedBackend) Start() {
+	defer l.lock()()
+	l.backend.Start()
+}
+
+func (l *LockedBackend) InitializeConnection(c ...transport.Connection) error {
+	defer l.lock()()
+	return l.backend.InitializeConnection(c...)
+}
@@ -0,0 +1,150 @@
+package ggpo_test
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/assemblaj/ggpo"
+	"github.com/assemblaj/ggpo/internal/mocks"
+)
+
+// Input is sampled on one goroutine while another simulates, as in an engine
+// whose input thread is separate from its game loop. Run with -race.
+func TestLockedBackendConcurrentInput(t *testing.T) {
+	session := mocks.NewFakeSessionWithBackend()
+	stb := ggpo.NewSyncTest(&session, 1, 8, 4, false)
+	backend := ggpo.NewLockedBackend(&stb)
+	// rollbacks call back into the session with the lock held, and the
+	// session calls the LockedBackend from there
+	session.SetBackend(backend)
+
+	player := ggpo.NewLocalPlayer(20, 1)
+	var handle ggpo.PlayerHandle
+	backend.AddPlayer(&player, &handle)
+	backend.Idle(0)
+
+	frames := 100
+	synced := make([]uint32, 0, frames)
+	var simulated int32
+	started := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := uint32(1); atomic.LoadInt32(&simulated) == 0; i++ {
+			values := make([]byte, 4)
+			binary.BigEndian.PutUint32(values, i)
+			err := backend.AddLocalInput(handle, values, 4)
+			if err != nil {
+				t.Errorf("Error when adding local input, %s", err)
+				return
+			}
+			if i == 1 {
+				close(started)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer atomic.StoreInt32(&simulated, 1)
+		<-started
+		var disconnectFlags int
+		for i := 0; i < frames; i++ {
+			backend.Idle(0)
+			vals, err := backend.SyncInput(&disconnectFlags)
+			if err != nil {
+				t.Errorf("Error when synchronizing input, %s", err)
+				return
+			}
+			synced = append(synced, binary.BigEndian.Uint32(vals[0]))
+			session.Game.UpdateByInputs(vals)
+			backend.AdvanceFrame(ggpo.DefaultChecksum)
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The goroutines deadlocked on the LockedBackend.")
+	}
+
+	// a frame syncs the last input added since the frame before, or none, so
+	// every input added shows up at most once and in order
+	last := uint32(0)
+	for frame, value := range synced {
+		if value != 0 && value <= last {
+			t.Fatalf("expected frame %d to sync an input added after %d or none, got %d", frame, last, value)
+		}
+		if value != 0 {
+			last = value
+		}
+	}
+	if len(synced) != frames || last == 0 {
+		t.Errorf("expected %d frames synced with the inputs added, got %v", frames, synced)
+	}
+	stats, err := backend.GetSessionStats()
+	if err != nil {
+		t.Errorf("Error when getting session stats, %s", err)
+	}
+	if stats.Rollbacks == 0 {
+		t.Errorf("Expected the sync test to have rolled back while input was being added.")
+	}
+}
+
+func TestLockedBackendConcurrentPeer(t *testing.T) {
+	session := mocks.NewFakeSession()
+	connection := mocks.NewFakeConnection()
+	p2p := ggpo.NewPeer(&session, 6000, 2, 4)
+	p2p.InitializeConnection(&connection)
+	backend := ggpo.NewLockedBackend(&p2p)
+
+	player1 := ggpo.NewLocalPlayer(20, 1)
+	player2 := ggpo.NewRemotePlayer(20, 2, "127.2.1.1", 6001)
+	var p1Handle, p2Handle ggpo.PlayerHandle
+	backend.AddPlayer(&player1, &p1Handle)
+	backend.AddPlayer(&player2, &p2Handle)
+
+	iterations := 100
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			backend.Idle(0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			backend.AddLocalInput(p1Handle, []byte{1, 2, 3, 4}, 4)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			backend.GetNetworkStats(p2Handle)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		err := backend.DisconnectPlayer(p2Handle)
+		if err != nil {
+			t.Errorf("Disconnecting player caused error %s", err)
+		}
+	}()
+	wg.Wait()
+
+	err := backend.Do(func(b ggpo.Backend) error {
+		return b.DisconnectPlayer(p2Handle)
+	})
+	if err == nil {
+		t.Errorf("Expected the player to already be disconnected.")
+	}
+}
@@ -0,0 +1,867 @@
+package ggpo
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/assemblaj/ggpo/internal/input"
+	"github.com/assemblaj/ggpo/internal/messages"
+	"github.com/assemblaj/ggpo/internal/polling"
+	"github.com/assemblaj/ggpo/internal/protocol"
+	"github.com/assemblaj/ggpo/internal/util"
+	"github.com/assemblaj/ggpo/transport"
+)
+
+const (
+	// A flag for whether the sender played the frame yet and its checksum,
+	// following every frame of packed input, see checksumTrailer
+	lockstepChecksumSize = 1 + messages.Int32size
+	// The input delay a Lockstep session starts with, before any ping is known
+	DefaultLockstepInputDelay = 3
+	MaxLockstepInputDelay     = 10
+	// How often, in frames, a Lockstep session revisits its input delay
+	LockstepDelayInterval = 60
+)
+
+/*
+A backend for games that can't save and load their state. It talks to the same
+endpoints as Peer but never predicts: SyncInput isn't ready until every
+player's input for the frame has arrived, and the session waits for it instead
+of rolling back. Local input is delayed by about the one-way latency to the
+slowest peer so that, on a steady connection, it rarely has to wait at all.
+
+Without rollback a disconnect can't be undone either, so every peer has to
+drop a player after the same frame, and it can't be one some peer already
+played with their input. Once every peer still connected has stopped taking
+input from a player, they're dropped after the last frame any of them got.
+Peers that got less are sent the rest by one that has it, and wait for it
+like any other input.
+
+As with Peer, every frame of input carries the sender's checksum of the frame
+ChecksumDistance before, and once we've played a frame the checksums for the
+one that far back are put to a vote. A peer whose checksum differs from ours
+raises EventCodeDesync for each of its players.
+*/
+type Lockstep struct {
+	session    Session
+	poll       polling.Poller
+	connection transport.Connection
+	localPort  int
+	numPlayers int
+	inputSize  int
+
+	// Which queues are played on this machine, and for remote ones the queue
+	// whose endpoint carries their input, as in Peer
+	endpoints     []protocol.UdpProtocol
+	endpointQueue []int
+	localPlayers  []bool
+
+	queues        []input.InputQueue
+	connectStatus []messages.UdpConnectStatus
+	synchronizing bool
+	frameCount    int
+	// The last frame each local player added input on, to ignore repeats
+	lastInputFrame []int
+	// The next frame of packed local input to send, see sendLocalInputs
+	nextLocalFrame int
+
+	// Checksums of the frames we played and the ones peers sent, by frame
+	// and for the latter by endpoint, until they're compared, see checkDesync
+	checksums       map[int]uint32
+	remoteChecksums map[int]map[int]uint32
+
+	// Local queues whose delay was set with SetFrameDelay, which adaptive delay leaves alone
+	adaptiveInputDelay bool
+	fixedFrameDelay    []bool
+	nextDelayCheck     int
+
+	// The last frame of each dropped player's input, NullFrame until the
+	// peers agree on it, see settleDrops
+	dropFrame       []int
+	lastDropRequest int64
+
+	disconnectTimeout     int
+	disconnectNotifyStart int
+
+	messageChannel chan transport.MessageChannelItem
+}
+
+func NewLockstep(cb Session, localPort int, numPlayers int, inputSize int) Lockstep {
+	l := Lockstep{}
+	l.session = cb
+	l.localPort = localPort
+	l.numPlayers = numPlayers
+	l.inputSize = inputSize
+	l.synchronizing = true
+	l.adaptiveInputDelay = true
+	l.disconnectTimeout = DefaultDisconnectTimeout
+	l.disconnectNotifyStart = DefaultDisconnectNotifyStart
+	var poll polling.Poll = polling.NewPoll()
+	l.poll = &poll
+
+	l.endpoints = make([]protocol.UdpProtocol, numPlayers)
+	l.endpointQueue = make([]int, numPlayers)
+	l.localPlayers = make([]bool, numPlayers)
+	l.queues = make([]input.InputQueue, numPlayers)
+	l.connectStatus = make([]messages.UdpConnectStatus, numPlayers)
+	l.lastInputFrame = make([]int, numPlayers)
+	l.fixedFrameDelay = make([]bool, numPlayers)
+	l.dropFrame = make([]int, numPlayers)
+	l.checksums = make(map[int]uint32)
+	l.remoteChecksums = make(map[int]map[int]uint32)
+	for i := 0; i < numPlayers; i++ {
+		l.endpointQueue[i] = i
+		l.queues[i] = input.NewInputQueue(i, inputSize)
+		l.connectStatus[i].LastFrame = -1
+		l.lastInputFrame[i] = input.NullFrame
+		l.dropFrame[i] = input.NullFrame
+	}
+	l.messageChannel = make(chan transport.MessageChannelItem, 256)
+	return l
+}
+
+func (l *Lockstep) Idle(timeout int, timeFunc ...polling.FuncTimeType) error {
+	l.HandleMessages()
+	if len(timeFunc) == 0 {
+		l.poll.Pump()
+	} else {
+		l.poll.Pump(timeFunc[0])
+	}
+	l.PollUdpProtocolEvents()
+	if l.synchronizing {
+		return nil
+	}
+
+	for i := 0; i < l.numPlayers; i++ {
+		if l.endpoints[i].IsInitialized() {
+			l.endpoints[i].SetLocalFrameNumber(l.frameCount)
+		}
+	}
+	l.pollRemoteDisconnects()
+	l.settleDrops()
+	if l.adaptiveInputDelay && l.frameCount >= l.nextDelayCheck {
+		l.adaptInputDelay()
+		l.nextDelayCheck = l.frameCount + LockstepDelayInterval
+	}
+	if timeout > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// Stops taking input from the players a peer tells us it has stopped taking input from.
+func (l *Lockstep) pollRemoteDisconnects() {
+	for q := 0; q < l.numPlayers; q++ {
+		if l.localPlayers[q] || l.connectStatus[q].Disconnected {
+			continue
+		}
+		for i := 0; i < l.numPlayers; i++ {
+			if !l.endpoints[i].IsInitialized() || !l.endpoints[i].IsRunning() {
+				continue
+			}
+			var last int32
+			if !l.endpoints[i].GetPeerConnectStatus(q, &last) {
+				l.disconnectQueue(q)
+				break
+			}
+		}
+	}
+}
+
+/*
+Settles the last frame of each dropped player's input once every peer still
+connected has stopped taking it, as the last one any of them got. Until we
+have the input up to it, it's asked for from a peer that does every
+RunningRetryInterval.
+*/
+func (l *Lockstep) settleDrops() {
+	now := time.Now().UnixMilli()
+	retry := now >= l.lastDropRequest+protocol.RunningRetryInterval
+	for q := 0; q < l.numPlayers; q++ {
+		if l.localPlayers[q] || !l.connectStatus[q].Disconnected {
+			continue
+		}
+		if l.dropFrame[q] == input.NullFrame {
+			l.dropFrame[q] = l.agreedDropFrame(q)
+		}
+		last := int(l.connectStatus[q].LastFrame)
+		if !retry || l.dropFrame[q] == input.NullFrame || last >= l.dropFrame[q] {
+			continue
+		}
+		for i := 0; i < l.numPlayers; i++ {
+			var reported int32
+			if l.endpoints[i].IsInitialized() && l.endpoints[i].IsRunning() &&
+				!l.endpoints[i].GetPeerConnectStatus(q, &reported) && int(reported) >= l.dropFrame[q] {
+				l.endpoints[i].SendRetransmitRequest(q, last+1, l.dropFrame[q]-last)
+				l.lastDropRequest = now
+				break
+			}
+		}
+	}
+}
+
+// The last frame any peer got from queue, or NullFrame while a peer still takes their input.
+func (l *Lockstep) agreedDropFrame(queue int) int {
+	frame := int(l.connectStatus[queue].LastFrame)
+	for i := 0; i < l.numPlayers; i++ {
+		if !l.endpoints[i].IsInitialized() || !l.endpoints[i].IsRunning() {
+			continue
+		}
+		var last int32
+		if l.endpoints[i].GetPeerConnectStatus(queue, &last) {
+			return input.NullFrame
+		}
+		frame = util.Max(frame, int(last))
+	}
+	return frame
+}
+
+// Delays local input by the one-way latency to the slowest peer, plus a frame to spare.
+func lockstepInputDelay(roundTrip int64) int {
+	frames := int(math.Ceil(float64(roundTrip)/2*60/1000)) + 1
+	return util.Min(frames, MaxLockstepInputDelay)
+}
+
+/*
+Moves every local player's delay to what the slowest connection needs. Every
+input carries its frame, so unlike Peer nobody else has to switch with us: the
+queue pads or drops frames and the peers simply wait for what's missing.
+*/
+func (l *Lockstep) adaptInputDelay() {
+	var roundTrip int64
+	measured := false
+	for i := 0; i < l.numPlayers; i++ {
+		if l.endpoints[i].IsInitialized() && l.endpoints[i].IsRunning() {
+			ping := l.endpoints[i].GetNetworkStats().Network.Ping
+			if ping > 0 {
+				measured = true
+				roundTrip = util.Max(roundTrip, ping)
+			}
+		}
+	}
+	if !measured {
+		return
+	}
+	delay := lockstepInputDelay(roundTrip)
+	for i := 0; i < l.numPlayers; i++ {
+		if !l.localPlayers[i] || l.fixedFrameDelay[i] || l.queues[i].FrameDelay() == delay {
+			continue
+		}
+		util.Log.Printf("Changing queue %d input delay from %d to %d for a %dms round trip.\n",
+			i, l.queues[i].FrameDelay(), delay, roundTrip)
+		l.queues[i].SetFrameDelay(delay)
+
+		var info Event
+		info.Code = EventCodeInputDelayAgreed
+		info.Player = PlayerHandle(i + 1)
+		info.InputDelay = delay
+		info.Frame = l.frameCount
+		l.session.OnEvent(&info)
+	}
+}
+
+/*
+Turns adapting the local players' input delay to the ping on or off. It's on
+by default, and SetFrameDelay turns it off for that player alone.
+*/
+func (l *Lockstep) SetAdaptiveInputDelay(enabled bool) error {
+	l.adaptiveInputDelay = enabled
+	return nil
+}
+
+/*
+Remote players at the same address share an endpoint, as in Peer. Spectators
+aren't supported.
+*/
+func (l *Lockstep) AddPlayer(player *Player, handle *PlayerHandle) error {
+	if player.PlayerType == PlayerTypeSpectator {
+		return Error{Code: ErrorCodeUnsupported, Name: "ErrorCodeUnsupported"}
+	}
+	if !l.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	queue := player.PlayerNum - 1
+	if player.PlayerNum < 1 || player.PlayerNum > l.numPlayers || l.numPlayers > MaxPlayers {
+		return Error{Code: ErrorCodePlayerOutOfRange, Name: "ErrorCodePlayerOutOfRange"}
+	}
+	*handle = PlayerHandle(queue + 1)
+
+	if player.PlayerType == PlayerTypeRemote {
+		return l.addRemotePlayer(player.Remote.IpAdress, player.Remote.Port, queue)
+	}
+	l.localPlayers[queue] = true
+	if !l.fixedFrameDelay[queue] {
+		l.queues[queue].SetFrameDelay(DefaultLockstepInputDelay)
+	}
+	return nil
+}
+
+func (l *Lockstep) addRemotePlayer(ip string, port int, queue int) error {
+	for i := 0; i < l.numPlayers; i++ {
+		if i != queue && l.endpoints[i].HandlesMsg(ip, port) {
+			l.endpointQueue[queue] = i
+			return nil
+		}
+	}
+	l.endpoints[queue] = protocol.NewUdpProtocol(l.connection, queue, ip, port, &l.connectStatus)
+	err := l.poll.RegisterLoop(&l.endpoints[queue], nil)
+	if err != nil {
+		return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
+	}
+	l.endpoints[queue].SetDisconnectTimeout(l.disconnectTimeout)
+	l.endpoints[queue].SetDisconnectNotifyStart(l.disconnectNotifyStart)
+	l.endpoints[queue].Synchronize()
+	return nil
+}
+
+/*
+Adds a local player's input for the current frame. The frame only advances
+once everyone's input is in, so a game that adds input every tick would add it
+again while waiting; those repeats are ignored.
+*/
+func (l *Lockstep) AddLocalInput(player PlayerHandle, values []byte, size int) error {
+	if l.synchronizing {
+		return Error{Code: ErrorCodeNotSynchronized, Name: "ErrorCodeNotSynchronized"}
+	}
+	queue, err := l.playerQueue(player)
+	if err != nil {
+		return err
+	}
+	if !l.localPlayers[queue] {
+		return Error{Code: ErrorCodeInvalidPlayerHandle, Name: "ErrorCodeInvalidPlayerHandle"}
+	}
+	if l.connectStatus[queue].Disconnected {
+		return Error{Code: ErrorCodePlayerDisconnected, Name: "ErrorCodePlayerDisconnected"}
+	}
+	if l.lastInputFrame[queue] == l.frameCount {
+		return nil
+	}
+
+	localInput, err := input.NewGameInput(l.frameCount, values, size)
+	if err != nil {
+		return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput", err)
+	}
+	err = l.queues[queue].AddInput(&localInput)
+	if err != nil {
+		return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput", err)
+	}
+	l.lastInputFrame[queue] = l.frameCount
+	return l.sendLocalInputs()
+}
+
+// Sends every frame all local players have input for, packed in queue order.
+func (l *Lockstep) sendLocalInputs() error {
+	for {
+		packed := input.GameInput{Frame: l.nextLocalFrame}
+		for i := 0; i < l.numPlayers; i++ {
+			if !l.localPlayers[i] {
+				continue
+			}
+			var in input.GameInput
+			ok, err := l.queues[i].GetConfirmedInput(l.nextLocalFrame, &in)
+			if err != nil {
+				return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
+			}
+			if !ok {
+				return nil
+			}
+			packed.Bits = append(packed.Bits, in.Bits...)
+		}
+		packed.Bits = append(packed.Bits, l.checksumTrailer(packed.Frame-ChecksumDistance)...)
+		packed.Size = len(packed.Bits)
+		for i := 0; i < l.numPlayers; i++ {
+			if l.localPlayers[i] {
+				l.connectStatus[i].LastFrame = int32(packed.Frame)
+			}
+		}
+		for i := 0; i < l.numPlayers; i++ {
+			if l.endpoints[i].IsInitialized() {
+				l.endpoints[i].SendInput(&packed)
+			}
+		}
+		l.nextLocalFrame++
+	}
+}
+
+// A flag for whether we've played frame yet, then our checksum of it.
+func (l *Lockstep) checksumTrailer(frame int) []byte {
+	trailer := make([]byte, lockstepChecksumSize)
+	if checksum, ok := l.checksums[frame]; ok {
+		trailer[0] = 1
+		binary.BigEndian.PutUint32(trailer[1:], checksum)
+	}
+	return trailer
+}
+
+/*
+Returns every player's input for the current frame, or
+ErrorCodeInputNotReady until all of it has arrived. Players who left
+before the frame get zeroed input and their disconnect flag.
+*/
+func (l *Lockstep) SyncInput(disconnectFlags *int) ([][]byte, error) {
+	if l.synchronizing {
+		return nil, Error{Code: ErrorCodeNotSynchronized, Name: "ErrorCodeNotSynchronized"}
+	}
+	flags := 0
+	values := make([][]byte, l.numPlayers)
+	for i := 0; i < l.numPlayers; i++ {
+		if l.dropFrame[i] != input.NullFrame && l.frameCount > l.dropFrame[i] {
+			flags |= 1 << i
+			values[i] = make([]byte, l.inputSize)
+			continue
+		}
+		var in input.GameInput
+		ok, err := l.queues[i].GetConfirmedInput(l.frameCount, &in)
+		if err != nil {
+			return nil, newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
+		}
+		if !ok {
+			return nil, Error{Code: ErrorCodeInputNotReady, Name: "ErrorCodeInputNotReady"}
+		}
+		values[i] = in.Bits
+	}
+	if disconnectFlags != nil {
+		*disconnectFlags = flags
+	}
+	return values, nil
+}
+
+func (l *Lockstep) AdvanceFrame(checksum uint32) error {
+	util.Log.Printf("End of frame (%d)...\n", l.frameCount)
+	// the frame just played stays queued, so no queue is ever emptied
+	for i := 0; l.frameCount > 0 && i < l.numPlayers; i++ {
+		if l.connectStatus[i].Disconnected {
+			continue
+		}
+		err := l.queues[i].DiscardConfirmedFrames(l.frameCount - 1)
+		if err != nil {
+			return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
+		}
+	}
+	l.checksums[l.frameCount] = checksum
+	// Everyone's input for this frame is in, and with it their checksums
+	// for the frame ChecksumDistance back.
+	l.checkDesync(l.frameCount - ChecksumDistance)
+	l.frameCount++
+	return l.Idle(0)
+}
+
+/*
+Compares our checksum of frame with every peer's, raising EventCodeDesync for
+each player on a peer that differs, with the players outvoted by a majority as
+MinorityPlayers. A peer that never got to send one, having left, has no say.
+Forgets the checksums up to frame.
+*/
+func (l *Lockstep) checkDesync(frame int) {
+	localChecksum, ok := l.checksums[frame]
+	votes := l.remoteChecksums[frame]
+	for f := range l.checksums {
+		if f <= frame {
+			delete(l.checksums, f)
+		}
+	}
+	for f := range l.remoteChecksums {
+		if f <= frame {
+			delete(l.remoteChecksums, f)
+		}
+	}
+	if !ok || len(votes) == 0 {
+		return
+	}
+
+	tally := map[uint32]int{localChecksum: 1}
+	for _, checksum := range votes {
+		tally[checksum]++
+	}
+	var majority uint32
+	hasMajority := false
+	for checksum, count := range tally {
+		if count*2 > len(votes)+1 {
+			majority = checksum
+			hasMajority = true
+		}
+	}
+	var minority []PlayerHandle
+	if hasMajority {
+		for i := 0; i < l.numPlayers; i++ {
+			checksum, voted := votes[l.endpointQueue[i]]
+			if (l.localPlayers[i] && localChecksum != majority) || (!l.localPlayers[i] && voted && checksum != majority) {
+				minority = append(minority, PlayerHandle(i+1))
+			}
+		}
+	}
+
+	for i := 0; i < l.numPlayers; i++ {
+		remoteChecksum, voted := votes[i]
+		if !voted || remoteChecksum == localChecksum {
+			continue
+		}
+		for _, queue := range l.endpointPlayers(i) {
+			var info Event
+			info.Code = EventCodeDesync
+			info.Player = PlayerHandle(queue + 1)
+			info.NumFrameOfDesync = frame
+			info.LocalChecksum = int(localChecksum)
+			info.RemoteChecksum = int(remoteChecksum)
+			info.MinorityPlayers = minority
+			l.session.OnEvent(&info)
+		}
+		util.Log.Printf("DESYNC Checksum frame %d, local: %d, player %d: %d, minority %v\n",
+			frame, localChecksum, i+1, remoteChecksum, minority)
+	}
+}
+
+func (l *Lockstep) PollUdpProtocolEvents() {
+	for i := 0; i < l.numPlayers; i++ {
+		if !l.endpoints[i].IsInitialized() {
+			continue
+		}
+		for {
+			evt, err := l.endpoints[i].GetEvent()
+			if err != nil {
+				break
+			}
+			err = l.OnUdpProtocolEvent(evt, i)
+			if err != nil {
+				util.Log.Printf("Disconnecting queue %d after a bad event: %s\n", i, err)
+				l.DisconnectPlayer(PlayerHandle(i + 1))
+			}
+		}
+	}
+}
+
+func (l *Lockstep) OnUdpProtocolEvent(evt *protocol.UdpProtocolEvent, queue int) error {
+	var info Event
+	info.Player = PlayerHandle(queue + 1)
+	switch evt.Type() {
+	case protocol.ConnectedEvent:
+		info.Code = EventCodeConnectedToPeer
+		l.session.OnEvent(&info)
+
+	case protocol.SynchronizingEvent:
+		info.Code = EventCodeSynchronizingWithPeer
+		info.Count = evt.Count
+		info.Total = evt.Total
+		l.session.OnEvent(&info)
+
+	case protocol.SynchronziedEvent:
+		info.Code = EventCodeSynchronizedWithPeer
+		l.session.OnEvent(&info)
+		l.CheckInitialSync()
+
+	case protocol.ProtocolMismatchEvent:
+		info.Code = EventCodeMismatchedPeer
+		l.session.OnEvent(&info)
+
+	case protocol.NetworkInterruptedEvent:
+		info.Code = EventCodeConnectionInterrupted
+		info.DisconnectTimeout = evt.DisconnectTimeout
+		l.session.OnEvent(&info)
+
+	case protocol.NetworkResumedEvent:
+		info.Code = EventCodeConnectionResumed
+		l.session.OnEvent(&info)
+
+	case protocol.DisconnectedEvent:
+		return l.DisconnectPlayer(info.Player)
+
+	case protocol.InputEvent:
+		return l.onRemoteInput(&evt.Input, queue)
+
+	case protocol.RetransmitRequestEvent:
+		l.sendDroppedInput(queue, evt.Player, evt.Frame, evt.Count)
+
+	case protocol.RetransmitEvent:
+		return l.onDroppedInput(evt)
+	}
+	return nil
+}
+
+/*
+Answers a peer missing input from a player who left, with as much of it as we
+have. Input stays readable until its queue wraps around, long after any peer
+could still be missing it.
+*/
+func (l *Lockstep) sendDroppedInput(endpoint int, queue int, start int, count int) {
+	if queue < 0 || queue >= l.numPlayers || l.localPlayers[queue] {
+		return
+	}
+	var inputs []input.GameInput
+	for frame := start; frame < start+count; frame++ {
+		var in input.GameInput
+		ok, err := l.queues[queue].GetConfirmedInput(frame, &in)
+		if err != nil || !ok {
+			break
+		}
+		inputs = append(inputs, in)
+	}
+	l.endpoints[endpoint].SendRetransmit(queue, start, inputs)
+}
+
+// Takes the input of a player who left that a peer sent us, up to the frame they're dropped after.
+func (l *Lockstep) onDroppedInput(evt *protocol.UdpProtocolEvent) error {
+	queue := evt.Player
+	if queue < 0 || queue >= l.numPlayers || l.localPlayers[queue] || !l.connectStatus[queue].Disconnected {
+		return nil
+	}
+	for _, in := range evt.Inputs {
+		if in.Frame != int(l.connectStatus[queue].LastFrame)+1 || in.Frame > l.dropFrame[queue] {
+			continue
+		}
+		if in.Size != l.inputSize {
+			return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput",
+				errors.New("ggpo Lockstep onDroppedInput : in.Size != l.inputSize"))
+		}
+		err := l.queues[queue].AddInput(&in)
+		if err != nil {
+			return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput", err)
+		}
+		l.connectStatus[queue].LastFrame = int32(in.Frame)
+	}
+	return nil
+}
+
+// Takes a frame of input from the peer at queue's endpoint, every player on it packed in queue order.
+func (l *Lockstep) onRemoteInput(in *input.GameInput, queue int) error {
+	queues := l.endpointPlayers(queue)
+	if len(in.Bits) != len(queues)*l.inputSize+lockstepChecksumSize {
+		return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput",
+			errors.New("ggpo Lockstep onRemoteInput : len(in.Bits) != len(queues)*l.inputSize+lockstepChecksumSize"))
+	}
+	if trailer := in.Bits[len(queues)*l.inputSize:]; trailer[0] == 1 && in.Frame >= l.frameCount {
+		frame := in.Frame - ChecksumDistance
+		if l.remoteChecksums[frame] == nil {
+			l.remoteChecksums[frame] = make(map[int]uint32)
+		}
+		l.remoteChecksums[frame][queue] = binary.BigEndian.Uint32(trailer[1:])
+	}
+	for n, q := range queues {
+		if l.connectStatus[q].Disconnected {
+			continue
+		}
+		if l.connectStatus[q].LastFrame != int32(in.Frame-1) {
+			return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput",
+				errors.New("ggpo Lockstep onRemoteInput : l.connectStatus[q].LastFrame != in.Frame-1"))
+		}
+		remoteInput := input.GameInput{
+			Frame: in.Frame,
+			Size:  l.inputSize,
+			Bits:  in.Bits[n*l.inputSize : (n+1)*l.inputSize],
+		}
+		err := l.queues[q].AddInput(&remoteInput)
+		if err != nil {
+			return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput", err)
+		}
+		l.connectStatus[q].LastFrame = int32(in.Frame)
+	}
+	return nil
+}
+
+/*
+Stops taking a remote player's input, see Lockstep for the frame they're
+dropped after. A local handle leaves the session, dropping every remote player
+from the current frame.
+*/
+func (l *Lockstep) DisconnectPlayer(handle PlayerHandle) error {
+	queue, err := l.playerQueue(handle)
+	if err != nil {
+		return err
+	}
+	if l.connectStatus[queue].Disconnected {
+		return Error{Code: ErrorCodePlayerDisconnected, Name: "ErrorCodePlayerDisconnected"}
+	}
+	if l.localPlayers[queue] {
+		for i := 0; i < l.numPlayers; i++ {
+			if !l.localPlayers[i] && !l.connectStatus[i].Disconnected {
+				l.disconnectQueue(i)
+			}
+			if !l.localPlayers[i] && l.dropFrame[i] == input.NullFrame {
+				l.dropFrame[i] = l.frameCount - 1
+			}
+		}
+		return nil
+	}
+	l.disconnectQueue(queue)
+	return nil
+}
+
+// Stops taking input from queue, along with every other player on its endpoint.
+func (l *Lockstep) disconnectQueue(queue int) {
+	util.Log.Printf("Disconnecting queue %d after receiving up to frame %d.\n", queue, l.connectStatus[queue].LastFrame)
+	l.endpoint(queue).Disconnect()
+	l.connectStatus[queue].Disconnected = true
+
+	var info Event
+	info.Code = EventCodeDisconnectedFromPeer
+	info.Player = PlayerHandle(queue + 1)
+	l.session.OnEvent(&info)
+
+	for _, other := range l.endpointPlayers(l.endpointQueue[queue]) {
+		if !l.connectStatus[other].Disconnected {
+			l.disconnectQueue(other)
+		}
+	}
+	l.CheckInitialSync()
+}
+
+func (l *Lockstep) GetNetworkStats(handle PlayerHandle) (protocol.NetworkStats, error) {
+	queue, err := l.playerQueue(handle)
+	if err != nil {
+		return protocol.NetworkStats{}, err
+	}
+	return l.endpoint(queue).GetNetworkStats(), nil
+}
+
+// There's no rollback to report on.
+func (l *Lockstep) GetSessionStats() (SessionStats, error) {
+	return SessionStats{}, Error{Code: ErrorCodeUnsupported, Name: "ErrorCodeUnsupported"}
+}
+
+func (l *Lockstep) GetPlayerStatus(handle PlayerHandle) (PlayerStatus, error) {
+	queue, err := l.playerQueue(handle)
+	if err != nil {
+		return PlayerStatus{}, err
+	}
+	var status PlayerStatus
+	if l.localPlayers[queue] {
+		status = PlayerStatus{
+			Local:                 true,
+			State:                 PlayerStateRunning,
+			FramesUntilDisconnect: -1,
+			InputDelay:            l.queues[queue].FrameDelay(),
+		}
+		if l.synchronizing {
+			status.State = PlayerStateSynchronizing
+		}
+	} else {
+		status = endpointStatus(l.endpoint(queue))
+	}
+	if l.connectStatus[queue].Disconnected {
+		status.State = PlayerStateDisconnected
+		status.FramesUntilDisconnect = -1
+	}
+	status.LastConfirmedFrame = int(l.connectStatus[queue].LastFrame)
+	return status, nil
+}
+
+/*
+Sets the frame delay of a local player, which adaptive delay then leaves
+alone. Peers wait for input by its frame, so the delay can change at any time.
+*/
+func (l *Lockstep) SetFrameDelay(player PlayerHandle, delay int) error {
+	queue, err := l.playerQueue(player)
+	if err != nil {
+		return err
+	}
+	if !l.localPlayers[queue] || delay < 0 {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	l.queues[queue].SetFrameDelay(delay)
+	l.fixedFrameDelay[queue] = true
+	return nil
+}
+
+func (l *Lockstep) SetDisconnectTimeout(timeout int) error {
+	l.disconnectTimeout = timeout
+	for i := 0; i < l.numPlayers; i++ {
+		if l.endpoints[i].IsInitialized() {
+			l.endpoints[i].SetDisconnectTimeout(timeout)
+		}
+	}
+	return nil
+}
+
+func (l *Lockstep) SetDisconnectNotifyStart(timeout int) error {
+	l.disconnectNotifyStart = timeout
+	for i := 0; i < l.numPlayers; i++ {
+		if l.endpoints[i].IsInitialized() {
+			l.endpoints[i].SetDisconnectNotifyStart(timeout)
+		}
+	}
+	return nil
+}
+
+func (l *Lockstep) playerQueue(handle PlayerHandle) (int, error) {
+	queue := int(handle) - 1
+	if queue < 0 || queue >= l.numPlayers {
+		return 0, Error{Code: ErrorCodeInvalidPlayerHandle, Name: "ErrorCodeInvalidPlayerHandle"}
+	}
+	return queue, nil
+}
+
+func (l *Lockstep) endpoint(queue int) *protocol.UdpProtocol {
+	return &l.endpoints[l.endpointQueue[queue]]
+}
+
+func (l *Lockstep) endpointPlayers(queue int) []int {
+	var queues []int
+	for i := 0; i < l.numPlayers; i++ {
+		if !l.localPlayers[i] && l.endpointQueue[i] == queue {
+			queues = append(queues, i)
+		}
+	}
+	return queues
+}
+
+// Starts running once every remote peer still connected is synchronized.
+func (l *Lockstep) CheckInitialSync() {
+	if !l.synchronizing {
+		return
+	}
+	for i := 0; i < l.numPlayers; i++ {
+		if l.endpoints[i].IsInitialized() && !l.connectStatus[i].Disconnected && !l.endpoints[i].IsSynchronized() {
+			return
+		}
+	}
+	var info Event
+	info.Code = EventCodeRunning
+	l.session.OnEvent(&info)
+	l.synchronizing = false
+}
+
+func (l *Lockstep) HandleMessage(ipAddress string, port int, msg messages.UDPMessage, length int) {
+	for i := 0; i < l.numPlayers; i++ {
+		if l.endpoints[i].HandlesMsg(ipAddress, port) {
+			l.endpoints[i].OnMsg(msg, length)
+			return
+		}
+	}
+}
+
+func (l *Lockstep) HandleMessages() {
+	for {
+		select {
+		case mi, ok := <-l.messageChannel:
+			if !ok {
+				return
+			}
+			l.HandleMessage(mi.Peer.Ip, mi.Peer.Port, mi.Message, mi.Length)
+		default:
+			return
+		}
+	}
+}
+
+func (l *Lockstep) Close() error {
+	for i := 0; i < l.numPlayers; i++ {
+		if l.endpoints[i].IsInitialized() {
+			l.endpoints[i].Close()
+		}
+	}
+	return nil
+}
+
+func (l *Lockstep) InitializeConnection(c ...transport.Connection) error {
+	if len(c) == 0 {
+		l.connection = transport.NewUdp(l, l.localPort)
+		return nil
+	}
+	l.connection = c[0]
+	return nil
+}
+
+func (l *Lockstep) Start() {
+	go l.connection.Read(l.messageChannel)
+}
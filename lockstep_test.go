@@ -0,0 +1,255 @@
+package ggpo_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/assemblaj/ggpo"
+	"github.com/assemblaj/ggpo/internal/protocol"
+)
+
+// Lockstep peers with player i+1 local to peer i.
+type lockstepTest struct {
+	*meshFixture
+	peers []*ggpo.Lockstep
+}
+
+func newLockstepTest(t *testing.T, numPlayers int) *lockstepTest {
+	l := &lockstepTest{}
+	var ports []int
+	var locals [][]int
+	for i := 0; i < numPlayers; i++ {
+		ports = append(ports, 7300+i)
+		locals = append(locals, []int{i + 1})
+	}
+	l.meshFixture = newMeshFixture(t, ports, locals, numPlayers, func(session *meshSession, port int) meshBackend {
+		peer := ggpo.NewLockstep(session, port, numPlayers, 4)
+		l.peers = append(l.peers, &peer)
+		return &peer
+	})
+	l.waitUntilRunning(t, nil)
+	return l
+}
+
+/*
+Has peer i add input and try to play a frame, unless it already reached until.
+Returns whether it played one, failing on anything but not having every input
+yet.
+*/
+func (l *lockstepTest) tick(t *testing.T, i int, until int) bool {
+	session := l.sessions[i]
+	l.peers[i].Idle(0)
+	if session.frame >= until {
+		return false
+	}
+	err := l.peers[i].AddLocalInput(ggpo.PlayerHandle(i+1), meshInput(session.frame, i+1), 4)
+	if err != nil {
+		t.Fatalf("Error when adding input for player %d on frame %d: %s", i+1, session.frame, err)
+	}
+	err = session.step()
+	if err != nil {
+		ggErr, ok := err.(ggpo.Error)
+		if !ok || ggErr.Code != ggpo.ErrorCodeInputNotReady {
+			t.Fatalf("Error when advancing peer %d on frame %d: %s", i+1, session.frame, err)
+		}
+		return false
+	}
+	return true
+}
+
+func TestLockstep(t *testing.T) {
+	l := newLockstepTest(t, 2)
+	// nothing from player 2 has arrived yet, so even a delayed frame 0 must wait
+	if l.tick(t, 0, 100) {
+		t.Errorf("expected peer 1 to wait for player 2's input")
+	}
+	err := l.peers[0].AddLocalInput(ggpo.PlayerHandle(2), []byte{1, 0, 0, 0}, 4)
+	if err == nil {
+		t.Errorf("Adding input for a remote player should be an error.")
+	}
+
+	for i := 0; i < 1000 && (l.sessions[0].frame < 100 || l.sessions[1].frame < 100); i++ {
+		l.tick(t, 0, 100)
+		l.tick(t, 1, 100)
+		// neither side can get further ahead than the other's input reaches
+		if diff := l.sessions[0].frame - l.sessions[1].frame; diff > ggpo.MaxLockstepInputDelay || diff < -ggpo.MaxLockstepInputDelay {
+			t.Fatalf("expected the peers to stay in step, got frames %d and %d", l.sessions[0].frame, l.sessions[1].frame)
+		}
+	}
+	if l.sessions[0].frame != 100 || l.sessions[1].frame != 100 {
+		t.Fatalf("expected both peers to reach frame 100, got %d and %d", l.sessions[0].frame, l.sessions[1].frame)
+	}
+	if l.sessions[0].checksum() != l.sessions[1].checksum() {
+		t.Errorf("expected both peers to have the same state, got %v and %v", l.sessions[0].totals, l.sessions[1].totals)
+	}
+	if len(l.sessions[0].saves) != 0 {
+		t.Errorf("expected lockstep to never save the game state, got %d saves", len(l.sessions[0].saves))
+	}
+}
+
+func TestLockstepFrameDelay(t *testing.T) {
+	l := newLockstepTest(t, 2)
+	status, err := l.peers[0].GetPlayerStatus(ggpo.PlayerHandle(1))
+	if err != nil {
+		t.Fatalf("Error when getting the status of player 1: %s", err)
+	}
+	if status.InputDelay != ggpo.DefaultLockstepInputDelay {
+		t.Errorf("expected player 1 to start with a delay of %d, got %d", ggpo.DefaultLockstepInputDelay, status.InputDelay)
+	}
+	if l.peers[0].SetFrameDelay(ggpo.PlayerHandle(2), 1) == nil {
+		t.Errorf("Setting the frame delay of a remote player should be an error.")
+	}
+
+	for i := 0; i < 1000 && (l.sessions[0].frame < 50 || l.sessions[1].frame < 50); i++ {
+		l.tick(t, 0, 50)
+		l.tick(t, 1, 50)
+	}
+	// mid-match changes need no agreement, either way
+	err = l.peers[0].SetFrameDelay(ggpo.PlayerHandle(1), 6)
+	if err != nil {
+		t.Fatalf("Error when raising the frame delay: %s", err)
+	}
+	err = l.peers[1].SetFrameDelay(ggpo.PlayerHandle(2), 0)
+	if err != nil {
+		t.Fatalf("Error when lowering the frame delay: %s", err)
+	}
+	for i := 0; i < 1000 && (l.sessions[0].frame < 100 || l.sessions[1].frame < 100); i++ {
+		l.tick(t, 0, 100)
+		l.tick(t, 1, 100)
+	}
+	if l.sessions[0].frame != 100 || l.sessions[1].frame != 100 {
+		t.Fatalf("expected both peers to reach frame 100, got %d and %d", l.sessions[0].frame, l.sessions[1].frame)
+	}
+	if l.sessions[0].checksum() != l.sessions[1].checksum() {
+		t.Errorf("expected both peers to have the same state, got %v and %v", l.sessions[0].totals, l.sessions[1].totals)
+	}
+}
+
+func TestLockstepDisconnect(t *testing.T) {
+	l := newLockstepTest(t, 2)
+	for i := 0; i < 1000 && (l.sessions[0].frame < 50 || l.sessions[1].frame < 50); i++ {
+		l.tick(t, 0, 50)
+		l.tick(t, 1, 50)
+	}
+
+	l.mesh.Cut(l.ports[1])
+	l.peers[0].SetDisconnectTimeout(500)
+	keepAlive := func() int64 {
+		return time.Now().Add(time.Millisecond * (protocol.KeepAliveInterval + 50)).UnixMilli()
+	}
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) && len(l.sessions[0].disconnected) == 0 {
+		l.peers[0].Idle(0, keepAlive)
+		l.tick(t, 0, 100)
+		time.Sleep(time.Millisecond * 20)
+	}
+	if len(l.sessions[0].disconnected) != 1 || l.sessions[0].disconnected[0] != ggpo.PlayerHandle(2) {
+		t.Fatalf("expected peer 1 to see player 2 disconnect, got %v", l.sessions[0].disconnected)
+	}
+
+	// player 2 stops counting after the last input that made it across
+	total := l.sessions[0].totals[1]
+	for i := 0; i < 1000 && l.sessions[0].frame < 100; i++ {
+		l.tick(t, 0, 100)
+	}
+	if l.sessions[0].frame != 100 {
+		t.Fatalf("expected peer 1 to play on alone to frame 100, got %d", l.sessions[0].frame)
+	}
+	if l.sessions[0].totals[1] != total {
+		t.Errorf("expected player 2's total to stay at %d, got %d", total, l.sessions[0].totals[1])
+	}
+	status, err := l.peers[0].GetPlayerStatus(ggpo.PlayerHandle(2))
+	if err != nil {
+		t.Fatalf("Error when getting the status of player 2: %s", err)
+	}
+	if status.State != ggpo.PlayerStateDisconnected {
+		t.Errorf("expected player 2 to be disconnected, got %v", status.State)
+	}
+}
+
+func TestLockstepDisconnectThreePlayers(t *testing.T) {
+	l := newLockstepTest(t, 3)
+	for i := 0; i < 1000 && (l.sessions[0].frame < 50 || l.sessions[1].frame < 50 || l.sessions[2].frame < 50); i++ {
+		for p := range l.peers {
+			l.tick(t, p, 50)
+		}
+	}
+
+	// player 3's input stops reaching peer 1 a few frames before it stops reaching peer 2
+	l.mesh.CutLink(l.ports[2], l.ports[0])
+	for i := 0; i < 20; i++ {
+		for p := range l.peers {
+			l.tick(t, p, 100)
+		}
+	}
+	l.mesh.Cut(l.ports[2])
+	first, _ := l.peers[0].GetPlayerStatus(ggpo.PlayerHandle(3))
+	second, _ := l.peers[1].GetPlayerStatus(ggpo.PlayerHandle(3))
+	if first.LastConfirmedFrame >= second.LastConfirmedFrame {
+		t.Fatalf("expected peer 2 to have more of player 3's input than peer 1, got frames %d and %d",
+			second.LastConfirmedFrame, first.LastConfirmedFrame)
+	}
+
+	l.peers[0].SetDisconnectTimeout(500)
+	l.peers[1].SetDisconnectTimeout(500)
+	keepAlive := func() int64 {
+		return time.Now().Add(time.Millisecond * (protocol.KeepAliveInterval + 50)).UnixMilli()
+	}
+	deadline := time.Now().Add(time.Second * 3)
+	for time.Now().Before(deadline) && (l.sessions[0].frame < 100 || l.sessions[1].frame < 100) {
+		for p := 0; p < 2; p++ {
+			l.peers[p].Idle(0, keepAlive)
+			l.tick(t, p, 100)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if l.sessions[0].frame != 100 || l.sessions[1].frame != 100 {
+		t.Fatalf("expected peers 1 and 2 to play on to frame 100, got %d and %d", l.sessions[0].frame, l.sessions[1].frame)
+	}
+	// both drop player 3 after the last frame peer 2 got, so they play the same frames
+	if l.sessions[0].checksum() != l.sessions[1].checksum() {
+		t.Errorf("expected peers 1 and 2 to have the same state, got %v and %v", l.sessions[0].totals, l.sessions[1].totals)
+	}
+	for p := 0; p < 2; p++ {
+		if len(l.sessions[p].disconnected) != 1 || l.sessions[p].disconnected[0] != ggpo.PlayerHandle(3) {
+			t.Errorf("expected peer %d to see player 3 disconnect, got %v", p+1, l.sessions[p].disconnected)
+		}
+		status, _ := l.peers[p].GetPlayerStatus(ggpo.PlayerHandle(3))
+		if status.LastConfirmedFrame != second.LastConfirmedFrame {
+			t.Errorf("expected peer %d to drop player 3 after frame %d, got %d", p+1, second.LastConfirmedFrame, status.LastConfirmedFrame)
+		}
+	}
+}
+
+func TestLockstepDesync(t *testing.T) {
+	l := newLockstepTest(t, 3)
+	for i := 0; i < 1000 && (l.sessions[0].frame < 50 || l.sessions[1].frame < 50 || l.sessions[2].frame < 50); i++ {
+		for p := range l.peers {
+			l.tick(t, p, 50)
+		}
+	}
+	for i, session := range l.sessions {
+		if session.desyncs != 0 {
+			t.Fatalf("expected no desyncs on peer %d before the states diverge, got %d", i+1, session.desyncs)
+		}
+	}
+	// peer 2 drifts off and is outvoted, which every peer hears of
+	l.sessions[1].totals[0]++
+	for i := 0; i < 1000 && (l.sessions[0].frame < 100 || l.sessions[1].frame < 100 || l.sessions[2].frame < 100); i++ {
+		for p := range l.peers {
+			l.tick(t, p, 100)
+		}
+	}
+	for i, session := range l.sessions {
+		if session.desyncs == 0 {
+			t.Fatalf("expected peer %d to see a desync", i+1)
+		}
+		minority := session.lastDesync.MinorityPlayers
+		if len(minority) != 1 || minority[0] != ggpo.PlayerHandle(2) {
+			t.Errorf("expected peer %d to see player 2 outvoted, got %v", i+1, minority)
+		}
+	}
+	if player := l.sessions[0].lastDesync.Player; player != ggpo.PlayerHandle(2) {
+		t.Errorf("expected peer 1 to blame player 2, got %d", player)
+	}
+}
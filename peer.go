@@ -2,7 +2,9 @@ package ggpo
 
 import (
 	"errors"
+	"io"
 	"math"
+	"sort"
 	"time"
 
 	"github.com/assemblaj/ggpo/internal/input"
@@ -18,6 +20,10 @@ const (
 	DefaultDisconnectTimeout     = 5000
 	DefaultDisconnectNotifyStart = 750
 	ChecksumDistance             = 16
+	SpectatorHistoryLength       = 1024
+	// How far ahead a frame delay change made while running is proposed, which
+	// leaves remote peers that long to ack it before it's due
+	FrameDelayChangeLead = 30
 )
 
 type Peer struct {
@@ -35,16 +41,59 @@ type Peer struct {
 	nextRecommendedSleep int
 
 	nextSpectatorFrame    int
+	spectatorDelay        int
+	spectatorBacklog      []input.GameInput
+	spectatorHistory      []input.GameInput
+	lastSpectatorFrame    int
 	disconnectTimeout     int
 	disconnectNotifyStart int
 
 	localConnectStatus []messages.UdpConnectStatus
 
+	// Which queues are played on this machine, and for remote ones the queue
+	// whose endpoint carries their input. Remote players at the same address
+	// share that endpoint, and their inputs come in packed together.
+	localPlayers  []bool
+	endpointQueue []int
+	// The next frame of packed local input to send, see sendLocalInputs
+	nextLocalFrame int
+
 	localPort              int
 	pendingChecksums       util.OrderedMap[int, uint32]
 	confirmedChecksums     util.OrderedMap[int, uint32]
 	confirmedChecksumFrame int
 
+	// Desync reports, only kept when a StateDiffer is set
+	desyncReportDir string
+	stateDiffer     StateDiffer
+	pendingStates   map[int][]byte
+	confirmedStates map[int][]byte
+	desyncStates    map[int][]byte
+
+	// Remote checksums by frame and queue, see CheckDesync
+	checksumVotes    map[int]map[int]uint32
+	checksumDistance int
+	checksumInterval int
+	desyncPolicy     DesyncPolicy
+	desyncAuthority  PlayerHandle
+	desyncHalted     bool
+	resyncedFrame    int
+	// As the authority, the frame before which each queue's checksums are stale
+	// because we sent it our state to resync from
+	resyncServed       []int
+	mismatchedPeerSent bool
+
+	// Local queues whose delay was set with SetFrameDelay, which auto delay leaves alone
+	autoInputDelay  bool
+	fixedFrameDelay []bool
+	// Every player's committed mid-match frame delay changes, and the local
+	// players' proposals still waiting on acks, see SetFrameDelay
+	delayChanges   []input.DelayChanges
+	delayProposals []input.DelayChanges
+
+	// Only set while recording, see SetReplayRecording
+	replay *replayRecorder
+
 	messageChannel chan transport.MessageChannelItem
 }
 
@@ -63,7 +112,7 @@ func NewPeer(cb Session,
 	//p.udp = NewUdp(&p, localPort)
 	p.localPort = localPort
 
-	p.localConnectStatus = make([]messages.UdpConnectStatus, messages.UDPMsgMaxPlayers)
+	p.localConnectStatus = make([]messages.UdpConnectStatus, numPlayers)
 	for i := 0; i < len(p.localConnectStatus); i++ {
 		p.localConnectStatus[i].LastFrame = -1
 	}
@@ -76,8 +125,25 @@ func NewPeer(cb Session,
 	p.sync = NewSync(p.localConnectStatus, &config)
 	p.endpoints = make([]protocol.UdpProtocol, numPlayers)
 	p.spectators = make([]protocol.UdpProtocol, MaxSpectators)
+	p.spectatorHistory = make([]input.GameInput, SpectatorHistoryLength)
+	p.lastSpectatorFrame = input.NullFrame
 	p.pendingChecksums = util.NewOrderedMap[int, uint32](16)
 	p.confirmedChecksums = util.NewOrderedMap[int, uint32](16)
+	p.pendingStates = make(map[int][]byte)
+	p.confirmedStates = make(map[int][]byte)
+	p.desyncStates = make(map[int][]byte)
+	p.checksumVotes = make(map[int]map[int]uint32)
+	p.checksumDistance = ChecksumDistance
+	p.checksumInterval = 1
+	p.fixedFrameDelay = make([]bool, numPlayers)
+	p.resyncServed = make([]int, numPlayers)
+	p.localPlayers = make([]bool, numPlayers)
+	p.endpointQueue = make([]int, numPlayers)
+	for i := 0; i < numPlayers; i++ {
+		p.endpointQueue[i] = i
+	}
+	p.delayChanges = make([]input.DelayChanges, numPlayers)
+	p.delayProposals = make([]input.DelayChanges, numPlayers)
 	p.messageChannel = make(chan transport.MessageChannelItem, 256)
 	//messages := make(chan UdpPacket)
 	//p.poll.RegisterLoop(&p.udp, nil )
@@ -101,6 +167,9 @@ func (p *Peer) Close() error {
 	return nil
 }
 func (p *Peer) Idle(timeout int, timeFunc ...polling.FuncTimeType) error {
+	if p.desyncHalted && !p.sync.InRollback() {
+		return Error{Code: ErrorCodeDesynchronized, Name: "ErrorCodeDesynchronized"}
+	}
 	if !p.sync.InRollback() {
 		p.HandleMessages()
 		if len(timeFunc) == 0 {
@@ -113,7 +182,11 @@ func (p *Peer) Idle(timeout int, timeFunc ...polling.FuncTimeType) error {
 		p.CheckDesync()
 
 		if !p.synchronizing {
-			p.sync.CheckSimulation(timeout)
+			p.settleDelayProposals()
+			err := p.sync.CheckSimulation(timeout)
+			if err != nil {
+				return err
+			}
 
 			// notify all of our endpoints of their local frame number for their
 			// next connection quality report
@@ -138,24 +211,31 @@ func (p *Peer) Idle(timeout int, timeFunc ...polling.FuncTimeType) error {
 				}
 				if p.numSpectators > 0 {
 					for p.nextSpectatorFrame <= totalMinConfirmed {
-						util.Log.Printf("pushing frame %d to spectators.\n", p.nextSpectatorFrame)
-
-						var input input.GameInput
-						var inputs [][]byte
-						input.Frame = p.nextSpectatorFrame
-						input.Size = p.inputSize * p.numPlayers
-						inputs, _ = p.sync.GetConfirmedInputs(p.nextSpectatorFrame)
-						for i, _ := range inputs {
-							input.Bits = append(input.Bits, inputs[i]...)
-						}
-						for i := 0; i < p.numSpectators; i++ {
-							p.spectators[i].SendInput(&input)
+						util.Log.Printf("queueing frame %d for spectators.\n", p.nextSpectatorFrame)
+						confirmed, err := p.confirmedFrame(p.nextSpectatorFrame)
+						if err != nil {
+							return err
 						}
+						p.spectatorBacklog = append(p.spectatorBacklog, confirmed)
 						p.nextSpectatorFrame++
 					}
+					p.SendSpectatorBacklog(currentFrame)
+				}
+				if p.replay != nil {
+					err := p.recordReplay(totalMinConfirmed, currentFrame)
+					if err != nil {
+						util.Log.Printf("Stopped recording the replay: %s\n", err)
+						p.replay = nil
+					}
 				}
 				util.Log.Printf("setting confirmed frame in sync to %d.\n", totalMinConfirmed)
-				p.sync.SetLastConfirmedFrame(totalMinConfirmed)
+				err := p.sync.SetLastConfirmedFrame(totalMinConfirmed)
+				if err != nil {
+					return err
+				}
+				for i := range p.delayChanges {
+					p.delayChanges[i].Prune(totalMinConfirmed)
+				}
 			}
 
 			// send timesync notifications if now is the proper time
@@ -175,6 +255,9 @@ func (p *Peer) Idle(timeout int, timeFunc ...polling.FuncTimeType) error {
 				p.session.OnEvent(&info)
 				p.nextRecommendedSleep = currentFrame + RecommendationInterval
 				//}
+				if p.autoInputDelay {
+					p.reviseAutoInputDelay()
+				}
 			}
 			// because GGPO had this
 			if timeout > 0 {
@@ -217,7 +300,11 @@ func (p *Peer) Poll2Players(currentFrame int) int {
 	return int(totalMinConfirmed)
 }
 
-// Just for parity with GGPO. Don't care to actually use this.
+/*
+Used instead of Poll2Players with more than two players. A player is only as
+confirmed as the least any endpoint has heard of them, and is disconnected as
+soon as any endpoint reports them gone, at the earliest frame reported.
+*/
 func (p *Peer) PollNPlayers(currentFrame int) int {
 	var i, queue int
 	var lastRecieved int32
@@ -265,24 +352,402 @@ func (p *Peer) PollNPlayers(currentFrame int) int {
 	return int(totalMinConfirmed)
 }
 
+/*
+Sends the confirmed frames waiting in the spectator backlog once they are at
+least spectatorDelay frames old. With no delay everything goes out right away.
+*/
+func (p *Peer) SendSpectatorBacklog(currentFrame int) {
+	sent := 0
+	for _, input := range p.spectatorBacklog {
+		if input.Frame > currentFrame-p.spectatorDelay {
+			break
+		}
+		util.Log.Printf("pushing frame %d to spectators.\n", input.Frame)
+		for i := 0; i < p.numSpectators; i++ {
+			p.spectators[i].SendInput(&input)
+		}
+		p.spectatorHistory[input.Frame%len(p.spectatorHistory)] = input
+		p.lastSpectatorFrame = input.Frame
+		sent++
+	}
+	p.spectatorBacklog = p.spectatorBacklog[sent:]
+}
+
+/*
+Resends confirmed frames a spectator lost before it could play them. Only
+frames that have already been released to spectators are sent, so this can't
+be used to get around the spectator delay. If startFrame has fallen out of
+the history the spectator is told it's gone and has to resync from a snapshot.
+*/
+func (p *Peer) SendSpectatorRetransmit(queue int, startFrame int, numFrames int) {
+	oldest := util.Max(0, p.lastSpectatorFrame-len(p.spectatorHistory)+1)
+	if startFrame < oldest || startFrame > p.lastSpectatorFrame {
+		util.Log.Printf("spectator %d asked for frame %d which is no longer available.\n", queue, startFrame)
+		p.spectators[queue].SendRetransmit(0, startFrame, nil)
+		return
+	}
+	numFrames = util.Min(numFrames, messages.MaxCompressedBits/p.spectatorFrameSize())
+	var inputs []input.GameInput
+	for frame := startFrame; frame < startFrame+numFrames && frame <= p.lastSpectatorFrame; frame++ {
+		inputs = append(inputs, p.spectatorHistory[frame%len(p.spectatorHistory)])
+	}
+	util.Log.Printf("resending frames %d to %d to spectator %d.\n", startFrame, startFrame+len(inputs)-1, queue)
+	p.spectators[queue].SendRetransmit(0, startFrame, inputs)
+}
+
+/*
+Every player's confirmed input for frame, followed by the disconnect flags.
+Spectators and replays need the flags to simulate the frame exactly like the
+players did.
+*/
+func (p *Peer) confirmedFrame(frame int) (input.GameInput, error) {
+	confirmed := input.GameInput{Frame: frame, Size: p.spectatorFrameSize()}
+	inputs, disconnectFlags, err := p.sync.GetConfirmedInputs(frame)
+	if err != nil {
+		return confirmed, err
+	}
+	for i := range inputs {
+		confirmed.Bits = append(confirmed.Bits, inputs[i]...)
+	}
+	confirmed.Bits = append(confirmed.Bits, byte(disconnectFlags))
+	return confirmed, nil
+}
+
+/*
+Writes every frame up to the last confirmed one to the replay, then the
+checksums of the frames among them we've simulated, which no rollback can
+change anymore.
+*/
+func (p *Peer) recordReplay(lastConfirmed int, currentFrame int) error {
+	for p.replay.nextFrame <= lastConfirmed {
+		confirmed, err := p.confirmedFrame(p.replay.nextFrame)
+		if err != nil {
+			return err
+		}
+		err = p.replay.writeFrame(&confirmed)
+		if err != nil {
+			return err
+		}
+	}
+	return p.replay.writeChecksums(util.Min(lastConfirmed, currentFrame-1))
+}
+
+/*
+Records every confirmed frame and a checksum every
+DefaultReplayChecksumInterval frames to w, see LoadReplay. game is stored in
+the header for the game to recognize its replays by. Must be set before the
+session starts running.
+*/
+func (p *Peer) SetReplayRecording(w io.Writer, game []byte) error {
+	if w == nil || !p.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	p.replay = newReplayRecorder(w, p.numPlayers, p.inputSize, game)
+	// sparse saving would otherwise leave most recorded frames without a checksum
+	p.sync.SetSavedFrameInterval(p.replay.info.ChecksumInterval)
+	return nil
+}
+
+// Every player's input plus one byte of disconnect flags.
+func (p *Peer) spectatorFrameSize() int {
+	return p.inputSize*p.numPlayers + 1
+}
+
+/*
+Sets how the given player's input is predicted while we wait for it to
+arrive. Pass nil to go back to repeating their last confirmed input.
+*/
+func (p *Peer) SetInputPredictor(player PlayerHandle, predictor InputPredictor) error {
+	var queue int
+
+	result := p.PlayerHandleToQueue(player, &queue)
+	if result != nil {
+		return result
+	}
+	p.sync.SetInputPredictor(queue, predictor)
+	return nil
+}
+
+/*
+Sets how many frames the session may run ahead of the last confirmed frame
+before AddLocalInput starts returning ErrorCodePredictionThreshod. Matches
+between distant regions may need 12-15 frames; the default is
+MaxPredictionFrames. It must be smaller than the checksum distance, so windows
+of ChecksumDistance and over need SetChecksumDistance first. Must be set before
+the session starts running.
+*/
+func (p *Peer) SetPredictionWindow(frames int) error {
+	if frames < 1 || frames > MaxPredictionWindow || frames >= p.checksumDistance || !p.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	err := p.sync.SetPredictionWindow(frames)
+	if err != nil {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	return nil
+}
+
+/*
+Saves game state only at the last confirmed frame rather than every frame. On a
+misprediction the session rolls back to that frame and resimulates further, so
+this suits games whose state is costly to save but cheap to simulate. Must be
+set before the session starts running.
+*/
+func (p *Peer) SetSparseSaving(enabled bool) error {
+	if !p.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	p.sync.SetSparseSaving(enabled)
+	return nil
+}
+
+/*
+Has peers swap their serialized game state for a frame whose checksums don't
+match, so a desync can be traced to the fields that diverged. The session must
+implement StateSerializer. Both states are written to dir, unless it's empty,
+and compared with differ, or ByteDiffer if nil; the result is raised as
+EventCodeDesyncReport. States over 32 KiB aren't sent, so no report is raised
+for them. Must be set before the session starts running.
+*/
+func (p *Peer) SetDesyncReports(dir string, differ StateDiffer) error {
+	if _, ok := p.session.(StateSerializer); !ok || !p.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	if differ == nil {
+		differ = ByteDiffer{}
+	}
+	p.desyncReportDir = dir
+	p.stateDiffer = differ
+	return nil
+}
+
+/*
+Chooses what happens when checksums don't match, see DesyncPolicy. With
+DesyncPolicyResync everyone takes over the state of the authority player, and
+the session has to implement both StateSerializer and StateDeserializer. The
+authority is checked while synchronizing: a peer with another one, or without
+DesyncPolicyResync, raises EventCodeMismatchedPeer and the session doesn't
+start running. Must be set on every peer before its first Idle.
+*/
+func (p *Peer) SetDesyncPolicy(policy DesyncPolicy, authority PlayerHandle) error {
+	if policy < DesyncPolicyNotify || policy > DesyncPolicyResync || !p.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	if policy == DesyncPolicyResync {
+		_, canSerialize := p.session.(StateSerializer)
+		_, canDeserialize := p.session.(StateDeserializer)
+		var queue int
+		if !canSerialize || !canDeserialize || p.PlayerHandleToQueue(authority, &queue) != nil {
+			return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+		}
+	}
+	p.desyncPolicy = policy
+	p.desyncAuthority = authority
+	p.updateRetainedFrames()
+	for i := range p.endpoints {
+		if p.endpoints[i].IsInitialized() {
+			p.endpoints[i].SetResyncAuthority(p.resyncAuthority())
+		}
+	}
+	return nil
+}
+
+// The authority handle peers agree on while synchronizing, 0 without DesyncPolicyResync.
+func (p *Peer) resyncAuthority() int {
+	if p.desyncPolicy != DesyncPolicyResync {
+		return 0
+	}
+	return int(p.desyncAuthority)
+}
+
+/*
+Whether every remote peer resyncs from the same authority we do. Otherwise they
+would keep taking over each other's states, so the mismatch is raised once and
+the session never starts running.
+*/
+func (p *Peer) resyncAuthorityAgreed() bool {
+	agreed := true
+	for i := 0; i < p.numPlayers; i++ {
+		if p.localPlayers[i] || !p.endpoints[i].IsInitialized() || p.localConnectStatus[i].Disconnected ||
+			p.endpoints[i].RemoteResyncAuthority() == p.resyncAuthority() {
+			continue
+		}
+		agreed = false
+		if !p.mismatchedPeerSent {
+			util.Log.Printf("Player %d resyncs from player %d, we resync from %d.\n",
+				p.QueueToPlayerHandle(i), p.endpoints[i].RemoteResyncAuthority(), p.resyncAuthority())
+			var info Event
+			info.Code = EventCodeMismatchedPeer
+			info.Player = p.QueueToPlayerHandle(i)
+			p.session.OnEvent(&info)
+		}
+	}
+	if !agreed {
+		p.mismatchedPeerSent = true
+	}
+	return agreed
+}
+
+/*
+Sets how many frames after a frame its checksum is sent, ChecksumDistance by
+default. It must be larger than the prediction window and the same on every
+peer. Must be set before the session starts running.
+*/
+func (p *Peer) SetChecksumDistance(frames int) error {
+	if frames <= p.sync.PredictionWindow() || frames > MaxChecksumDistance || !p.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	p.checksumDistance = frames
+	p.updateRetainedFrames()
+	return nil
+}
+
+/*
+Only checks every interval-th frame for desyncs instead of every frame. It must
+be the same on every peer. Must be set before the session starts running.
+*/
+func (p *Peer) SetChecksumInterval(interval int) error {
+	if interval < 1 || !p.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	p.checksumInterval = interval
+	return nil
+}
+
+// Resyncing replays from a frame about a checksum distance back, plus however
+// long the authority's state takes to arrive, so sync has to hold on to those
+// inputs.
+func (p *Peer) updateRetainedFrames() {
+	if p.desyncPolicy == DesyncPolicyResync {
+		p.sync.SetRetainedFrames(2 * p.checksumDistance)
+	} else {
+		p.sync.SetRetainedFrames(0)
+	}
+}
+
+func (p *Peer) capturesStates() bool {
+	return p.stateDiffer != nil || p.desyncPolicy == DesyncPolicyResync
+}
+
+/*
+Holds confirmed inputs back from spectators until they are the given number of
+frames old, so the delay is enforced before inputs ever leave this machine.
+Must be set before the session starts running.
+*/
+func (p *Peer) SetSpectatorDelay(frames int) error {
+	if frames < 0 || !p.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	p.spectatorDelay = frames
+	return nil
+}
+
+/*
+Picks the input delay from the round trip time measured while synchronizing
+instead of a fixed one. Remote peers agree on the larger of their proposals,
+and the session only starts running once every peer has. Once running, the
+delay follows the round trip time of the connection quality reports, revised
+every RecommendationInterval frames the same way SetFrameDelay changes it
+mid-match. Local players given a delay with SetFrameDelay keep it. Must be set
+before the session starts running.
+*/
+func (p *Peer) SetAutoInputDelay(enabled bool) error {
+	if !p.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	p.autoInputDelay = enabled
+	for i := 0; i < p.numPlayers; i++ {
+		if p.endpoints[i].IsInitialized() {
+			p.endpoints[i].SetAutoInputDelay(enabled)
+		}
+	}
+	return nil
+}
+
+/*
+Proposes a new delay for every automatic local player when the slowest remote
+peer's current round trip time calls for one. A player whose last change is
+still being agreed on is left alone until it's settled.
+*/
+func (p *Peer) reviseAutoInputDelay() {
+	delay := -1
+	for i := 0; i < p.numPlayers; i++ {
+		if !p.delayVoter(i) {
+			continue
+		}
+		if roundTrip, ok := p.endpoints[i].RoundTripTime(); ok {
+			delay = util.Max(delay, protocol.InputDelayForRoundTrip(roundTrip))
+		}
+	}
+	if delay < 0 {
+		return
+	}
+	for i := 0; i < p.numPlayers; i++ {
+		if !p.localPlayers[i] || p.fixedFrameDelay[i] || len(p.delayProposals[i]) > 0 {
+			continue
+		}
+		current := p.sync.FrameDelay(i)
+		if last, ok := p.delayChanges[i].Last(); ok {
+			current = last.Delay
+		}
+		if delay != current {
+			p.proposeFrameDelay(i, delay)
+		}
+	}
+	p.settleDelayProposals()
+}
+
+// Uses the largest delay agreed with any remote peer so far for everyone.
+func (p *Peer) applyAgreedInputDelay() int {
+	delay := 0
+	for i := 0; i < p.numPlayers; i++ {
+		if p.endpoints[i].IsInitialized() && p.endpoints[i].InputDelayAgreed() {
+			delay = util.Max(delay, p.endpoints[i].AgreedInputDelay())
+		}
+	}
+	for i := 0; i < p.numPlayers; i++ {
+		if p.localPlayers[i] {
+			if !p.fixedFrameDelay[i] {
+				p.sync.SetFrameDelay(i, delay)
+			}
+		} else if p.endpoints[i].IsInitialized() {
+			p.endpoints[i].SetFrameDelay(delay)
+		}
+	}
+	return delay
+}
+
 /*
 Giving each spectator and remote player their own UDP object (which GGPO didn't do)
 a copy of the poll, a copy of our localConnectStatus (might want to send a pointer?)
 Setting the default disconnect timeout and disconnect notify
 And calling the synchronize method, which sends a sync request to that endpoint.
+A player at the same address as one already added shares their endpoint.
 */
-func (p *Peer) AddRemotePlayer(ip string, port int, queue int) {
+func (p *Peer) AddRemotePlayer(ip string, port int, queue int) error {
 	p.synchronizing = true
+	for i := 0; i < p.numPlayers; i++ {
+		if i != queue && p.endpoints[i].HandlesMsg(ip, port) {
+			p.endpointQueue[queue] = i
+			return nil
+		}
+	}
 	p.endpoints[queue] = protocol.NewUdpProtocol(p.connection, queue, ip, port, &p.localConnectStatus)
 	// have to reqgister the loop from here or else the Poll won't see changed state
 	// that we've initiated.
-	p.poll.RegisterLoop(&(p.endpoints[queue]), nil)
+	err := p.poll.RegisterLoop(&(p.endpoints[queue]), nil)
+	if err != nil {
+		return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
+	}
 
 	// actually this Idle wouldn't run at all if it wasn't called from here.
 	//p.poll.RegisterLoop(&udp, nil)
 	p.endpoints[queue].SetDisconnectTimeout(p.disconnectTimeout)
 	p.endpoints[queue].SetDisconnectNotifyStart(p.disconnectNotifyStart)
+	p.endpoints[queue].SetAutoInputDelay(p.autoInputDelay)
+	p.endpoints[queue].SetResyncAuthority(p.resyncAuthority())
 	p.endpoints[queue].Synchronize()
+	return nil
 }
 
 func (p *Peer) AddSpectator(ip string, port int) error {
@@ -296,7 +761,11 @@ func (p *Peer) AddSpectator(ip string, port int) error {
 	queue := p.numSpectators
 	p.numSpectators++
 	p.spectators[queue] = protocol.NewUdpProtocol(p.connection, queue+1000, ip, port, &p.localConnectStatus)
-	p.poll.RegisterLoop(&(p.spectators[queue]), nil)
+	err := p.poll.RegisterLoop(&(p.spectators[queue]), nil)
+	if err != nil {
+		p.numSpectators--
+		return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
+	}
 	p.spectators[queue].SetDisconnectTimeout(p.disconnectTimeout)
 	p.spectators[queue].SetDisconnectNotifyStart(p.disconnectNotifyStart)
 	p.spectators[queue].Synchronize()
@@ -312,15 +781,16 @@ func (p *Peer) AddPlayer(player *Player, handle *PlayerHandle) error {
 	}
 
 	queue := player.PlayerNum - 1
-	if player.PlayerNum < 1 || player.PlayerNum > p.numPlayers {
+	if player.PlayerNum < 1 || player.PlayerNum > p.numPlayers || p.numPlayers > MaxPlayers {
 		return Error{Code: ErrorCodePlayerOutOfRange, Name: "ErrorCodePlayerOutOfRange"}
 	}
 	*handle = p.QueueToPlayerHandle(queue)
 
 	if player.PlayerType == PlayerTypeRemote {
-		p.AddRemotePlayer(player.Remote.IpAdress, player.Remote.Port, queue)
+		return p.AddRemotePlayer(player.Remote.IpAdress, player.Remote.Port, queue)
 	}
 
+	p.localPlayers[queue] = true
 	return nil
 }
 
@@ -339,53 +809,104 @@ func (p *Peer) AddLocalInput(player PlayerHandle, values []byte, size int) error
 	if p.synchronizing {
 		return Error{Code: ErrorCodeNotSynchronized, Name: "ErrorCodeNotSynchronized"}
 	}
+	if p.desyncHalted {
+		return Error{Code: ErrorCodeDesynchronized, Name: "ErrorCodeDesynchronized"}
+	}
 
 	result := p.PlayerHandleToQueue(player, &queue)
 	if result != nil {
 		return result
 	}
+	if !p.localPlayers[queue] {
+		return Error{Code: ErrorCodeInvalidPlayerHandle, Name: "ErrorCodeInvalidPlayerHandle"}
+	}
 
 	localInput, err = input.NewGameInput(-1, values, size)
 	if err != nil {
-		panic(err)
+		return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput", err)
 	}
 
 	// Feed the input for the current frame into the synchronization layer.
-	if !p.sync.AddLocalInput(queue, &localInput) {
-		return Error{Code: ErrorCodePredictionThreshod, Name: "ErrorCodePredictionThreshod"}
+	err = p.sync.AddLocalInput(queue, &localInput)
+	if err != nil {
+		return err
 	}
+	// A scheduled delay change takes effect as its frame's input is added.
+	p.setEndpointFrameDelay()
+
+	return p.sendLocalInputs()
+}
+
+/*
+Sends every frame all local players have input for, packed together in queue
+order. The input queues pad the frames a growing frame delay skips, so remotes
+still get every frame in order.
+*/
+func (p *Peer) sendLocalInputs() error {
+	for {
+		packed := input.GameInput{Frame: p.nextLocalFrame}
+		for i := 0; i < p.numPlayers; i++ {
+			if !p.localPlayers[i] {
+				continue
+			}
+			in, ok, err := p.sync.GetConfirmedInput(i, p.nextLocalFrame)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+			packed.Bits = append(packed.Bits, in.Bits...)
+		}
+		packed.Size = len(packed.Bits)
+		p.sendLocalInput(&packed)
+		p.nextLocalFrame++
+	}
+}
 
-	if localInput.Frame != input.NullFrame {
-		// Update the local connect status state to indicate that we've got a
-		// confirmed local frame for this player.  this must come first so it
-		// gets incorporated into the next packet we send.
-		// - pond3r
+// Sends a confirmed frame of local input, along with the checksum that's due, to every remote.
+func (p *Peer) sendLocalInput(in *input.GameInput) {
+	// Update the local connect status state to indicate that we've got a
+	// confirmed local frame for this player.  this must come first so it
+	// gets incorporated into the next packet we send.
+	// - pond3r
 
-		p.confirmedChecksumFrame = localInput.Frame - ChecksumDistance
+	p.confirmedChecksumFrame = in.Frame - p.checksumDistance
 
-		localInput.Checksum = 0
-		if p.confirmedChecksumFrame >= 0 {
+	in.Checksum = 0
+	if p.confirmedChecksumFrame >= 0 {
+		if p.confirmedChecksumFrame%p.checksumInterval == 0 {
 			cs, ok := p.pendingChecksums.Get(p.confirmedChecksumFrame)
 			if ok {
-				localInput.Checksum = cs
+				in.Checksum = cs
 			}
-			p.confirmedChecksums.Set(p.confirmedChecksumFrame, localInput.Checksum)
-			p.pendingChecksums.Delete(p.confirmedChecksumFrame)
-			util.Log.Printf("Frame %d: Send checksum for frame %d, val %d\n", localInput.Frame, p.confirmedChecksumFrame, localInput.Checksum)
+			p.confirmedChecksums.Set(p.confirmedChecksumFrame, in.Checksum)
+			if state, ok := p.pendingStates[p.confirmedChecksumFrame]; ok {
+				p.confirmedStates[p.confirmedChecksumFrame] = state
+			}
+			util.Log.Printf("Frame %d: Send checksum for frame %d, val %d\n", in.Frame, p.confirmedChecksumFrame, in.Checksum)
 		}
-
-		util.Log.Printf("setting local connect status for local queue %d to %d", queue, localInput.Frame)
-		p.localConnectStatus[queue].LastFrame = int32(localInput.Frame)
-
-		// Send the input to all the remote players.
-		for i := 0; i < p.numPlayers; i++ {
-			if p.endpoints[i].IsInitialized() {
-				p.endpoints[i].SendInput(&localInput)
+		p.pendingChecksums.Delete(p.confirmedChecksumFrame)
+		for frame := range p.pendingStates {
+			if frame <= p.confirmedChecksumFrame {
+				delete(p.pendingStates, frame)
 			}
 		}
 	}
 
-	return nil
+	for i := 0; i < p.numPlayers; i++ {
+		if p.localPlayers[i] {
+			util.Log.Printf("setting local connect status for local queue %d to %d", i, in.Frame)
+			p.localConnectStatus[i].LastFrame = int32(in.Frame)
+		}
+	}
+
+	// Send the input to all the remote players.
+	for i := 0; i < p.numPlayers; i++ {
+		if p.endpoints[i].IsInitialized() {
+			p.endpoints[i].SendInput(in)
+		}
+	}
 }
 
 // Maps to top level API function
@@ -398,7 +919,10 @@ func (p *Peer) SyncInput(disconnectFlags *int) ([][]byte, error) {
 	if p.synchronizing {
 		return nil, Error{Code: ErrorCodeNotSynchronized, Name: "ErrorCodeNotSynchronized"}
 	}
-	values, flags := p.sync.SynchronizeInputs()
+	values, flags, err := p.sync.SynchronizeInputs()
+	if err != nil {
+		return nil, err
+	}
 
 	if disconnectFlags != nil {
 		*disconnectFlags = flags
@@ -412,6 +936,9 @@ func (p *Peer) SyncInput(disconnectFlags *int) ([][]byte, error) {
 // Do Poll Not only runs everything in the system that's registered to poll
 // it... well does everything. I'll get ti it when I get to it.
 func (p *Peer) AdvanceFrame(checksum uint32) error {
+	if p.desyncHalted && !p.sync.InRollback() {
+		return Error{Code: ErrorCodeDesynchronized, Name: "ErrorCodeDesynchronized"}
+	}
 	util.Log.Printf("End of frame (%d)...\n", p.sync.FrameCount())
 
 	var maxDiff int = 0
@@ -425,15 +952,27 @@ func (p *Peer) AdvanceFrame(checksum uint32) error {
 	} else {
 		util.Log.Printf("Added local checksum for frame %d: %d\n", currentFrame, checksum)
 	}
-	p.pendingChecksums.Set(currentFrame, checksum)
 
 	p.sync.AdvanceFrame()
-	err := p.Idle(0)
-	if err != nil {
-		panic(err)
+	recorded := checksum
+	if saved := p.sync.GetLastSavedFrame(); checksum == DefaultChecksum && usesSavedChecksums(p.session) && saved.frame == currentFrame+1 {
+		// Fall back on the checksum from saving the state, which is what a
+		// BufferedSession provides. With sparse saving peers save different
+		// frames, so only the replay, which saves its frames on purpose,
+		// takes it then.
+		recorded = uint32(saved.checksum)
+		if !p.sync.SparseSaving() {
+			checksum = recorded
+		}
 	}
-
-	return nil
+	p.pendingChecksums.Set(currentFrame, checksum)
+	if p.replay != nil {
+		p.replay.setChecksum(currentFrame, recorded)
+	}
+	if p.capturesStates() {
+		p.pendingStates[currentFrame] = p.session.(StateSerializer).SerializeGameState()
+	}
+	return p.Idle(0)
 }
 
 // Handles all the events  for all spactors and players. Done OnPoll
@@ -447,7 +986,10 @@ func (p *Peer) PollUdpProtocolEvents() {
 			} else {
 				err := p.OnUdpProtocolPeerEvent(evt, i)
 				if err != nil {
-					panic(err)
+					// A peer sending inputs we can't use would corrupt the
+					// session, so drop them rather than the whole game.
+					util.Log.Printf("Disconnecting queue %d after a bad event: %s\n", i, err)
+					p.DisconnectPlayer(p.QueueToPlayerHandle(i))
 				}
 			}
 		}
@@ -479,18 +1021,33 @@ func (p *Peer) OnUdpProtocolPeerEvent(evt *protocol.UdpProtocolEvent, queue int)
 			currentRemoteFrame := p.localConnectStatus[queue].LastFrame
 			newRemoteFrame := evt.Input.Frame
 			if !(currentRemoteFrame == -1 || int32(newRemoteFrame) == (currentRemoteFrame+1)) {
-				return errors.New("ggpo Peer OnUdpProtocolPeerEvent : !(currentRemoteFrame == -1 || newRemoteFrame == (currentRemoteFrame+1)) ")
+				return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput",
+					errors.New("ggpo Peer OnUdpProtocolPeerEvent : !(currentRemoteFrame == -1 || newRemoteFrame == (currentRemoteFrame+1)) "))
 			}
 
-			p.sync.AddRemoteInput(queue, &evt.Input)
-			// Notify the other endpoints which frame we received from a peer
-			util.Log.Printf("setting remote connect status for queue %d to %d\n", queue,
-				evt.Input.Frame)
-			p.localConnectStatus[queue].LastFrame = int32(evt.Input.Frame)
+			// the input holds every player on that peer, packed in queue order
+			queues := p.endpointPlayers(queue)
+			if len(evt.Input.Bits) != len(queues)*p.inputSize {
+				return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput",
+					errors.New("ggpo Peer OnUdpProtocolPeerEvent : len(evt.Input.Bits) != len(queues)*p.inputSize"))
+			}
+			for n, q := range queues {
+				remoteInput := evt.Input
+				remoteInput.Bits = evt.Input.Bits[n*p.inputSize : (n+1)*p.inputSize]
+				remoteInput.Size = p.inputSize
+				err := p.sync.AddRemoteInput(q, &remoteInput)
+				if err != nil {
+					return err
+				}
+				// Notify the other endpoints which frame we received from a peer
+				util.Log.Printf("setting remote connect status for queue %d to %d\n", q,
+					evt.Input.Frame)
+				p.localConnectStatus[q].LastFrame = int32(evt.Input.Frame)
+			}
 
 			remoteChecksum := evt.Input.Checksum
-			checksumFrame := newRemoteFrame - ChecksumDistance
-			if checksumFrame >= p.endpoints[queue].RemoteFrameDelay()-1 {
+			checksumFrame := newRemoteFrame - p.checksumDistance
+			if checksumFrame >= p.endpoints[queue].RemoteFrameDelay()-1 && checksumFrame%p.checksumInterval == 0 {
 				p.endpoints[queue].SetIncomingRemoteChecksum(checksumFrame, remoteChecksum)
 			}
 
@@ -502,12 +1059,77 @@ func (p *Peer) OnUdpProtocolPeerEvent(evt *protocol.UdpProtocolEvent, queue int)
 	case protocol.DisconnectedEvent:
 		err := p.DisconnectPlayer(handle)
 		if err != nil {
-			panic(err)
+			return err
 		}
+	case protocol.DesyncReportEvent:
+		p.OnDesyncReport(handle, evt.Frame, evt.State)
 	}
 	return nil
 }
 
+// Handles the state a peer had at a desynced frame, diffing it against ours
+// and taking it over if it comes from the resync authority.
+func (p *Peer) OnDesyncReport(handle PlayerHandle, frame int, remote []byte) {
+	if p.stateDiffer != nil {
+		p.reportDesync(handle, frame, remote)
+	}
+	if p.desyncPolicy == DesyncPolicyResync && handle == p.desyncAuthority && frame >= p.resyncedFrame {
+		p.resync(frame, remote)
+	}
+}
+
+// Loads the authority's state after frame and resimulates up to the current
+// frame from it.
+func (p *Peer) resync(frame int, state []byte) {
+	if !p.sync.CanReplayFrom(frame + 1) {
+		util.Log.Printf("Can't resync from frame %d, the inputs since then are gone.\n", frame)
+		return
+	}
+	p.session.(StateDeserializer).DeserializeGameState(state)
+	err := p.sync.ReplayFrom(frame + 1)
+	if err != nil {
+		util.Log.Printf("Resync from frame %d failed: %s\n", frame, err)
+		return
+	}
+	// checksums already sent for the frames we just replayed are stale
+	p.resyncedFrame = p.sync.FrameCount()
+
+	var info Event
+	info.Code = EventCodeResynchronized
+	info.Player = p.desyncAuthority
+	info.Frame = frame
+	p.session.OnEvent(&info)
+}
+
+// Hands the diff between our state at a desynced frame and a peer's to the
+// session.
+func (p *Peer) reportDesync(handle PlayerHandle, frame int, remote []byte) {
+	local, ok := p.desyncStates[frame]
+	if !ok {
+		local, ok = p.confirmedStates[frame]
+	}
+	if !ok {
+		util.Log.Printf("Got a desync report from player %d for frame %d, but we no longer have that state.\n", handle, frame)
+		return
+	}
+
+	var info Event
+	info.Code = EventCodeDesyncReport
+	info.Player = handle
+	info.Frame = frame
+	info.DiffFields = p.stateDiffer.DiffStates(local, remote)
+	if p.desyncReportDir != "" {
+		localFile, remoteFile, err := writeDesyncReport(p.desyncReportDir, frame, handle, local, remote)
+		if err != nil {
+			util.Log.Printf("Could not write the desync report for frame %d: %s\n", frame, err)
+		} else {
+			info.LocalStateFile = localFile
+			info.RemoteStateFile = remoteFile
+		}
+	}
+	p.session.OnEvent(&info)
+}
+
 // Every Idle, every endpoint and spectator goes through its event queue
 // handles each event and pops it from the queue.  Though most of the logic
 // for handling these events is the same (see: OnUdpProtocolEvent ), spectators
@@ -524,6 +1146,8 @@ func (p *Peer) OnUdpProtocolSpectatorEvent(evt *protocol.UdpProtocolEvent, queue
 		info.Code = EventCodeDisconnectedFromPeer
 		info.Player = handle
 		p.session.OnEvent(&info)
+	case protocol.RetransmitRequestEvent:
+		p.SendSpectatorRetransmit(queue, evt.Frame, evt.Count)
 	}
 }
 
@@ -553,6 +1177,30 @@ func (p *Peer) OnUdpProtocolEvent(evt *protocol.UdpProtocolEvent, handle PlayerH
 
 		p.CheckInitialSync()
 
+	case protocol.ProtocolMismatchEvent:
+		info.Code = EventCodeMismatchedPeer
+		info.Player = handle
+		p.session.OnEvent(&info)
+
+	case protocol.InputDelayAgreedEvent:
+		info.Code = EventCodeInputDelayAgreed
+		info.Player = handle
+		info.InputDelay = p.applyAgreedInputDelay()
+		p.session.OnEvent(&info)
+
+		p.CheckInitialSync()
+
+	case protocol.InputDelayChangeEvent:
+		if evt.Player < 0 || evt.Player >= p.numPlayers || p.localPlayers[evt.Player] ||
+			!p.delayChanges[evt.Player].Add(evt.Frame, evt.InputDelay) {
+			break
+		}
+		info.Code = EventCodeInputDelayAgreed
+		info.Player = p.QueueToPlayerHandle(evt.Player)
+		info.InputDelay = evt.InputDelay
+		info.Frame = evt.Frame
+		p.session.OnEvent(&info)
+
 	case protocol.NetworkInterruptedEvent:
 		info.Code = EventCodeConnectionInterrupted
 		info.Player = handle
@@ -588,18 +1236,13 @@ func (p *Peer) DisconnectPlayer(player PlayerHandle) error {
 		return Error{Code: ErrorCodePlayerDisconnected, Name: "ErrorCodePlayerDisconnected"}
 	}
 
-	if !p.endpoints[queue].IsInitialized() {
+	if p.localPlayers[queue] {
 		currentFrame := p.sync.FrameCount()
-		// xxx: we should be tracking who the local player is, but for now assume
-		// that if the endpoint is not initalized, this must be the local player. - pond3r
-
-		// 100% sure this assumption won't be applicable for me, but we'll see.
-		// Not that it matters lol
 		util.Log.Printf("Disconnecting local player %d at frame %d by user request.\n",
 			queue, p.localConnectStatus[queue].LastFrame)
 		// Disconnecting all the other players too
 		for i := 0; i < p.numPlayers; i++ {
-			if p.endpoints[i].IsInitialized() {
+			if !p.localPlayers[i] && !p.localConnectStatus[i].Disconnected {
 				p.DisconnectPlayerQueue(i, currentFrame)
 			}
 		}
@@ -622,7 +1265,7 @@ func (p *Peer) DisconnectPlayerQueue(queue int, syncto int) {
 	var info Event
 	frameCount := p.sync.FrameCount()
 
-	p.endpoints[queue].Disconnect()
+	p.endpoint(queue).Disconnect()
 
 	util.Log.Printf("Changing queue %d local connect status for last frame from %d to %d on disconnect request (current: %d).\n",
 		queue, p.localConnectStatus[queue].LastFrame, syncto, frameCount)
@@ -632,17 +1275,37 @@ func (p *Peer) DisconnectPlayerQueue(queue int, syncto int) {
 
 	if syncto < frameCount {
 		util.Log.Printf("adjusting simulation to account for the fact that %d disconnected @ %d.\n", queue, syncto)
-		p.sync.AdjustSimulation(syncto)
-		util.Log.Printf("Finished adjusting simulation.\n")
+		err := p.sync.AdjustSimulation(syncto)
+		if err != nil {
+			// the player is gone either way, so the session carries on
+			util.Log.Printf("Adjusting simulation failed: %s\n", err)
+		} else {
+			util.Log.Printf("Finished adjusting simulation.\n")
+		}
 	}
 
 	info.Code = EventCodeDisconnectedFromPeer
 	info.Player = p.QueueToPlayerHandle(queue)
 	p.session.OnEvent(&info)
 
+	// the rest of the players on that peer went with the endpoint
+	for _, other := range p.endpointPlayers(p.endpointQueue[queue]) {
+		if !p.localConnectStatus[other].Disconnected {
+			p.DisconnectPlayerQueue(other, int(p.localConnectStatus[other].LastFrame))
+		}
+	}
+
 	p.CheckInitialSync()
 }
 
+/*
+Gets how often and how deep the session has rolled back, and how long it has
+spent stuck at the prediction barrier, since it started.
+*/
+func (p *Peer) GetSessionStats() (SessionStats, error) {
+	return p.sync.SessionStats(), nil
+}
+
 /*
 Gets network stats for that specific play from their UdpProtocol Endpoint
 Includes ping, sendQueLen, kbpsSent, remoteFramesBehind and remoteFrameAdvantage
@@ -657,7 +1320,71 @@ func (p *Peer) GetNetworkStats(player PlayerHandle) (protocol.NetworkStats, erro
 		return protocol.NetworkStats{}, result
 	}
 
-	return p.endpoints[queue].GetNetworkStats(), nil
+	return p.endpoint(queue).GetNetworkStats(), nil
+}
+
+/*
+Reports where a player's connection is at, so games don't have to piece it
+together from events. Works for spectator handles too, whose last confirmed
+frame is the last one queued for them.
+*/
+func (p *Peer) GetPlayerStatus(handle PlayerHandle) (PlayerStatus, error) {
+	if int(handle) >= 1000 {
+		queue := int(handle) - 1000
+		if queue >= p.numSpectators {
+			return PlayerStatus{}, Error{Code: ErrorCodeInvalidPlayerHandle, Name: "ErrorCodeInvalidPlayerHandle"}
+		}
+		status := endpointStatus(&p.spectators[queue])
+		status.LastConfirmedFrame = p.nextSpectatorFrame - 1
+		return status, nil
+	}
+
+	var queue int
+	result := p.PlayerHandleToQueue(handle, &queue)
+	if result != nil {
+		return PlayerStatus{}, result
+	}
+
+	var status PlayerStatus
+	if !p.localPlayers[queue] {
+		status = endpointStatus(p.endpoint(queue))
+		status.InputDelay = p.delayChanges[queue].At(p.sync.FrameCount(), p.endpoint(queue).RemoteFrameDelay())
+	} else {
+		status = PlayerStatus{
+			Local:                 true,
+			State:                 PlayerStateRunning,
+			FramesUntilDisconnect: -1,
+			InputDelay:            p.sync.FrameDelay(queue),
+		}
+		if p.synchronizing {
+			status.State = PlayerStateSynchronizing
+		}
+	}
+	if p.localConnectStatus[queue].Disconnected {
+		status.State = PlayerStateDisconnected
+		status.FramesUntilDisconnect = -1
+	}
+	status.LastConfirmedFrame = int(p.localConnectStatus[queue].LastFrame)
+	return status, nil
+}
+
+// The connection state of a remote player, spectator or host.
+func endpointStatus(endpoint *protocol.UdpProtocol) PlayerStatus {
+	status := PlayerStatus{FramesUntilDisconnect: -1}
+	switch {
+	case endpoint.IsDisconnected():
+		status.State = PlayerStateDisconnected
+	case endpoint.IsInterrupted():
+		status.State = PlayerStateInterrupted
+	case endpoint.IsRunning():
+		status.State = PlayerStateRunning
+	default:
+		status.State = PlayerStateSynchronizing
+	}
+	if left := endpoint.TimeUntilDisconnect(time.Now().UnixMilli()); left >= 0 {
+		status.FramesUntilDisconnect = FramesFromDuration(time.Duration(left) * time.Millisecond)
+	}
+	return status
 }
 
 /*
@@ -666,6 +1393,12 @@ Frame delay is used in the input queue, when remote inputs are recieved from
 the UdpProtocol and sent to Sync, sync then adds those inputs to the input queue
 for that specific player, and sort of artificially corrects the frame that player
 should be on by increasing it frameDelay amount
+Once the session is running only local players can be changed. The change is
+proposed to every remote peer for FrameDelayChangeLead frames ahead, or the
+frame after the player's last change if that's later, so back to back changes
+take effect one after the other. It's only committed once they have all acked
+it with its frame still ahead; otherwise it's proposed again further on. Remote
+peers raise EventCodeInputDelayAgreed once it's committed.
 Maps to top level API function
 */
 func (p *Peer) SetFrameDelay(player PlayerHandle, delay int) error {
@@ -675,15 +1408,112 @@ func (p *Peer) SetFrameDelay(player PlayerHandle, delay int) error {
 	if result != nil {
 		return result
 	}
+	if delay < 0 {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	if !p.synchronizing {
+		if !p.localPlayers[queue] {
+			return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+		}
+		p.proposeFrameDelay(queue, delay)
+		p.settleDelayProposals()
+		return nil
+	}
 
 	p.sync.SetFrameDelay(queue, delay)
+	p.fixedFrameDelay[queue] = true
+	p.setEndpointFrameDelay()
+
+	return nil
+}
+
+// Proposes queue's delay change for the first frame it can still be agreed on.
+func (p *Peer) proposeFrameDelay(queue int, delay int) {
+	frame := p.sync.FrameCount() + FrameDelayChangeLead
+	if last, ok := p.delayChanges[queue].Last(); ok {
+		frame = util.Max(frame, last.Frame+1)
+	}
+	if last, ok := p.delayProposals[queue].Last(); ok {
+		frame = util.Max(frame, last.Frame+1)
+	}
+	p.delayProposals[queue].Add(frame, delay)
+	for i := 0; i < p.numPlayers; i++ {
+		if p.delayVoter(i) {
+			p.endpoints[i].ProposeInputDelay(queue, frame, delay)
+		}
+	}
+}
+
+/*
+Commits each local player's proposals in order once every connected remote peer
+has acked them, as long as their frame hasn't come yet. A proposal that runs out
+of time is withdrawn and proposed again, along with the ones queued behind it.
+*/
+func (p *Peer) settleDelayProposals() {
+	for queue := range p.delayProposals {
+		for len(p.delayProposals[queue]) > 0 {
+			proposal := p.delayProposals[queue][0]
+			if proposal.Frame <= p.sync.FrameCount() {
+				p.reproposeFrameDelays(queue)
+				break
+			}
+			if !p.delayProposalAcked(queue, proposal) {
+				break
+			}
+			p.delayProposals[queue] = p.delayProposals[queue][1:]
+			p.delayChanges[queue].Add(proposal.Frame, proposal.Delay)
+			p.sync.ScheduleFrameDelay(queue, proposal.Frame, proposal.Delay)
+			for i := 0; i < p.numPlayers; i++ {
+				if p.delayVoter(i) {
+					p.endpoints[i].CommitInputDelay(queue, proposal.Frame, proposal.Delay)
+				}
+			}
+		}
+	}
+}
+
+func (p *Peer) reproposeFrameDelays(queue int) {
+	proposals := p.delayProposals[queue]
+	p.delayProposals[queue] = nil
 	for i := 0; i < p.numPlayers; i++ {
 		if p.endpoints[i].IsInitialized() {
-			p.endpoints[i].SetFrameDelay(delay)
+			p.endpoints[i].WithdrawInputDelay(queue)
 		}
 	}
+	for _, proposal := range proposals {
+		p.proposeFrameDelay(queue, proposal.Delay)
+	}
+}
 
-	return nil
+func (p *Peer) delayProposalAcked(queue int, proposal input.DelayChange) bool {
+	for i := 0; i < p.numPlayers; i++ {
+		if p.delayVoter(i) && !p.endpoints[i].InputDelayAcked(queue, proposal.Frame, proposal.Delay) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the endpoint at queue has to ack delay changes: one lives there and
+// is still connected. A shared endpoint lives at its first queue only.
+func (p *Peer) delayVoter(queue int) bool {
+	return p.endpoints[queue].IsInitialized() && !p.localConnectStatus[queue].Disconnected
+}
+
+// Endpoints judge frame advantage by our input delay. With several local
+// players that's the largest of their delays, the one our inputs arrive with.
+func (p *Peer) setEndpointFrameDelay() {
+	delay := 0
+	for i := 0; i < p.numPlayers; i++ {
+		if p.localPlayers[i] {
+			delay = util.Max(delay, p.sync.FrameDelay(i))
+		}
+	}
+	for i := 0; i < p.numPlayers; i++ {
+		if p.endpoints[i].IsInitialized() {
+			p.endpoints[i].SetFrameDelay(delay)
+		}
+	}
 }
 
 /*
@@ -746,6 +1576,23 @@ func (p *Peer) QueueToSpectatorHandle(queue int) PlayerHandle {
 	return PlayerHandle(queue + 1000) /* out of range of the player array, basically  - pond3r*/
 }
 
+// The endpoint carrying queue's input, shared by every player on that peer.
+func (p *Peer) endpoint(queue int) *protocol.UdpProtocol {
+	return &p.endpoints[p.endpointQueue[queue]]
+}
+
+// The queues whose input comes in through the endpoint at queue, in the order
+// it's packed.
+func (p *Peer) endpointPlayers(queue int) []int {
+	var queues []int
+	for i := 0; i < p.numPlayers; i++ {
+		if !p.localPlayers[i] && p.endpointQueue[i] == queue {
+			queues = append(queues, i)
+		}
+	}
+	return queues
+}
+
 /*
 Propogates messages to all endpoints and spectators (?)
 As of right now it hands the message off to the first endpoint that
@@ -794,8 +1641,8 @@ func (p *Peer) CheckInitialSync() {
 		// Check to see if everyone is now synchronized. If so,
 		// go and tell the client that we're ok to accept in.
 		for i = 0; i < p.numPlayers; i++ {
-			// xxx: IsInitialized() must go... we're actually using it as a proxy for "represents the local player" -pond3r
-			if p.endpoints[i].IsInitialized() && !p.endpoints[i].IsSynchronized() && !p.localConnectStatus[i].Disconnected {
+			if !p.localPlayers[i] && p.endpoints[i].IsInitialized() && !p.localConnectStatus[i].Disconnected &&
+				(!p.endpoints[i].IsSynchronized() || !p.endpoints[i].InputDelayAgreed()) {
 				return
 			}
 		}
@@ -806,6 +1653,18 @@ func (p *Peer) CheckInitialSync() {
 			}
 		}
 
+		if !p.resyncAuthorityAgreed() {
+			return
+		}
+
+		if p.replay != nil {
+			for i := 0; i < p.numPlayers; i++ {
+				if p.localPlayers[i] {
+					p.replay.info.FrameDelay = util.Max(p.replay.info.FrameDelay, p.sync.FrameDelay(i))
+				}
+			}
+		}
+
 		var info Event
 		info.Code = EventCodeRunning
 		p.session.OnEvent(&info)
@@ -813,43 +1672,152 @@ func (p *Peer) CheckInitialSync() {
 	}
 }
 
+/*
+Collects the checksums every endpoint sent into per-frame ballots alongside our
+own, then settles each ballot that all connected peers have voted on. A ballot
+still missing votes when a newer one settles is dropped, since endpoints only
+keep the newest checksum they received each poll.
+*/
 func (p *Peer) CheckDesync() {
-	keysToRemove := make([]int, 0, 16)
 	for i := 0; i < len(p.endpoints); i++ {
 		for _, k := range p.endpoints[i].RemoteChecksums.Keys() {
-			checksumFrame := k
+			if _, ok := p.confirmedChecksums.Get(k); !ok {
+				continue
+			}
 			remoteChecksum, _ := p.endpoints[i].RemoteChecksums.Get(k)
-			localChecksum, ok := p.confirmedChecksums.Get(checksumFrame)
-			if ok {
-				keysToRemove = append(keysToRemove, k)
-				if remoteChecksum != localChecksum {
-					var info Event
-					info.Code = EventCodeDesync
-					info.NumFrameOfDesync = checksumFrame
-					info.LocalChecksum = int(localChecksum)
-					info.RemoteChecksum = int(remoteChecksum)
-					p.session.OnEvent(&info)
-					util.Log.Printf("DESYNC Checksum frame %d, local: %d, remote %d, size of checksum maps: %d,%d\n",
-						checksumFrame, localChecksum, remoteChecksum, p.confirmedChecksums.Len(), p.endpoints[i].RemoteChecksums.Len())
-				}
+			p.endpoints[i].RemoteChecksums.Delete(k)
+			if p.checksumVotes[k] == nil {
+				p.checksumVotes[k] = make(map[int]uint32)
+			}
+			p.checksumVotes[k][i] = remoteChecksum
+		}
+	}
+
+	frames := make([]int, 0, len(p.checksumVotes))
+	for frame := range p.checksumVotes {
+		frames = append(frames, frame)
+	}
+	sort.Ints(frames)
+	settled := input.NullFrame
+	for _, frame := range frames {
+		if p.allPeersVoted(p.checksumVotes[frame]) {
+			p.settleChecksumVote(frame, p.checksumVotes[frame])
+			settled = frame
+		}
+	}
+	if settled == input.NullFrame {
+		return
+	}
+
+	for frame := range p.checksumVotes {
+		if frame <= settled {
+			delete(p.checksumVotes, frame)
+		}
+	}
+	for _, frame := range p.confirmedChecksums.Keys() {
+		if frame <= settled {
+			p.confirmedChecksums.Delete(frame)
+			delete(p.confirmedStates, frame)
+		}
+	}
+}
 
-				if checksumFrame%100 == 0 {
-					util.Log.Printf("Checksum frame %d, local: %d, remote %d, size of checksum maps: %d,%d\n", checksumFrame, localChecksum, remoteChecksum, p.confirmedChecksums.Len(), p.endpoints[i].RemoteChecksums.Len())
+func (p *Peer) allPeersVoted(votes map[int]uint32) bool {
+	for i := 0; i < p.numPlayers; i++ {
+		if !p.endpoints[i].IsInitialized() || p.localConnectStatus[i].Disconnected {
+			continue
+		}
+		if _, ok := votes[i]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Raises EventCodeDesync for every remote player whose checksum for frame differs
+from ours. When one checksum has a strict majority, the players that didn't
+match it, which may include our own, are named in MinorityPlayers. In a two
+player session there is never a majority, so that list stays empty.
+*/
+func (p *Peer) settleChecksumVote(frame int, votes map[int]uint32) {
+	if p.desyncPolicy == DesyncPolicyIgnore || frame < p.resyncedFrame {
+		return
+	}
+	for i := range votes {
+		if frame < p.resyncServed[i] {
+			delete(votes, i)
+		}
+	}
+	var authority int
+	servesResync := p.desyncPolicy == DesyncPolicyResync &&
+		p.PlayerHandleToQueue(p.desyncAuthority, &authority) == nil && p.localPlayers[authority]
+	localChecksum, _ := p.confirmedChecksums.Get(frame)
+	tally := map[uint32]int{localChecksum: 1}
+	for _, checksum := range votes {
+		tally[checksum]++
+	}
+	var majority uint32
+	hasMajority := false
+	for checksum, count := range tally {
+		if count*2 > len(votes)+1 {
+			majority = checksum
+			hasMajority = true
+		}
+	}
+
+	// Votes are by endpoint, each standing for every player behind it.
+	var minority []PlayerHandle
+	if hasMajority {
+		for i := 0; i < p.numPlayers; i++ {
+			if p.localPlayers[i] && localChecksum != majority {
+				minority = append(minority, p.QueueToPlayerHandle(i))
+			}
+			if checksum, voted := votes[i]; voted && checksum != majority {
+				for _, queue := range p.endpointPlayers(i) {
+					minority = append(minority, p.QueueToPlayerHandle(queue))
 				}
 			}
 		}
-		for _, key := range keysToRemove {
-			p.endpoints[i].RemoteChecksums.Delete(key)
-		}
+		sort.Slice(minority, func(a, b int) bool { return minority[a] < minority[b] })
 	}
 
-	for _, key := range keysToRemove {
-		confirmedFrames := p.confirmedChecksums.Keys()
-		for _, frame := range confirmedFrames {
-			if frame <= key {
-				p.confirmedChecksums.Delete(frame)
+	for i := 0; i < p.numPlayers; i++ {
+		remoteChecksum, ok := votes[i]
+		if !ok || remoteChecksum == localChecksum {
+			continue
+		}
+		for _, queue := range p.endpointPlayers(i) {
+			var info Event
+			info.Code = EventCodeDesync
+			info.Player = p.QueueToPlayerHandle(queue)
+			info.NumFrameOfDesync = frame
+			info.LocalChecksum = int(localChecksum)
+			info.RemoteChecksum = int(remoteChecksum)
+			info.MinorityPlayers = minority
+			p.session.OnEvent(&info)
+		}
+		if state, ok := p.confirmedStates[frame]; ok {
+			p.desyncStates[frame] = state
+			err := p.endpoints[i].SendDesyncReport(frame, state)
+			if err != nil {
+				util.Log.Printf("Not sending a desync report: %s\n", err)
+			} else if servesResync {
+				// The peer resyncs once our state arrives, which may take it a
+				// prediction window past where we are. The checksums it sent
+				// before that, up to a checksum distance back, are stale.
+				p.resyncServed[i] = p.sync.FrameCount() + p.checksumDistance
 			}
 		}
+		util.Log.Printf("DESYNC Checksum frame %d, local: %d, player %d: %d, minority %v\n",
+			frame, localChecksum, p.QueueToPlayerHandle(i), remoteChecksum, minority)
+		if p.desyncPolicy == DesyncPolicyHalt {
+			p.desyncHalted = true
+		}
+	}
+
+	if frame%100 == 0 {
+		util.Log.Printf("Checksum frame %d, local: %d, votes %v\n", frame, localChecksum, votes)
 	}
 }
 
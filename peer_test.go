@@ -2,11 +2,15 @@ package ggpo_test
 
 import (
 	"bytes"
+	"fmt"
 	"math"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/assemblaj/ggpo/internal/messages"
 	"github.com/assemblaj/ggpo/internal/mocks"
+	"github.com/assemblaj/ggpo/internal/polling"
 	"github.com/assemblaj/ggpo/internal/protocol"
 	"github.com/assemblaj/ggpo/transport"
 
@@ -223,14 +227,10 @@ func TestP2PBackendCharacterizationAddLocalInput(t *testing.T) {
 	p2p2.AddLocalInput(p2Handle, inputBytes, len(inputBytes))
 	p2p2.Idle(0)
 
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic due to an InputQueue error")
-		}
-	}()
-
-	p2p2.AddLocalInput(p2Handle, inputBytes, len(inputBytes))
-
+	err := p2p2.AddLocalInput(p2Handle, inputBytes, len(inputBytes))
+	if !hasErrorCode(err, ggpo.ErrorCodeInvalidInput) {
+		t.Errorf("Expected ErrorCodeInvalidInput due to an InputQueue error, got %v", err)
+	}
 }
 
 func TestP2PBackendPoll2PlayersDefault(t *testing.T) {
@@ -530,12 +530,15 @@ func TestP2PBackendDisconnectPlayerRemoteCharacterization(t *testing.T) {
 	p2p2.AddPlayer(&player1, &p2handle1)
 	p2p2.AddPlayer(&player2, &p2handle2)
 
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic due attempting to load frames when none had been saved.")
-		}
-	}()
-	p2p2.DisconnectPlayer(p2handle1)
+	// There are no frames to load yet, which shouldn't stop the disconnect.
+	err := p2p2.DisconnectPlayer(p2handle1)
+	if err != nil {
+		t.Errorf("Disconnecting before any frames were saved caused error %s", err)
+	}
+	err = p2p2.DisconnectPlayer(p2handle1)
+	if !hasErrorCode(err, ggpo.ErrorCodePlayerDisconnected) {
+		t.Errorf("Expected the player to be disconnected, got %v", err)
+	}
 }
 
 func TestP2PBackendDisconnectPlayerError(t *testing.T) {
@@ -651,12 +654,7 @@ func TestP2PBackendMoockInputExchangeCharacterization(t *testing.T) {
 	}
 	input1 := []byte{1, 2, 3, 4}
 	input2 := []byte{5, 6, 7, 8}
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic.")
-		}
-	}()
-
+	var advanceErr error
 	for i := 0; i < 8; i++ {
 		p2p.Idle(0, advance)
 		p2p2.Idle(0, advance)
@@ -665,8 +663,15 @@ func TestP2PBackendMoockInputExchangeCharacterization(t *testing.T) {
 		var disconnectFlags int
 		p2p2.SyncInput(&disconnectFlags)
 		p2p.SyncInput(&disconnectFlags)
-		p2p.AdvanceFrame(ggpo.DefaultChecksum)
-		p2p2.AdvanceFrame(ggpo.DefaultChecksum)
+		if err := p2p.AdvanceFrame(ggpo.DefaultChecksum); err != nil {
+			advanceErr = err
+		}
+		if err := p2p2.AdvanceFrame(ggpo.DefaultChecksum); err != nil {
+			advanceErr = err
+		}
+	}
+	if advanceErr == nil {
+		t.Errorf("The code did not return an error.")
 	}
 
 }
@@ -887,6 +892,10 @@ func TestP2PBackendMoockInputDelay(t *testing.T) {
 	p2p2.AddPlayer(&player1, &p2handle1)
 	p2p2.AddPlayer(&player2, &p2handle2)
 
+	// set before synchronizing, since changes made while running are scheduled ahead
+	p2p.SetFrameDelay(p1Handle, 2)
+	p2p2.SetFrameDelay(p2handle2, 2)
+
 	advance := func() int64 {
 		return time.Now().Add(time.Millisecond * 2000).UnixMilli()
 	}
@@ -895,9 +904,6 @@ func TestP2PBackendMoockInputDelay(t *testing.T) {
 		p2p2.Idle(0, advance)
 	}
 
-	p2p.SetFrameDelay(p1Handle, 2)
-	p2p2.SetFrameDelay(p2handle2, 2)
-
 	/*
 		p2p.SetDisconnectTimeout(3000)
 		p2p.SetDisconnectNotifyStart(1000)
@@ -974,20 +980,28 @@ func TestP2PBackendMoockDisconnectTimeoutCharacterization(t *testing.T) {
 
 	doPollTimeOuts := 90
 	iterations := 6
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic.")
-		}
-	}()
+	var idleErr error
 	for i := 0; i < iterations; i++ {
-		p2p.Idle(doPollTimeOuts, timeout)
-		p2p2.Idle(doPollTimeOuts, timeout)
+		if err := p2p.Idle(doPollTimeOuts, timeout); err != nil {
+			idleErr = err
+		}
+		if err := p2p2.Idle(doPollTimeOuts, timeout); err != nil {
+			idleErr = err
+		}
 		//p2p.AddLocalInput(p1Handle, input1, 4)
 		//p2p2.AddLocalInput(p2handle2, input2, 4)
 		//p2p.AdvanceFrame(ggpo.DefaultChecksum)
 		//p2p2.AdvanceFrame(ggpo.DefaultChecksum)
 	}
-
+	// Timing out rolls back to a frame that was never saved, which used to
+	// take the session down with it.
+	if idleErr != nil {
+		t.Errorf("Timing out caused error %s", idleErr)
+	}
+	err := p2p.DisconnectPlayer(p2Handle)
+	if !hasErrorCode(err, ggpo.ErrorCodePlayerDisconnected) {
+		t.Errorf("Expected the player to be disconnected after timing out, got %v", err)
+	}
 }
 func TestP2PBackendMoockDisconnectTimeoutCharacterization2(t *testing.T) {
 	session := mocks.NewFakeSession()
@@ -1036,19 +1050,26 @@ func TestP2PBackendMoockDisconnectTimeoutCharacterization2(t *testing.T) {
 	p2p2.SetDisconnectTimeout(3000)
 	doPollTimeOuts := 0
 	iterations := 2
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic due to trying to load frame that hadn't been saved.")
-		}
-	}()
+	var advanceErr error
 	for i := 0; i < iterations; i++ {
 
 		p2p.Idle(doPollTimeOuts, timeout)
 		p2p2.Idle(doPollTimeOuts, timeout)
 		//p2p.AddLocalInput(p1Handle, input1, 4)
 		//p2p2.AddLocalInput(p2handle2, input2, 4)
-		p2p.AdvanceFrame(ggpo.DefaultChecksum)
-		p2p2.AdvanceFrame(ggpo.DefaultChecksum)
+		if err := p2p.AdvanceFrame(ggpo.DefaultChecksum); err != nil {
+			advanceErr = err
+		}
+		if err := p2p2.AdvanceFrame(ggpo.DefaultChecksum); err != nil {
+			advanceErr = err
+		}
+	}
+	if advanceErr != nil {
+		t.Errorf("Trying to load a frame that hadn't been saved on disconnect caused error %s", advanceErr)
+	}
+	err := p2p2.DisconnectPlayer(p2handle1)
+	if !hasErrorCode(err, ggpo.ErrorCodePlayerDisconnected) {
+		t.Errorf("Expected the player to be disconnected after timing out, got %v", err)
 	}
 }
 func TestP2PBackendMoockDisconnectTimeout(t *testing.T) {
@@ -1786,3 +1807,1358 @@ func TestP2PBackendMoockInputExchangeSameState(t *testing.T) {
 	}
 }
 */
+
+func TestP2PBackendSetPredictionWindow(t *testing.T) {
+	session := mocks.NewFakeSession()
+	p2p := ggpo.NewPeer(&session, 6000, 2, 4)
+	err := p2p.SetPredictionWindow(ggpo.MaxPredictionWindow + 1)
+	if err == nil {
+		t.Errorf("A prediction window over MaxPredictionWindow should be an error.")
+	}
+	err = p2p.SetPredictionWindow(0)
+	if err == nil {
+		t.Errorf("A prediction window under 1 frame should be an error.")
+	}
+	err = p2p.SetPredictionWindow(12)
+	if err != nil {
+		t.Errorf("Error when setting the prediction window %s", err)
+	}
+	err = p2p.SetPredictionWindow(20)
+	if err == nil {
+		t.Errorf("A prediction window not under the checksum distance should be an error.")
+	}
+}
+
+// Frames predicted past the checksum distance would have their checksums sent and
+// mismatch, so a window of 20 needs a longer distance.
+func TestP2PBackendLongPredictionWindow(t *testing.T) {
+	f := newMeshFixture(t, []int{7500, 7501}, [][]int{{1}, {2}}, 2, func(session *meshSession, port int) meshBackend {
+		peer := ggpo.NewPeer(session, port, 2, 4)
+		err := peer.SetChecksumDistance(24)
+		if err != nil {
+			t.Fatalf("Error when setting the checksum distance %s", err)
+		}
+		err = peer.SetPredictionWindow(20)
+		if err != nil {
+			t.Fatalf("Error when setting the prediction window %s", err)
+		}
+		return &peer
+	})
+	f.waitUntilRunning(t, nil)
+
+	// each peer in turn predicts 18 frames of the other's input
+	for frame := 0; frame < 18; frame++ {
+		f.advance(t, frame, map[int]bool{1: true})
+	}
+	for frame := 0; frame < 18; frame++ {
+		f.advance(t, frame, map[int]bool{0: true})
+	}
+	for frame := 18; frame < 100; frame++ {
+		f.advance(t, frame, nil)
+	}
+	f.checkStates(t, nil)
+}
+
+type zeroPredictor struct{}
+
+func (z zeroPredictor) PredictInput(frame int, recent [][]byte) []byte {
+	return make([]byte, 4)
+}
+
+func TestP2PBackendSetInputPredictor(t *testing.T) {
+	session := mocks.NewFakeSession()
+	p2p := ggpo.NewPeer(&session, 6000, 2, 4)
+	player1 := ggpo.NewLocalPlayer(20, 1)
+	var p1Handle ggpo.PlayerHandle
+	player2 := ggpo.NewRemotePlayer(20, 2, "127.2.1.1", 6001)
+	var p2Handle ggpo.PlayerHandle
+	p2p.AddPlayer(&player1, &p1Handle)
+	p2p.AddPlayer(&player2, &p2Handle)
+
+	err := p2p.SetInputPredictor(p2Handle, zeroPredictor{})
+	if err != nil {
+		t.Errorf("Error when setting an input predictor %s", err)
+	}
+	err = p2p.SetInputPredictor(ggpo.PlayerHandle(8), zeroPredictor{})
+	if err == nil {
+		t.Errorf("Setting an input predictor for an invalid handle should be an error.")
+	}
+}
+
+type desyncSession struct {
+	mocks.FakeSession
+	state      []byte
+	desyncs    []ggpo.Event
+	reports    []ggpo.Event
+	mismatched []ggpo.Event
+}
+
+func (d *desyncSession) SerializeGameState() []byte {
+	return append([]byte(nil), d.state...)
+}
+
+func (d *desyncSession) OnEvent(info *ggpo.Event) {
+	switch info.Code {
+	case ggpo.EventCodeDesync:
+		d.desyncs = append(d.desyncs, *info)
+	case ggpo.EventCodeDesyncReport:
+		d.reports = append(d.reports, *info)
+	case ggpo.EventCodeMismatchedPeer:
+		d.mismatched = append(d.mismatched, *info)
+	}
+}
+
+func TestP2PBackendDesyncReport(t *testing.T) {
+	session := desyncSession{FakeSession: mocks.NewFakeSession(), state: []byte{1, 2, 3, 4}}
+	localPort := 6000
+	remotePort := 6001
+	remoteIp := "127.2.1.1"
+	numPlayers := 2
+	inputSize := 4
+	p2p := ggpo.NewPeer(&session, localPort, numPlayers, inputSize)
+
+	session2 := desyncSession{FakeSession: mocks.NewFakeSession(), state: []byte{1, 2, 9, 4}}
+	p2p2 := ggpo.NewPeer(&session2, remotePort, numPlayers, inputSize)
+	connection := mocks.NewFakeP2PConnection(&p2p2, localPort, remoteIp)
+	connection2 := mocks.NewFakeP2PConnection(&p2p, remotePort, remoteIp)
+
+	p2p.InitializeConnection(&connection)
+	p2p2.InitializeConnection(&connection2)
+
+	dir := t.TempDir()
+	err := p2p.SetDesyncReports(dir, nil)
+	if err != nil {
+		t.Errorf("Error when enabling desync reports %s", err)
+	}
+	err = p2p2.SetDesyncReports("", nil)
+	if err != nil {
+		t.Errorf("Error when enabling desync reports %s", err)
+	}
+
+	player1 := ggpo.NewLocalPlayer(20, 1)
+	var p1Handle ggpo.PlayerHandle
+	player2 := ggpo.NewRemotePlayer(20, 2, remoteIp, remotePort)
+	var p2Handle ggpo.PlayerHandle
+	p2p.AddPlayer(&player1, &p1Handle)
+	p2p.AddPlayer(&player2, &p2Handle)
+
+	player1 = ggpo.NewRemotePlayer(20, 1, remoteIp, localPort)
+	player2 = ggpo.NewLocalPlayer(20, 2)
+	var p2handle1 ggpo.PlayerHandle
+	var p2handle2 ggpo.PlayerHandle
+	p2p2.AddPlayer(&player1, &p2handle1)
+	p2p2.AddPlayer(&player2, &p2handle2)
+
+	advance := func() int64 {
+		return time.Now().Add(time.Millisecond * 2000).UnixMilli()
+	}
+	for i := 0; i < protocol.NumSyncPackets; i++ {
+		p2p.Idle(0, advance)
+		p2p2.Idle(0, advance)
+	}
+	input1 := []byte{1, 2, 3, 4}
+	input2 := []byte{5, 6, 7, 8}
+
+	for i := 0; i < ggpo.ChecksumDistance+4; i++ {
+		p2p.Idle(0, advance)
+		p2p2.Idle(0, advance)
+		p2p.AddLocalInput(p1Handle, input1, 4)
+		p2p2.AddLocalInput(p2handle2, input2, 4)
+		p2p.AdvanceFrame(1)
+		p2p2.AdvanceFrame(2)
+	}
+
+	if len(session.reports) == 0 || len(session2.reports) == 0 {
+		t.Fatalf("Both peers should have gotten a desync report, got %d and %d", len(session.reports), len(session2.reports))
+	}
+	report := session.reports[0]
+	if report.Player != p2Handle {
+		t.Errorf("expected the report to come from player %d but it came from %d", p2Handle, report.Player)
+	}
+	if len(report.DiffFields) != 1 || report.DiffFields[0] != "bytes 2-2 differ" {
+		t.Errorf("expected only byte 2 to differ but got %v", report.DiffFields)
+	}
+	remote, err := os.ReadFile(report.RemoteStateFile)
+	if err != nil || !bytes.Equal(remote, session2.state) {
+		t.Errorf("expected the remote state %v to be written to disk but got %v (%v)", session2.state, remote, err)
+	}
+	if session2.reports[0].LocalStateFile != "" {
+		t.Errorf("A peer without a report directory shouldn't write anything.")
+	}
+}
+
+func TestP2PBackendDesyncMajorityVote(t *testing.T) {
+	localPort := 6000
+	remotePort := 6001
+	p3port := 6005
+	remoteIp := "127.2.1.1"
+	numPlayers := 3
+	inputSize := 4
+	ports := []int{localPort, remotePort, p3port}
+
+	sessions := make([]desyncSession, numPlayers)
+	peers := make([]ggpo.Peer, numPlayers)
+	for i := range peers {
+		sessions[i] = desyncSession{FakeSession: mocks.NewFakeSession()}
+		peers[i] = ggpo.NewPeer(&sessions[i], ports[i], numPlayers, inputSize)
+	}
+	connections := make([]mocks.FakeMultiplePeerConnection, numPlayers)
+	handles := make([]ggpo.PlayerHandle, numPlayers)
+	for i := range peers {
+		var others []transport.MessageHandler
+		for j := range peers {
+			if j != i {
+				others = append(others, &peers[j])
+			}
+		}
+		connections[i] = mocks.NewFakeMultiplePeerConnection(others, ports[i], remoteIp)
+		peers[i].InitializeConnection(&connections[i])
+		for j := range peers {
+			var player ggpo.Player
+			if j == i {
+				player = ggpo.NewLocalPlayer(20, j+1)
+			} else {
+				player = ggpo.NewRemotePlayer(20, j+1, remoteIp, ports[j])
+			}
+			var handle ggpo.PlayerHandle
+			peers[i].AddPlayer(&player, &handle)
+			if j == i {
+				handles[i] = handle
+			}
+		}
+	}
+
+	advance := func() int64 {
+		return time.Now().Add(time.Millisecond * 2000).UnixMilli()
+	}
+	for i := 0; i < protocol.NumSyncPackets; i++ {
+		for j := range peers {
+			peers[j].Idle(0, advance)
+		}
+	}
+	checksums := []uint32{7, 7, 9}
+	for i := 0; i < ggpo.ChecksumDistance+4; i++ {
+		for j := range peers {
+			peers[j].Idle(0, advance)
+			if peers[j].AddLocalInput(handles[j], []byte{1, 2, 3, 4}, 4) == nil {
+				peers[j].AdvanceFrame(checksums[j])
+			}
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if len(sessions[i].desyncs) == 0 {
+			t.Fatalf("Player %d should have seen player 3 desync.", i+1)
+		}
+		for _, info := range sessions[i].desyncs {
+			if info.Player != 3 {
+				t.Errorf("expected player %d to blame player 3 but it blamed %d", i+1, info.Player)
+			}
+			if len(info.MinorityPlayers) != 1 || info.MinorityPlayers[0] != 3 {
+				t.Errorf("expected player 3 to be the minority but got %v", info.MinorityPlayers)
+			}
+		}
+	}
+	if len(sessions[2].desyncs) == 0 {
+		t.Fatalf("Player 3 should have seen a desync.")
+	}
+	for _, info := range sessions[2].desyncs {
+		if len(info.MinorityPlayers) != 1 || info.MinorityPlayers[0] != handles[2] {
+			t.Errorf("expected player 3 to find itself in the minority but got %v", info.MinorityPlayers)
+		}
+	}
+}
+
+// Players 3 and 4 share the third peer's endpoint, so both are blamed for its checksum.
+func TestP2PBackendDesyncMajorityVoteSharedEndpoint(t *testing.T) {
+	remoteIp := "127.2.1.1"
+	numPlayers := 4
+	inputSize := 4
+	ports := []int{6000, 6001, 6005}
+	owners := []int{0, 1, 2, 2}
+
+	sessions := make([]desyncSession, len(ports))
+	peers := make([]ggpo.Peer, len(ports))
+	for i := range peers {
+		sessions[i] = desyncSession{FakeSession: mocks.NewFakeSession()}
+		peers[i] = ggpo.NewPeer(&sessions[i], ports[i], numPlayers, inputSize)
+	}
+	connections := make([]mocks.FakeMultiplePeerConnection, len(ports))
+	for i := range peers {
+		var others []transport.MessageHandler
+		for j := range peers {
+			if j != i {
+				others = append(others, &peers[j])
+			}
+		}
+		connections[i] = mocks.NewFakeMultiplePeerConnection(others, ports[i], remoteIp)
+		peers[i].InitializeConnection(&connections[i])
+		for num, owner := range owners {
+			player := ggpo.NewRemotePlayer(20, num+1, remoteIp, ports[owner])
+			if owner == i {
+				player = ggpo.NewLocalPlayer(20, num+1)
+			}
+			var handle ggpo.PlayerHandle
+			peers[i].AddPlayer(&player, &handle)
+		}
+	}
+
+	advance := func() int64 {
+		return time.Now().Add(time.Millisecond * 2000).UnixMilli()
+	}
+	for i := 0; i < protocol.NumSyncPackets; i++ {
+		for j := range peers {
+			peers[j].Idle(0, advance)
+		}
+	}
+	checksums := []uint32{7, 7, 9}
+	for i := 0; i < ggpo.ChecksumDistance+4; i++ {
+		for j := range peers {
+			peers[j].Idle(0, advance)
+			added := true
+			for num, owner := range owners {
+				if owner == j && peers[j].AddLocalInput(ggpo.PlayerHandle(num+1), []byte{1, 2, 3, 4}, 4) != nil {
+					added = false
+				}
+			}
+			if added {
+				peers[j].AdvanceFrame(checksums[j])
+			}
+		}
+	}
+
+	want := []ggpo.PlayerHandle{3, 4}
+	for i := range peers {
+		if len(sessions[i].desyncs) == 0 {
+			t.Fatalf("Peer %d should have seen a desync.", i+1)
+		}
+		for _, info := range sessions[i].desyncs {
+			if len(info.MinorityPlayers) != len(want) || info.MinorityPlayers[0] != want[0] || info.MinorityPlayers[1] != want[1] {
+				t.Errorf("expected peer %d to see players %v in the minority but got %v", i+1, want, info.MinorityPlayers)
+			}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		blamed := map[ggpo.PlayerHandle]int{}
+		for _, info := range sessions[i].desyncs {
+			blamed[info.Player]++
+		}
+		if len(blamed) != 2 || blamed[3] == 0 || blamed[3] != blamed[4] {
+			t.Errorf("expected peer %d to blame players 3 and 4 alike, got %v", i+1, blamed)
+		}
+	}
+}
+
+// A game whose whole state is a byte slice that never changes on its own, so
+// only a resync can bring two diverged peers back together.
+type resyncSession struct {
+	desyncSession
+	backend *ggpo.Peer
+	saves   map[int][]byte
+	resyncs []ggpo.Event
+}
+
+func (r *resyncSession) SaveGameState(stateID int) int {
+	r.saves[stateID] = r.SerializeGameState()
+	return int(ggpo.Checksum(r.state))
+}
+
+func (r *resyncSession) LoadGameState(stateID int) {
+	r.state = r.saves[stateID]
+}
+
+func (r *resyncSession) DeserializeGameState(state []byte) {
+	r.state = append([]byte(nil), state...)
+}
+
+func (r *resyncSession) AdvanceFrame(flags int) {
+	var disconnectFlags int
+	_, err := r.backend.SyncInput(&disconnectFlags)
+	if err == nil {
+		r.backend.AdvanceFrame(ggpo.Checksum(r.state))
+	}
+}
+
+func (r *resyncSession) OnEvent(info *ggpo.Event) {
+	if info.Code == ggpo.EventCodeResynchronized {
+		r.resyncs = append(r.resyncs, *info)
+	}
+	r.desyncSession.OnEvent(info)
+}
+
+// Loses the desync report chunks sent to a peer while lose is set.
+type reportDropper struct {
+	*ggpo.Peer
+	lose bool
+}
+
+func (r *reportDropper) HandleMessage(ipAddress string, port int, msg messages.UDPMessage, length int) {
+	if _, ok := msg.(*messages.DesyncReportPacket); ok && r.lose {
+		return
+	}
+	r.Peer.HandleMessage(ipAddress, port, msg, length)
+}
+
+/*
+How runDesyncPolicy sets up its two peers. Both resync from player 1 unless
+authorities says otherwise, and player 2 loses every desync report chunk sent
+to it during the first lostReportFrames frames.
+*/
+type desyncPolicyRun struct {
+	policy           ggpo.DesyncPolicy
+	frames           int
+	authorities      []ggpo.PlayerHandle
+	lostReportFrames int
+}
+
+func runDesyncPolicy(t *testing.T, run desyncPolicyRun) ([]resyncSession, []error) {
+	localPort := 6000
+	remotePort := 6001
+	remoteIp := "127.2.1.1"
+	numPlayers := 2
+	inputSize := 4
+	ports := []int{localPort, remotePort}
+
+	sessions := []resyncSession{
+		{desyncSession: desyncSession{state: []byte{1, 2, 3, 4}}, saves: make(map[int][]byte)},
+		{desyncSession: desyncSession{state: []byte{1, 2, 9, 4}}, saves: make(map[int][]byte)},
+	}
+	peers := make([]ggpo.Peer, numPlayers)
+	for i := range peers {
+		peers[i] = ggpo.NewPeer(&sessions[i], ports[i], numPlayers, inputSize)
+		sessions[i].backend = &peers[i]
+	}
+	dropper := reportDropper{Peer: &peers[1]}
+	connection := mocks.NewFakeP2PConnection(&dropper, localPort, remoteIp)
+	connection2 := mocks.NewFakeP2PConnection(&peers[0], remotePort, remoteIp)
+	peers[0].InitializeConnection(&connection)
+	peers[1].InitializeConnection(&connection2)
+
+	handles := make([]ggpo.PlayerHandle, numPlayers)
+	for i := range peers {
+		for j := range peers {
+			var player ggpo.Player
+			if j == i {
+				player = ggpo.NewLocalPlayer(20, j+1)
+			} else {
+				player = ggpo.NewRemotePlayer(20, j+1, remoteIp, ports[j])
+			}
+			var handle ggpo.PlayerHandle
+			peers[i].AddPlayer(&player, &handle)
+			if j == i {
+				handles[i] = handle
+			}
+		}
+		authority := handles[0]
+		if run.authorities != nil {
+			authority = run.authorities[i]
+		}
+		err := peers[i].SetDesyncPolicy(run.policy, authority)
+		if err != nil {
+			t.Fatalf("Error when setting the desync policy %s", err)
+		}
+	}
+
+	advance := func() int64 {
+		return time.Now().Add(time.Millisecond * 2000).UnixMilli()
+	}
+	for i := 0; i < protocol.NumSyncPackets; i++ {
+		peers[0].Idle(0, advance)
+		peers[1].Idle(0, advance)
+	}
+	errs := make([]error, numPlayers)
+	for i := 0; i < run.frames; i++ {
+		dropper.lose = i < run.lostReportFrames
+		for j := range peers {
+			peers[j].Idle(0, advance)
+			errs[j] = peers[j].AddLocalInput(handles[j], []byte{1, 2, 3, 4}, 4)
+			if errs[j] == nil {
+				sessions[j].AdvanceFrame(0)
+			}
+		}
+	}
+	return sessions, errs
+}
+
+func TestP2PBackendDesyncPolicyIgnore(t *testing.T) {
+	sessions, _ := runDesyncPolicy(t, desyncPolicyRun{policy: ggpo.DesyncPolicyIgnore, frames: ggpo.ChecksumDistance + 4})
+	if len(sessions[0].desyncs) != 0 || len(sessions[1].desyncs) != 0 {
+		t.Errorf("Ignored desyncs shouldn't raise events.")
+	}
+}
+
+func TestP2PBackendDesyncPolicyHalt(t *testing.T) {
+	sessions, errs := runDesyncPolicy(t, desyncPolicyRun{policy: ggpo.DesyncPolicyHalt, frames: ggpo.ChecksumDistance + 4})
+	if len(sessions[0].desyncs) == 0 {
+		t.Errorf("The desync should still be raised before halting.")
+	}
+	for i, err := range errs {
+		ggpoErr, ok := err.(ggpo.Error)
+		if !ok || ggpoErr.Code != ggpo.ErrorCodeDesynchronized {
+			t.Errorf("expected peer %d to be halted with ErrorCodeDesynchronized but got %v", i+1, err)
+		}
+	}
+}
+
+func TestP2PBackendDesyncPolicyResync(t *testing.T) {
+	sessions, errs := runDesyncPolicy(t, desyncPolicyRun{policy: ggpo.DesyncPolicyResync, frames: 3 * ggpo.ChecksumDistance})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Peer %d should keep running after a resync, got %s", i+1, err)
+		}
+	}
+	if len(sessions[1].resyncs) == 0 {
+		t.Fatalf("Player 2 should have taken over the authority's state.")
+	}
+	if len(sessions[0].resyncs) != 0 {
+		t.Errorf("The authority should never resync.")
+	}
+	if !bytes.Equal(sessions[0].state, sessions[1].state) {
+		t.Errorf("expected both states to be %v after resyncing but player 2 has %v", sessions[0].state, sessions[1].state)
+	}
+	desyncs := len(sessions[1].desyncs)
+	last := sessions[1].desyncs[desyncs-1].NumFrameOfDesync
+	if last >= sessions[1].resyncs[0].Frame+ggpo.ChecksumDistance+ggpo.MaxPredictionFrames {
+		t.Errorf("The peers should stop desyncing soon after the resync at frame %d, the last desync was at %d", sessions[1].resyncs[0].Frame, last)
+	}
+}
+
+// Player 2 keeps sending checksums from its desynced state until the late
+// report arrives, which the authority mustn't take for new desyncs.
+func TestP2PBackendDesyncPolicyResyncLateReport(t *testing.T) {
+	sessions, errs := runDesyncPolicy(t, desyncPolicyRun{
+		policy:           ggpo.DesyncPolicyResync,
+		frames:           6 * ggpo.ChecksumDistance,
+		lostReportFrames: 40,
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Peer %d should keep running after a resync, got %s", i+1, err)
+		}
+	}
+	if len(sessions[1].resyncs) == 0 || !bytes.Equal(sessions[0].state, sessions[1].state) {
+		t.Fatalf("expected player 2 to resync once the report got through, got state %v", sessions[1].state)
+	}
+	desyncs := sessions[0].desyncs
+	for _, info := range desyncs[1:] {
+		if info.NumFrameOfDesync < desyncs[0].NumFrameOfDesync+ggpo.ChecksumDistance {
+			t.Errorf("expected the authority to ignore player 2's stale checksums after serving the resync for frame %d, got a desync at frame %d",
+				desyncs[0].NumFrameOfDesync, info.NumFrameOfDesync)
+		}
+	}
+}
+
+func TestP2PBackendDesyncPolicyMismatchedAuthority(t *testing.T) {
+	sessions, errs := runDesyncPolicy(t, desyncPolicyRun{
+		policy:      ggpo.DesyncPolicyResync,
+		frames:      10,
+		authorities: []ggpo.PlayerHandle{1, 2},
+	})
+	for i := range sessions {
+		if !hasErrorCode(errs[i], ggpo.ErrorCodeNotSynchronized) {
+			t.Errorf("expected peer %d not to start running, got %v", i+1, errs[i])
+		}
+		if len(sessions[i].mismatched) != 1 || sessions[i].mismatched[0].Player != ggpo.PlayerHandle(2-i) {
+			t.Errorf("expected peer %d to raise the mismatch once, got %v", i+1, sessions[i].mismatched)
+		}
+	}
+}
+
+func TestP2PBackendSetDesyncPolicy(t *testing.T) {
+	session := mocks.NewFakeSession()
+	p2p := ggpo.NewPeer(&session, 6000, 2, 4)
+	err := p2p.SetDesyncPolicy(ggpo.DesyncPolicyResync, 1)
+	if err == nil {
+		t.Errorf("Resyncing without a StateSerializer and StateDeserializer should be an error.")
+	}
+	err = p2p.SetDesyncPolicy(ggpo.DesyncPolicyHalt, 0)
+	if err != nil {
+		t.Errorf("Error when setting the desync policy %s", err)
+	}
+	err = p2p.SetChecksumDistance(ggpo.MaxChecksumDistance + 1)
+	if err == nil {
+		t.Errorf("A checksum distance over MaxChecksumDistance should be an error.")
+	}
+	err = p2p.SetChecksumDistance(ggpo.MaxPredictionFrames)
+	if err == nil {
+		t.Errorf("A checksum distance not over the prediction window should be an error.")
+	}
+	err = p2p.SetChecksumDistance(ggpo.MaxPredictionFrames + 1)
+	if err != nil {
+		t.Errorf("Error when setting the checksum distance %s", err)
+	}
+	err = p2p.SetChecksumInterval(0)
+	if err == nil {
+		t.Errorf("A checksum interval under 1 frame should be an error.")
+	}
+}
+
+type inputDelaySession struct {
+	mocks.FakeSession
+	running bool
+	delays  []int
+	// the frame each delay took effect on
+	frames []int
+}
+
+func (s *inputDelaySession) OnEvent(info *ggpo.Event) {
+	switch info.Code {
+	case ggpo.EventCodeRunning:
+		s.running = true
+	case ggpo.EventCodeInputDelayAgreed:
+		s.delays = append(s.delays, info.InputDelay)
+		s.frames = append(s.frames, info.Frame)
+	}
+}
+
+// Two peers with one local player each, auto input delay enabled as given.
+func newInputDelayPeers(auto ...bool) ([]*ggpo.Peer, []*inputDelaySession, []ggpo.PlayerHandle) {
+	return newInputDelayPeersVia(func(i int, peer *ggpo.Peer) transport.MessageHandler { return peer }, auto...)
+}
+
+// Like newInputDelayPeers, with what each peer receives passed through inbound.
+func newInputDelayPeersVia(inbound func(int, *ggpo.Peer) transport.MessageHandler, auto ...bool) ([]*ggpo.Peer, []*inputDelaySession, []ggpo.PlayerHandle) {
+	localPort := 6000
+	remotePort := 6001
+	remoteIp := "127.2.1.1"
+	sessions := []*inputDelaySession{
+		{FakeSession: mocks.NewFakeSession()},
+		{FakeSession: mocks.NewFakeSession()},
+	}
+	p2p := ggpo.NewPeer(sessions[0], localPort, 2, 4)
+	p2p2 := ggpo.NewPeer(sessions[1], remotePort, 2, 4)
+	connection := mocks.NewFakeP2PConnection(inbound(1, &p2p2), localPort, remoteIp)
+	connection2 := mocks.NewFakeP2PConnection(inbound(0, &p2p), remotePort, remoteIp)
+	p2p.InitializeConnection(&connection)
+	p2p2.InitializeConnection(&connection2)
+	p2p.SetAutoInputDelay(auto[0])
+	p2p2.SetAutoInputDelay(auto[1])
+
+	player1 := ggpo.NewLocalPlayer(20, 1)
+	player2 := ggpo.NewRemotePlayer(20, 2, remoteIp, remotePort)
+	var p1Handle, p2Handle ggpo.PlayerHandle
+	p2p.AddPlayer(&player1, &p1Handle)
+	p2p.AddPlayer(&player2, &p2Handle)
+
+	player1 = ggpo.NewRemotePlayer(20, 1, remoteIp, localPort)
+	player2 = ggpo.NewLocalPlayer(20, 2)
+	var p2handle1, p2handle2 ggpo.PlayerHandle
+	p2p2.AddPlayer(&player1, &p2handle1)
+	p2p2.AddPlayer(&player2, &p2handle2)
+	return []*ggpo.Peer{&p2p, &p2p2}, sessions, []ggpo.PlayerHandle{p1Handle, p2handle2}
+}
+
+// Proposals sent before the other side finished synchronizing are dropped, so
+// time has to pass for them to be resent.
+func idleUntilRunning(peers []*ggpo.Peer, sessions []*inputDelaySession) {
+	advance := func() int64 {
+		return time.Now().Add(time.Millisecond * 2000).UnixMilli()
+	}
+	for i := 0; i < 20 && !(sessions[0].running && sessions[1].running); i++ {
+		peers[0].Idle(0, advance)
+		peers[1].Idle(0, advance)
+	}
+}
+
+func TestP2PBackendAutoInputDelay(t *testing.T) {
+	peers, sessions, _ := newInputDelayPeers(true, true)
+	idleUntilRunning(peers, sessions)
+	for i, session := range sessions {
+		if !session.running {
+			t.Fatalf("Peer %d should be running once the input delay is agreed.", i+1)
+		}
+		if len(session.delays) != 1 {
+			t.Fatalf("expected peer %d to agree on an input delay once, got %v", i+1, session.delays)
+		}
+	}
+	if sessions[0].delays[0] != sessions[1].delays[0] {
+		t.Errorf("expected both peers to agree on the same input delay, got %d and %d", sessions[0].delays[0], sessions[1].delays[0])
+	}
+
+	err := peers[0].SetAutoInputDelay(false)
+	if err == nil {
+		t.Errorf("Changing auto input delay after synchronizing should be an error.")
+	}
+}
+
+// Makes every connection quality report the peer gets back look lag ms late.
+type laggedReplies struct {
+	*ggpo.Peer
+	lag uint64
+}
+
+func (l *laggedReplies) HandleMessage(ipAddress string, port int, msg messages.UDPMessage, length int) {
+	if reply, ok := msg.(*messages.QualityReplyPacket); ok {
+		reply.Pong -= l.lag
+	}
+	l.Peer.HandleMessage(ipAddress, port, msg, length)
+}
+
+func TestP2PBackendAutoInputDelayRevised(t *testing.T) {
+	peers, sessions, handles := newInputDelayPeersVia(func(i int, peer *ggpo.Peer) transport.MessageHandler {
+		if i == 0 {
+			return &laggedReplies{Peer: peer, lag: 180}
+		}
+		return peer
+	}, true, true)
+	idleUntilRunning(peers, sessions)
+	if len(sessions[1].delays) != 1 || sessions[1].delays[0] != 0 {
+		t.Fatalf("expected the handshake to agree on no input delay, got %v", sessions[1].delays)
+	}
+
+	// The first peer's quality reports say the link got slower, so it proposes
+	// a longer delay for its player on the first revision.
+	want := protocol.InputDelayForRoundTrip(180)
+	for frame := 0; frame < 2*ggpo.FrameDelayChangeLead; frame++ {
+		for i, peer := range peers {
+			peer.Idle(0)
+			err := peer.AddLocalInput(handles[i], []byte{byte(frame), 0, 0, 0}, 4)
+			if err != nil {
+				t.Fatalf("Error when adding input for frame %d on peer %d: %s", frame, i+1, err)
+			}
+		}
+		for _, peer := range peers {
+			peer.Idle(0)
+			var disconnectFlags int
+			peer.SyncInput(&disconnectFlags)
+			peer.AdvanceFrame(ggpo.DefaultChecksum)
+		}
+	}
+
+	if len(sessions[1].delays) != 2 || sessions[1].delays[1] != want {
+		t.Fatalf("expected the second peer to hear of a delay of %d, got %v", want, sessions[1].delays)
+	}
+	for i, peer := range peers {
+		status, _ := peer.GetPlayerStatus(handles[0])
+		if status.InputDelay != want {
+			t.Errorf("expected peer %d to report player 1's delay as %d, got %d", i+1, want, status.InputDelay)
+		}
+		status, _ = peer.GetPlayerStatus(handles[1])
+		if status.InputDelay != 0 {
+			t.Errorf("expected peer %d to report player 2's delay as 0, got %d", i+1, status.InputDelay)
+		}
+	}
+}
+
+func TestP2PBackendAutoInputDelayOverride(t *testing.T) {
+	peers, sessions, handles := newInputDelayPeers(true, false)
+	// The second peer sticks to a fixed delay, which the first one has to match.
+	peers[1].SetFrameDelay(handles[1], 3)
+	idleUntilRunning(peers, sessions)
+	if !sessions[0].running || !sessions[1].running {
+		t.Fatalf("Both peers should be running.")
+	}
+	if len(sessions[0].delays) != 1 || sessions[0].delays[0] != 3 {
+		t.Errorf("expected the auto peer to agree on the fixed peer's delay of 3 but got %v", sessions[0].delays)
+	}
+	if len(sessions[1].delays) != 0 {
+		t.Errorf("A peer with a fixed delay shouldn't raise input delay events.")
+	}
+}
+
+func TestP2PBackendFrameDelayChange(t *testing.T) {
+	peers, sessions, handles := newInputDelayPeers(false, false)
+	idleUntilRunning(peers, sessions)
+
+	frames := 60
+	// every player's input on each frame, by peer
+	values := make([][][][]byte, len(peers))
+	for frame := 0; frame < frames; frame++ {
+		if frame == 5 {
+			err := peers[0].SetFrameDelay(handles[0], 3)
+			if err != nil {
+				t.Fatalf("Error when changing the frame delay %s", err)
+			}
+		}
+		for i, peer := range peers {
+			peer.Idle(0)
+			err := peer.AddLocalInput(handles[i], []byte{byte(frame), 0, 0, 0}, 4)
+			if err != nil {
+				t.Fatalf("Error when adding input for frame %d on peer %d: %s", frame, i+1, err)
+			}
+		}
+		for i, peer := range peers {
+			peer.Idle(0)
+			var disconnectFlags int
+			vals, err := peer.SyncInput(&disconnectFlags)
+			if err != nil {
+				t.Fatalf("Error when synchronizing input for frame %d on peer %d: %s", frame, i+1, err)
+			}
+			values[i] = append(values[i], vals)
+			peer.AdvanceFrame(ggpo.DefaultChecksum)
+		}
+	}
+
+	change := 5 + ggpo.FrameDelayChangeLead
+	if len(sessions[1].delays) != 1 {
+		t.Fatalf("expected the second peer to hear about the change once, got %v", sessions[1].delays)
+	}
+	for frame := 0; frame < frames; frame++ {
+		// The frames skipped by growing the delay repeat the last input before it.
+		want := frame
+		if frame >= change+3 {
+			want = frame - 3
+		} else if frame >= change {
+			want = change - 1
+		}
+		for i := range peers {
+			if int(values[i][frame][0][0]) != want {
+				t.Fatalf("expected peer %d to see input %d for player 1 on frame %d but got %d", i+1, want, frame, values[i][frame][0][0])
+			}
+			// only the player it was set for changes
+			if int(values[i][frame][1][0]) != frame {
+				t.Fatalf("expected peer %d to see input %d for player 2 on frame %d but got %d", i+1, frame, frame, values[i][frame][1][0])
+			}
+		}
+	}
+	status, _ := peers[1].GetPlayerStatus(handles[0])
+	if status.InputDelay != 3 {
+		t.Errorf("expected the second peer to report player 1's delay as 3, got %d", status.InputDelay)
+	}
+	status, _ = peers[1].GetPlayerStatus(handles[1])
+	if status.InputDelay != 0 {
+		t.Errorf("expected player 2 to keep a delay of 0, got %d", status.InputDelay)
+	}
+	if peers[0].SetFrameDelay(handles[1], 1) == nil {
+		t.Errorf("Changing a remote player's delay mid-match should be an error.")
+	}
+}
+
+func TestP2PBackendFrameDelayChangeBackToBack(t *testing.T) {
+	peers, sessions, handles := newInputDelayPeers(false, false)
+	idleUntilRunning(peers, sessions)
+
+	frames := 60
+	values := make([][][][]byte, len(peers))
+	for frame := 0; frame < frames; frame++ {
+		if frame == 5 {
+			// the second change can't share the first one's frame, so it follows it
+			err := peers[0].SetFrameDelay(handles[0], 3)
+			if err != nil {
+				t.Fatalf("Error when changing the frame delay %s", err)
+			}
+			err = peers[0].SetFrameDelay(handles[0], 1)
+			if err != nil {
+				t.Fatalf("Error when changing the frame delay again %s", err)
+			}
+		}
+		for i, peer := range peers {
+			peer.Idle(0)
+			err := peer.AddLocalInput(handles[i], []byte{byte(frame), 0, 0, 0}, 4)
+			if err != nil {
+				t.Fatalf("Error when adding input for frame %d on peer %d: %s", frame, i+1, err)
+			}
+		}
+		for i, peer := range peers {
+			peer.Idle(0)
+			var disconnectFlags int
+			vals, err := peer.SyncInput(&disconnectFlags)
+			if err != nil {
+				t.Fatalf("Error when synchronizing input for frame %d on peer %d: %s", frame, i+1, err)
+			}
+			values[i] = append(values[i], vals)
+			peer.AdvanceFrame(ggpo.DefaultChecksum)
+		}
+	}
+
+	change := 5 + ggpo.FrameDelayChangeLead
+	if len(sessions[1].delays) != 2 || sessions[1].delays[0] != 3 || sessions[1].delays[1] != 1 {
+		t.Fatalf("expected the second peer to hear about both changes in order, got %v", sessions[1].delays)
+	}
+	for frame := 0; frame < frames; frame++ {
+		// Growing to 3 repeats the input before the change, then shrinking to 1
+		// a frame later drops the two inputs that would land on queued frames.
+		want := frame
+		switch {
+		case frame >= change+4:
+			want = frame - 1
+		case frame == change+3:
+			want = change
+		case frame >= change:
+			want = change - 1
+		}
+		for i := range peers {
+			if int(values[i][frame][0][0]) != want {
+				t.Fatalf("expected peer %d to see input %d for player 1 on frame %d but got %d", i+1, want, frame, values[i][frame][0][0])
+			}
+		}
+	}
+	for i, peer := range peers {
+		status, _ := peer.GetPlayerStatus(handles[0])
+		if status.InputDelay != 1 {
+			t.Errorf("expected peer %d to report player 1's delay as 1, got %d", i+1, status.InputDelay)
+		}
+	}
+}
+
+// Loses every input delay change sent to the peer for frame lose.
+type delayChangeDropper struct {
+	*ggpo.Peer
+	lose int
+}
+
+func (d *delayChangeDropper) HandleMessage(ipAddress string, port int, msg messages.UDPMessage, length int) {
+	if change, ok := msg.(*messages.InputDelayChangePacket); ok && int(change.Frame) == d.lose {
+		return
+	}
+	d.Peer.HandleMessage(ipAddress, port, msg, length)
+}
+
+func TestP2PBackendFrameDelayChangeUnacked(t *testing.T) {
+	var dropper delayChangeDropper
+	peers, sessions, handles := newInputDelayPeersVia(func(i int, peer *ggpo.Peer) transport.MessageHandler {
+		if i == 0 {
+			return peer
+		}
+		dropper.Peer = peer
+		return &dropper
+	}, false, false)
+	idleUntilRunning(peers, sessions)
+
+	// The proposal for frame 35 never arrives, so it's only committed once
+	// it's been proposed again FrameDelayChangeLead frames on.
+	first := 5 + ggpo.FrameDelayChangeLead
+	change := first + ggpo.FrameDelayChangeLead
+	dropper.lose = first
+	frames := change + 20
+	values := make([][][][]byte, len(peers))
+	for frame := 0; frame < frames; frame++ {
+		if frame == 5 {
+			err := peers[0].SetFrameDelay(handles[0], 3)
+			if err != nil {
+				t.Fatalf("Error when changing the frame delay %s", err)
+			}
+		}
+		for i, peer := range peers {
+			peer.Idle(0)
+			err := peer.AddLocalInput(handles[i], []byte{byte(frame), 0, 0, 0}, 4)
+			if err != nil {
+				t.Fatalf("Error when adding input for frame %d on peer %d: %s", frame, i+1, err)
+			}
+		}
+		for i, peer := range peers {
+			peer.Idle(0)
+			var disconnectFlags int
+			vals, err := peer.SyncInput(&disconnectFlags)
+			if err != nil {
+				t.Fatalf("Error when synchronizing input for frame %d on peer %d: %s", frame, i+1, err)
+			}
+			values[i] = append(values[i], vals)
+			peer.AdvanceFrame(ggpo.DefaultChecksum)
+		}
+	}
+
+	if len(sessions[1].delays) != 1 || sessions[1].frames[0] != change {
+		t.Fatalf("expected the second peer to hear about the change for frame %d once, got %v at %v", change, sessions[1].delays, sessions[1].frames)
+	}
+	for frame := 0; frame < frames; frame++ {
+		want := frame
+		if frame >= change+3 {
+			want = frame - 3
+		} else if frame >= change {
+			want = change - 1
+		}
+		for i := range peers {
+			if int(values[i][frame][0][0]) != want {
+				t.Fatalf("expected peer %d to see input %d for player 1 on frame %d but got %d", i+1, want, frame, values[i][frame][0][0])
+			}
+		}
+	}
+}
+
+func TestP2PBackendGetPlayerStatus(t *testing.T) {
+	peers, sessions, handles := newInputDelayPeers(false, false)
+	remote := ggpo.PlayerHandle(2)
+	peers[0].SetFrameDelay(handles[0], 2)
+	peers[0].SetDisconnectTimeout(3000)
+
+	status, err := peers[0].GetPlayerStatus(handles[0])
+	if err != nil {
+		t.Fatalf("Error when getting the player status %s", err)
+	}
+	if !status.Local || status.State != ggpo.PlayerStateSynchronizing {
+		t.Errorf("expected a synchronizing local player but got %#v", status)
+	}
+
+	idleUntilRunning(peers, sessions)
+	for frame := 0; frame < 5; frame++ {
+		for i, peer := range peers {
+			peer.Idle(0)
+			peer.AddLocalInput(handles[i], []byte{1, 2, 3, 4}, 4)
+			peer.AdvanceFrame(ggpo.DefaultChecksum)
+		}
+	}
+	peers[0].Idle(0)
+
+	status, _ = peers[0].GetPlayerStatus(handles[0])
+	if status.State != ggpo.PlayerStateRunning || status.InputDelay != 2 || status.FramesUntilDisconnect != -1 {
+		t.Errorf("expected a running local player with 2 frames of delay but got %#v", status)
+	}
+	if status.LastConfirmedFrame != 6 {
+		t.Errorf("expected the local player to be confirmed up to frame 6 but got %d", status.LastConfirmedFrame)
+	}
+	status, _ = peers[0].GetPlayerStatus(remote)
+	if status.Local || status.State != ggpo.PlayerStateRunning || status.LastConfirmedFrame != 4 {
+		t.Errorf("expected a running remote player confirmed up to frame 4 but got %#v", status)
+	}
+	maxFrames := ggpo.FramesFromDuration(3000 * time.Millisecond)
+	if status.FramesUntilDisconnect <= 0 || status.FramesUntilDisconnect > maxFrames {
+		t.Errorf("expected the remote player to time out within %d frames but got %d", maxFrames, status.FramesUntilDisconnect)
+	}
+
+	peers[0].DisconnectPlayer(remote)
+	status, _ = peers[0].GetPlayerStatus(remote)
+	if status.State != ggpo.PlayerStateDisconnected {
+		t.Errorf("expected the remote player to be disconnected but got %#v", status)
+	}
+	_, err = peers[0].GetPlayerStatus(3)
+	if err == nil {
+		t.Errorf("Getting the status of an invalid handle should be an error.")
+	}
+}
+
+// Keeps a running total of each player's input, so states only match when
+// every peer simulated the same inputs.
+type meshSession struct {
+	backend      ggpo.Backend
+	totals       []int
+	frame        int
+	saves        map[int][]int
+	running      bool
+	desyncs      int
+	lastDesync   ggpo.Event
+	disconnected []ggpo.PlayerHandle
+	// reports every checksum as 0, like a game that drifted off to a zero state
+	zeroChecksums bool
+}
+
+func (m *meshSession) SaveGameState(stateID int) int {
+	m.saves[stateID] = append([]int{m.frame}, m.totals...)
+	return m.checksum()
+}
+
+func (m *meshSession) LoadGameState(stateID int) {
+	m.frame = m.saves[stateID][0]
+	m.totals = append([]int(nil), m.saves[stateID][1:]...)
+}
+
+func (m *meshSession) AdvanceFrame(flags int) {
+	m.step()
+}
+
+func (m *meshSession) OnEvent(info *ggpo.Event) {
+	switch info.Code {
+	case ggpo.EventCodeRunning:
+		m.running = true
+	case ggpo.EventCodeDesync:
+		m.desyncs++
+		m.lastDesync = *info
+	case ggpo.EventCodeDisconnectedFromPeer:
+		m.disconnected = append(m.disconnected, info.Player)
+	}
+}
+
+func (m *meshSession) step() error {
+	var disconnectFlags int
+	inputs, err := m.backend.SyncInput(&disconnectFlags)
+	if err != nil {
+		return err
+	}
+	for i, in := range inputs {
+		if disconnectFlags&(1<<i) == 0 {
+			m.totals[i] += int(in[0])*(m.frame+1) + 1
+		}
+	}
+	m.frame++
+	if m.zeroChecksums {
+		return m.backend.AdvanceFrame(0)
+	}
+	return m.backend.AdvanceFrame(uint32(m.checksum()))
+}
+
+func (m *meshSession) checksum() int {
+	sum := m.frame
+	for i, total := range m.totals {
+		sum = sum*31 + total*(i+1)
+	}
+	return sum
+}
+
+// A backend under test that can sit on a FakeMesh.
+type meshBackend interface {
+	ggpo.Backend
+	transport.MessageHandler
+}
+
+// Anything else on the mesh that has to be idled, like a relay server.
+type meshIdler interface {
+	Idle(timeout int, timeFunc ...polling.FuncTimeType) error
+}
+
+/*
+Backends connected on a FakeMesh, one per port, with the player numbers in
+locals[i] local to backend i and every other player remote at the backend it's
+local to. Each player presses a different button every frame, see meshInput.
+*/
+type meshFixture struct {
+	mesh     *mocks.FakeMesh
+	ip       string
+	ports    []int
+	locals   [][]int
+	backends []meshBackend
+	sessions []*meshSession
+}
+
+/*
+Makes a backend for each port with newBackend and adds numPlayers players to
+it. Anything else on the mesh, like a relay server, can be set up before
+calling waitUntilRunning.
+*/
+func newMeshFixture(t *testing.T, ports []int, locals [][]int, numPlayers int, newBackend func(session *meshSession, port int) meshBackend) *meshFixture {
+	f := &meshFixture{mesh: mocks.NewFakeMesh(), ip: "127.2.1.1", ports: ports, locals: locals}
+	for _, port := range ports {
+		session := &meshSession{totals: make([]int, numPlayers), saves: make(map[int][]int)}
+		backend := newBackend(session, port)
+		session.backend = backend
+		connection := f.mesh.Connect(backend, port, f.ip)
+		backend.InitializeConnection(&connection)
+		f.backends = append(f.backends, backend)
+		f.sessions = append(f.sessions, session)
+	}
+	for i, backend := range f.backends {
+		for num := 1; num <= numPlayers; num++ {
+			owner := f.owner(num)
+			player := ggpo.NewRemotePlayer(20, num, f.ip, f.ports[owner])
+			if owner == i {
+				player = ggpo.NewLocalPlayer(20, num)
+			}
+			var handle ggpo.PlayerHandle
+			err := backend.AddPlayer(&player, &handle)
+			if err != nil {
+				t.Fatalf("Error when adding player %d to backend %d: %s", num, i+1, err)
+			}
+		}
+		backend.Start()
+	}
+	return f
+}
+
+// The backend player num is local to.
+func (f *meshFixture) owner(num int) int {
+	for i, locals := range f.locals {
+		for _, local := range locals {
+			if local == num {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+/*
+Idles the backends, and others with them, until every session is running and
+ready, if given, agrees.
+*/
+func (f *meshFixture) waitUntilRunning(t *testing.T, ready func() bool, others ...meshIdler) {
+	advance := func() int64 {
+		return time.Now().Add(time.Millisecond * 2000).UnixMilli()
+	}
+	done := func() bool {
+		return f.allRunning() && (ready == nil || ready())
+	}
+	for i := 0; i < 4*protocol.NumSyncPackets && !done(); i++ {
+		for _, other := range others {
+			other.Idle(0, advance)
+		}
+		for _, backend := range f.backends {
+			backend.Idle(0, advance)
+		}
+	}
+	if !done() {
+		t.Fatalf("All %d backends should be running.", len(f.backends))
+	}
+}
+
+func (f *meshFixture) allRunning() bool {
+	for _, session := range f.sessions {
+		if !session.running {
+			return false
+		}
+	}
+	return true
+}
+
+func meshInput(frame int, num int) []byte {
+	return []byte{byte(frame*num + num - 1), 0, 0, 0}
+}
+
+// Runs a frame on every backend that's still connected.
+func (f *meshFixture) advance(t *testing.T, frame int, skip map[int]bool) {
+	for i, backend := range f.backends {
+		if skip[i] {
+			continue
+		}
+		backend.Idle(0)
+		for _, num := range f.locals[i] {
+			err := backend.AddLocalInput(ggpo.PlayerHandle(num), meshInput(frame, num), 4)
+			if err != nil {
+				t.Fatalf("Error when adding input for player %d on frame %d: %s", num, frame, err)
+			}
+		}
+		err := f.sessions[i].step()
+		if err != nil {
+			t.Fatalf("Error when advancing backend %d on frame %d: %s", i+1, frame, err)
+		}
+	}
+}
+
+// Idles the backends until they've caught up on each other's inputs and rolled
+// back where they guessed wrong, then compares their states.
+func (f *meshFixture) checkStates(t *testing.T, skip map[int]bool, others ...meshIdler) {
+	for j := 0; j < 3; j++ {
+		for _, other := range others {
+			other.Idle(0)
+		}
+		for i, backend := range f.backends {
+			if !skip[i] {
+				backend.Idle(0)
+			}
+		}
+	}
+	first := -1
+	for i, session := range f.sessions {
+		if skip[i] {
+			continue
+		}
+		if session.desyncs > 0 {
+			t.Errorf("Backend %d saw %d desyncs.", i+1, session.desyncs)
+		}
+		if first < 0 {
+			first = i
+			continue
+		}
+		if session.checksum() != f.sessions[first].checksum() {
+			t.Errorf("expected backend %d to have the same state as backend %d, got %v at frame %d and %v at frame %d",
+				i+1, first+1, session.totals, session.frame, f.sessions[first].totals, f.sessions[first].frame)
+		}
+	}
+}
+
+// A full mesh of n peers with player i+1 local to peer i.
+type meshTest struct {
+	*meshFixture
+	peers []*ggpo.Peer
+}
+
+func newMeshTest(t *testing.T, n int) *meshTest {
+	m := &meshTest{}
+	var ports []int
+	var locals [][]int
+	for i := 0; i < n; i++ {
+		ports = append(ports, 7000+i)
+		locals = append(locals, []int{i + 1})
+	}
+	m.meshFixture = newMeshFixture(t, ports, locals, n, func(session *meshSession, port int) meshBackend {
+		peer := ggpo.NewPeer(session, port, n, 4)
+		m.peers = append(m.peers, &peer)
+		return &peer
+	})
+	m.waitUntilRunning(t, nil)
+	return m
+}
+
+func TestP2PBackendMesh(t *testing.T) {
+	for _, n := range []int{3, 4, ggpo.MaxPlayers} {
+		t.Run(fmt.Sprintf("%d players", n), func(t *testing.T) {
+			m := newMeshTest(t, n)
+			for frame := 0; frame < 100; frame++ {
+				m.advance(t, frame, nil)
+			}
+			m.checkStates(t, nil)
+		})
+	}
+}
+
+func TestP2PBackendMeshDisconnect(t *testing.T) {
+	m := newMeshTest(t, 4)
+	for frame := 0; frame < 50; frame++ {
+		m.advance(t, frame, nil)
+	}
+	gone := 3
+	skip := map[int]bool{gone: true}
+	m.mesh.Cut(m.ports[gone])
+	for _, peer := range m.peers {
+		peer.SetDisconnectTimeout(500)
+	}
+
+	// keepalives go out on every poll so only the cut peer goes quiet
+	keepAlive := func() int64 {
+		return time.Now().Add(time.Millisecond * (protocol.KeepAliveInterval + 50)).UnixMilli()
+	}
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		done := true
+		for i, peer := range m.peers {
+			if !skip[i] {
+				peer.Idle(0, keepAlive)
+				done = done && len(m.sessions[i].disconnected) > 0
+			}
+		}
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	for i, session := range m.sessions {
+		if skip[i] {
+			continue
+		}
+		if len(session.disconnected) != 1 || session.disconnected[0] != ggpo.PlayerHandle(gone+1) {
+			t.Errorf("expected peer %d to disconnect player %d, got %v", i+1, gone+1, session.disconnected)
+		}
+	}
+
+	for frame := 50; frame < 100; frame++ {
+		m.advance(t, frame, skip)
+	}
+	m.checkStates(t, skip)
+}
+
+// Two peers with two local players each, like a couch 2v2 played online.
+func TestP2PBackendMultipleLocalPlayers(t *testing.T) {
+	var peers []*ggpo.Peer
+	f := newMeshFixture(t, []int{7100, 7101}, [][]int{{1, 2}, {3, 4}}, 4, func(session *meshSession, port int) meshBackend {
+		peer := ggpo.NewPeer(session, port, 4, 4)
+		peers = append(peers, &peer)
+		return &peer
+	})
+	f.waitUntilRunning(t, nil)
+
+	err := peers[0].AddLocalInput(ggpo.PlayerHandle(3), []byte{1, 0, 0, 0}, 4)
+	if err == nil {
+		t.Errorf("Adding input for a remote player should be an error.")
+	}
+
+	for frame := 0; frame < 100; frame++ {
+		f.advance(t, frame, nil)
+	}
+	f.checkStates(t, nil)
+
+	for j := 0; j < 4; j++ {
+		status, err := peers[0].GetPlayerStatus(ggpo.PlayerHandle(j + 1))
+		if err != nil {
+			t.Fatalf("Error when getting the status of player %d: %s", j+1, err)
+		}
+		if status.Local != (j < 2) {
+			t.Errorf("expected player %d to be local %t, got %t", j+1, j < 2, status.Local)
+		}
+	}
+
+	err = peers[0].DisconnectPlayer(ggpo.PlayerHandle(3))
+	if err != nil {
+		t.Fatalf("Error when disconnecting player 3: %s", err)
+	}
+	if len(f.sessions[0].disconnected) != 2 {
+		t.Errorf("expected players 3 and 4 to go with their peer, got %v", f.sessions[0].disconnected)
+	}
+}
@@ -54,3 +54,25 @@ type RemotePlayer struct {
 type LocalEndpoint struct {
 	playerNum int
 }
+
+// Where a player's connection is at, see Backend.GetPlayerStatus.
+type PlayerConnectionState int
+
+const (
+	PlayerStateSynchronizing PlayerConnectionState = iota
+	PlayerStateRunning
+	// Nothing has arrived from the player for longer than the disconnect
+	// notify start, but they haven't timed out yet.
+	PlayerStateInterrupted
+	PlayerStateDisconnected
+)
+
+type PlayerStatus struct {
+	Local              bool
+	State              PlayerConnectionState
+	LastConfirmedFrame int // NullFrame until the first input
+	// Frames left before the player times out if nothing more arrives, -1
+	// if there's no timeout or the player can't time out.
+	FramesUntilDisconnect int
+	InputDelay            int
+}
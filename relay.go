@@ -0,0 +1,574 @@
+package ggpo
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/assemblaj/ggpo/internal/input"
+	"github.com/assemblaj/ggpo/internal/messages"
+	"github.com/assemblaj/ggpo/internal/polling"
+	"github.com/assemblaj/ggpo/internal/protocol"
+	"github.com/assemblaj/ggpo/internal/util"
+	"github.com/assemblaj/ggpo/transport"
+)
+
+/*
+A client of a RelayServer. Rather than talking to every other player, it sends
+its local players' input to the server and gets every player's confirmed input
+back from it, predicting and rolling back in between just like Peer. The
+server decides when players disconnect; handle 0 stands for the server itself
+in events.
+
+Each client sends its checksum of the frame ChecksumDistance before with every
+frame of input. The server puts every frame's checksums to a majority vote, one
+vote per client, and sends the verdict with the frame it confirms ChecksumDistance
+later. On any disagreement every client raises EventCodeDesync for handle 0,
+with the players of the outvoted clients as MinorityPlayers and the majority's
+checksum as RemoteChecksum.
+*/
+type Relay struct {
+	session    Session
+	poll       polling.Poller
+	sync       Sync
+	connection transport.Connection
+	server     protocol.UdpProtocol
+	serverIp   string
+	serverPort int
+	localPort  int
+	numPlayers int
+	inputSize  int
+
+	synchronizing        bool
+	nextRecommendedSleep int
+
+	disconnectTimeout     int
+	disconnectNotifyStart int
+
+	// Last confirmed frame of each player, remote ones as the server sent them
+	localConnectStatus []messages.UdpConnectStatus
+	localPlayers       []bool
+	// The next frame of packed local input to send, see sendLocalInputs
+	nextLocalFrame int
+
+	// Checksums of the frames we simulated, by frame, until the server's
+	// verdict on them comes in, see checkDesync
+	checksums map[int]uint32
+
+	messageChannel chan transport.MessageChannelItem
+}
+
+func NewRelay(cb Session, localPort int, numPlayers int, inputSize int, serverIp string, serverPort int) Relay {
+	r := Relay{}
+	r.session = cb
+	r.localPort = localPort
+	r.numPlayers = numPlayers
+	r.inputSize = inputSize
+	r.serverIp = serverIp
+	r.serverPort = serverPort
+	r.synchronizing = true
+	r.disconnectTimeout = DefaultDisconnectTimeout
+	r.disconnectNotifyStart = DefaultDisconnectNotifyStart
+	var poll polling.Poll = polling.NewPoll()
+	r.poll = &poll
+
+	r.localConnectStatus = make([]messages.UdpConnectStatus, numPlayers)
+	for i := 0; i < len(r.localConnectStatus); i++ {
+		r.localConnectStatus[i].LastFrame = -1
+	}
+	config := NewSyncConfig(r.session, MaxPredictionFrames, numPlayers, inputSize)
+	r.sync = NewSync(r.localConnectStatus, &config)
+	r.localPlayers = make([]bool, numPlayers)
+	r.checksums = make(map[int]uint32)
+	r.messageChannel = make(chan transport.MessageChannelItem, 256)
+	return r
+}
+
+func (r *Relay) Idle(timeout int, timeFunc ...polling.FuncTimeType) error {
+	if r.sync.InRollback() {
+		return nil
+	}
+	r.HandleMessages()
+	if len(timeFunc) == 0 {
+		r.poll.Pump()
+	} else {
+		r.poll.Pump(timeFunc[0])
+	}
+	r.PollUdpProtocolEvents()
+	if r.synchronizing {
+		return nil
+	}
+
+	err := r.sync.CheckSimulation(timeout)
+	if err != nil {
+		return err
+	}
+	currentFrame := r.sync.FrameCount()
+	r.server.SetLocalFrameNumber(currentFrame)
+
+	totalMinConfirmed := int32(math.MaxInt32)
+	for i := 0; i < r.numPlayers; i++ {
+		if !r.localConnectStatus[i].Disconnected {
+			totalMinConfirmed = util.Min(r.localConnectStatus[i].LastFrame, totalMinConfirmed)
+		}
+	}
+	if totalMinConfirmed >= 0 && totalMinConfirmed != math.MaxInt32 {
+		util.Log.Printf("setting confirmed frame in sync to %d.\n", totalMinConfirmed)
+		err = r.sync.SetLastConfirmedFrame(int(totalMinConfirmed))
+		if err != nil {
+			return err
+		}
+	}
+
+	// the server reports the slowest player's frame, so faster clients ease off
+	if currentFrame > r.nextRecommendedSleep {
+		var info Event
+		info.Code = EventCodeTimeSync
+		info.FramesAhead = r.server.RecommendFrameDelay()
+		info.TimeSyncPeriodInFrames = RecommendationInterval
+		r.session.OnEvent(&info)
+		r.nextRecommendedSleep = currentFrame + RecommendationInterval
+	}
+	if timeout > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+/*
+Local players are played on this client. Remote players only need a valid
+player number, since their input comes through the server whatever their
+address. Spectators aren't supported.
+*/
+func (r *Relay) AddPlayer(player *Player, handle *PlayerHandle) error {
+	if player.PlayerType == PlayerTypeSpectator {
+		return Error{Code: ErrorCodeUnsupported, Name: "ErrorCodeUnsupported"}
+	}
+	if !r.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	queue := player.PlayerNum - 1
+	if player.PlayerNum < 1 || player.PlayerNum > r.numPlayers || r.numPlayers > MaxPlayers {
+		return Error{Code: ErrorCodePlayerOutOfRange, Name: "ErrorCodePlayerOutOfRange"}
+	}
+	*handle = PlayerHandle(queue + 1)
+	r.localPlayers[queue] = player.PlayerType == PlayerTypeLocal
+	return nil
+}
+
+func (r *Relay) AddLocalInput(player PlayerHandle, values []byte, size int) error {
+	if r.sync.InRollback() {
+		return Error{Code: ErrorCodeInRollback, Name: "ErrorCodeInRollback"}
+	}
+	if r.synchronizing {
+		return Error{Code: ErrorCodeNotSynchronized, Name: "ErrorCodeNotSynchronized"}
+	}
+	queue, err := r.playerQueue(player)
+	if err != nil {
+		return err
+	}
+	if !r.localPlayers[queue] {
+		return Error{Code: ErrorCodeInvalidPlayerHandle, Name: "ErrorCodeInvalidPlayerHandle"}
+	}
+
+	localInput, err := input.NewGameInput(-1, values, size)
+	if err != nil {
+		return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput", err)
+	}
+	err = r.sync.AddLocalInput(queue, &localInput)
+	if err != nil {
+		return err
+	}
+	return r.sendLocalInputs()
+}
+
+// Sends the server every frame all local players have input for, packed in queue order.
+func (r *Relay) sendLocalInputs() error {
+	for {
+		packed := input.GameInput{Frame: r.nextLocalFrame}
+		for i := 0; i < r.numPlayers; i++ {
+			if !r.localPlayers[i] {
+				continue
+			}
+			in, ok, err := r.sync.GetConfirmedInput(i, r.nextLocalFrame)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+			packed.Bits = append(packed.Bits, in.Bits...)
+		}
+		// The prediction window is smaller than ChecksumDistance, see
+		// SetPredictionWindow, so no rollback can change this checksum anymore.
+		checksum := make([]byte, relayChecksumSize)
+		binary.BigEndian.PutUint32(checksum, r.checksums[packed.Frame-ChecksumDistance])
+		packed.Bits = append(packed.Bits, checksum...)
+		packed.Size = len(packed.Bits)
+		for i := 0; i < r.numPlayers; i++ {
+			if r.localPlayers[i] {
+				r.localConnectStatus[i].LastFrame = int32(packed.Frame)
+			}
+		}
+		r.server.SendInput(&packed)
+		r.nextLocalFrame++
+	}
+}
+
+func (r *Relay) SyncInput(disconnectFlags *int) ([][]byte, error) {
+	if r.synchronizing {
+		return nil, Error{Code: ErrorCodeNotSynchronized, Name: "ErrorCodeNotSynchronized"}
+	}
+	values, flags, err := r.sync.SynchronizeInputs()
+	if err != nil {
+		return nil, err
+	}
+	if disconnectFlags != nil {
+		*disconnectFlags = flags
+	}
+	return values, nil
+}
+
+func (r *Relay) AdvanceFrame(checksum uint32) error {
+	util.Log.Printf("End of frame (%d)...\n", r.sync.FrameCount())
+	currentFrame := r.sync.FrameCount()
+	r.sync.AdvanceFrame()
+	if checksum == DefaultChecksum && usesSavedChecksums(r.session) {
+		checksum = uint32(r.sync.GetLastSavedFrame().checksum)
+	}
+	r.checksums[currentFrame] = checksum
+	return r.Idle(0)
+}
+
+/*
+Raises the server's verdict on frame, see RelayServer.checksumVerdict, and
+forgets our checksums up to frame, which no verdict is coming for anymore.
+*/
+func (r *Relay) checkDesync(frame int, verdict []byte) {
+	localChecksum := r.checksums[frame]
+	for f := range r.checksums {
+		if f <= frame {
+			delete(r.checksums, f)
+		}
+	}
+	if frame < 0 || verdict[0] != relayChecksumDisagreed {
+		return
+	}
+	var info Event
+	info.Code = EventCodeDesync
+	info.NumFrameOfDesync = frame
+	info.LocalChecksum = int(localChecksum)
+	info.RemoteChecksum = int(binary.BigEndian.Uint32(verdict[2:]))
+	for i := 0; i < r.numPlayers; i++ {
+		if verdict[1]&(1<<i) != 0 {
+			info.MinorityPlayers = append(info.MinorityPlayers, PlayerHandle(i+1))
+		}
+	}
+	r.session.OnEvent(&info)
+	util.Log.Printf("DESYNC Checksum frame %d, local: %d, majority: %d, minority %v\n",
+		frame, localChecksum, info.RemoteChecksum, info.MinorityPlayers)
+}
+
+func (r *Relay) PollUdpProtocolEvents() {
+	if !r.server.IsInitialized() {
+		return
+	}
+	for {
+		evt, err := r.server.GetEvent()
+		if err != nil {
+			break
+		}
+		err = r.OnUdpProtocolEvent(evt)
+		if err != nil {
+			// The server is the only source of remote input, so there is
+			// nobody else to carry on with.
+			util.Log.Printf("Leaving the server after a bad event: %s\n", err)
+			r.disconnectRemotePlayers()
+		}
+	}
+}
+
+func (r *Relay) OnUdpProtocolEvent(evt *protocol.UdpProtocolEvent) error {
+	var info Event
+	switch evt.Type() {
+	case protocol.ConnectedEvent:
+		info.Code = EventCodeConnectedToPeer
+		r.session.OnEvent(&info)
+
+	case protocol.SynchronizingEvent:
+		info.Code = EventCodeSynchronizingWithPeer
+		info.Count = evt.Count
+		info.Total = evt.Total
+		r.session.OnEvent(&info)
+
+	case protocol.SynchronziedEvent:
+		if r.synchronizing {
+			info.Code = EventCodeSynchronizedWithPeer
+			r.session.OnEvent(&info)
+
+			info.Code = EventCodeRunning
+			r.session.OnEvent(&info)
+			r.synchronizing = false
+		}
+
+	case protocol.ProtocolMismatchEvent:
+		info.Code = EventCodeMismatchedPeer
+		r.session.OnEvent(&info)
+
+	case protocol.NetworkInterruptedEvent:
+		info.Code = EventCodeConnectionInterrupted
+		info.DisconnectTimeout = evt.DisconnectTimeout
+		r.session.OnEvent(&info)
+
+	case protocol.NetworkResumedEvent:
+		info.Code = EventCodeConnectionResumed
+		r.session.OnEvent(&info)
+
+	case protocol.DisconnectedEvent:
+		r.disconnectRemotePlayers()
+		info.Code = EventCodeDisconnectedFromPeer
+		r.session.OnEvent(&info)
+
+	case protocol.InputEvent:
+		return r.onConfirmedFrame(&evt.Input)
+	}
+	return nil
+}
+
+/*
+Takes a frame the server confirmed: every player's input followed by the
+disconnect flags and the checksum verdict. Our own players are already in
+place, and a player flagged for the first time is dropped from the frame before
+on, the same way every other client drops them.
+*/
+func (r *Relay) onConfirmedFrame(in *input.GameInput) error {
+	if len(in.Bits) != r.numPlayers*r.inputSize+relayTrailerSize {
+		return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput",
+			errors.New("ggpo Relay onConfirmedFrame : len(in.Bits) != r.numPlayers*r.inputSize+relayTrailerSize"))
+	}
+	flags := int(in.Bits[r.numPlayers*r.inputSize])
+	for i := 0; i < r.numPlayers; i++ {
+		if r.localPlayers[i] || r.localConnectStatus[i].Disconnected {
+			continue
+		}
+		if flags&(1<<i) != 0 {
+			r.disconnectQueue(i, in.Frame-1)
+			continue
+		}
+		if r.localConnectStatus[i].LastFrame != int32(in.Frame-1) {
+			return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput",
+				errors.New("ggpo Relay onConfirmedFrame : r.localConnectStatus[i].LastFrame != in.Frame-1"))
+		}
+		remoteInput := input.GameInput{
+			Frame: in.Frame,
+			Size:  r.inputSize,
+			Bits:  in.Bits[i*r.inputSize : (i+1)*r.inputSize],
+		}
+		err := r.sync.AddRemoteInput(i, &remoteInput)
+		if err != nil {
+			return err
+		}
+		r.localConnectStatus[i].LastFrame = int32(in.Frame)
+	}
+	r.checkDesync(in.Frame-ChecksumDistance, in.Bits[r.numPlayers*r.inputSize+1:])
+	return nil
+}
+
+// Drops a remote player from syncto on, resimulating if we've gone past it.
+func (r *Relay) disconnectQueue(queue int, syncto int) {
+	util.Log.Printf("Disconnecting queue %d at frame %d on the server's word.\n", queue, syncto)
+	r.localConnectStatus[queue].Disconnected = true
+	r.localConnectStatus[queue].LastFrame = int32(syncto)
+	if syncto < r.sync.FrameCount() {
+		err := r.sync.AdjustSimulation(syncto)
+		if err != nil {
+			util.Log.Printf("Adjusting simulation failed: %s\n", err)
+		}
+	}
+
+	var info Event
+	info.Code = EventCodeDisconnectedFromPeer
+	info.Player = PlayerHandle(queue + 1)
+	r.session.OnEvent(&info)
+}
+
+// Without the server every remote player is gone from the last frame we got.
+func (r *Relay) disconnectRemotePlayers() {
+	r.server.Disconnect()
+	for i := 0; i < r.numPlayers; i++ {
+		if !r.localPlayers[i] && !r.localConnectStatus[i].Disconnected {
+			r.disconnectQueue(i, int(r.localConnectStatus[i].LastFrame))
+		}
+	}
+}
+
+/*
+Only the server disconnects players, so this only takes local handles: it
+leaves the server, which drops our players for everyone else.
+*/
+func (r *Relay) DisconnectPlayer(handle PlayerHandle) error {
+	queue, err := r.playerQueue(handle)
+	if err != nil {
+		return err
+	}
+	if !r.localPlayers[queue] {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	if r.localConnectStatus[queue].Disconnected {
+		return Error{Code: ErrorCodePlayerDisconnected, Name: "ErrorCodePlayerDisconnected"}
+	}
+	for i := 0; i < r.numPlayers; i++ {
+		if r.localPlayers[i] {
+			r.localConnectStatus[i].Disconnected = true
+		}
+	}
+	r.disconnectRemotePlayers()
+	return nil
+}
+
+// Every player's input travels through the server, so they all share its stats.
+func (r *Relay) GetNetworkStats(handle PlayerHandle) (protocol.NetworkStats, error) {
+	_, err := r.playerQueue(handle)
+	if err != nil {
+		return protocol.NetworkStats{}, err
+	}
+	return r.server.GetNetworkStats(), nil
+}
+
+func (r *Relay) GetSessionStats() (SessionStats, error) {
+	return r.sync.SessionStats(), nil
+}
+
+// Remote players share the server's connection until it drops them.
+func (r *Relay) GetPlayerStatus(handle PlayerHandle) (PlayerStatus, error) {
+	queue, err := r.playerQueue(handle)
+	if err != nil {
+		return PlayerStatus{}, err
+	}
+	var status PlayerStatus
+	if r.localPlayers[queue] {
+		status = PlayerStatus{
+			Local:                 true,
+			State:                 PlayerStateRunning,
+			FramesUntilDisconnect: -1,
+			InputDelay:            r.sync.FrameDelay(queue),
+		}
+		if r.synchronizing {
+			status.State = PlayerStateSynchronizing
+		}
+	} else {
+		status = endpointStatus(&r.server)
+	}
+	if r.localConnectStatus[queue].Disconnected {
+		status.State = PlayerStateDisconnected
+		status.FramesUntilDisconnect = -1
+	}
+	status.LastConfirmedFrame = int(r.localConnectStatus[queue].LastFrame)
+	return status, nil
+}
+
+/*
+Sets how many frames the client may run ahead of the last frame the server
+confirmed, MaxPredictionFrames by default. It must be smaller than
+ChecksumDistance, so our checksums are final by the time they're sent. Must be
+set before the session starts running.
+*/
+func (r *Relay) SetPredictionWindow(frames int) error {
+	if frames < 1 || frames > MaxPredictionWindow || frames >= ChecksumDistance || !r.synchronizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	err := r.sync.SetPredictionWindow(frames)
+	if err != nil {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	return nil
+}
+
+/*
+Sets the frame delay of a local player. Every client plays the frames the
+server confirmed, so unlike Peer the delay can change at any time without
+telling anyone.
+*/
+func (r *Relay) SetFrameDelay(player PlayerHandle, delay int) error {
+	queue, err := r.playerQueue(player)
+	if err != nil {
+		return err
+	}
+	if !r.localPlayers[queue] || delay < 0 {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	r.sync.SetFrameDelay(queue, delay)
+	return nil
+}
+
+func (r *Relay) SetDisconnectTimeout(timeout int) error {
+	r.disconnectTimeout = timeout
+	if r.server.IsInitialized() {
+		r.server.SetDisconnectTimeout(timeout)
+	}
+	return nil
+}
+
+func (r *Relay) SetDisconnectNotifyStart(timeout int) error {
+	r.disconnectNotifyStart = timeout
+	if r.server.IsInitialized() {
+		r.server.SetDisconnectNotifyStart(timeout)
+	}
+	return nil
+}
+
+func (r *Relay) playerQueue(handle PlayerHandle) (int, error) {
+	queue := int(handle) - 1
+	if queue < 0 || queue >= r.numPlayers {
+		return 0, Error{Code: ErrorCodeInvalidPlayerHandle, Name: "ErrorCodeInvalidPlayerHandle"}
+	}
+	return queue, nil
+}
+
+func (r *Relay) HandleMessage(ipAddress string, port int, msg messages.UDPMessage, length int) {
+	if r.server.HandlesMsg(ipAddress, port) {
+		r.server.OnMsg(msg, length)
+	}
+}
+
+func (r *Relay) HandleMessages() {
+	for {
+		select {
+		case mi, ok := <-r.messageChannel:
+			if !ok {
+				return
+			}
+			r.HandleMessage(mi.Peer.Ip, mi.Peer.Port, mi.Message, mi.Length)
+		default:
+			return
+		}
+	}
+}
+
+func (r *Relay) Close() error {
+	if r.server.IsInitialized() {
+		r.server.Close()
+	}
+	return nil
+}
+
+func (r *Relay) InitializeConnection(c ...transport.Connection) error {
+	if len(c) == 0 {
+		r.connection = transport.NewUdp(r, r.localPort)
+		return nil
+	}
+	r.connection = c[0]
+	return nil
+}
+
+// Starts synchronizing with the server. Add every player first.
+func (r *Relay) Start() {
+	go r.connection.Read(r.messageChannel)
+
+	r.server = protocol.NewUdpProtocol(r.connection, 0, r.serverIp, r.serverPort, &r.localConnectStatus)
+	r.poll.RegisterLoop(&r.server, nil)
+	r.server.SetDisconnectTimeout(r.disconnectTimeout)
+	r.server.SetDisconnectNotifyStart(r.disconnectNotifyStart)
+	r.server.Synchronize()
+}
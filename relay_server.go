@@ -0,0 +1,394 @@
+package ggpo
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/assemblaj/ggpo/internal/input"
+	"github.com/assemblaj/ggpo/internal/messages"
+	"github.com/assemblaj/ggpo/internal/polling"
+	"github.com/assemblaj/ggpo/internal/protocol"
+	"github.com/assemblaj/ggpo/internal/util"
+	"github.com/assemblaj/ggpo/transport"
+)
+
+/*
+The dedicated server Relay clients talk to. It runs no simulation: it collects
+each client's input and, once every player has input for a frame or has been
+dropped, sends that frame to every client the same way a host sends frames to
+spectators, the players' inputs followed by their disconnect flags. Clients
+that go quiet are dropped here, and everyone learns of it through those flags.
+Each frame also carries the server's verdict on the clients' checksums, see
+checksumVerdict, so every client hears of a desync and who caused it.
+*/
+type RelayServer struct {
+	poll       polling.Poller
+	connection transport.Connection
+	localPort  int
+	numPlayers int
+	inputSize  int
+
+	// One endpoint per client, at the queue of the first player added for it.
+	// Every player at that address is played on that client.
+	endpoints     []protocol.UdpProtocol
+	endpointQueue []int
+
+	disconnectTimeout     int
+	disconnectNotifyStart int
+
+	// The last frame received from each player, sent to every client
+	connectStatus []messages.UdpConnectStatus
+	// Inputs received but not yet relayed, by queue and frame
+	inputs    []map[int][]byte
+	nextFrame int
+	// Checksums each client sent, by endpoint and the frame they're for
+	checksums []map[int]uint32
+
+	messageChannel chan transport.MessageChannelItem
+}
+
+// How a relayed frame's checksum verdict turned out, see checksumVerdict.
+const (
+	relayChecksumUnchecked byte = iota
+	relayChecksumAgreed
+	relayChecksumDisagreed
+)
+
+/*
+Every client's input for a frame is followed by its checksum of the frame
+ChecksumDistance before. Every relayed frame ends with the disconnect flags and
+the verdict on that earlier frame: how it turned out, the flags of the players
+whose clients were outvoted, and the majority's checksum.
+*/
+const (
+	relayChecksumSize = messages.Int32size
+	// disconnect flags, verdict, outvoted players and checksum
+	relayTrailerSize = 3 + messages.Int32size
+)
+
+func NewRelayServer(localPort int, numPlayers int, inputSize int) RelayServer {
+	s := RelayServer{}
+	s.localPort = localPort
+	s.numPlayers = numPlayers
+	s.inputSize = inputSize
+	s.disconnectTimeout = DefaultDisconnectTimeout
+	s.disconnectNotifyStart = DefaultDisconnectNotifyStart
+	var poll polling.Poll = polling.NewPoll()
+	s.poll = &poll
+
+	s.endpoints = make([]protocol.UdpProtocol, numPlayers)
+	s.endpointQueue = make([]int, numPlayers)
+	s.connectStatus = make([]messages.UdpConnectStatus, numPlayers)
+	s.inputs = make([]map[int][]byte, numPlayers)
+	s.checksums = make([]map[int]uint32, numPlayers)
+	for i := 0; i < numPlayers; i++ {
+		s.endpointQueue[i] = i
+		s.connectStatus[i].LastFrame = -1
+		s.inputs[i] = make(map[int][]byte)
+		s.checksums[i] = make(map[int]uint32)
+	}
+	s.messageChannel = make(chan transport.MessageChannelItem, 256)
+	return s
+}
+
+/*
+Adds a remote player at the address of the client playing them. A client with
+several local players is added once per player, in the same order it numbers
+them.
+*/
+func (s *RelayServer) AddPlayer(player *Player, handle *PlayerHandle) error {
+	if player.PlayerType != PlayerTypeRemote {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	queue := player.PlayerNum - 1
+	if player.PlayerNum < 1 || player.PlayerNum > s.numPlayers || s.numPlayers > MaxPlayers {
+		return Error{Code: ErrorCodePlayerOutOfRange, Name: "ErrorCodePlayerOutOfRange"}
+	}
+	*handle = PlayerHandle(queue + 1)
+
+	ip, port := player.Remote.IpAdress, player.Remote.Port
+	for i := 0; i < s.numPlayers; i++ {
+		if i != queue && s.endpoints[i].HandlesMsg(ip, port) {
+			s.endpointQueue[queue] = i
+			return nil
+		}
+	}
+	s.endpoints[queue] = protocol.NewUdpProtocol(s.connection, queue, ip, port, &s.connectStatus)
+	err := s.poll.RegisterLoop(&s.endpoints[queue], nil)
+	if err != nil {
+		return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
+	}
+	s.endpoints[queue].SetDisconnectTimeout(s.disconnectTimeout)
+	s.endpoints[queue].SetDisconnectNotifyStart(s.disconnectNotifyStart)
+	s.endpoints[queue].Synchronize()
+	return nil
+}
+
+func (s *RelayServer) Idle(timeout int, timeFunc ...polling.FuncTimeType) error {
+	s.HandleMessages()
+	if len(timeFunc) == 0 {
+		s.poll.Pump()
+	} else {
+		s.poll.Pump(timeFunc[0])
+	}
+	s.PollUdpProtocolEvents()
+	s.relayConfirmedFrames()
+
+	// clients compare themselves against the slowest player
+	slowest := input.NullFrame
+	for i := 0; i < s.numPlayers; i++ {
+		if !s.connectStatus[i].Disconnected && (slowest == input.NullFrame || int(s.connectStatus[i].LastFrame) < slowest) {
+			slowest = int(s.connectStatus[i].LastFrame)
+		}
+	}
+	for i := 0; i < s.numPlayers; i++ {
+		if s.endpoints[i].IsInitialized() {
+			s.endpoints[i].SetLocalFrameNumber(slowest)
+		}
+	}
+	return nil
+}
+
+func (s *RelayServer) PollUdpProtocolEvents() {
+	for i := 0; i < s.numPlayers; i++ {
+		if !s.endpoints[i].IsInitialized() {
+			continue
+		}
+		for {
+			evt, err := s.endpoints[i].GetEvent()
+			if err != nil {
+				break
+			}
+			err = s.OnUdpProtocolEvent(evt, i)
+			if err != nil {
+				util.Log.Printf("Dropping client %d after a bad event: %s\n", i, err)
+				s.disconnectClient(i)
+			}
+		}
+	}
+}
+
+func (s *RelayServer) OnUdpProtocolEvent(evt *protocol.UdpProtocolEvent, queue int) error {
+	switch evt.Type() {
+	case protocol.SynchronziedEvent:
+		util.Log.Printf("Client %d synchronized.\n", queue)
+	case protocol.DisconnectedEvent:
+		s.disconnectClient(queue)
+	case protocol.InputEvent:
+		queues := s.clientPlayers(queue)
+		if len(evt.Input.Bits) != len(queues)*s.inputSize+relayChecksumSize {
+			return errors.New("ggpo RelayServer OnUdpProtocolEvent : len(evt.Input.Bits) != len(queues)*s.inputSize+relayChecksumSize")
+		}
+		for n, q := range queues {
+			if s.connectStatus[q].Disconnected {
+				continue
+			}
+			if s.connectStatus[q].LastFrame != int32(evt.Input.Frame-1) {
+				return errors.New("ggpo RelayServer OnUdpProtocolEvent : s.connectStatus[q].LastFrame != evt.Input.Frame-1")
+			}
+			bits := make([]byte, s.inputSize)
+			copy(bits, evt.Input.Bits[n*s.inputSize:(n+1)*s.inputSize])
+			s.inputs[q][evt.Input.Frame] = bits
+			s.connectStatus[q].LastFrame = int32(evt.Input.Frame)
+		}
+		if evt.Input.Frame >= ChecksumDistance {
+			s.checksums[queue][evt.Input.Frame-ChecksumDistance] =
+				binary.BigEndian.Uint32(evt.Input.Bits[len(queues)*s.inputSize:])
+		}
+	}
+	return nil
+}
+
+// The queues played on the client at queue's endpoint, in the order their input is packed.
+func (s *RelayServer) clientPlayers(queue int) []int {
+	var queues []int
+	for i := 0; i < s.numPlayers; i++ {
+		if s.endpointQueue[i] == queue {
+			queues = append(queues, i)
+		}
+	}
+	return queues
+}
+
+// Drops every player on a client from the frame after the last one it sent.
+func (s *RelayServer) disconnectClient(queue int) {
+	s.endpoints[queue].Disconnect()
+	for _, q := range s.clientPlayers(queue) {
+		if !s.connectStatus[q].Disconnected {
+			util.Log.Printf("Disconnecting queue %d after frame %d.\n", q, s.connectStatus[q].LastFrame)
+			s.connectStatus[q].Disconnected = true
+		}
+	}
+}
+
+// Sends every frame all players have input for or have left by to every client still connected.
+func (s *RelayServer) relayConfirmedFrames() {
+	for {
+		var confirmed input.GameInput
+		confirmed.Frame = s.nextFrame
+		flags := 0
+		for i := 0; i < s.numPlayers; i++ {
+			if s.connectStatus[i].Disconnected && int32(s.nextFrame) > s.connectStatus[i].LastFrame {
+				flags |= 1 << i
+				confirmed.Bits = append(confirmed.Bits, make([]byte, s.inputSize)...)
+				continue
+			}
+			bits, ok := s.inputs[i][s.nextFrame]
+			if !ok {
+				return
+			}
+			confirmed.Bits = append(confirmed.Bits, bits...)
+		}
+		if flags == 1<<s.numPlayers-1 {
+			// nobody left to play it
+			return
+		}
+		confirmed.Bits = append(confirmed.Bits, byte(flags))
+		confirmed.Bits = append(confirmed.Bits, s.checksumVerdict(s.nextFrame-ChecksumDistance)...)
+		confirmed.Size = len(confirmed.Bits)
+
+		util.Log.Printf("relaying frame %d.\n", s.nextFrame)
+		for i := 0; i < s.numPlayers; i++ {
+			if s.endpoints[i].IsInitialized() && !s.endpoints[i].IsDisconnected() {
+				s.endpoints[i].SendInput(&confirmed)
+			}
+			delete(s.inputs[i], s.nextFrame)
+		}
+		s.nextFrame++
+	}
+}
+
+/*
+Puts the checksums the connected clients sent for frame to a vote, one vote per
+client as Peer does, and forgets everything up to frame. Any disagreement is a
+desync; the players of clients that differ from a majority are flagged as the
+ones that drifted off. With no majority nobody is flagged.
+*/
+func (s *RelayServer) checksumVerdict(frame int) []byte {
+	votes := make(map[int]uint32)
+	for i := 0; i < s.numPlayers; i++ {
+		if checksum, ok := s.checksums[i][frame]; ok && !s.endpoints[i].IsDisconnected() {
+			votes[i] = checksum
+		}
+		for f := range s.checksums[i] {
+			if f <= frame {
+				delete(s.checksums[i], f)
+			}
+		}
+	}
+	verdict := make([]byte, relayTrailerSize-1)
+	if len(votes) == 0 {
+		verdict[0] = relayChecksumUnchecked
+		return verdict
+	}
+
+	tally := make(map[uint32]int)
+	for _, checksum := range votes {
+		tally[checksum]++
+	}
+	var majority uint32
+	hasMajority := false
+	for checksum, count := range tally {
+		if count*2 > len(votes) {
+			majority = checksum
+			hasMajority = true
+		}
+	}
+	verdict[0] = relayChecksumAgreed
+	if len(tally) > 1 {
+		verdict[0] = relayChecksumDisagreed
+		util.Log.Printf("DESYNC Checksum frame %d, votes %v\n", frame, votes)
+	}
+	if hasMajority {
+		for i, checksum := range votes {
+			if checksum == majority {
+				continue
+			}
+			for _, q := range s.clientPlayers(i) {
+				verdict[1] |= 1 << q
+			}
+		}
+		binary.BigEndian.PutUint32(verdict[2:], majority)
+	}
+	return verdict
+}
+
+// Where the server's connection to a player's client is at.
+func (s *RelayServer) GetPlayerStatus(handle PlayerHandle) (PlayerStatus, error) {
+	queue := int(handle) - 1
+	if queue < 0 || queue >= s.numPlayers || !s.endpoints[s.endpointQueue[queue]].IsInitialized() {
+		return PlayerStatus{}, Error{Code: ErrorCodeInvalidPlayerHandle, Name: "ErrorCodeInvalidPlayerHandle"}
+	}
+	status := endpointStatus(&s.endpoints[s.endpointQueue[queue]])
+	if s.connectStatus[queue].Disconnected {
+		status.State = PlayerStateDisconnected
+		status.FramesUntilDisconnect = -1
+	}
+	status.LastConfirmedFrame = int(s.connectStatus[queue].LastFrame)
+	return status, nil
+}
+
+func (s *RelayServer) SetDisconnectTimeout(timeout int) error {
+	s.disconnectTimeout = timeout
+	for i := 0; i < s.numPlayers; i++ {
+		if s.endpoints[i].IsInitialized() {
+			s.endpoints[i].SetDisconnectTimeout(timeout)
+		}
+	}
+	return nil
+}
+
+func (s *RelayServer) SetDisconnectNotifyStart(timeout int) error {
+	s.disconnectNotifyStart = timeout
+	for i := 0; i < s.numPlayers; i++ {
+		if s.endpoints[i].IsInitialized() {
+			s.endpoints[i].SetDisconnectNotifyStart(timeout)
+		}
+	}
+	return nil
+}
+
+func (s *RelayServer) HandleMessage(ipAddress string, port int, msg messages.UDPMessage, length int) {
+	for i := 0; i < s.numPlayers; i++ {
+		if s.endpoints[i].HandlesMsg(ipAddress, port) {
+			s.endpoints[i].OnMsg(msg, length)
+			return
+		}
+	}
+}
+
+func (s *RelayServer) HandleMessages() {
+	for {
+		select {
+		case mi, ok := <-s.messageChannel:
+			if !ok {
+				return
+			}
+			s.HandleMessage(mi.Peer.Ip, mi.Peer.Port, mi.Message, mi.Length)
+		default:
+			return
+		}
+	}
+}
+
+func (s *RelayServer) Close() error {
+	for i := 0; i < s.numPlayers; i++ {
+		if s.endpoints[i].IsInitialized() {
+			s.endpoints[i].Close()
+		}
+	}
+	return nil
+}
+
+func (s *RelayServer) InitializeConnection(c ...transport.Connection) error {
+	if len(c) == 0 {
+		s.connection = transport.NewUdp(s, s.localPort)
+		return nil
+	}
+	s.connection = c[0]
+	return nil
+}
+
+func (s *RelayServer) Start() {
+	go s.connection.Read(s.messageChannel)
+}
@@ -0,0 +1,200 @@
+package ggpo_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/assemblaj/ggpo"
+	"github.com/assemblaj/ggpo/internal/protocol"
+)
+
+// A server with clients playing the players in locals, see newMeshFixture.
+type relayTest struct {
+	*meshFixture
+	server     *ggpo.RelayServer
+	clients    []*ggpo.Relay
+	serverPort int
+	numPlayers int
+}
+
+// Two clients, the first playing players 1 and 2 and the second player 3.
+func newRelayTest(t *testing.T) *relayTest {
+	return newRelayTestFor(t, [][]int{{1, 2}, {3}})
+}
+
+func newRelayTestFor(t *testing.T, locals [][]int) *relayTest {
+	r := &relayTest{serverPort: 7200}
+	var ports []int
+	for i, players := range locals {
+		ports = append(ports, r.serverPort+1+i)
+		r.numPlayers += len(players)
+	}
+	r.meshFixture = newMeshFixture(t, ports, locals, r.numPlayers, func(session *meshSession, port int) meshBackend {
+		client := ggpo.NewRelay(session, port, r.numPlayers, 4, "127.2.1.1", r.serverPort)
+		r.clients = append(r.clients, &client)
+		return &client
+	})
+	server := ggpo.NewRelayServer(r.serverPort, r.numPlayers, 4)
+	serverConnection := r.mesh.Connect(&server, r.serverPort, r.ip)
+	server.InitializeConnection(&serverConnection)
+	r.server = &server
+	for num := 1; num <= r.numPlayers; num++ {
+		player := ggpo.NewRemotePlayer(20, num, r.ip, r.ports[r.owner(num)])
+		var handle ggpo.PlayerHandle
+		err := server.AddPlayer(&player, &handle)
+		if err != nil {
+			t.Fatalf("Error when adding player %d to the server: %s", num, err)
+		}
+	}
+	server.Start()
+	r.waitUntilRunning(t, r.serverRunning, r.server)
+	return r
+}
+
+func (r *relayTest) serverRunning() bool {
+	for num := 1; num <= r.numPlayers; num++ {
+		status, err := r.server.GetPlayerStatus(ggpo.PlayerHandle(num))
+		if err != nil || status.State != ggpo.PlayerStateRunning {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *relayTest) advance(t *testing.T, frame int, skip map[int]bool) {
+	r.server.Idle(0)
+	r.meshFixture.advance(t, frame, skip)
+}
+
+func TestRelay(t *testing.T) {
+	r := newRelayTest(t)
+	err := r.clients[0].AddLocalInput(ggpo.PlayerHandle(3), []byte{1, 0, 0, 0}, 4)
+	if err == nil {
+		t.Errorf("Adding input for a remote player should be an error.")
+	}
+	for frame := 0; frame < 100; frame++ {
+		r.advance(t, frame, nil)
+	}
+	r.checkStates(t, nil, r.server)
+	if r.sessions[0].frame != 100 {
+		t.Errorf("expected the clients to reach frame 100, got %d", r.sessions[0].frame)
+	}
+}
+
+func TestRelayDisconnect(t *testing.T) {
+	r := newRelayTest(t)
+	for frame := 0; frame < 50; frame++ {
+		r.advance(t, frame, nil)
+	}
+
+	err := r.clients[0].DisconnectPlayer(ggpo.PlayerHandle(3))
+	if err == nil {
+		t.Errorf("Only the server should be able to disconnect remote players.")
+	}
+
+	// only the server times the client out, the other client hears it from the server
+	skip := map[int]bool{1: true}
+	r.mesh.Cut(r.ports[1])
+	r.server.SetDisconnectTimeout(500)
+	keepAlive := func() int64 {
+		return time.Now().Add(time.Millisecond * (protocol.KeepAliveInterval + 50)).UnixMilli()
+	}
+	// the news comes with the first frame player 3 is missing from, so keep
+	// playing as far as prediction allows
+	frame := 50
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) && len(r.sessions[0].disconnected) == 0 {
+		r.server.Idle(0, keepAlive)
+		r.clients[0].Idle(0, keepAlive)
+		err1 := r.clients[0].AddLocalInput(ggpo.PlayerHandle(1), meshInput(frame, 1), 4)
+		err2 := r.clients[0].AddLocalInput(ggpo.PlayerHandle(2), meshInput(frame, 2), 4)
+		if err1 == nil && err2 == nil {
+			err := r.sessions[0].step()
+			if err != nil {
+				t.Fatalf("Error when advancing client 1 on frame %d: %s", frame, err)
+			}
+			frame++
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if len(r.sessions[0].disconnected) != 1 || r.sessions[0].disconnected[0] != ggpo.PlayerHandle(3) {
+		t.Fatalf("expected client 1 to see player 3 disconnect, got %v", r.sessions[0].disconnected)
+	}
+
+	for ; frame < 100; frame++ {
+		r.advance(t, frame, skip)
+	}
+	// player 3's input stops counting at the same frame for both clients
+	if r.sessions[0].totals[2] != r.sessions[1].totals[2] {
+		t.Errorf("expected player 3's total to stop at %d, got %d", r.sessions[1].totals[2], r.sessions[0].totals[2])
+	}
+	status, err := r.clients[0].GetPlayerStatus(ggpo.PlayerHandle(3))
+	if err != nil {
+		t.Fatalf("Error when getting the status of player 3: %s", err)
+	}
+	if status.State != ggpo.PlayerStateDisconnected {
+		t.Errorf("expected player 3 to be disconnected, got %v", status.State)
+	}
+}
+
+func TestRelayDesync(t *testing.T) {
+	r := newRelayTestFor(t, [][]int{{1}, {2}, {3}})
+	for frame := 0; frame < 50; frame++ {
+		r.advance(t, frame, nil)
+	}
+	for i, session := range r.sessions {
+		if session.desyncs != 0 {
+			t.Fatalf("expected no desyncs on client %d before the states diverge, got %d", i+1, session.desyncs)
+		}
+	}
+	// client 2 drifts off and is outvoted, which every client hears of
+	r.sessions[1].totals[0]++
+	for _, save := range r.sessions[1].saves {
+		save[1]++
+	}
+	for frame := 50; frame < 100; frame++ {
+		r.advance(t, frame, nil)
+	}
+	for i, session := range r.sessions {
+		if session.desyncs == 0 {
+			t.Fatalf("expected client %d to see a desync", i+1)
+		}
+		minority := session.lastDesync.MinorityPlayers
+		if len(minority) != 1 || minority[0] != ggpo.PlayerHandle(2) {
+			t.Errorf("expected client %d to see player 2 outvoted, got %v", i+1, minority)
+		}
+		if session.lastDesync.RemoteChecksum != r.sessions[0].lastDesync.RemoteChecksum {
+			t.Errorf("expected client %d to get the same majority checksum as client 1", i+1)
+		}
+	}
+	if r.sessions[0].lastDesync.RemoteChecksum != r.sessions[0].lastDesync.LocalChecksum {
+		t.Errorf("expected client 1 to be in the majority, got %d against %d",
+			r.sessions[0].lastDesync.LocalChecksum, r.sessions[0].lastDesync.RemoteChecksum)
+	}
+}
+
+// A checksum of 0 is a checksum like any other.
+func TestRelayDesyncZeroChecksum(t *testing.T) {
+	r := newRelayTestFor(t, [][]int{{1}, {2}, {3}})
+	r.sessions[0].zeroChecksums = true
+	for frame := 0; frame < 50; frame++ {
+		r.advance(t, frame, nil)
+	}
+	if r.sessions[0].desyncs == 0 {
+		t.Fatalf("expected client 1 to be told its zero checksums were outvoted")
+	}
+	if minority := r.sessions[0].lastDesync.MinorityPlayers; len(minority) != 1 || minority[0] != ggpo.PlayerHandle(1) {
+		t.Errorf("expected player 1 to be outvoted, got %v", minority)
+	}
+}
+
+func TestRelayPredictionWindow(t *testing.T) {
+	client := ggpo.NewRelay(nil, 7201, 2, 4, "127.2.1.1", 7200)
+	if client.SetPredictionWindow(ggpo.ChecksumDistance) == nil {
+		t.Errorf("A prediction window as long as the checksum distance should be an error.")
+	}
+	err := client.SetPredictionWindow(12)
+	if err != nil {
+		t.Errorf("Error when setting the prediction window %s", err)
+	}
+}
@@ -0,0 +1,245 @@
+package ggpo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/assemblaj/ggpo/internal/input"
+)
+
+/*
+A replay starts with a header:
+
+	magic "GGRP", version uint16, players uint16, input size uint16,
+	frame delay uint16, checksum interval uint16, game length uint32, game
+
+followed by records, each a kind byte and its payload, all little endian:
+
+	'F' frame uint32, every player's input and a byte of disconnect flags
+	'C' frame uint32, checksum uint32
+
+Frames come in order from 0. A checksum for a frame can come some frames after
+it, once the frame was simulated with confirmed input. The frame delay is the
+one the session started with; later changes aren't recorded, as the frames
+already hold the input they delayed.
+*/
+const (
+	ReplayVersion = 1
+	// How often, in frames, a replay records the game's checksum
+	DefaultReplayChecksumInterval = 60
+
+	replayFrameRecord    = 'F'
+	replayChecksumRecord = 'C'
+)
+
+var replayMagic = []byte("GGRP")
+
+// Describes the session a replay was recorded in.
+type ReplayInfo struct {
+	Version          int
+	NumPlayers       int
+	InputSize        int
+	FrameDelay       int // the local players' input delay as the session started running
+	ChecksumInterval int
+	// Whatever the game needs to know it can play the replay, like its name and build
+	Game []byte
+}
+
+type ReplayData struct {
+	Info ReplayInfo
+	// Every player's input for each frame followed by a byte of disconnect
+	// flags, the same frames spectators get
+	Frames    [][]byte
+	Checksums map[int]uint32
+}
+
+// Frame size in bytes, the players' inputs and the disconnect flags.
+func (r *ReplayInfo) frameSize() int {
+	return r.NumPlayers*r.InputSize + 1
+}
+
+/*
+Reads a replay written by Peer or SyncTest. A recording cut off partway
+through a record, say by a crash, is read up to the last whole one.
+*/
+func LoadReplay(r io.Reader) (ReplayData, error) {
+	var data ReplayData
+	var header struct {
+		Magic            [4]byte
+		Version          uint16
+		NumPlayers       uint16
+		InputSize        uint16
+		FrameDelay       uint16
+		ChecksumInterval uint16
+		GameLength       uint32
+	}
+	err := binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return data, newError(ErrorCodeInvalidReplay, "ErrorCodeInvalidReplay", err)
+	}
+	if !bytes.Equal(header.Magic[:], replayMagic) || header.Version != ReplayVersion {
+		return data, newError(ErrorCodeInvalidReplay, "ErrorCodeInvalidReplay",
+			errors.New("ggpo LoadReplay : not a replay or an unsupported version"))
+	}
+	data.Info = ReplayInfo{
+		Version:          int(header.Version),
+		NumPlayers:       int(header.NumPlayers),
+		InputSize:        int(header.InputSize),
+		FrameDelay:       int(header.FrameDelay),
+		ChecksumInterval: int(header.ChecksumInterval),
+		Game:             make([]byte, header.GameLength),
+	}
+	_, err = io.ReadFull(r, data.Info.Game)
+	if err != nil {
+		return data, newError(ErrorCodeInvalidReplay, "ErrorCodeInvalidReplay", err)
+	}
+
+	data.Checksums = make(map[int]uint32)
+	for {
+		var record struct {
+			Kind  byte
+			Frame uint32
+		}
+		err = binary.Read(r, binary.LittleEndian, &record)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return data, nil
+		}
+		if err != nil {
+			return data, newError(ErrorCodeInvalidReplay, "ErrorCodeInvalidReplay", err)
+		}
+
+		switch record.Kind {
+		case replayFrameRecord:
+			if int(record.Frame) != len(data.Frames) {
+				return data, newError(ErrorCodeInvalidReplay, "ErrorCodeInvalidReplay",
+					errors.New("ggpo LoadReplay : frame out of order"))
+			}
+			bits := make([]byte, data.Info.frameSize())
+			_, err = io.ReadFull(r, bits)
+			if err == nil {
+				data.Frames = append(data.Frames, bits)
+			}
+		case replayChecksumRecord:
+			var checksum uint32
+			err = binary.Read(r, binary.LittleEndian, &checksum)
+			if err == nil {
+				data.Checksums[int(record.Frame)] = checksum
+			}
+		default:
+			return data, newError(ErrorCodeInvalidReplay, "ErrorCodeInvalidReplay",
+				errors.New("ggpo LoadReplay : unknown record"))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return data, nil
+		}
+		if err != nil {
+			return data, newError(ErrorCodeInvalidReplay, "ErrorCodeInvalidReplay", err)
+		}
+	}
+}
+
+/*
+Writes confirmed frames and the checksums of every ChecksumInterval'th frame.
+The header goes out with the first frame, once the session is running and its
+frame delay is settled.
+*/
+type replayRecorder struct {
+	w         io.Writer
+	info      ReplayInfo
+	nextFrame int
+	// Checksums of frames that were simulated but may still be rolled back
+	checksums map[int]uint32
+}
+
+func newReplayRecorder(w io.Writer, numPlayers int, inputSize int, game []byte) *replayRecorder {
+	return &replayRecorder{
+		w: w,
+		info: ReplayInfo{
+			Version:          ReplayVersion,
+			NumPlayers:       numPlayers,
+			InputSize:        inputSize,
+			ChecksumInterval: DefaultReplayChecksumInterval,
+			Game:             game,
+		},
+		checksums: make(map[int]uint32),
+	}
+}
+
+func (r *replayRecorder) writeHeader() error {
+	var buf bytes.Buffer
+	buf.Write(replayMagic)
+	binary.Write(&buf, binary.LittleEndian, []uint16{
+		uint16(r.info.Version),
+		uint16(r.info.NumPlayers),
+		uint16(r.info.InputSize),
+		uint16(r.info.FrameDelay),
+		uint16(r.info.ChecksumInterval),
+	})
+	binary.Write(&buf, binary.LittleEndian, uint32(len(r.info.Game)))
+	buf.Write(r.info.Game)
+	_, err := r.w.Write(buf.Bytes())
+	return err
+}
+
+// Writes the next confirmed frame, in the layout spectators get it.
+func (r *replayRecorder) writeFrame(in *input.GameInput) error {
+	if in.Frame != r.nextFrame || len(in.Bits) != r.info.frameSize() {
+		return errors.New("ggpo replayRecorder writeFrame : frame out of order or the wrong size")
+	}
+	if r.nextFrame == 0 {
+		err := r.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(replayFrameRecord)
+	binary.Write(&buf, binary.LittleEndian, uint32(in.Frame))
+	buf.Write(in.Bits)
+	_, err := r.w.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	r.nextFrame++
+	return nil
+}
+
+/*
+Keeps the checksum after frame if it's one to record, replacing any from before
+a rollback. DefaultChecksum means there is none to check a replay against.
+*/
+func (r *replayRecorder) setChecksum(frame int, checksum uint32) {
+	if frame%r.info.ChecksumInterval != 0 {
+		return
+	}
+	if checksum == DefaultChecksum {
+		delete(r.checksums, frame)
+	} else {
+		r.checksums[frame] = checksum
+	}
+}
+
+// Writes the checksums kept up to frame, which must be written and final.
+func (r *replayRecorder) writeChecksums(frame int) error {
+	var frames []int
+	for f := range r.checksums {
+		if f <= frame {
+			frames = append(frames, f)
+		}
+	}
+	sort.Ints(frames)
+	for _, f := range frames {
+		var buf bytes.Buffer
+		buf.WriteByte(replayChecksumRecord)
+		binary.Write(&buf, binary.LittleEndian, []uint32{uint32(f), r.checksums[f]})
+		_, err := r.w.Write(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		delete(r.checksums, f)
+	}
+	return nil
+}
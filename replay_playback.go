@@ -0,0 +1,284 @@
+package ggpo
+
+import (
+	"errors"
+
+	"github.com/assemblaj/ggpo/internal/polling"
+	"github.com/assemblaj/ggpo/internal/protocol"
+	"github.com/assemblaj/ggpo/internal/util"
+	"github.com/assemblaj/ggpo/transport"
+)
+
+// How often, in frames, Replay saves the game state to seek back to.
+const ReplaySnapshotInterval = 120
+
+/*
+Plays a recorded replay through the game's normal Session, see LoadReplay.
+SyncInput hands out the recorded input a frame at a time, or isn't ready
+(ErrorCodePredictionThreshod) while paused, between frames at speeds under 1
+and at the end, so a game loop or Runner drives it like any other backend.
+Idle must be called once per tick, which is what the playback speed counts in.
+
+Every ReplaySnapshotInterval frames the state is saved for Seek to go back to.
+Snapshot n is saved under state ID n+1; state ID 0 is left for getting the
+checksums of BufferedSessions that pass DefaultChecksum to AdvanceFrame. A recorded
+checksum that doesn't match raises EventCodeDesync, meaning this build no
+longer plays the match the way it was recorded.
+*/
+type Replay struct {
+	session Session
+	data    ReplayData
+	running bool
+
+	// The next frame to play
+	frame int
+	// The disconnect flags of the last frame played
+	lastFlags int
+	// Snapshots saved so far, always the first ones in order
+	snapshots     int
+	verifiedFrame int
+
+	paused bool
+	speed  float64
+	// Frames the game is due to play, earned at speed every Idle
+	credit  float64
+	seeking bool
+}
+
+func NewReplay(cb Session, data ReplayData) Replay {
+	return Replay{
+		session:       cb,
+		data:          data,
+		speed:         1,
+		verifiedFrame: -1,
+	}
+}
+
+/*
+Earns the frames this tick plays. Above speed 1 every frame past the first is
+played right away, through the session's AdvanceFrame callback as in a
+rollback.
+*/
+func (r *Replay) Idle(timeout int, timeFunc ...polling.FuncTimeType) error {
+	if !r.running {
+		var info Event
+		info.Code = EventCodeRunning
+		r.session.OnEvent(&info)
+		r.running = true
+	}
+	if r.paused || r.seeking {
+		return nil
+	}
+	// a game that stopped asking for frames doesn't get a burst of them later
+	r.credit = util.Min(r.credit+r.speed, r.speed+1)
+	for r.credit >= 2 && r.frame < len(r.data.Frames) {
+		frame := r.frame
+		r.session.AdvanceFrame(0)
+		if r.frame == frame {
+			return Error{Code: ErrorCodeGeneralFailure, Name: "ErrorCodeGeneralFailure"}
+		}
+	}
+	return nil
+}
+
+/*
+Players can be added as usual so the game's setup runs unchanged. Spectators
+aren't supported, and a player whose input size differs from the recording's
+means the replay isn't one for this game.
+*/
+func (r *Replay) AddPlayer(player *Player, handle *PlayerHandle) error {
+	if player.PlayerType == PlayerTypeSpectator {
+		return Error{Code: ErrorCodeUnsupported, Name: "ErrorCodeUnsupported"}
+	}
+	if player.PlayerNum < 1 || player.PlayerNum > r.data.Info.NumPlayers {
+		return Error{Code: ErrorCodePlayerOutOfRange, Name: "ErrorCodePlayerOutOfRange"}
+	}
+	if player.Size != r.data.Info.InputSize {
+		return Error{Code: ErrorCodeInvalidReplay, Name: "ErrorCodeInvalidReplay"}
+	}
+	*handle = PlayerHandle(player.PlayerNum)
+	return nil
+}
+
+// Local input is ignored, the recorded input is played instead.
+func (r *Replay) AddLocalInput(player PlayerHandle, values []byte, size int) error {
+	return nil
+}
+
+func (r *Replay) SyncInput(disconnectFlags *int) ([][]byte, error) {
+	if !r.running {
+		return nil, Error{Code: ErrorCodeNotSynchronized, Name: "ErrorCodeNotSynchronized"}
+	}
+	if r.frame >= len(r.data.Frames) || (!r.seeking && r.credit < 1) {
+		return nil, Error{Code: ErrorCodePredictionThreshod, Name: "ErrorCodePredictionThreshod"}
+	}
+	if r.frame == r.snapshots*ReplaySnapshotInterval {
+		r.session.SaveGameState(r.snapshots + 1)
+		r.snapshots++
+	}
+
+	bits := r.data.Frames[r.frame]
+	size := r.data.Info.InputSize
+	values := make([][]byte, r.data.Info.NumPlayers)
+	for i := range values {
+		values[i] = bits[i*size : (i+1)*size]
+	}
+	if disconnectFlags != nil {
+		*disconnectFlags = int(bits[len(bits)-1])
+	}
+	return values, nil
+}
+
+// Checks the frame just played against the recording, if it has a checksum for it.
+func (r *Replay) AdvanceFrame(checksum uint32) error {
+	frame := r.frame
+	if recorded, ok := r.data.Checksums[frame]; ok && frame > r.verifiedFrame {
+		if checksum == DefaultChecksum && usesSavedChecksums(r.session) {
+			checksum = uint32(r.session.SaveGameState(0))
+		}
+		if checksum != recorded {
+			var info Event
+			info.Code = EventCodeDesync
+			info.NumFrameOfDesync = frame
+			info.LocalChecksum = int(checksum)
+			info.RemoteChecksum = int(recorded)
+			r.session.OnEvent(&info)
+		}
+		r.verifiedFrame = frame
+	}
+	r.lastFlags = int(r.data.Frames[frame][len(r.data.Frames[frame])-1])
+	r.frame++
+	if !r.seeking {
+		r.credit--
+	}
+	return nil
+}
+
+func (r *Replay) Pause() {
+	r.paused = true
+	r.credit = 0
+}
+
+func (r *Replay) Play() {
+	r.paused = false
+}
+
+func (r *Replay) Paused() bool {
+	return r.paused
+}
+
+// Pauses and lets the game play a single frame on its next tick.
+func (r *Replay) StepFrame() {
+	r.paused = true
+	r.credit = 1
+}
+
+// Frames played per tick, so 2 plays twice as fast and 0.5 at half speed.
+func (r *Replay) SetSpeed(speed float64) error {
+	if speed <= 0 {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	r.speed = speed
+	return nil
+}
+
+/*
+Moves playback to just before frame, from 0 to Length. Going back loads the
+last snapshot before it and plays forward from there through the session's
+AdvanceFrame callback, as does going forward.
+*/
+func (r *Replay) Seek(frame int) error {
+	if frame < 0 || frame > len(r.data.Frames) || !r.running {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	snapshot := util.Min(frame/ReplaySnapshotInterval, r.snapshots-1)
+	if snapshot >= 0 && (frame < r.frame || snapshot*ReplaySnapshotInterval > r.frame) {
+		r.session.LoadGameState(snapshot + 1)
+		r.frame = snapshot * ReplaySnapshotInterval
+		// landing on the snapshot plays nothing to set them
+		r.lastFlags = 0
+		if r.frame > 0 {
+			r.lastFlags = int(r.data.Frames[r.frame-1][len(r.data.Frames[r.frame-1])-1])
+		}
+	}
+	if frame < r.frame {
+		return newError(ErrorCodeStateNotFound, "ErrorCodeStateNotFound",
+			errors.New("ggpo Replay Seek : no snapshot before frame"))
+	}
+
+	r.seeking = true
+	defer func() { r.seeking = false }()
+	for r.frame < frame {
+		played := r.frame
+		r.session.AdvanceFrame(0)
+		if r.frame == played {
+			return Error{Code: ErrorCodeGeneralFailure, Name: "ErrorCodeGeneralFailure"}
+		}
+	}
+	return nil
+}
+
+// The next frame to play.
+func (r *Replay) Frame() int {
+	return r.frame
+}
+
+// The number of frames in the replay.
+func (r *Replay) Length() int {
+	return len(r.data.Frames)
+}
+
+func (r *Replay) DisconnectPlayer(handle PlayerHandle) error {
+	return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+}
+
+func (r *Replay) GetNetworkStats(handle PlayerHandle) (protocol.NetworkStats, error) {
+	return protocol.NetworkStats{}, Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+}
+
+func (r *Replay) GetSessionStats() (SessionStats, error) {
+	return SessionStats{}, Error{Code: ErrorCodeUnsupported, Name: "ErrorCodeUnsupported"}
+}
+
+// Every player is confirmed to the end of the recording, until the recording drops them.
+func (r *Replay) GetPlayerStatus(handle PlayerHandle) (PlayerStatus, error) {
+	queue := int(handle) - 1
+	if queue < 0 || queue >= r.data.Info.NumPlayers {
+		return PlayerStatus{}, Error{Code: ErrorCodeInvalidPlayerHandle, Name: "ErrorCodeInvalidPlayerHandle"}
+	}
+	status := PlayerStatus{
+		State:                 PlayerStateRunning,
+		LastConfirmedFrame:    len(r.data.Frames) - 1,
+		FramesUntilDisconnect: -1,
+		InputDelay:            r.data.Info.FrameDelay,
+	}
+	if !r.running {
+		status.State = PlayerStateSynchronizing
+	}
+	if r.lastFlags&(1<<queue) != 0 {
+		status.State = PlayerStateDisconnected
+	}
+	return status, nil
+}
+
+func (r *Replay) SetFrameDelay(player PlayerHandle, delay int) error {
+	return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+}
+
+func (r *Replay) SetDisconnectTimeout(timeout int) error {
+	return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+}
+
+func (r *Replay) SetDisconnectNotifyStart(timeout int) error {
+	return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+}
+
+func (r *Replay) Close() error {
+	return nil
+}
+
+func (r *Replay) Start() {}
+
+func (r *Replay) InitializeConnection(c ...transport.Connection) error {
+	return nil
+}
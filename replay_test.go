@@ -0,0 +1,458 @@
+package ggpo_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/assemblaj/ggpo"
+)
+
+func TestSyncTestReplayRecording(t *testing.T) {
+	session := &meshSession{totals: make([]int, 2), saves: make(map[int][]int)}
+	stb := ggpo.NewSyncTest(session, 2, 8, 4, true)
+	session.backend = &stb
+	var recording bytes.Buffer
+	err := stb.SetReplayRecording(&recording, []byte("test game"))
+	if err != nil {
+		t.Fatalf("Error when starting the recording: %s", err)
+	}
+	for num := 1; num <= 2; num++ {
+		player := ggpo.NewLocalPlayer(20, num)
+		var handle ggpo.PlayerHandle
+		stb.AddPlayer(&player, &handle)
+	}
+	stb.Idle(0)
+	if stb.SetReplayRecording(&recording, nil) == nil {
+		t.Errorf("Starting a recording once running should be an error.")
+	}
+
+	checksums := make(map[int]int)
+	for frame := 0; frame < 130; frame++ {
+		for handle := 0; handle < 2; handle++ {
+			stb.AddLocalInput(ggpo.PlayerHandle(handle), []byte{byte(frame + handle), 0, 0, 0}, 4)
+		}
+		err = session.step()
+		if err != nil {
+			t.Fatalf("Error when advancing on frame %d: %s", frame, err)
+		}
+		checksums[frame] = session.checksum()
+	}
+
+	replay, err := ggpo.LoadReplay(&recording)
+	if err != nil {
+		t.Fatalf("Error when loading the replay: %s", err)
+	}
+	if replay.Info.NumPlayers != 2 || replay.Info.InputSize != 4 || string(replay.Info.Game) != "test game" {
+		t.Errorf("expected the header to describe the session, got %+v", replay.Info)
+	}
+	if len(replay.Frames) != 130 {
+		t.Fatalf("expected 130 frames, got %d", len(replay.Frames))
+	}
+	for frame, bits := range replay.Frames {
+		want := []byte{byte(frame), 0, 0, 0, byte(frame + 1), 0, 0, 0, 0}
+		if !bytes.Equal(bits, want) {
+			t.Fatalf("expected frame %d to be %v, got %v", frame, want, bits)
+		}
+	}
+	for _, frame := range []int{0, 60, 120} {
+		checksum, ok := replay.Checksums[frame]
+		if !ok || int(checksum) != checksums[frame] {
+			t.Errorf("expected the checksum after frame %d to be %d, got %d", frame, checksums[frame], checksum)
+		}
+	}
+	if len(replay.Checksums) != 3 {
+		t.Errorf("expected a checksum every %d frames, got %v", ggpo.DefaultReplayChecksumInterval, replay.Checksums)
+	}
+}
+
+func TestP2PBackendReplayRecording(t *testing.T) {
+	var peers []*ggpo.Peer
+	f := newMeshFixture(t, []int{7400, 7401}, [][]int{{1}, {2}}, 2, func(session *meshSession, port int) meshBackend {
+		peer := ggpo.NewPeer(session, port, 2, 4)
+		peers = append(peers, &peer)
+		return &peer
+	})
+	var recording bytes.Buffer
+	err := peers[0].SetReplayRecording(&recording, []byte{7})
+	if err != nil {
+		t.Fatalf("Error when starting the recording: %s", err)
+	}
+	f.waitUntilRunning(t, nil)
+
+	for frame := 0; frame < 100; frame++ {
+		f.advance(t, frame, nil)
+	}
+	f.checkStates(t, nil)
+
+	replay, err := ggpo.LoadReplay(&recording)
+	if err != nil {
+		t.Fatalf("Error when loading the replay: %s", err)
+	}
+	if len(replay.Frames) < 90 {
+		t.Fatalf("expected nearly every frame to be confirmed and recorded, got %d", len(replay.Frames))
+	}
+	// replaying the recorded frames has to land on the state the peers played
+	replayed := &meshSession{totals: make([]int, 2)}
+	for frame, bits := range replay.Frames {
+		for i := 0; i < 2; i++ {
+			want := byte(frame*(i+1) + i)
+			if bits[i*4] != want {
+				t.Fatalf("expected player %d's input on frame %d to be %d, got %d", i+1, frame, want, bits[i*4])
+			}
+			replayed.totals[i] += int(bits[i*4])*(replayed.frame+1) + 1
+		}
+		replayed.frame++
+		if checksum, ok := replay.Checksums[frame]; ok && int(checksum) != replayed.checksum() {
+			t.Errorf("expected the checksum after frame %d to be %d, got %d", frame, replayed.checksum(), checksum)
+		}
+	}
+	if _, ok := replay.Checksums[60]; !ok {
+		t.Errorf("expected a checksum after frame 60, got %v", replay.Checksums)
+	}
+}
+
+// A game passing its own checksums gets them recorded with sparse saving too.
+func TestP2PBackendReplayRecordingSparseSaving(t *testing.T) {
+	var peers []*ggpo.Peer
+	f := newMeshFixture(t, []int{7402, 7403}, [][]int{{1}, {2}}, 2, func(session *meshSession, port int) meshBackend {
+		peer := ggpo.NewPeer(session, port, 2, 4)
+		peer.SetSparseSaving(true)
+		peers = append(peers, &peer)
+		return &peer
+	})
+	var recording bytes.Buffer
+	err := peers[0].SetReplayRecording(&recording, nil)
+	if err != nil {
+		t.Fatalf("Error when starting the recording: %s", err)
+	}
+	f.waitUntilRunning(t, nil)
+	for frame := 0; frame < 150; frame++ {
+		f.advance(t, frame, nil)
+	}
+	f.checkStates(t, nil)
+
+	data, err := ggpo.LoadReplay(&recording)
+	if err != nil {
+		t.Fatalf("Error when loading the replay: %s", err)
+	}
+	if len(data.Checksums) != 3 {
+		t.Errorf("expected a checksum every %d frames, got %v", ggpo.DefaultReplayChecksumInterval, data.Checksums)
+	}
+	replay, session := newReplayPlayback(data)
+	for i := 0; i < 200; i++ {
+		tickReplay(t, replay, session)
+	}
+	if session.frame != len(data.Frames) {
+		t.Fatalf("expected playback to reach frame %d, got %d", len(data.Frames), session.frame)
+	}
+	if session.desyncs != 0 {
+		t.Errorf("expected no desyncs playing back a sparse saving recording, got %d", session.desyncs)
+	}
+}
+
+// A meshSession kept by a BufferedSession, passing DefaultChecksum.
+type bufferedMeshGame struct {
+	*meshSession
+}
+
+func newBufferedMeshGame(session *meshSession) *ggpo.BufferedSessionAdapter {
+	session.zeroChecksums = true
+	return ggpo.NewBufferedSession(bufferedMeshGame{session})
+}
+
+func (b bufferedMeshGame) SaveGameState() []byte {
+	state, _ := json.Marshal(append([]int{b.frame}, b.totals...))
+	return state
+}
+
+func (b bufferedMeshGame) LoadGameState(state []byte) {
+	var saved []int
+	json.Unmarshal(state, &saved)
+	b.frame = saved[0]
+	b.totals = saved[1:]
+}
+
+// A BufferedSession gets the saved states' checksums recorded with sparse saving too.
+func TestP2PBackendReplayRecordingSparseSavingBuffered(t *testing.T) {
+	var peers []*ggpo.Peer
+	f := newMeshFixture(t, []int{7404, 7405}, [][]int{{1}, {2}}, 2, func(session *meshSession, port int) meshBackend {
+		peer := ggpo.NewPeer(newBufferedMeshGame(session), port, 2, 4)
+		peer.SetSparseSaving(true)
+		peers = append(peers, &peer)
+		return &peer
+	})
+	var recording bytes.Buffer
+	err := peers[0].SetReplayRecording(&recording, nil)
+	if err != nil {
+		t.Fatalf("Error when starting the recording: %s", err)
+	}
+	f.waitUntilRunning(t, nil)
+	// peer 2 plays in bursts, so peer 1 plays a few frames with confirmed
+	// input at a time as it rolls back, and saves only the newest
+	for frame := 0; frame < 150; frame++ {
+		f.advance(t, frame, map[int]bool{1: true})
+		if frame%4 == 3 || frame == 149 {
+			for behind := frame - frame%4; behind <= frame; behind++ {
+				f.advance(t, behind, map[int]bool{0: true})
+			}
+		}
+	}
+	f.checkStates(t, nil)
+
+	data, err := ggpo.LoadReplay(&recording)
+	if err != nil {
+		t.Fatalf("Error when loading the replay: %s", err)
+	}
+	if len(data.Checksums) != 3 {
+		t.Errorf("expected a checksum every %d frames, got %v", ggpo.DefaultReplayChecksumInterval, data.Checksums)
+	}
+	session := &meshSession{totals: make([]int, 2), saves: make(map[int][]int)}
+	replay := ggpo.NewReplay(newBufferedMeshGame(session), data)
+	session.backend = &replay
+	for i := 0; i < 200; i++ {
+		tickReplay(t, &replay, session)
+	}
+	if session.frame != len(data.Frames) {
+		t.Fatalf("expected playback to reach frame %d, got %d", len(data.Frames), session.frame)
+	}
+	if session.desyncs != 0 {
+		t.Errorf("expected the recorded checksums to match playing back, got %d desyncs", session.desyncs)
+	}
+}
+
+func TestLoadReplayInvalid(t *testing.T) {
+	_, err := ggpo.LoadReplay(bytes.NewReader([]byte("not a replay at all")))
+	if !hasErrorCode(err, ggpo.ErrorCodeInvalidReplay) {
+		t.Errorf("expected ErrorCodeInvalidReplay, got %v", err)
+	}
+
+	session := &meshSession{totals: make([]int, 1), saves: make(map[int][]int)}
+	stb := ggpo.NewSyncTest(session, 1, 8, 4, true)
+	session.backend = &stb
+	var recording bytes.Buffer
+	stb.SetReplayRecording(&recording, nil)
+	player := ggpo.NewLocalPlayer(20, 1)
+	var handle ggpo.PlayerHandle
+	stb.AddPlayer(&player, &handle)
+	stb.Idle(0)
+	for frame := 0; frame < 10; frame++ {
+		stb.AddLocalInput(handle, []byte{byte(frame), 0, 0, 0}, 4)
+		session.step()
+	}
+	// a recording cut off mid-frame keeps the frames before
+	truncated := recording.Bytes()[:recording.Len()-2]
+	replay, err := ggpo.LoadReplay(bytes.NewReader(truncated))
+	if err != nil {
+		t.Fatalf("Error when loading a truncated replay: %s", err)
+	}
+	if len(replay.Frames) != 9 {
+		t.Errorf("expected 9 whole frames, got %d", len(replay.Frames))
+	}
+}
+
+// Records frames of a two player SyncTest session and the state after each one.
+func recordSyncTestReplay(t *testing.T, frames int) (ggpo.ReplayData, []int) {
+	session := &meshSession{totals: make([]int, 2), saves: make(map[int][]int)}
+	stb := ggpo.NewSyncTest(session, 2, 8, 4, true)
+	session.backend = &stb
+	var recording bytes.Buffer
+	stb.SetReplayRecording(&recording, nil)
+	for num := 1; num <= 2; num++ {
+		player := ggpo.NewLocalPlayer(20, num)
+		var handle ggpo.PlayerHandle
+		stb.AddPlayer(&player, &handle)
+	}
+	stb.Idle(0)
+	var states []int
+	for frame := 0; frame < frames; frame++ {
+		for handle := 0; handle < 2; handle++ {
+			stb.AddLocalInput(ggpo.PlayerHandle(handle), []byte{byte(frame * (handle + 3)), 0, 0, 0}, 4)
+		}
+		err := session.step()
+		if err != nil {
+			t.Fatalf("Error when recording frame %d: %s", frame, err)
+		}
+		states = append(states, session.checksum())
+	}
+	replay, err := ggpo.LoadReplay(&recording)
+	if err != nil {
+		t.Fatalf("Error when loading the replay: %s", err)
+	}
+	return replay, states
+}
+
+func newReplayPlayback(data ggpo.ReplayData) (*ggpo.Replay, *meshSession) {
+	session := &meshSession{totals: make([]int, 2), saves: make(map[int][]int)}
+	replay := ggpo.NewReplay(session, data)
+	session.backend = &replay
+	return &replay, session
+}
+
+// Ticks like a game loop would, returning whether a frame was played.
+func tickReplay(t *testing.T, replay *ggpo.Replay, session *meshSession) bool {
+	err := replay.Idle(0)
+	if err != nil {
+		t.Fatalf("Error when idling on frame %d: %s", session.frame, err)
+	}
+	err = session.step()
+	if err != nil {
+		if !hasErrorCode(err, ggpo.ErrorCodePredictionThreshod) {
+			t.Fatalf("Error when playing frame %d: %s", session.frame, err)
+		}
+		return false
+	}
+	return true
+}
+
+func TestReplayPlayback(t *testing.T) {
+	data, states := recordSyncTestReplay(t, 300)
+	replay, session := newReplayPlayback(data)
+	for i := 0; i < 400; i++ {
+		tickReplay(t, replay, session)
+	}
+	if session.frame != 300 || replay.Frame() != replay.Length() {
+		t.Fatalf("expected playback to stop at the end, frame 300, got %d", session.frame)
+	}
+	if session.checksum() != states[299] {
+		t.Errorf("expected the replay to reproduce the recorded state")
+	}
+	if session.desyncs != 0 {
+		t.Errorf("expected the recorded checksums to match, got %d desyncs", session.desyncs)
+	}
+}
+
+func TestReplayPauseStepAndSpeed(t *testing.T) {
+	data, states := recordSyncTestReplay(t, 300)
+	replay, session := newReplayPlayback(data)
+	for i := 0; i < 10; i++ {
+		tickReplay(t, replay, session)
+	}
+
+	replay.Pause()
+	for i := 0; i < 5; i++ {
+		if tickReplay(t, replay, session) {
+			t.Fatalf("expected nothing to play while paused")
+		}
+	}
+	replay.StepFrame()
+	tickReplay(t, replay, session)
+	tickReplay(t, replay, session)
+	if session.frame != 11 || !replay.Paused() {
+		t.Errorf("expected a step to play one frame and stay paused, got frame %d", session.frame)
+	}
+
+	replay.Play()
+	replay.SetSpeed(3)
+	tickReplay(t, replay, session)
+	if session.frame != 14 {
+		t.Errorf("expected 3 frames a tick at speed 3, got to frame %d", session.frame)
+	}
+	replay.SetSpeed(0.5)
+	for i := 0; i < 4; i++ {
+		tickReplay(t, replay, session)
+	}
+	if session.frame != 16 {
+		t.Errorf("expected a frame every other tick at speed 0.5, got to frame %d", session.frame)
+	}
+	if session.checksum() != states[15] {
+		t.Errorf("expected the state after frame 15 whatever the speed")
+	}
+	if replay.SetSpeed(0) == nil {
+		t.Errorf("A speed of 0 should be an error, that's what Pause is for.")
+	}
+}
+
+func TestReplaySeek(t *testing.T) {
+	data, states := recordSyncTestReplay(t, 300)
+	replay, session := newReplayPlayback(data)
+	tickReplay(t, replay, session)
+
+	// forward, playing every frame on the way
+	err := replay.Seek(250)
+	if err != nil {
+		t.Fatalf("Error when seeking forward: %s", err)
+	}
+	if session.frame != 250 || session.checksum() != states[249] {
+		t.Errorf("expected to land on frame 250, got %d", session.frame)
+	}
+	// back, from the snapshot at frame 120
+	err = replay.Seek(130)
+	if err != nil {
+		t.Fatalf("Error when seeking back: %s", err)
+	}
+	if session.frame != 130 || session.checksum() != states[129] {
+		t.Errorf("expected to land on frame 130, got %d", session.frame)
+	}
+	err = replay.Seek(0)
+	if err != nil || session.frame != 0 || session.totals[0] != 0 {
+		t.Errorf("expected seeking to 0 to restore the start, got frame %d and %v", session.frame, err)
+	}
+	for i := 0; i < 10; i++ {
+		tickReplay(t, replay, session)
+	}
+	if session.frame != 10 || session.checksum() != states[9] {
+		t.Errorf("expected playback to carry on from the seek, got frame %d", session.frame)
+	}
+	if replay.Seek(301) == nil {
+		t.Errorf("Seeking past the end should be an error.")
+	}
+}
+
+// Player 2 drops on frame 10, so a seek back to the start brings them back.
+func TestReplaySeekDisconnectFlags(t *testing.T) {
+	data := ggpo.ReplayData{
+		Info:      ggpo.ReplayInfo{Version: ggpo.ReplayVersion, NumPlayers: 2, InputSize: 4},
+		Checksums: make(map[int]uint32),
+	}
+	for frame := 0; frame < 200; frame++ {
+		bits := make([]byte, 2*4+1)
+		if frame >= 10 {
+			bits[2*4] = 1 << 1
+		}
+		data.Frames = append(data.Frames, bits)
+	}
+	replay, session := newReplayPlayback(data)
+	player := ggpo.NewLocalPlayer(20, 1)
+	var handle ggpo.PlayerHandle
+	if !hasErrorCode(replay.AddPlayer(&player, &handle), ggpo.ErrorCodeInvalidReplay) {
+		t.Errorf("A player with another input size than the recording should be an error.")
+	}
+	tickReplay(t, replay, session)
+
+	stateAt := func(frame int) ggpo.PlayerConnectionState {
+		if err := replay.Seek(frame); err != nil {
+			t.Fatalf("Error when seeking to frame %d: %s", frame, err)
+		}
+		status, _ := replay.GetPlayerStatus(ggpo.PlayerHandle(2))
+		return status.State
+	}
+	if state := stateAt(150); state != ggpo.PlayerStateDisconnected {
+		t.Errorf("expected player 2 to be disconnected at frame 150, got %v", state)
+	}
+	// both land right on a snapshot, playing no frames
+	if state := stateAt(ggpo.ReplaySnapshotInterval); state != ggpo.PlayerStateDisconnected {
+		t.Errorf("expected player 2 to be disconnected at frame %d, got %v", ggpo.ReplaySnapshotInterval, state)
+	}
+	if state := stateAt(0); state != ggpo.PlayerStateRunning {
+		t.Errorf("expected player 2 to be running again at frame 0, got %v", state)
+	}
+}
+
+func TestReplayDesync(t *testing.T) {
+	data, _ := recordSyncTestReplay(t, 130)
+	data.Checksums[60]++
+	replay, session := newReplayPlayback(data)
+	for i := 0; i < 130; i++ {
+		tickReplay(t, replay, session)
+	}
+	if session.desyncs != 1 {
+		t.Errorf("expected the changed checksum to raise one desync, got %d", session.desyncs)
+	}
+	// seeking back over it doesn't raise it again
+	replay.Seek(0)
+	replay.Seek(130)
+	if session.desyncs != 1 {
+		t.Errorf("expected a frame to only be checked once, got %d desyncs", session.desyncs)
+	}
+}
@@ -0,0 +1,209 @@
+package ggpo
+
+import (
+	"time"
+
+	"github.com/assemblaj/ggpo/internal/util"
+)
+
+/*
+What a game hands to a Runner: saving and loading its state like a Session, plus
+sampling local input and simulating a single frame. The Runner takes care of
+everything in between.
+*/
+type RunnerGame interface {
+	SaveGameState(stateID int) int
+	LoadGameState(stateID int)
+	OnEvent(info *Event)
+	// The input of a local player for the frame about to run.
+	ReadInput(player PlayerHandle) []byte
+	// Runs one frame with every player's input and returns its checksum, or
+	// DefaultChecksum to use the one from saving the state.
+	Simulate(inputs [][]byte, disconnectFlags int) uint32
+}
+
+// Where a Runner gets the time from, so it can be driven by a fake clock in tests.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+/*
+Owns the fixed-timestep loop. Each tick it idles the backend for the time left
+until the next frame is due, feeds it the local players' input and simulates a
+frame. Time sync recommendations are applied by stretching the next frames a
+little at a time rather than stalling for the whole amount at once.
+
+The Runner is the Session its backend calls back into, so create the backend
+with it and then hand the backend over with SetBackend.
+*/
+type Runner struct {
+	game      RunnerGame
+	backend   Backend
+	clock     Clock
+	frameTime time.Duration
+	players   []PlayerHandle
+	// How many of players already have input in for the frame that's next to
+	// run, since a backend won't take a player's input for a frame twice
+	inputsAdded int
+
+	next time.Time
+	// extra time added to each of the next slowdownFrames frames
+	slowdown       time.Duration
+	slowdownFrames int
+}
+
+// tickRate is in frames per second, FrameRate if it isn't positive.
+func NewRunner(game RunnerGame, tickRate int) *Runner {
+	if tickRate <= 0 {
+		tickRate = FrameRate
+	}
+	return &Runner{
+		game:      game,
+		clock:     systemClock{},
+		frameTime: time.Second / time.Duration(tickRate),
+	}
+}
+
+// The backend must be the one calling back into the Runner, not a LockedBackend
+// wrapping it, since rollbacks advance frames with its lock already held.
+func (r *Runner) SetBackend(backend Backend) {
+	r.backend = backend
+}
+
+func (r *Runner) SetClock(clock Clock) {
+	r.clock = clock
+}
+
+// Adds a player whose input is read from the game every frame.
+func (r *Runner) AddLocalPlayer(handle PlayerHandle) {
+	r.players = append(r.players, handle)
+}
+
+func (r *Runner) FrameTime() time.Duration {
+	return r.frameTime
+}
+
+/*
+Waits for the next frame to be due, idling the backend in the meantime, then
+runs it. A frame that can't run yet, because the session is still synchronizing
+or is at the prediction barrier, is skipped without an error.
+*/
+func (r *Runner) Step() error {
+	if r.backend == nil {
+		return Error{Code: ErrorCodeInvalidSession, Name: "ErrorCodeInvalidSession"}
+	}
+	now := r.clock.Now()
+	if r.next.IsZero() {
+		r.next = now
+	}
+	budget := r.next.Sub(now)
+	err := r.backend.Idle(int(util.Max(0, budget.Milliseconds()-1)))
+	if err != nil {
+		return err
+	}
+	if wait := r.next.Sub(r.clock.Now()); wait > 0 {
+		r.clock.Sleep(wait)
+	}
+
+	r.next = r.next.Add(r.frameTime + r.takeSlowdown())
+	// After a long stall start over rather than running the missed frames back to back.
+	if now := r.clock.Now(); r.next.Before(now) {
+		r.next = now
+	}
+	return r.runFrame()
+}
+
+// Steps until stop is closed or a step fails.
+func (r *Runner) Run(stop <-chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		err := r.Step()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Runner) runFrame() error {
+	for _, handle := range r.players[r.inputsAdded:] {
+		input := r.game.ReadInput(handle)
+		err := r.backend.AddLocalInput(handle, input, len(input))
+		if err != nil {
+			return skippable(err)
+		}
+		r.inputsAdded++
+	}
+	var disconnectFlags int
+	inputs, err := r.backend.SyncInput(&disconnectFlags)
+	if err != nil {
+		return skippable(err)
+	}
+	r.inputsAdded = 0
+	checksum := r.game.Simulate(inputs, disconnectFlags)
+	return r.backend.AdvanceFrame(checksum)
+}
+
+// Errors that just mean this frame can't run yet.
+func skippable(err error) error {
+	if ggpoErr, ok := err.(Error); ok {
+		switch ggpoErr.Code {
+		case ErrorCodeNotSynchronized, ErrorCodePredictionThreshod, ErrorCodeInRollback:
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *Runner) takeSlowdown() time.Duration {
+	if r.slowdownFrames == 0 {
+		return 0
+	}
+	r.slowdownFrames--
+	return r.slowdown
+}
+
+func (r *Runner) SaveGameState(stateID int) int {
+	return r.game.SaveGameState(stateID)
+}
+
+func (r *Runner) LoadGameState(stateID int) {
+	r.game.LoadGameState(stateID)
+}
+
+// Resimulates a frame during a rollback.
+func (r *Runner) AdvanceFrame(flags int) {
+	var disconnectFlags int
+	inputs, err := r.backend.SyncInput(&disconnectFlags)
+	if err != nil {
+		util.Log.Printf("Runner couldn't synchronize inputs during a rollback: %s\n", err)
+		return
+	}
+	checksum := r.game.Simulate(inputs, disconnectFlags)
+	r.backend.AdvanceFrame(checksum)
+}
+
+// Spreads a time sync recommendation over its period, then passes the event on.
+func (r *Runner) OnEvent(info *Event) {
+	if info.Code == EventCodeTimeSync && info.FramesAhead > 0 {
+		frames := util.Max(1, info.TimeSyncPeriodInFrames)
+		total := time.Duration(float64(r.frameTime) * float64(info.FramesAhead))
+		r.slowdown = total / time.Duration(frames)
+		r.slowdownFrames = frames
+	}
+	r.game.OnEvent(info)
+}
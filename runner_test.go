@@ -0,0 +1,210 @@
+package ggpo_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/assemblaj/ggpo"
+	"github.com/assemblaj/ggpo/internal/mocks"
+	"github.com/assemblaj/ggpo/internal/protocol"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// Counts frames and sums the inputs it has seen.
+type runnerGame struct {
+	frame  int
+	total  int
+	saves  map[int][2]int
+	events []ggpo.Event
+}
+
+func (g *runnerGame) SaveGameState(stateID int) int {
+	g.saves[stateID] = [2]int{g.frame, g.total}
+	return g.total
+}
+
+func (g *runnerGame) LoadGameState(stateID int) {
+	g.frame, g.total = g.saves[stateID][0], g.saves[stateID][1]
+}
+
+func (g *runnerGame) OnEvent(info *ggpo.Event) {
+	g.events = append(g.events, *info)
+}
+
+func (g *runnerGame) ReadInput(player ggpo.PlayerHandle) []byte {
+	return []byte{1, 0, 0, 0}
+}
+
+func (g *runnerGame) Simulate(inputs [][]byte, disconnectFlags int) uint32 {
+	g.frame++
+	for _, input := range inputs {
+		g.total += int(input[0])
+	}
+	return ggpo.DefaultChecksum
+}
+
+func newTestRunner(tickRate int) (*ggpo.Runner, *runnerGame, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	game := &runnerGame{saves: make(map[int][2]int)}
+	runner := ggpo.NewRunner(game, tickRate)
+	runner.SetClock(clock)
+	stb := ggpo.NewSyncTest(runner, 1, 8, 4, true)
+	runner.SetBackend(&stb)
+
+	player := ggpo.NewLocalPlayer(20, 1)
+	var handle ggpo.PlayerHandle
+	stb.AddPlayer(&player, &handle)
+	runner.AddLocalPlayer(handle)
+	return runner, game, clock
+}
+
+func TestRunnerFixedTimestep(t *testing.T) {
+	runner, game, clock := newTestRunner(50)
+	start := clock.Now()
+	frames := 30
+	for i := 0; i < frames; i++ {
+		err := runner.Step()
+		if err != nil {
+			t.Fatalf("Step %d failed: %s", i, err)
+		}
+	}
+	if game.frame != frames || game.total != frames {
+		t.Errorf("expected %d frames with %d input but got %d frames with %d", frames, frames, game.frame, game.total)
+	}
+	// the first frame runs right away
+	want := time.Duration(frames-1) * 20 * time.Millisecond
+	if got := clock.Now().Sub(start); got != want {
+		t.Errorf("expected %d frames to take %s but they took %s", frames, want, got)
+	}
+}
+
+func TestRunnerSpreadsTimeSync(t *testing.T) {
+	runner, game, clock := newTestRunner(50)
+	runner.Step()
+	runner.OnEvent(&ggpo.Event{Code: ggpo.EventCodeTimeSync, FramesAhead: 2, TimeSyncPeriodInFrames: 10})
+	// The frame already scheduled keeps its time, the next 10 take 4ms longer
+	// to make up the 2 frames, then it's back to normal.
+	var durations []time.Duration
+	for i := 0; i < 13; i++ {
+		before := clock.Now()
+		runner.Step()
+		durations = append(durations, clock.Now().Sub(before))
+	}
+	for i, got := range durations {
+		want := 20 * time.Millisecond
+		if i >= 1 && i <= 10 {
+			want = 24 * time.Millisecond
+		}
+		if got != want {
+			t.Errorf("expected frame %d to take %s but it took %s", i, want, got)
+		}
+	}
+	if game.events[len(game.events)-1].Code != ggpo.EventCodeTimeSync {
+		t.Errorf("The time sync event should still be passed on to the game.")
+	}
+}
+
+func TestRunnerNeedsBackend(t *testing.T) {
+	runner := ggpo.NewRunner(&runnerGame{saves: make(map[int][2]int)}, 0)
+	if runner.FrameTime() != time.Second/ggpo.FrameRate {
+		t.Errorf("expected the default tick rate to be %d", ggpo.FrameRate)
+	}
+	err := runner.Step()
+	if err == nil {
+		t.Errorf("Stepping a runner without a backend should be an error.")
+	}
+}
+
+// Turns away one player's input a number of times, as at a prediction barrier.
+type stallingBackend struct {
+	ggpo.Backend
+	player ggpo.PlayerHandle
+	stalls int
+}
+
+func (b *stallingBackend) AddLocalInput(player ggpo.PlayerHandle, values []byte, size int) error {
+	if player == b.player && b.stalls > 0 {
+		b.stalls--
+		return ggpo.Error{Code: ggpo.ErrorCodePredictionThreshod, Name: "ErrorCodePredictionThreshod"}
+	}
+	return b.Backend.AddLocalInput(player, values, size)
+}
+
+// Player 1's input for a frame goes in once, even when player 2's is turned away.
+func TestRunnerTwoLocalPlayers(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	game := &runnerGame{saves: make(map[int][2]int)}
+	runner := ggpo.NewRunner(game, 50)
+	runner.SetClock(clock)
+
+	// players 1 and 2 are on the runner's peer, player 3 on the other one
+	ip := "127.2.1.1"
+	ports := []int{7600, 7601}
+	mesh := mocks.NewFakeMesh()
+	peer := ggpo.NewPeer(runner, ports[0], 3, 4)
+	backend := &stallingBackend{Backend: &peer, player: 2}
+	runner.SetBackend(backend)
+	remote := &meshSession{totals: make([]int, 3), saves: make(map[int][]int)}
+	remotePeer := ggpo.NewPeer(remote, ports[1], 3, 4)
+	remote.backend = &remotePeer
+	for i, p := range []*ggpo.Peer{&peer, &remotePeer} {
+		connection := mesh.Connect(p, ports[i], ip)
+		p.InitializeConnection(&connection)
+		for num := 1; num <= 3; num++ {
+			owner := (num - 1) / 2
+			player := ggpo.NewRemotePlayer(20, num, ip, ports[owner])
+			if owner == i {
+				player = ggpo.NewLocalPlayer(20, num)
+			}
+			var handle ggpo.PlayerHandle
+			err := p.AddPlayer(&player, &handle)
+			if err != nil {
+				t.Fatalf("Error when adding player %d to peer %d: %s", num, i+1, err)
+			}
+			if owner == 0 && i == 0 {
+				runner.AddLocalPlayer(handle)
+			}
+		}
+	}
+	advance := func() int64 {
+		return time.Now().Add(time.Millisecond * 2000).UnixMilli()
+	}
+	running := func() bool {
+		status, err := peer.GetPlayerStatus(ggpo.PlayerHandle(3))
+		return err == nil && status.State == ggpo.PlayerStateRunning && remote.running
+	}
+	for i := 0; i < 4*protocol.NumSyncPackets && !running(); i++ {
+		peer.Idle(0, advance)
+		remotePeer.Idle(0, advance)
+	}
+	if !running() {
+		t.Fatalf("Both peers should be running.")
+	}
+
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			backend.stalls = 2
+		}
+		err := runner.Step()
+		if err != nil {
+			t.Fatalf("Step %d failed: %s", i, err)
+		}
+		remotePeer.Idle(0)
+		remotePeer.AddLocalInput(ggpo.PlayerHandle(3), []byte{1, 0, 0, 0}, 4)
+		remote.step()
+	}
+	if game.frame != 8 {
+		t.Errorf("expected 8 frames to run around the 2 that were turned away, got %d", game.frame)
+	}
+}
@@ -8,8 +8,49 @@ type Session interface {
 	//SetBackend(backend Backend)
 }
 
+/*
+Passing this to AdvanceFrame leaves desync detection off for the frame. A
+session made with NewBufferedSession is the exception: it uses the checksum of
+the saved state instead, which is how a BufferedSession gets its checksums.
+*/
 const DefaultChecksum = 0
 
+/*
+Guesses a player's input for frames that haven't arrived yet. recent holds up
+to the last 8 confirmed inputs for that player, oldest first, and may be empty
+at the start of a match. The returned slice must be the session's input size
+and must not alias recent. The default prediction repeats the last confirmed
+input; mispredictions are still caught when the real input arrives.
+*/
+type InputPredictor interface {
+	PredictInput(frame int, recent [][]byte) []byte
+}
+
+/*
+Implemented by sessions that can hand over their game state for desync
+reports, see Peer.SetDesyncReports. It is called right after each frame is
+advanced, so the result must not alias state the game keeps mutating.
+*/
+type StateSerializer interface {
+	SerializeGameState() []byte
+}
+
+/*
+Implemented by sessions that can restore a state produced by StateSerializer,
+which DesyncPolicyResync needs to take over another peer's state.
+*/
+type StateDeserializer interface {
+	DeserializeGameState(state []byte)
+}
+
+/*
+Compares the local and remote serialized states of a desynced frame and
+returns one line per field that diverged.
+*/
+type StateDiffer interface {
+	DiffStates(local []byte, remote []byte) []string
+}
+
 type SessionCallbacks struct {
 	BeginGame     beginGame
 	SaveGameState saveGameState
@@ -1,6 +1,8 @@
 package ggpo
 
 import (
+	"time"
+
 	"github.com/assemblaj/ggpo/internal/input"
 	"github.com/assemblaj/ggpo/internal/messages"
 	"github.com/assemblaj/ggpo/internal/polling"
@@ -13,22 +15,76 @@ const SpectatorFrameBufferSize int = 32
 const DefaultMaxFramesBehind int = 10
 const DefaultCatchupSpeed int = 1
 
+// How long to wait for the host to answer a retransmit request before asking again.
+const SpectatorRetransmitInterval int64 = 200
+
+// Playback never slows below this rate while the jitter buffer is starved.
+const MinSpectatorPlaybackRate float32 = 0.5
+
 type Spectator struct {
 	session         Session
 	poll            polling.Poller
 	connection      transport.Connection
-	host            protocol.UdpProtocol
+	hosts           []protocol.UdpProtocol
 	synchonizing    bool
 	inputSize       int
 	numPlayers      int
 	nextInputToSend int
 	inputs          []input.GameInput
-	hostIp          string
-	hostPort        int
+	hostAddresses   []hostAddress
 	framesBehind    int
 	localPort       int
 	currentFrame    int
 	messageChannel  chan transport.MessageChannelItem
+
+	// Broadcast delay: a frame is only released by SyncInput once the host
+	// has sent us broadcastDelay frames past it.
+	broadcastDelay    int
+	lastReceivedFrame int
+
+	// Jitter buffer
+	targetBufferFrames int
+	maxFramesBehind    int
+	catchupSpeed       int
+	prebuffering       bool
+	catchingUp         bool
+	playbackCredit     float32
+	playbackRate       float32
+	catchupFrames      int
+	stalledFrames      int
+
+	// Gap recovery: confirmed frames resent by the host after they were
+	// overwritten in inputs before we could play them.
+	retransmitted         map[int]input.GameInput
+	retransmitFrame       int
+	retransmitRequestTime int64
+	historyLost           bool
+
+	// Disconnect flags for the players, as sent by the host with every frame.
+	// disconnectedPlayers are the ones we've already raised an event for.
+	disconnectFlags     int
+	disconnectedPlayers int
+
+	// Failover: every candidate host streams the same confirmed inputs, so
+	// we listen to all of them and only talk to activeHost.
+	activeHost       int
+	hostDisconnected []bool
+	hostTimeout      int
+	hostTimeoutSet   bool
+}
+
+type hostAddress struct {
+	ip   string
+	port int
+}
+
+type SpectatorStats struct {
+	BufferedFrames int     // confirmed frames received but not yet played
+	TargetFrames   int     // jitter buffer depth we're aiming for
+	FramesBehind   int     // frames buffered beyond the target
+	CatchupFrames  int     // extra frames run to catch up since the start
+	StalledFrames  int     // ticks held back to let the buffer refill
+	PlaybackRate   float32 // current playback speed, 1 is real time
 }
 
 func NewSpectator(cb Session, localPort int, numPlayers int, inputSize int, hostIp string, hostPort int) Spectator {
@@ -45,10 +101,15 @@ func NewSpectator(cb Session, localPort int, numPlayers int, inputSize int, host
 		i.Frame = -1
 	}
 	s.inputs = inputs
+	s.lastReceivedFrame = input.NullFrame
+	s.maxFramesBehind = DefaultMaxFramesBehind
+	s.catchupSpeed = DefaultCatchupSpeed
+	s.playbackRate = 1
+	s.retransmitted = make(map[int]input.GameInput)
+	s.retransmitFrame = input.NullFrame
 	//port := strconv.Itoa(hostPort)
 	//s.udp = NewUdp(&s, localPort)
-	s.hostIp = hostIp
-	s.hostPort = hostPort
+	s.hostAddresses = []hostAddress{{ip: hostIp, port: hostPort}}
 	s.localPort = localPort
 	var poll polling.Poll = polling.NewPoll()
 	s.poll = &poll
@@ -57,6 +118,57 @@ func NewSpectator(cb Session, localPort int, numPlayers int, inputSize int, host
 	return s
 }
 
+/*
+Delays playback by the given number of frames, e.g. for tournament streams
+(see FramesFromDuration to convert a duration). The input buffer grows so it
+can hold the whole delay on top of the usual SpectatorFrameBufferSize.
+Must be called before the spectator has synchronized with the host.
+*/
+func (s *Spectator) SetBroadcastDelay(frames int) error {
+	if frames < 0 || !s.synchonizing {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	s.broadcastDelay = frames
+	s.inputs = make([]input.GameInput, SpectatorFrameBufferSize+frames)
+	for i := range s.inputs {
+		s.inputs[i].Frame = input.NullFrame
+	}
+	return nil
+}
+
+/*
+Adds another player the spectator can watch through. Every host must have
+added this spectator too. The spectator synchronizes with all of them and
+switches to the next one when the current host disconnects or stops sending,
+picking up from the last confirmed frame it has. Adding a host turns on the
+host timeout (DefaultDisconnectTimeout) unless SetHostTimeout was called.
+Must be called before Start.
+*/
+func (s *Spectator) AddHost(ip string, port int) error {
+	if s.hosts != nil || len(s.hostAddresses) == messages.UDPMsgMaxPlayers {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	s.hostAddresses = append(s.hostAddresses, hostAddress{ip: ip, port: port})
+	if !s.hostTimeoutSet {
+		s.hostTimeout = DefaultDisconnectTimeout
+	}
+	return nil
+}
+
+// Sets how long a host can go quiet, in ms, before the spectator moves on to the next one.
+// 0 disables the timeout, which is the default with a single host.
+func (s *Spectator) SetHostTimeout(timeout int) error {
+	if timeout < 0 {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	s.hostTimeout = timeout
+	s.hostTimeoutSet = true
+	for i := range s.hosts {
+		s.hosts[i].SetDisconnectTimeout(timeout)
+	}
+	return nil
+}
+
 func (s *Spectator) Idle(timeout int, timeFunc ...polling.FuncTimeType) error {
 	s.HandleMessages()
 	if len(timeFunc) == 0 {
@@ -66,56 +178,228 @@ func (s *Spectator) Idle(timeout int, timeFunc ...polling.FuncTimeType) error {
 	}
 	s.PollUdpProtocolEvents()
 
-	if s.framesBehind > 0 {
-		for s.nextInputToSend < s.currentFrame {
-			s.session.AdvanceFrame(0)
-			util.Log.Printf("In Spectator: skipping frame %d\n", s.nextInputToSend)
-			s.nextInputToSend++
+	if !s.synchonizing && !s.catchingUp {
+		s.framesBehind = s.BufferedFrames() - s.targetBufferFrames
+		if s.framesBehind > s.maxFramesBehind {
+			// Run a few extra frames this tick rather than skipping straight
+			// to the newest input. The session's AdvanceFrame callback pulls
+			// them through SyncInput like any other frame.
+			s.catchingUp = true
+			for i := 0; i < s.catchupSpeed && s.BufferedFrames() > s.targetBufferFrames; i++ {
+				util.Log.Printf("In Spectator: catching up frame %d\n", s.nextInputToSend)
+				s.session.AdvanceFrame(0)
+				s.catchupFrames++
+			}
+			s.catchingUp = false
 		}
-		s.framesBehind = 0
 	}
 
 	return nil
 }
 
+/*
+Number of received frames that haven't been handed out by SyncInput yet,
+not counting the ones still held back by the broadcast delay.
+*/
+func (s *Spectator) BufferedFrames() int {
+	return util.Max(0, s.lastReceivedFrame-s.broadcastDelay-s.nextInputToSend+1)
+}
+
+/*
+Sets how many frames the spectator tries to keep buffered to absorb network
+jitter. Playback waits until the buffer is this full before starting, and
+slows down smoothly when it runs low.
+*/
+func (s *Spectator) SetJitterBuffer(targetFrames int) error {
+	if targetFrames < 0 {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	s.targetBufferFrames = targetFrames
+	s.prebuffering = targetFrames > 0 && s.nextInputToSend == 0
+	return nil
+}
+
+// Sets how many extra frames are run per Idle while catching up.
+func (s *Spectator) SetCatchupSpeed(framesPerTick int) error {
+	if framesPerTick < 1 {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	s.catchupSpeed = framesPerTick
+	return nil
+}
+
+// Sets how far past the jitter buffer target we may fall before catching up.
+func (s *Spectator) SetMaxFramesBehind(frames int) error {
+	if frames < 0 {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	s.maxFramesBehind = frames
+	return nil
+}
+
+func (s *Spectator) GetSpectatorStats() SpectatorStats {
+	buffered := s.BufferedFrames()
+	return SpectatorStats{
+		BufferedFrames: buffered,
+		TargetFrames:   s.targetBufferFrames,
+		FramesBehind:   util.Max(0, buffered-s.targetBufferFrames),
+		CatchupFrames:  s.catchupFrames,
+		StalledFrames:  s.stalledFrames,
+		PlaybackRate:   s.playbackRate,
+	}
+}
+
+/*
+Decides whether this tick gets a frame. Normally every tick does; when the
+jitter buffer runs low playback slows down in proportion to how starved it
+is, so the buffer can refill without a visible freeze.
+*/
+func (s *Spectator) readyToPlay() bool {
+	if s.targetBufferFrames == 0 || s.catchingUp {
+		s.playbackRate = 1
+		return true
+	}
+	buffered := s.BufferedFrames()
+	if s.prebuffering {
+		if buffered < s.targetBufferFrames {
+			return false
+		}
+		s.prebuffering = false
+	}
+	if buffered >= s.targetBufferFrames {
+		s.playbackRate = 1
+		s.playbackCredit = 0
+		return true
+	}
+	s.playbackRate = util.Max(MinSpectatorPlaybackRate, float32(buffered)/float32(s.targetBufferFrames))
+	s.playbackCredit += s.playbackRate
+	if s.playbackCredit < 1 {
+		s.stalledFrames++
+		return false
+	}
+	s.playbackCredit--
+	return true
+}
+
 func (s *Spectator) SyncInput(disconnectFlags *int) ([][]byte, error) {
 	// Wait until we've started to return inputs
 	if s.synchonizing {
 		return nil, Error{Code: ErrorCodeNotSynchronized, Name: "ErrorCodeNotSynchronized"}
 	}
 
-	input := s.inputs[s.nextInputToSend%SpectatorFrameBufferSize]
+	if s.broadcastDelay > 0 && s.nextInputToSend > s.lastReceivedFrame-s.broadcastDelay {
+		// Still inside the broadcast delay window. Wait
+		return nil, Error{Code: ErrorCodePredictionThreshod, Name: "ErrorCodePredictionThreshod"}
+	}
+
+	input := s.inputs[s.nextInputToSend%len(s.inputs)]
+	if input.Frame > s.nextInputToSend {
+		s.framesBehind = input.Frame - s.nextInputToSend
+		// The host is way way way far ahead of the spetator, so the input we
+		// need was overwritten. Get it from the host's history instead.
+		recovered, ok := s.retransmitted[s.nextInputToSend]
+		if !ok {
+			return nil, s.requestRetransmit()
+		}
+		input = recovered
+	}
 	s.currentFrame = input.Frame
 	if input.Frame < s.nextInputToSend {
 		// Haved recieved input from the host yet. Wait
 		return nil, Error{Code: ErrorCodePredictionThreshod, Name: "ErrorCodePredictionThreshod"}
 
 	}
-	if input.Frame > s.nextInputToSend {
-		s.framesBehind = input.Frame - s.nextInputToSend
-		// The host is way way way far ahead of the spetator. How'd this
-		// happen? Any, the input we need is gone forever.
-		return nil, Error{Code: ErrorCodeGeneralFailure, Name: "ErrorCodeGeneralFailure"}
-	}
 	//s.framesBehind = 0
+	if !s.readyToPlay() {
+		// Letting the jitter buffer fill up. Wait
+		return nil, Error{Code: ErrorCodePredictionThreshod, Name: "ErrorCodePredictionThreshod"}
+	}
 
 	//Assert(size >= s.inputSize*s.numPlayers)
 	values := make([][]byte, s.numPlayers)
-	offset := 0
-	counter := 0
-	for offset < len(input.Bits) {
-		values[counter] = input.Bits[offset : s.inputSize+offset]
-		offset += s.inputSize
-		counter++
+	if len(input.Bits) >= s.inputSize*s.numPlayers {
+		for i := 0; i < s.numPlayers; i++ {
+			values[i] = input.Bits[i*s.inputSize : (i+1)*s.inputSize]
+		}
 	}
+	s.disconnectFlags = s.frameDisconnectFlags(&input)
+	s.checkDisconnectedPlayers(input.Frame)
 
 	if disconnectFlags != nil {
-		*disconnectFlags = 0 // xxx: we should get them from the host! -pond3r
+		*disconnectFlags = s.disconnectFlags
 	}
+	delete(s.retransmitted, s.nextInputToSend)
 	s.nextInputToSend++
 	return values, nil
 }
 
+// The host appends the frame's disconnect flags after the players' inputs.
+func (s *Spectator) frameDisconnectFlags(in *input.GameInput) int {
+	if len(in.Bits) <= s.inputSize*s.numPlayers {
+		return 0
+	}
+	return int(in.Bits[s.inputSize*s.numPlayers])
+}
+
+/*
+Raises EventCodeDisconnectedFromPeer when playback reaches the first frame a
+player is flagged disconnected on, using the same handle the players' sessions
+use.
+*/
+func (s *Spectator) checkDisconnectedPlayers(frame int) {
+	for i := 0; i < s.numPlayers; i++ {
+		if s.disconnectFlags&(1<<i) == 0 || s.disconnectedPlayers&(1<<i) != 0 {
+			continue
+		}
+		s.disconnectedPlayers |= 1 << i
+		util.Log.Printf("In Spectator: player %d disconnected at frame %d.\n", i+1, frame)
+		var info Event
+		info.Code = EventCodeDisconnectedFromPeer
+		info.Player = PlayerHandle(i + 1)
+		s.session.OnEvent(&info)
+	}
+}
+
+/*
+Asks the host for every frame from nextInputToSend on that we've received but
+not played yet. Only one request is outstanding at a time; it's repeated every
+SpectatorRetransmitInterval until the host answers.
+*/
+func (s *Spectator) requestRetransmit() error {
+	if s.historyLost {
+		return Error{Code: ErrorCodeInputDropped, Name: "ErrorCodeInputDropped"}
+	}
+	now := time.Now().UnixMilli()
+	if s.retransmitFrame != s.nextInputToSend || now-s.retransmitRequestTime >= SpectatorRetransmitInterval {
+		count := util.Min(s.lastReceivedFrame-s.nextInputToSend+1, SpectatorHistoryLength)
+		util.Log.Printf("In Spectator: requesting frames %d to %d from the host.\n", s.nextInputToSend, s.nextInputToSend+count-1)
+		s.hosts[s.activeHost].SendRetransmitRequest(0, s.nextInputToSend, count)
+		s.retransmitFrame = s.nextInputToSend
+		s.retransmitRequestTime = now
+	}
+	return Error{Code: ErrorCodePredictionThreshod, Name: "ErrorCodePredictionThreshod"}
+}
+
+/*
+Picks playback back up at frame after the game has resynced from a snapshot
+because the host no longer had the frames we were missing
+(see EventCodeSpectatorResync).
+*/
+func (s *Spectator) ResumeFrom(frame int) error {
+	if frame < 0 {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	s.nextInputToSend = frame
+	s.historyLost = false
+	s.retransmitFrame = input.NullFrame
+	for f := range s.retransmitted {
+		if f < frame {
+			delete(s.retransmitted, f)
+		}
+	}
+	return nil
+}
+
 func (s *Spectator) AdvanceFrame(checksum uint32) error {
 	util.Log.Printf("End of frame (%d)...\n", s.nextInputToSend-1)
 	s.Idle(0)
@@ -125,17 +409,44 @@ func (s *Spectator) AdvanceFrame(checksum uint32) error {
 }
 
 func (s *Spectator) PollUdpProtocolEvents() {
-	for {
-		evt, ok := s.host.GetEvent()
-		if ok != nil {
-			break
-		} else {
-			s.OnUdpProtocolEvent(evt)
+	for i := range s.hosts {
+		for {
+			evt, ok := s.hosts[i].GetEvent()
+			if ok != nil {
+				break
+			} else {
+				s.OnUdpProtocolEvent(evt, i)
+			}
+		}
+	}
+}
+
+/*
+Drops a host that has disconnected and, if it was the one we were talking to,
+moves on to the next candidate still connected. Only once every host is gone
+is the user told the spectator was disconnected.
+*/
+func (s *Spectator) failover(queue int) {
+	s.hostDisconnected[queue] = true
+	s.hosts[queue].Disconnect()
+	if queue != s.activeHost {
+		return
+	}
+	for i := range s.hosts {
+		if !s.hostDisconnected[i] {
+			util.Log.Printf("In Spectator: host %d left, switching to host %d at frame %d.\n", queue, i, s.nextInputToSend)
+			s.activeHost = i
+			s.retransmitFrame = input.NullFrame
+			return
 		}
 	}
+	var info Event
+	info.Code = EventCodeDisconnectedFromPeer
+	info.Player = 0
+	s.session.OnEvent(&info)
 }
 
-func (s *Spectator) OnUdpProtocolEvent(evt *protocol.UdpProtocolEvent) {
+func (s *Spectator) OnUdpProtocolEvent(evt *protocol.UdpProtocolEvent, queue int) {
 	var info Event
 	switch evt.Type() {
 	case protocol.ConnectedEvent:
@@ -161,34 +472,69 @@ func (s *Spectator) OnUdpProtocolEvent(evt *protocol.UdpProtocolEvent) {
 			s.synchonizing = false
 		}
 
+	case protocol.ProtocolMismatchEvent:
+		info.Code = EventCodeMismatchedPeer
+		info.Player = 0
+		s.session.OnEvent(&info)
+
 	case protocol.NetworkInterruptedEvent:
+		if queue != s.activeHost {
+			break
+		}
 		info.Code = EventCodeConnectionInterrupted
 		info.Player = 0
 		info.DisconnectTimeout = evt.DisconnectTimeout
 		s.session.OnEvent(&info)
 
 	case protocol.NetworkResumedEvent:
+		if queue != s.activeHost {
+			break
+		}
 		info.Code = EventCodeConnectionResumed
 		info.Player = 0
 		s.session.OnEvent(&info)
 
 	case protocol.DisconnectedEvent:
-		info.Code = EventCodeDisconnectedFromPeer
-		info.Player = 0
-		s.session.OnEvent(&info)
+		if !s.hostDisconnected[queue] {
+			s.failover(queue)
+		}
 
 	case protocol.InputEvent:
 		input := evt.Input
 
-		s.host.SetLocalFrameNumber(input.Frame)
-		s.host.SendInputAck()
-		s.inputs[input.Frame%SpectatorFrameBufferSize] = input
+		s.hosts[queue].SetLocalFrameNumber(input.Frame)
+		s.hosts[queue].SendInputAck()
+		// Every host sends the same frames; keep whichever copy is newest.
+		if input.Frame >= s.inputs[input.Frame%len(s.inputs)].Frame {
+			s.inputs[input.Frame%len(s.inputs)] = input
+		}
+		s.lastReceivedFrame = util.Max(s.lastReceivedFrame, input.Frame)
+
+	case protocol.RetransmitEvent:
+		s.retransmitFrame = input.NullFrame
+		if evt.Unavailable {
+			if !s.historyLost && evt.Frame == s.nextInputToSend {
+				s.historyLost = true
+				info.Code = EventCodeSpectatorResync
+				info.Player = 0
+				info.Frame = evt.Frame
+				s.session.OnEvent(&info)
+			}
+			break
+		}
+		for _, input := range evt.Inputs {
+			if input.Frame >= s.nextInputToSend {
+				s.retransmitted[input.Frame] = input
+			}
+		}
 	}
 }
 
 func (s *Spectator) HandleMessage(ipAddress string, port int, msg messages.UDPMessage, len int) {
-	if s.host.HandlesMsg(ipAddress, port) {
-		s.host.OnMsg(msg, len)
+	for i := range s.hosts {
+		if s.hosts[i].HandlesMsg(ipAddress, port) {
+			s.hosts[i].OnMsg(msg, len)
+		}
 	}
 }
 
@@ -207,6 +553,31 @@ func (s *Spectator) DisconnectPlayer(handle PlayerHandle) error {
 func (s *Spectator) GetNetworkStats(handle PlayerHandle) (protocol.NetworkStats, error) {
 	return protocol.NetworkStats{}, Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
 }
+func (s *Spectator) GetSessionStats() (SessionStats, error) {
+	return SessionStats{}, Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+}
+
+/*
+Handle 0 is the host we're watching through and the players keep the handles
+their own sessions use. Players share the host's connection unless the host
+told us they disconnected. The last confirmed frame is the newest one received.
+*/
+func (s *Spectator) GetPlayerStatus(handle PlayerHandle) (PlayerStatus, error) {
+	if handle < 0 || int(handle) > s.numPlayers {
+		return PlayerStatus{}, Error{Code: ErrorCodeInvalidPlayerHandle, Name: "ErrorCodeInvalidPlayerHandle"}
+	}
+	if s.hosts == nil {
+		// nothing to report on until Start
+		return PlayerStatus{}, Error{Code: ErrorCodeNotSynchronized, Name: "ErrorCodeNotSynchronized"}
+	}
+	status := endpointStatus(&s.hosts[s.activeHost])
+	status.LastConfirmedFrame = s.lastReceivedFrame
+	if handle > 0 && s.disconnectFlags&(1<<(int(handle)-1)) != 0 {
+		status.State = PlayerStateDisconnected
+		status.FramesUntilDisconnect = -1
+	}
+	return status, nil
+}
 func (s *Spectator) SetFrameDelay(player PlayerHandle, delay int) error {
 	return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
 }
@@ -238,8 +609,13 @@ func (s *Spectator) HandleMessages() {
 func (s *Spectator) Start() {
 	go s.connection.Read(s.messageChannel)
 
-	s.host = protocol.NewUdpProtocol(s.connection, 0, s.hostIp, s.hostPort, nil)
-	s.poll.RegisterLoop(&s.host, nil)
-	s.host.Synchronize()
+	s.hosts = make([]protocol.UdpProtocol, len(s.hostAddresses))
+	s.hostDisconnected = make([]bool, len(s.hostAddresses))
+	for i, address := range s.hostAddresses {
+		s.hosts[i] = protocol.NewUdpProtocol(s.connection, i, address.ip, address.port, nil)
+		s.poll.RegisterLoop(&s.hosts[i], nil)
+		s.hosts[i].SetDisconnectTimeout(s.hostTimeout)
+		s.hosts[i].Synchronize()
+	}
 
 }
@@ -311,17 +311,13 @@ func TestNewSpectatorBackendCharacterization(t *testing.T) {
 	inputBytes := []byte{1, 2, 3, 4}
 	inputBytes2 := []byte{5, 6, 7, 8}
 	var ignore int
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic when framecount hadn't been incremented..")
-		}
-	}()
+	var inputErr error
 
 	for i := 0; i < 2; i++ {
 		p2p2.Idle(0, advance)
 		err := p2p2.AddLocalInput(p2Handle, inputBytes2, len(inputBytes2))
 		if err != nil {
-			t.Errorf(" Error when adding local input to p2, %s", err)
+			inputErr = err
 		} else {
 			_, err = p2p2.SyncInput(&ignore)
 			if err == nil {
@@ -346,6 +342,9 @@ func TestNewSpectatorBackendCharacterization(t *testing.T) {
 			stb.AdvanceFrame(ggpo.DefaultChecksum)
 		}
 	}
+	if !hasErrorCode(inputErr, ggpo.ErrorCodeInvalidInput) {
+		t.Errorf("Expected ErrorCodeInvalidInput when framecount hadn't been incremented, got %v", inputErr)
+	}
 }
 
 func TestNewSpectatorBackendNoInputYet(t *testing.T) {
@@ -653,3 +652,534 @@ func TestSpectatorBackendAddPlayerError(t *testing.T) {
 		t.Errorf("The code did not error when using an unsupported Feature.")
 	}
 }
+
+type spectatorTestSession struct {
+	p2p      *ggpo.Peer
+	p2p2     *ggpo.Peer
+	stb      *ggpo.Spectator
+	events   *spectatorEventSession
+	p1Handle ggpo.PlayerHandle
+	p2Handle ggpo.PlayerHandle
+}
+
+// Keeps the players the spectator was told disconnected.
+type spectatorEventSession struct {
+	mocks.FakeSessionWithBackend
+	disconnected []ggpo.PlayerHandle
+}
+
+func (s *spectatorEventSession) OnEvent(info *ggpo.Event) {
+	if info.Code == ggpo.EventCodeDisconnectedFromPeer {
+		s.disconnected = append(s.disconnected, info.Player)
+	}
+}
+
+// Two peers on localPort/remotePort with a spectator watching the first one.
+// configure runs before anything is started, so backend options can be set.
+func newSpectatorTestSession(configure func(s *spectatorTestSession)) spectatorTestSession {
+	session := mocks.NewFakeSession()
+	localPort := 6000
+	remotePort := 6001
+	remoteIp := "127.2.1.1"
+	numPlayers := 2
+	inputSize := 4
+	p2p := ggpo.NewPeer(&session, localPort, numPlayers, inputSize)
+
+	session2 := mocks.NewFakeSession()
+	p2p2 := ggpo.NewPeer(&session2, remotePort, numPlayers, inputSize)
+
+	var stb ggpo.Spectator
+	session3 := &spectatorEventSession{FakeSessionWithBackend: mocks.NewFakeSessionWithBackend()}
+	session3.SetBackend(&stb)
+	specPort := 6005
+	stb = ggpo.NewSpectator(session3, specPort, numPlayers, inputSize, remoteIp, localPort)
+
+	s := spectatorTestSession{p2p: &p2p, p2p2: &p2p2, stb: &stb, events: session3}
+
+	connection := mocks.NewFakeMultiplePeerConnection([]transport.MessageHandler{&p2p2, &stb}, localPort, remoteIp)
+	// p2 and the spectator can see each other so p2 can be added as a second host.
+	connection2 := mocks.NewFakeMultiplePeerConnection([]transport.MessageHandler{&p2p, &stb}, remotePort, remoteIp)
+	connection3 := mocks.NewFakeMultiplePeerConnection([]transport.MessageHandler{&p2p, &p2p2}, specPort, remoteIp)
+
+	p2p.InitializeConnection(&connection)
+	p2p2.InitializeConnection(&connection2)
+	stb.InitializeConnection(&connection3)
+
+	player1 := ggpo.NewLocalPlayer(20, 1)
+	player2 := ggpo.NewRemotePlayer(20, 2, remoteIp, remotePort)
+	spectator := ggpo.NewSpectatorPlayer(20, remoteIp, specPort)
+	var specHandle ggpo.PlayerHandle
+	p2p.AddPlayer(&player1, &s.p1Handle)
+	p2p.AddPlayer(&player2, &s.p2Handle)
+	p2p.AddPlayer(&spectator, &specHandle)
+
+	player1 = ggpo.NewRemotePlayer(20, 1, remoteIp, localPort)
+	player2 = ggpo.NewLocalPlayer(20, 2)
+	var ignore ggpo.PlayerHandle
+	p2p2.AddPlayer(&player1, &ignore)
+	p2p2.AddPlayer(&player2, &ignore)
+
+	if configure != nil {
+		configure(&s)
+	}
+
+	stb.Start()
+	advance := func() int64 {
+		return time.Now().Add(time.Millisecond * 2000).UnixMilli()
+	}
+	for i := 0; i < protocol.NumSyncPackets; i++ {
+		p2p.Idle(0, advance)
+		p2p2.Idle(0, advance)
+		stb.Idle(0, advance)
+	}
+	return s
+}
+
+// Runs a frame on both peers with the given inputs.
+func (s *spectatorTestSession) advancePeers(t *testing.T, input1 []byte, input2 []byte) {
+	s.p2p2.Idle(0)
+	err := s.p2p2.AddLocalInput(s.p2Handle, input2, len(input2))
+	if err != nil {
+		t.Errorf("Error when adding local input to p2, %s", err)
+	}
+	s.p2p2.AdvanceFrame(ggpo.DefaultChecksum)
+
+	s.p2p.Idle(0)
+	err = s.p2p.AddLocalInput(s.p1Handle, input1, len(input1))
+	if err != nil {
+		t.Errorf("Error when adding local input to p1, %s", err)
+	}
+	s.p2p.AdvanceFrame(ggpo.DefaultChecksum)
+}
+
+func TestSpectatorBroadcastDelay(t *testing.T) {
+	delay := 3
+	s := newSpectatorTestSession(func(s *spectatorTestSession) {
+		err := s.stb.SetBroadcastDelay(delay)
+		if err != nil {
+			t.Errorf("Error when setting the broadcast delay, %s", err)
+		}
+	})
+	inputBytes := []byte{1, 2, 3, 4}
+	inputBytes2 := []byte{5, 6, 7, 8}
+	var ignore int
+
+	for i := 0; i < 2; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+	}
+	s.stb.Idle(0)
+	_, err := s.stb.SyncInput(&ignore)
+	ggErr, ok := err.(ggpo.Error)
+	if !ok || ggErr.Code != ggpo.ErrorCodePredictionThreshod {
+		t.Errorf("The spectator should hold inputs back while inside the broadcast delay, got %v", err)
+	}
+
+	for i := 0; i < delay+1; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+	}
+	s.stb.Idle(0)
+	vals, err := s.stb.SyncInput(&ignore)
+	if err != nil {
+		t.Errorf("Error when spectator synchronize inputs after the broadcast delay. %s", err)
+	} else if !bytes.Equal(inputBytes, vals[0]) || !bytes.Equal(inputBytes2, vals[1]) {
+		t.Errorf("Spectator returned %v after the broadcast delay, expected %v and %v", vals, inputBytes, inputBytes2)
+	}
+}
+
+func TestSpectatorBroadcastDelayAfterStart(t *testing.T) {
+	s := newSpectatorTestSession(nil)
+	err := s.stb.SetBroadcastDelay(5)
+	if err == nil {
+		t.Errorf("Setting the broadcast delay after synchronizing should be an error.")
+	}
+}
+
+func TestPeerSpectatorDelay(t *testing.T) {
+	delay := 4
+	s := newSpectatorTestSession(func(s *spectatorTestSession) {
+		err := s.p2p.SetSpectatorDelay(delay)
+		if err != nil {
+			t.Errorf("Error when setting the spectator delay, %s", err)
+		}
+	})
+	inputBytes := []byte{1, 2, 3, 4}
+	inputBytes2 := []byte{5, 6, 7, 8}
+	var ignore int
+
+	for i := 0; i < delay-1; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+	}
+	s.stb.Idle(0)
+	vals, _ := s.stb.SyncInput(&ignore)
+	if len(vals) > 0 && bytes.Equal(inputBytes, vals[0]) {
+		t.Errorf("The host should not have sent any input to the spectator inside the delay window.")
+	}
+
+	s = newSpectatorTestSession(func(s *spectatorTestSession) {
+		s.p2p.SetSpectatorDelay(delay)
+	})
+	for i := 0; i < delay+2; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+	}
+	s.stb.Idle(0)
+	vals, err := s.stb.SyncInput(&ignore)
+	if err != nil {
+		t.Errorf("Error when spectator synchronize inputs after the host's spectator delay. %s", err)
+	} else if !bytes.Equal(inputBytes, vals[0]) {
+		t.Errorf("Spectator returned %v after the host's spectator delay, expected %v", vals[0], inputBytes)
+	}
+}
+
+func TestSpectatorJitterBufferPrebuffers(t *testing.T) {
+	target := 4
+	s := newSpectatorTestSession(func(s *spectatorTestSession) {
+		s.stb.SetJitterBuffer(target)
+	})
+	inputBytes := []byte{1, 2, 3, 4}
+	inputBytes2 := []byte{5, 6, 7, 8}
+	var ignore int
+
+	s.advancePeers(t, inputBytes, inputBytes2)
+	s.advancePeers(t, inputBytes, inputBytes2)
+	s.stb.Idle(0)
+	_, err := s.stb.SyncInput(&ignore)
+	if err == nil {
+		t.Errorf("The spectator should wait for the jitter buffer to fill before playing.")
+	}
+
+	for i := 0; i < target+2; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+	}
+	s.stb.Idle(0)
+	vals, err := s.stb.SyncInput(&ignore)
+	if err != nil {
+		t.Errorf("Error when spectator synchronize inputs with a full jitter buffer. %s", err)
+	} else if !bytes.Equal(inputBytes, vals[0]) {
+		t.Errorf("Spectator returned %v, expected %v", vals[0], inputBytes)
+	}
+	stats := s.stb.GetSpectatorStats()
+	if stats.TargetFrames != target || stats.BufferedFrames < target-1 {
+		t.Errorf("Unexpected jitter buffer stats %+v", stats)
+	}
+}
+
+func TestSpectatorJitterBufferSlowsDownWhenStarved(t *testing.T) {
+	target := 4
+	s := newSpectatorTestSession(func(s *spectatorTestSession) {
+		s.stb.SetJitterBuffer(target)
+	})
+	inputBytes := []byte{1, 2, 3, 4}
+	inputBytes2 := []byte{5, 6, 7, 8}
+	var ignore int
+
+	for i := 0; i < target+2; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+	}
+	s.stb.Idle(0)
+	played := 0
+	for i := 0; i < 6; i++ {
+		_, err := s.stb.SyncInput(&ignore)
+		if err == nil {
+			played++
+		}
+	}
+	stats := s.stb.GetSpectatorStats()
+	if stats.StalledFrames == 0 {
+		t.Errorf("The spectator should have held back some ticks as the jitter buffer drained, stats %+v", stats)
+	}
+	if played == 0 {
+		t.Errorf("The spectator should keep playing, only slower, while the buffer drains.")
+	}
+}
+
+func TestSpectatorCatchesUp(t *testing.T) {
+	s := newSpectatorTestSession(func(s *spectatorTestSession) {
+		s.stb.SetMaxFramesBehind(2)
+		s.stb.SetCatchupSpeed(3)
+	})
+	inputBytes := []byte{1, 2, 3, 4}
+	inputBytes2 := []byte{5, 6, 7, 8}
+
+	for i := 0; i < 10; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+	}
+	s.stb.Idle(0)
+	stats := s.stb.GetSpectatorStats()
+	if stats.CatchupFrames != 3 {
+		t.Errorf("expected the spectator to run 3 catch up frames but it ran %d", stats.CatchupFrames)
+	}
+	before := stats.BufferedFrames
+	s.stb.Idle(0)
+	after := s.stb.GetSpectatorStats().BufferedFrames
+	if after >= before {
+		t.Errorf("Catching up should drain the buffer, had %d frames and now %d", before, after)
+	}
+}
+
+func TestSpectatorRecoversOverwrittenInput(t *testing.T) {
+	s := newSpectatorTestSession(func(s *spectatorTestSession) {
+		s.stb.SetMaxFramesBehind(1000)
+	})
+	inputBytes := []byte{1, 2, 3, 4}
+	inputBytes2 := []byte{5, 6, 7, 8}
+	var ignore int
+
+	// The spectator keeps receiving but doesn't play, so frame 0 gets
+	// overwritten in its input buffer.
+	for i := 0; i < ggpo.SpectatorFrameBufferSize+8; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+		s.stb.Idle(0)
+	}
+	_, err := s.stb.SyncInput(&ignore)
+	ggErr, ok := err.(ggpo.Error)
+	if !ok || ggErr.Code != ggpo.ErrorCodePredictionThreshod {
+		t.Errorf("The spectator should wait on the host to resend lost frames, got %v", err)
+	}
+
+	s.p2p.Idle(0)
+	s.stb.Idle(0)
+	for i := 0; i < ggpo.SpectatorFrameBufferSize+8; i++ {
+		vals, err := s.stb.SyncInput(&ignore)
+		if err != nil {
+			t.Fatalf("Error when spectator synchronize inputs for frame %d after a retransmit. %s", i, err)
+		}
+		if !bytes.Equal(inputBytes, vals[0]) || !bytes.Equal(inputBytes2, vals[1]) {
+			t.Errorf("Spectator returned %v for frame %d, expected %v and %v", vals, i, inputBytes, inputBytes2)
+		}
+	}
+}
+
+func TestSpectatorHistoryGone(t *testing.T) {
+	s := newSpectatorTestSession(func(s *spectatorTestSession) {
+		s.stb.SetMaxFramesBehind(ggpo.SpectatorHistoryLength * 2)
+	})
+	inputBytes := []byte{1, 2, 3, 4}
+	inputBytes2 := []byte{5, 6, 7, 8}
+	var ignore int
+
+	frames := ggpo.SpectatorHistoryLength + 10
+	for i := 0; i < frames; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+		s.stb.Idle(0)
+	}
+	s.stb.SyncInput(&ignore)
+	s.p2p.Idle(0)
+	s.stb.Idle(0)
+	_, err := s.stb.SyncInput(&ignore)
+	ggErr, ok := err.(ggpo.Error)
+	if !ok || ggErr.Code != ggpo.ErrorCodeInputDropped {
+		t.Errorf("The spectator should report dropped input once the host's history is gone, got %v", err)
+	}
+
+	err = s.stb.ResumeFrom(frames - 4)
+	if err != nil {
+		t.Errorf("Error when resuming the spectator. %s", err)
+	}
+	vals, err := s.stb.SyncInput(&ignore)
+	if err != nil {
+		t.Errorf("Error when spectator synchronize inputs after resuming. %s", err)
+	} else if !bytes.Equal(inputBytes, vals[0]) {
+		t.Errorf("Spectator returned %v after resuming, expected %v", vals[0], inputBytes)
+	}
+}
+
+func TestSpectatorGetsDisconnectFlags(t *testing.T) {
+	s := newSpectatorTestSession(nil)
+	inputBytes := []byte{1, 2, 3, 4}
+	inputBytes2 := []byte{5, 6, 7, 8}
+
+	for i := 0; i < 2; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+	}
+	// Let the host see player 2's input for the current frame so the
+	// disconnect doesn't need a rollback.
+	s.p2p2.Idle(0)
+	s.p2p2.AddLocalInput(s.p2Handle, inputBytes2, len(inputBytes2))
+	s.p2p.Idle(0)
+	err := s.p2p.DisconnectPlayer(s.p2Handle)
+	if err != nil {
+		t.Errorf("Error when disconnecting player 2, %s", err)
+	}
+	for i := 0; i < 4; i++ {
+		s.p2p.Idle(0)
+		s.p2p.AddLocalInput(s.p1Handle, inputBytes, len(inputBytes))
+		s.p2p.AdvanceFrame(ggpo.DefaultChecksum)
+	}
+	s.stb.Idle(0)
+
+	sawDisconnect := false
+	for i := 0; i < 6; i++ {
+		var disconnectFlags int
+		vals, err := s.stb.SyncInput(&disconnectFlags)
+		if err != nil {
+			break
+		}
+		if disconnectFlags&(1<<1) != 0 {
+			sawDisconnect = true
+			if !bytes.Equal(vals[1], make([]byte, len(inputBytes2))) {
+				t.Errorf("A disconnected player's input should be zeroed, got %v", vals[1])
+			}
+		} else if sawDisconnect {
+			t.Errorf("Player 2 shouldn't reconnect on frame %d.", i)
+		}
+		if disconnectFlags&1 != 0 {
+			t.Errorf("Player 1 should still be connected on frame %d.", i)
+		}
+	}
+	if !sawDisconnect {
+		t.Errorf("The spectator should have received the disconnect flags from the host.")
+	}
+}
+
+// A disconnect is news once playback reaches it, not when its frame arrives.
+func TestSpectatorDisconnectEventWithBroadcastDelay(t *testing.T) {
+	s := newSpectatorTestSession(func(s *spectatorTestSession) {
+		err := s.stb.SetBroadcastDelay(8)
+		if err != nil {
+			t.Errorf("Error when setting the broadcast delay, %s", err)
+		}
+	})
+	inputBytes := []byte{1, 2, 3, 4}
+	inputBytes2 := []byte{5, 6, 7, 8}
+	for i := 0; i < 2; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+	}
+	s.p2p2.Idle(0)
+	s.p2p2.AddLocalInput(s.p2Handle, inputBytes2, len(inputBytes2))
+	s.p2p.Idle(0)
+	err := s.p2p.DisconnectPlayer(s.p2Handle)
+	if err != nil {
+		t.Errorf("Error when disconnecting player 2, %s", err)
+	}
+	for i := 0; i < 12; i++ {
+		s.p2p.Idle(0)
+		s.p2p.AddLocalInput(s.p1Handle, inputBytes, len(inputBytes))
+		s.p2p.AdvanceFrame(ggpo.DefaultChecksum)
+	}
+	s.stb.Idle(0)
+	if len(s.events.disconnected) != 0 {
+		t.Fatalf("The spectator shouldn't hear of the disconnect before playing up to it, got %v", s.events.disconnected)
+	}
+
+	for i := 0; i < 8; i++ {
+		var disconnectFlags int
+		_, err := s.stb.SyncInput(&disconnectFlags)
+		if err != nil {
+			break
+		}
+		flagged := disconnectFlags&(1<<1) != 0
+		if flagged != (len(s.events.disconnected) == 1) {
+			t.Fatalf("expected the disconnect event with the first flagged frame, got flags %d and events %v on frame %d",
+				disconnectFlags, s.events.disconnected, i)
+		}
+	}
+	if len(s.events.disconnected) != 1 || s.events.disconnected[0] != s.p2Handle {
+		t.Errorf("expected the spectator to see player 2 disconnect once, got %v", s.events.disconnected)
+	}
+}
+
+func TestSpectatorFailsOverToAnotherHost(t *testing.T) {
+	s := newSpectatorTestSession(func(s *spectatorTestSession) {
+		err := s.stb.AddHost("127.2.1.1", 6001)
+		if err != nil {
+			t.Errorf("Error when adding a second host, %s", err)
+		}
+		spectator := ggpo.NewSpectatorPlayer(20, "127.2.1.1", 6005)
+		var specHandle ggpo.PlayerHandle
+		s.p2p2.AddPlayer(&spectator, &specHandle)
+		s.stb.SetHostTimeout(50)
+		s.stb.SetMaxFramesBehind(1000)
+	})
+	// Give the second host's handshake with the spectator time to finish.
+	advance := func() int64 {
+		return time.Now().Add(time.Millisecond * 2000).UnixMilli()
+	}
+	for i := 0; i < protocol.NumSyncPackets; i++ {
+		s.p2p.Idle(0, advance)
+		s.p2p2.Idle(0, advance)
+		s.stb.Idle(0, advance)
+	}
+	inputBytes := []byte{1, 2, 3, 4}
+	inputBytes2 := []byte{5, 6, 7, 8}
+	var ignore int
+
+	frames := ggpo.SpectatorFrameBufferSize + 8
+	for i := 0; i < frames; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+		s.stb.Idle(0)
+	}
+
+	// The first host goes quiet, only the second one is still around to
+	// resend the frames the spectator has lost.
+	time.Sleep(100 * time.Millisecond)
+	s.p2p2.Idle(0)
+	s.stb.Idle(0)
+	s.stb.SyncInput(&ignore)
+	s.p2p2.Idle(0)
+	s.stb.Idle(0)
+	for i := 0; i < frames-1; i++ {
+		vals, err := s.stb.SyncInput(&ignore)
+		if err != nil {
+			t.Fatalf("Error when spectator synchronize inputs for frame %d after failing over. %s", i, err)
+		}
+		if !bytes.Equal(inputBytes, vals[0]) || !bytes.Equal(inputBytes2, vals[1]) {
+			t.Errorf("Spectator returned %v for frame %d, expected %v and %v", vals, i, inputBytes, inputBytes2)
+		}
+	}
+}
+
+func TestSpectatorAddHostAfterStart(t *testing.T) {
+	s := newSpectatorTestSession(nil)
+	err := s.stb.AddHost("127.2.1.1", 6001)
+	if err == nil {
+		t.Errorf("Adding a host after the spectator has started should be an error.")
+	}
+}
+
+func TestSpectatorGetPlayerStatus(t *testing.T) {
+	s := newSpectatorTestSession(nil)
+	inputBytes := []byte{1, 2, 3, 4}
+	inputBytes2 := []byte{5, 6, 7, 8}
+	for i := 0; i < 10; i++ {
+		s.advancePeers(t, inputBytes, inputBytes2)
+	}
+	s.stb.Idle(0)
+
+	// the host's view of the spectator
+	status, err := s.p2p.GetPlayerStatus(1000)
+	if err != nil {
+		t.Fatalf("Error when getting the spectator's status %s", err)
+	}
+	if status.Local || status.State != ggpo.PlayerStateRunning || status.LastConfirmedFrame < 0 {
+		t.Errorf("expected a running spectator that has been sent frames but got %#v", status)
+	}
+	_, err = s.p2p.GetPlayerStatus(1001)
+	if err == nil {
+		t.Errorf("Getting the status of a spectator that doesn't exist should be an error.")
+	}
+
+	// the spectator's view of the host and the players
+	for _, handle := range []ggpo.PlayerHandle{0, 1, 2} {
+		status, err = s.stb.GetPlayerStatus(handle)
+		if err != nil {
+			t.Fatalf("Error when getting the status of handle %d: %s", handle, err)
+		}
+		if status.State != ggpo.PlayerStateRunning || status.LastConfirmedFrame < 0 {
+			t.Errorf("expected handle %d to be running with frames received but got %#v", handle, status)
+		}
+	}
+	_, err = s.stb.GetPlayerStatus(3)
+	if err == nil {
+		t.Errorf("Getting the status of a player that doesn't exist should be an error.")
+	}
+}
+
+func TestSpectatorGetPlayerStatusBeforeStart(t *testing.T) {
+	session := mocks.NewFakeSession()
+	stb := ggpo.NewSpectator(&session, 6005, 2, 4, "127.2.1.1", 6000)
+	_, err := stb.GetPlayerStatus(0)
+	ggErr, ok := err.(ggpo.Error)
+	if !ok || ggErr.Code != ggpo.ErrorCodeNotSynchronized {
+		t.Errorf("Getting a status before Start should be ErrorCodeNotSynchronized, got %v", err)
+	}
+}
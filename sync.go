@@ -2,6 +2,7 @@ package ggpo
 
 import (
 	"errors"
+	"time"
 
 	"github.com/assemblaj/ggpo/internal/util"
 
@@ -22,6 +23,30 @@ type Sync struct {
 	inputQueues []input.InputQueue
 
 	localConnectStatus []messages.UdpConnectStatus
+
+	stats        SessionStats
+	barrierStart time.Time
+
+	sparseSaving   bool
+	lastSavedFrame int
+	// with sparse saving, frames whose state is saved anyway once their
+	// input is confirmed, see SetSavedFrameInterval
+	savedFrameInterval int
+
+	// confirmed inputs kept past the last confirmed frame, see ReplayFrom
+	retainedFrames int
+}
+
+// Rollback and prediction barrier counters, see Backend.GetSessionStats.
+type SessionStats struct {
+	Rollbacks         int           // times the simulation was rolled back
+	RollbackDepth     []int         // RollbackDepth[n] is how many rollbacks went back n frames
+	ResimulatedFrames int           // frames run again during rollbacks
+	LoadStateTime     time.Duration // spent in LoadGameState during rollbacks
+	ResimulateTime    time.Duration // spent in AdvanceFrame during rollbacks
+	BarrierStalls     int           // times AddLocalInput ran into the prediction barrier
+	BarrierRejections int           // inputs rejected at the prediction barrier
+	BarrierTime       time.Duration // spent stuck at the prediction barrier
 }
 
 //const MaxPredictionFrames int = 8
@@ -55,9 +80,10 @@ func NewSync(status []messages.UdpConnectStatus, config *SyncConfig) Sync {
 		localConnectStatus:  status,
 		frameCount:          0,
 		lastConfirmedFrame:  -1,
+		lastSavedFrame:      input.NullFrame,
 		rollingBack:         false,
 		savedState: savedState{
-			frames: make([]savedFrame, MaxPredictionFrames+2)},
+			frames: make([]savedFrame, config.numPredictionFrames+2)},
 	}
 	s.CreateQueues(*config)
 	return s
@@ -83,23 +109,39 @@ func (s *Sync) Close() {
 	s.inputQueues = nil
 }
 
-func (s *Sync) SetLastConfirmedFrame(frame int) {
+func (s *Sync) SetLastConfirmedFrame(frame int) error {
 	s.lastConfirmedFrame = frame
-	if s.lastConfirmedFrame > 0 {
+	discardTo := frame
+	if s.sparseSaving {
+		// rolling back to the last save replays everything after it
+		discardTo = util.Min(discardTo, s.lastSavedFrame)
+	}
+	discardTo -= s.retainedFrames
+	if discardTo > 0 {
 		for i := 0; i < s.config.numPlayers; i++ {
-			err := s.inputQueues[i].DiscardConfirmedFrames(frame - 1)
+			err := s.inputQueues[i].DiscardConfirmedFrames(discardTo - 1)
 			if err != nil {
-				panic(err)
+				return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
 			}
 		}
 	}
+	return nil
 }
 
-func (s *Sync) AddLocalInput(queue int, input *input.GameInput) bool {
+func (s *Sync) AddLocalInput(queue int, input *input.GameInput) error {
 	framesBehind := s.frameCount - s.lastConfirmedFrame
 	if s.frameCount >= s.maxPredictionFrames && framesBehind >= s.maxPredictionFrames {
 		util.Log.Printf("Rejecting input from emulator: reached prediction barrier.\n")
-		return false
+		if s.barrierStart.IsZero() {
+			s.barrierStart = time.Now()
+			s.stats.BarrierStalls++
+		}
+		s.stats.BarrierRejections++
+		return Error{Code: ErrorCodePredictionThreshod, Name: "ErrorCodePredictionThreshod"}
+	}
+	if !s.barrierStart.IsZero() {
+		s.stats.BarrierTime += time.Since(s.barrierStart)
+		s.barrierStart = time.Time{}
 	}
 
 	if s.frameCount == 0 {
@@ -110,24 +152,23 @@ func (s *Sync) AddLocalInput(queue int, input *input.GameInput) bool {
 	input.Frame = s.frameCount
 	err := s.inputQueues[queue].AddInput(input)
 	if err != nil {
-		panic(err)
+		return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput", err)
 	}
-
-	return true
+	return nil
 }
 
-func (s *Sync) AddRemoteInput(queue int, input *input.GameInput) {
-
+func (s *Sync) AddRemoteInput(queue int, input *input.GameInput) error {
 	err := s.inputQueues[queue].AddInput(input)
 	if err != nil {
-		panic(err)
+		return newError(ErrorCodeInvalidInput, "ErrorCodeInvalidInput", err)
 	}
+	return nil
 }
 
 // originally took in a void ptr buffer and filled it with input
 // maybe i should return that the filled buffer instead idk
 // used by p2pbackend
-func (s *Sync) GetConfirmedInputs(frame int) ([][]byte, int) {
+func (s *Sync) GetConfirmedInputs(frame int) ([][]byte, int, error) {
 	disconnectFlags := 0
 	//Assert(size >= s.config.numPlayers*s.config.inputSize)
 
@@ -137,21 +178,22 @@ func (s *Sync) GetConfirmedInputs(frame int) ([][]byte, int) {
 		var input input.GameInput
 		if (s.localConnectStatus[i].Disconnected) && (int32(frame) > s.localConnectStatus[i].LastFrame) {
 			disconnectFlags |= (1 << i)
-			input.Erase()
+			// zeroed rather than left empty so every player keeps their slot
+			input.Bits = make([]byte, s.config.inputSize)
 		} else {
 			_, err := s.inputQueues[i].GetConfirmedInput(frame, &input)
 			if err != nil {
-				panic(err)
+				return nil, 0, newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
 			}
 		}
 		// this was originally a memcpy
 		values = append(values, input.Bits)
 	}
-	return values, disconnectFlags
+	return values, disconnectFlags, nil
 }
 
 // used by p2pbackend
-func (s *Sync) SynchronizeInputs() ([][]byte, int) {
+func (s *Sync) SynchronizeInputs() ([][]byte, int, error) {
 	disconnectFlags := 0
 	//Assert(size >= s.config.numPlayers*s.config.inputSize)
 
@@ -165,32 +207,128 @@ func (s *Sync) SynchronizeInputs() ([][]byte, int) {
 		} else {
 			_, err := s.inputQueues[i].GetInput(s.frameCount, &input)
 			if err != nil {
-				panic(err)
+				return nil, 0, newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
 			}
 		}
 		values = append(values, input.Bits)
 	}
-	return values, disconnectFlags
+	return values, disconnectFlags, nil
 }
 
-func (s *Sync) CheckSimulation(timeout int) {
+func (s *Sync) CheckSimulation(timeout int) error {
 
 	var seekTo int
 	if !s.CheckSimulationConsistency(&seekTo) {
-		err := s.AdjustSimulation(seekTo)
-		if err != nil {
-			panic(err)
-		}
+		return s.AdjustSimulation(seekTo)
+	} else if s.sparseSaving && s.lastSavedFrame < s.lastConfirmedFrame+1 &&
+		s.frameCount-s.lastSavedFrame >= s.maxPredictionFrames {
+		// Nothing was mispredicted for a while, so the only save is getting
+		// old. Replay from it to save the newest confirmed frame instead.
+		return s.AdjustSimulation(s.lastSavedFrame)
 	}
+	return nil
 }
 
 func (s *Sync) AdvanceFrame() {
 	s.frameCount++
 
+	if !s.sparseSaving {
+		s.SaveCurrentFrame()
+		return
+	}
+	// Only states whose inputs are all confirmed get saved, and a rollback
+	// only needs to save the newest of them, plus any whose checksum is wanted.
+	confirmed := s.frameCount <= s.lastConfirmedFrame+1
+	wanted := s.savedFrameInterval > 0 && (s.frameCount-1)%s.savedFrameInterval == 0
+	if confirmed && (!s.rollingBack || s.frameCount == s.lastConfirmedFrame+1 || wanted) {
+		s.SaveCurrentFrame()
+	}
+}
+
+/*
+With sparse saving, also saves the state after every interval'th frame once it
+is simulated with confirmed input, so its checksum is known. Every frame is,
+either as it's first played or when a rollback replays it.
+*/
+func (s *Sync) SetSavedFrameInterval(interval int) {
+	s.savedFrameInterval = interval
+}
+
+/*
+Saves only at the last confirmed frame instead of every frame. A misprediction
+then rolls back to that frame and resimulates from there, which suits games
+where saving costs more than simulating.
+*/
+func (s *Sync) SetSparseSaving(enabled bool) {
+	s.sparseSaving = enabled
+}
+
+func (s *Sync) SparseSaving() bool {
+	return s.sparseSaving
+}
+
+// Keeps the inputs for this many frames before the last confirmed one, so
+// ReplayFrom can reach back that far.
+func (s *Sync) SetRetainedFrames(frames int) {
+	s.retainedFrames = frames
+}
+
+// Whether ReplayFrom(frame) would find all the inputs it needs.
+func (s *Sync) CanReplayFrom(frame int) bool {
+	if frame < 0 || frame > s.frameCount {
+		return false
+	}
+	var seekTo int
+	if !s.CheckSimulationConsistency(&seekTo) && seekTo < frame {
+		return false
+	}
+	for i := 0; i < s.config.numPlayers; i++ {
+		if s.inputQueues[i].Discarded(frame) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Resimulates from frame up to the current frame, after the session has already
+restored the state for frame itself rather than loading one of our saves. This
+is how a peer takes over another peer's state after a desync.
+*/
+func (s *Sync) ReplayFrom(frame int) error {
+	if !s.CanReplayFrom(frame) {
+		return newError(ErrorCodeStateNotFound, "ErrorCodeStateNotFound",
+			errors.New("ggpo Sync ReplayFrom: the inputs since frame are gone"))
+	}
+	frameCount := s.frameCount
+	count := s.frameCount - frame
+
+	s.rollingBack = true
+	s.frameCount = frame
 	s.SaveCurrentFrame()
+	err := s.ResetPrediction(s.frameCount)
+	if err != nil {
+		s.rollingBack = false
+		return err
+	}
+	resimulateStart := time.Now()
+	for i := 0; i < count; i++ {
+		s.session.AdvanceFrame(0)
+	}
+	s.RecordRollback(count, 0, time.Since(resimulateStart))
+	s.rollingBack = false
+
+	if s.frameCount != frameCount {
+		return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure",
+			errors.New("ggpo Sync ReplayFrom: s.frameCount != frameCount"))
+	}
+	return nil
 }
 
 func (s *Sync) AdjustSimulation(seekTo int) error {
+	if s.sparseSaving && s.lastSavedFrame < seekTo {
+		seekTo = s.lastSavedFrame
+	}
 	frameCount := s.frameCount
 	count := s.frameCount - seekTo
 
@@ -198,42 +336,79 @@ func (s *Sync) AdjustSimulation(seekTo int) error {
 	s.rollingBack = true
 
 	// flush our input queue and load the last frame
+	loadStart := time.Now()
 	err := s.LoadFrame(seekTo)
 	if err != nil {
-		panic(err)
+		s.rollingBack = false
+		return err
 	}
+	loadTime := time.Since(loadStart)
 
 	if s.frameCount != seekTo {
-		return errors.New("ggpo Sync AdjustSimulation: s.frameCount != seekTo")
+		s.rollingBack = false
+		return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure",
+			errors.New("ggpo Sync AdjustSimulation: s.frameCount != seekTo"))
 	}
 
 	// Advance frame by frame (stuffing notifications back to
 	// the master).
-	s.ResetPrediction(s.frameCount)
+	err = s.ResetPrediction(s.frameCount)
+	if err != nil {
+		s.rollingBack = false
+		return err
+	}
+	resimulateStart := time.Now()
 	for i := 0; i < count; i++ {
 		s.session.AdvanceFrame(0)
 	}
+	s.RecordRollback(count, loadTime, time.Since(resimulateStart))
 
+	s.rollingBack = false
 	if s.frameCount != frameCount {
-		return errors.New("ggpo Sync AdjustSimulation: s.frameCount != frameCount")
+		return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure",
+			errors.New("ggpo Sync AdjustSimulation: s.frameCount != frameCount"))
 	}
-	s.rollingBack = false
 
 	util.Log.Printf("---\n")
 	return nil
 }
 
+// Adds a rollback of depth frames to the session stats.
+func (s *Sync) RecordRollback(depth int, loadTime time.Duration, resimulateTime time.Duration) {
+	if depth <= 0 {
+		return
+	}
+	for len(s.stats.RollbackDepth) <= depth {
+		s.stats.RollbackDepth = append(s.stats.RollbackDepth, 0)
+	}
+	s.stats.Rollbacks++
+	s.stats.RollbackDepth[depth]++
+	s.stats.ResimulatedFrames += depth
+	s.stats.LoadStateTime += loadTime
+	s.stats.ResimulateTime += resimulateTime
+}
+
+// A copy of the stats so far, including a stall at the barrier still in progress.
+func (s *Sync) SessionStats() SessionStats {
+	stats := s.stats
+	stats.RollbackDepth = append([]int(nil), s.stats.RollbackDepth...)
+	if !s.barrierStart.IsZero() {
+		stats.BarrierTime += time.Since(s.barrierStart)
+	}
+	return stats
+}
+
 func (s *Sync) LoadFrame(frame int) error {
 	if frame == s.frameCount {
 		util.Log.Printf("Skipping NOP.\n")
 		return nil
 	}
 	// Move the head pointer back and load it up
-	var err error
-	s.savedState.head, err = s.FindSavedFrameIndex(frame)
+	head, err := s.FindSavedFrameIndex(frame)
 	if err != nil {
-		panic(err)
+		return newError(ErrorCodeStateNotFound, "ErrorCodeStateNotFound", err)
 	}
+	s.savedState.head = head
 	state := s.savedState.frames[s.savedState.head]
 
 	util.Log.Printf("=== Loading frame info %d (checksum: %08x).\n",
@@ -255,6 +430,7 @@ func (s *Sync) SaveCurrentFrame() {
 	// SavedFrame *state = _savedstate.frames + _savedstate.head;
 	state := s.savedState.frames[s.savedState.head]
 	state.frame = s.frameCount
+	s.lastSavedFrame = s.frameCount
 	checksum := s.session.SaveGameState(s.savedState.head)
 	state.checksum = checksum
 
@@ -271,8 +447,7 @@ func (s *Sync) GetLastSavedFrame() savedFrame {
 	return s.savedState.frames[i]
 }
 
-// Trying to load a frame when it hasn't been saved causes an error
-// that will panic up the chair.
+// Trying to load a frame when it hasn't been saved causes an error.
 func (s *Sync) FindSavedFrameIndex(frame int) (int, error) {
 
 	count := len(s.savedState.frames)
@@ -292,11 +467,59 @@ func (s *Sync) CreateQueues(config SyncConfig) bool {
 
 	s.inputQueues = make([]input.InputQueue, s.config.numPlayers)
 	for i := 0; i < s.config.numPlayers; i++ {
-		s.inputQueues[i] = input.NewInputQueue(i, s.config.inputSize)
+		s.inputQueues[i] = input.NewInputQueue(i, s.config.inputSize, s.inputQueueLength())
 	}
 	return true
 }
 
+/*
+Input queue length, in prediction windows. At most the queue holds a window of
+predicted frames past the last confirmed one, another window before it with
+sparse saving, 2*MaxChecksumDistance frames kept for a resync (see
+SetRetainedFrames) and the frame delay. Spectators are served from the Peer's
+own history, so they don't count. That's 2*window+64 plus the delay, which
+16 windows (and the InputQueueLength floor for short windows) leaves plenty of
+headroom for.
+*/
+const inputQueueWindows = 16
+
+func (s *Sync) inputQueueLength() int {
+	return util.Max(input.InputQueueLength, inputQueueWindows*s.config.numPredictionFrames)
+}
+
+/*
+Changes how many frames ahead of the last confirmed frame the session may
+predict. The saved-state ring and input queues are rebuilt to fit, keeping any
+frame delays already set. Only possible before the first frame is run.
+*/
+func (s *Sync) SetPredictionWindow(frames int) error {
+	if s.frameCount != 0 {
+		return errors.New("ggpo Sync SetPredictionWindow: the session has already started")
+	}
+	delays := make([]int, len(s.inputQueues))
+	predictors := make([]input.Predictor, len(s.inputQueues))
+	for i := range s.inputQueues {
+		delays[i] = s.inputQueues[i].FrameDelay()
+		predictors[i] = s.inputQueues[i].Predictor()
+	}
+	s.config.numPredictionFrames = frames
+	s.maxPredictionFrames = frames
+	s.savedState = savedState{
+		frames: make([]savedFrame, frames+2)}
+	s.CreateQueues(s.config)
+	for i, delay := range delays {
+		s.inputQueues[i].SetFrameDelay(delay)
+		if predictors[i] != nil {
+			s.inputQueues[i].SetPredictor(predictors[i])
+		}
+	}
+	return nil
+}
+
+func (s *Sync) PredictionWindow() int {
+	return s.maxPredictionFrames
+}
+
 func (s *Sync) CheckSimulationConsistency(seekTo *int) bool {
 
 	firstInorrect := input.NullFrame
@@ -321,13 +544,36 @@ func (s *Sync) SetFrameDelay(queue int, delay int) {
 	s.inputQueues[queue].SetFrameDelay(delay)
 }
 
-func (s *Sync) ResetPrediction(frameNumber int) {
+func (s *Sync) FrameDelay(queue int) int {
+	return s.inputQueues[queue].FrameDelay()
+}
+
+func (s *Sync) ScheduleFrameDelay(queue int, frame int, delay int) {
+	s.inputQueues[queue].ScheduleFrameDelay(frame, delay)
+}
+
+// The confirmed input of a single queue, false if frame hasn't been added yet.
+func (s *Sync) GetConfirmedInput(queue int, frame int) (input.GameInput, bool, error) {
+	var in input.GameInput
+	ok, err := s.inputQueues[queue].GetConfirmedInput(frame, &in)
+	if err != nil {
+		return in, false, newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
+	}
+	return in, ok, nil
+}
+
+func (s *Sync) SetInputPredictor(queue int, predictor InputPredictor) {
+	s.inputQueues[queue].SetPredictor(predictor)
+}
+
+func (s *Sync) ResetPrediction(frameNumber int) error {
 	for i := 0; i < s.config.numPlayers; i++ {
 		err := s.inputQueues[i].ResetPrediction(frameNumber)
 		if err != nil {
-			panic(err)
+			return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
 		}
 	}
+	return nil
 }
 
 func (s *Sync) FrameCount() int {
@@ -44,13 +44,10 @@ func TestSyncLoadFrameCharacterization(t *testing.T) {
 		&session, 8, 2, 4,
 	)
 	sync := ggpo.NewSync(peerConnection, &syncConfig)
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic when load frame tried to load an unsaved frame")
-		}
-	}()
-	sync.LoadFrame(6)
-
+	err := sync.LoadFrame(6)
+	if !hasErrorCode(err, ggpo.ErrorCodeStateNotFound) {
+		t.Errorf("Loading an unsaved frame should be ErrorCodeStateNotFound, got %v", err)
+	}
 }
 func TestSyncIncrementFrame(t *testing.T) {
 	session := mocks.NewFakeSession()
@@ -71,7 +68,7 @@ func TestSyncIncrementFrame(t *testing.T) {
 		t.Errorf("expected '%#v' but got '%#v'", want, got)
 	}
 }
-func TestSyncAdustSimulationPanicIfSeekToUnsavedFrame(t *testing.T) {
+func TestSyncAdustSimulationErrorIfSeekToUnsavedFrame(t *testing.T) {
 	session := mocks.NewFakeSession()
 
 	peerConnection := []messages.UdpConnectStatus{
@@ -82,13 +79,13 @@ func TestSyncAdustSimulationPanicIfSeekToUnsavedFrame(t *testing.T) {
 		&session, 8, 2, 4,
 	)
 	sync := ggpo.NewSync(peerConnection, &syncConfig)
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic when AdjustSimulation attempted to load an unsaved frame.")
-		}
-	}()
-	sync.AdjustSimulation(18)
-
+	err := sync.AdjustSimulation(18)
+	if !hasErrorCode(err, ggpo.ErrorCodeStateNotFound) {
+		t.Errorf("AdjustSimulation to an unsaved frame should be ErrorCodeStateNotFound, got %v", err)
+	}
+	if sync.InRollback() {
+		t.Errorf("A failed AdjustSimulation shouldn't leave sync rolling back.")
+	}
 }
 func TestSyncAjdustSimulationError(t *testing.T) {
 	session := mocks.NewFakeSession()
@@ -147,10 +144,10 @@ func TestSyncAddLocalInput(t *testing.T) {
 	sync := ggpo.NewSync(peerConnection, &syncConfig)
 	queue := 0
 	input := input.GameInput{}
-	success := sync.AddLocalInput(queue, &input)
+	err := sync.AddLocalInput(queue, &input)
 	want := 0
 	got := input.Frame
-	if success == false {
+	if err != nil {
 		t.Errorf("The AddLocalInput failed.")
 	}
 	if want != got {
@@ -175,10 +172,10 @@ func TestSyncAddLocalInputAfterIncrementFrame(t *testing.T) {
 
 	queue := 0
 	input := input.GameInput{}
-	success := sync.AddLocalInput(queue, &input)
+	err := sync.AddLocalInput(queue, &input)
 	want := 2
 	got := input.Frame
-	if success == false {
+	if err != nil {
 		t.Errorf("The AddLocalInput failed.")
 	}
 	if want != got {
@@ -196,7 +193,7 @@ func TestSyncSynchronizeInputsNoInput(t *testing.T) {
 		&session, 8, 2, 4,
 	)
 	sync := ggpo.NewSync(peerConnection, &syncConfig)
-	inputs, disconnectFlags := sync.SynchronizeInputs()
+	inputs, disconnectFlags, _ := sync.SynchronizeInputs()
 	want := 2
 	got := len(inputs)
 	if want != got {
@@ -230,7 +227,7 @@ func TestSyncSynchronizeInputsWithLocalInputs(t *testing.T) {
 	input := input.GameInput{Bits: []byte{1, 2, 3, 4}}
 	sync.AddLocalInput(queue, &input)
 
-	inputs, disconnectFlags := sync.SynchronizeInputs()
+	inputs, disconnectFlags, _ := sync.SynchronizeInputs()
 	want := 2
 	got := len(inputs)
 	if want != got {
@@ -262,7 +259,7 @@ func TestSyncSynchronizeInputsWithRemoteInputs(t *testing.T) {
 	input := input.GameInput{Bits: []byte{1, 2, 3, 4}}
 	sync.AddRemoteInput(queue, &input)
 
-	inputs, _ := sync.SynchronizeInputs()
+	inputs, _, _ := sync.SynchronizeInputs()
 	want := []byte{1, 2, 3, 4}
 	got := inputs[1]
 	if !bytes.Equal(want, got) {
@@ -291,7 +288,7 @@ func TestSyncSynchronizeInputsWithBothInputs(t *testing.T) {
 	sync.AddRemoteInput(queue, &input1)
 	sync.AddLocalInput(0, &input2)
 
-	inputs, _ := sync.SynchronizeInputs()
+	inputs, _, _ := sync.SynchronizeInputs()
 	want := []byte{1, 2, 3, 4}
 	got := inputs[1]
 	if !bytes.Equal(want, got) {
@@ -324,7 +321,7 @@ func TestSyncGetConfirmedInputs(t *testing.T) {
 	sync.AddRemoteInput(queue, &input1)
 	sync.AddLocalInput(0, &input2)
 
-	inputs, _ := sync.GetConfirmedInputs(0)
+	inputs, _, _ := sync.GetConfirmedInputs(0)
 	want := []byte{1, 2, 3, 4}
 	got := inputs[1]
 	if !bytes.Equal(want, got) {
@@ -341,7 +338,7 @@ func TestSyncGetConfirmedInputs(t *testing.T) {
 }
 
 // Characterization Test
-func TestSyncAddLocalInputPanic(t *testing.T) {
+func TestSyncAddLocalInputOutOfSequence(t *testing.T) {
 	session := mocks.NewFakeSession()
 
 	peerConnection := []messages.UdpConnectStatus{
@@ -358,13 +355,10 @@ func TestSyncAddLocalInputPanic(t *testing.T) {
 	sync.AddRemoteInput(queue, &input1)
 	sync.AddLocalInput(0, &input2)
 	//sync.SetLastConfirmedFrame(8)
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic when AddLocalInput attempted to add an input even when the frame hadn't been incremented.")
-		}
-	}()
-	sync.AddLocalInput(0, &input2)
-
+	err := sync.AddLocalInput(0, &input2)
+	if !hasErrorCode(err, ggpo.ErrorCodeInvalidInput) {
+		t.Errorf("AddLocalInput for a frame that hadn't been incremented should be ErrorCodeInvalidInput, got %v", err)
+	}
 }
 
 func TestSyncAddLocalInputNoPanic(t *testing.T) {
@@ -386,7 +380,7 @@ func TestSyncAddLocalInputNoPanic(t *testing.T) {
 	sync.AddLocalInput(0, &input2)
 }
 
-func TestSyncAddRemoteInputPanic(t *testing.T) {
+func TestSyncAddRemoteInputOutOfSequence(t *testing.T) {
 	session := mocks.NewFakeSession()
 
 	peerConnection := []messages.UdpConnectStatus{
@@ -400,12 +394,10 @@ func TestSyncAddRemoteInputPanic(t *testing.T) {
 	input1 := input.GameInput{Bits: []byte{1, 2, 3, 4}}
 	input2 := input.GameInput{Bits: []byte{5, 6, 7, 8}}
 	sync.AddRemoteInput(1, &input2)
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic when AddRemoteInput attempted to add an input even when the frame hadn't been incremented.")
-		}
-	}()
-	sync.AddRemoteInput(1, &input1)
+	err := sync.AddRemoteInput(1, &input1)
+	if !hasErrorCode(err, ggpo.ErrorCodeInvalidInput) {
+		t.Errorf("AddRemoteInput for a frame that hadn't been incremented should be ErrorCodeInvalidInput, got %v", err)
+	}
 }
 
 // Characterization mocks. No idea why this works and the above doesn't.
@@ -458,6 +450,162 @@ func TestSyncAddFrameDelay(t *testing.T) {
 		sync.AddRemoteInput(1, &input)
 	*/
 }
+func TestSyncSetPredictionWindow(t *testing.T) {
+	session := mocks.NewFakeSession()
+
+	peerConnection := []messages.UdpConnectStatus{
+		{Disconnected: false, LastFrame: 12},
+		{Disconnected: false, LastFrame: 13},
+	}
+	syncConfig := ggpo.NewSyncConfig(
+		&session, 8, 2, 4,
+	)
+	sync := ggpo.NewSync(peerConnection, &syncConfig)
+	sync.SetFrameDelay(0, 2)
+	window := 12
+	err := sync.SetPredictionWindow(window)
+	if err != nil {
+		t.Errorf("Error when setting the prediction window %s", err)
+	}
+
+	accepted := 0
+	for i := 0; i < window+2; i++ {
+		in := input.GameInput{Bits: []byte{1, 2, 3, 4}}
+		if sync.AddLocalInput(0, &in) != nil {
+			break
+		}
+		if i == 0 && in.Frame != 2 {
+			t.Errorf("The frame delay should survive changing the prediction window, input went to frame %d", in.Frame)
+		}
+		accepted++
+		sync.AdvanceFrame()
+	}
+	if accepted != window {
+		t.Errorf("expected the prediction barrier at %d frames but it was at %d", window, accepted)
+	}
+
+	err = sync.SetPredictionWindow(15)
+	if err == nil {
+		t.Errorf("Changing the prediction window after the session started should be an error.")
+	}
+}
+
+func TestSyncPredictionBarrierStats(t *testing.T) {
+	session := mocks.NewFakeSession()
+
+	peerConnection := []messages.UdpConnectStatus{
+		{Disconnected: false, LastFrame: 12},
+		{Disconnected: false, LastFrame: 13},
+	}
+	window := 8
+	syncConfig := ggpo.NewSyncConfig(
+		&session, window, 2, 4,
+	)
+	sync := ggpo.NewSync(peerConnection, &syncConfig)
+	for i := 0; i < window; i++ {
+		in := input.GameInput{Bits: []byte{1, 2, 3, 4}}
+		sync.AddLocalInput(0, &in)
+		sync.AdvanceFrame()
+	}
+	for i := 0; i < 3; i++ {
+		in := input.GameInput{Bits: []byte{1, 2, 3, 4}}
+		err := sync.AddLocalInput(0, &in)
+		if !hasErrorCode(err, ggpo.ErrorCodePredictionThreshod) {
+			t.Errorf("Input past the prediction window should be rejected, got %v", err)
+		}
+	}
+	stats := sync.SessionStats()
+	if stats.BarrierStalls != 1 || stats.BarrierRejections != 3 {
+		t.Errorf("expected 1 stall and 3 rejected inputs, got %+v", stats)
+	}
+}
+
+// Sums every player's first input byte, driving sync the way a session would.
+type summingGame struct {
+	sync      *ggpo.Sync
+	total     int
+	saves     map[int]int
+	saveCount int
+}
+
+func (g *summingGame) SaveGameState(stateID int) int {
+	g.saves[stateID] = g.total
+	g.saveCount++
+	return g.total
+}
+
+func (g *summingGame) LoadGameState(stateID int) {
+	g.total = g.saves[stateID]
+}
+
+func (g *summingGame) AdvanceFrame(flags int) {
+	values, _, _ := g.sync.SynchronizeInputs()
+	for _, v := range values {
+		g.total += int(v[0])
+	}
+	g.sync.AdvanceFrame()
+}
+
+func (g *summingGame) OnEvent(info *ggpo.Event) {}
+
+func runSummingGame(t *testing.T, sparse bool) summingGame {
+	game := summingGame{saves: make(map[int]int)}
+	peerConnection := []messages.UdpConnectStatus{
+		{Disconnected: false, LastFrame: -1},
+		{Disconnected: false, LastFrame: -1},
+	}
+	syncConfig := ggpo.NewSyncConfig(
+		&game, 8, 2, 4,
+	)
+	sync := ggpo.NewSync(peerConnection, &syncConfig)
+	game.sync = &sync
+	sync.SetSparseSaving(sparse)
+
+	latency := 4
+	frames := 40
+	remote := func(frame int) {
+		in := input.GameInput{Frame: frame, Size: 4, Bits: []byte{byte(frame / 8 % 3), 0, 0, 0}}
+		sync.AddRemoteInput(1, &in)
+	}
+	for f := 0; f < frames; f++ {
+		in := input.GameInput{Bits: []byte{1, 0, 0, 0}}
+		if sync.AddLocalInput(0, &in) != nil {
+			t.Fatalf("Input for frame %d was rejected at the prediction barrier.", f)
+		}
+		game.AdvanceFrame(0)
+		if f >= latency {
+			remote(f - latency)
+		}
+		if err := sync.CheckSimulation(0); err != nil {
+			t.Fatalf("Rolling back at frame %d failed: %s", f, err)
+		}
+		sync.SetLastConfirmedFrame(f - latency)
+	}
+	for f := frames - latency; f < frames; f++ {
+		remote(f)
+	}
+	if err := sync.CheckSimulation(0); err != nil {
+		t.Fatalf("Rolling back at the end failed: %s", err)
+	}
+
+	want := 0
+	for f := 0; f < frames; f++ {
+		want += 1 + f/8%3
+	}
+	if game.total != want {
+		t.Errorf("expected the game total to be %d after rolling back but it was %d", want, game.total)
+	}
+	return game
+}
+
+func TestSyncSparseSaving(t *testing.T) {
+	dense := runSummingGame(t, false)
+	sparse := runSummingGame(t, true)
+	if sparse.saveCount >= dense.saveCount {
+		t.Errorf("Sparse saving should save less often, saved %d times vs %d", sparse.saveCount, dense.saveCount)
+	}
+}
+
 func TestSyncUseAfterClose(t *testing.T) {
 	session := mocks.NewFakeSession()
 
@@ -483,3 +631,8 @@ func TestSyncUseAfterClose(t *testing.T) {
 
 	sync.AddLocalInput(0, &input2)
 }
+
+func hasErrorCode(err error, code ggpo.ErrorCode) bool {
+	ggpoErr, ok := err.(ggpo.Error)
+	return ok && ggpoErr.Code == code
+}
@@ -1,13 +1,15 @@
 package ggpo
 
 import (
-	"github.com/assemblaj/ggpo/internal/util"
+	"io"
 	"os"
+	"time"
 
 	"github.com/assemblaj/ggpo/internal/buffer"
 	"github.com/assemblaj/ggpo/internal/input"
 	"github.com/assemblaj/ggpo/internal/polling"
 	"github.com/assemblaj/ggpo/internal/protocol"
+	"github.com/assemblaj/ggpo/internal/util"
 	"github.com/assemblaj/ggpo/transport"
 )
 
@@ -27,6 +29,9 @@ type SyncTest struct {
 	savedFrames   buffer.RingBuffer[savedInfo]
 	strict        bool
 	leniantRevert bool
+
+	// Only set while recording, see SetReplayRecording
+	replay *replayRecorder
 }
 
 type savedInfo struct {
@@ -46,7 +51,7 @@ func NewSyncTest(cb Session,
 		checkDistance: frames,
 		savedFrames:   buffer.NewRingBuffer[savedInfo](32)}
 	s.currentInput.Erase()
-	s.currentInput.Bits = make([]byte, input.GameInputMaxBytes*input.GameInputMaxPlayers)
+	s.currentInput.Bits = make([]byte, inputSize*numPlayers)
 	s.currentInput.Size = inputSize
 	var config SyncConfig
 	config.session = s.session
@@ -97,7 +102,7 @@ func (s *SyncTest) SyncInput(discconectFlags *int) ([][]byte, error) {
 		var err error
 		info, err = s.savedFrames.Front()
 		if err != nil {
-			panic(err)
+			return nil, newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
 		}
 		s.lastInput = *info.input.Clone()
 	} else {
@@ -145,30 +150,45 @@ func (s *SyncTest) AdvanceFrame(checksum uint32) error {
 
 	err = s.savedFrames.Push(info)
 	if err != nil {
-		panic(err)
+		return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
+	}
+
+	if s.replay != nil {
+		if checksum == DefaultChecksum && usesSavedChecksums(s.session) {
+			checksum = uint32(info.checksum)
+		}
+		err = s.recordReplay(frame-1, checksum)
+		if err != nil {
+			util.Log.Printf("Stopped recording the replay: %s\n", err)
+			s.replay = nil
+		}
 	}
 
 	if frame-s.lastVerified == s.checkDistance {
 		// We've gone far enough ahead and should now now start replaying frames
 		// Load the last verified frame and set the rollback flag to true.
+		loadStart := time.Now()
 		err = s.sync.LoadFrame(s.lastVerified)
 		if err != nil {
-			panic(err)
+			return err
 		}
+		loadTime := time.Since(loadStart)
 
 		s.rollingBack = true
+		resimulateStart := time.Now()
+		depth := s.savedFrames.Size()
 		for !s.savedFrames.Empty() {
 			s.session.AdvanceFrame(0)
 
 			// Verify that the checksum of this frame is the same as the one in our
 			// list
 			info, err = s.savedFrames.Front()
-			if err != nil {
-				panic(err)
+			if err == nil {
+				err = s.savedFrames.Pop()
 			}
-			err = s.savedFrames.Pop()
 			if err != nil {
-				panic(err)
+				s.rollingBack = false
+				return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
 			}
 			if info.frame != s.sync.FrameCount() {
 				util.Log.Printf("Frame number %d does not match saved frame number %d", info.frame, frame)
@@ -200,24 +220,51 @@ func (s *SyncTest) AdvanceFrame(checksum uint32) error {
 			}
 			util.Log.Printf("Checksum %08d for frame %d matches.\n", checksum, info.frame)
 		}
+		s.sync.RecordRollback(depth, loadTime, time.Since(resimulateStart))
 		s.lastVerified = frame
 		s.rollingBack = false
 	}
 	return nil
 }
 
-func (s *SyncTest) revert() {
+// Every input is final as soon as its frame runs, so frames are written as they're played.
+func (s *SyncTest) recordReplay(frame int, checksum uint32) error {
+	played := input.GameInput{Frame: frame, Size: len(s.lastInput.Bits) + 1}
+	played.Bits = append(append(played.Bits, s.lastInput.Bits...), 0)
+	err := s.replay.writeFrame(&played)
+	if err != nil {
+		return err
+	}
+	s.replay.setChecksum(frame, checksum)
+	return s.replay.writeChecksums(frame)
+}
+
+/*
+Records every frame played and a checksum every DefaultReplayChecksumInterval
+frames to w, see LoadReplay. game is stored in the header for the game to
+recognize its replays by. Must be set before the first Idle.
+*/
+func (s *SyncTest) SetReplayRecording(w io.Writer, game []byte) error {
+	if w == nil || s.running {
+		return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
+	}
+	s.replay = newReplayRecorder(w, s.numPlayers, s.currentInput.Size, game)
+	return nil
+}
+
+func (s *SyncTest) revert() error {
 	err := s.sync.LoadFrame(s.lastVerified)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	s.leniantRevert = true
 	for !s.savedFrames.Empty() {
 		err = s.savedFrames.Pop()
 		if err != nil {
-			panic(err)
+			return newError(ErrorCodeGeneralFailure, "ErrorCodeGeneralFailure", err)
 		}
 	}
+	return nil
 }
 
 func (s *SyncTest) LogGameStates(info savedInfo) {
@@ -232,6 +279,26 @@ func (s *SyncTest) DisconnectPlayer(handle PlayerHandle) error {
 func (s *SyncTest) GetNetworkStats(handle PlayerHandle) (protocol.NetworkStats, error) {
 	return protocol.NetworkStats{}, Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
 }
+func (s *SyncTest) GetSessionStats() (SessionStats, error) {
+	return s.sync.SessionStats(), nil
+}
+
+// Every player is local and confirmed as soon as their frame runs.
+func (s *SyncTest) GetPlayerStatus(handle PlayerHandle) (PlayerStatus, error) {
+	if handle < 0 || int(handle) >= s.numPlayers {
+		return PlayerStatus{}, Error{Code: ErrorCodeInvalidPlayerHandle, Name: "ErrorCodeInvalidPlayerHandle"}
+	}
+	status := PlayerStatus{
+		Local:                 true,
+		State:                 PlayerStateSynchronizing,
+		LastConfirmedFrame:    s.sync.FrameCount() - 1,
+		FramesUntilDisconnect: -1,
+	}
+	if s.running {
+		status.State = PlayerStateRunning
+	}
+	return status, nil
+}
 func (s *SyncTest) SetFrameDelay(player PlayerHandle, delay int) error {
 	return Error{Code: ErrorCodeInvalidRequest, Name: "ErrorCodeInvalidRequest"}
 }
@@ -294,3 +294,76 @@ func TestSyncTestBackendCloseError(t *testing.T) {
 		t.Errorf("The code did not error when using an unsupported Feature.")
 	}
 }
+
+func TestSyncTestBackendSessionStats(t *testing.T) {
+	session := mocks.NewFakeSessionWithBackend()
+	var stb ggpo.SyncTest
+	session.SetBackend(&stb)
+	player := ggpo.NewLocalPlayer(20, 1)
+	checkDistance := 8
+	stb = ggpo.NewSyncTest(&session, 1, checkDistance, 4, true)
+
+	var handle ggpo.PlayerHandle
+	stb.AddPlayer(&player, &handle)
+	inputBytes := []byte{1, 2, 3, 4}
+	var disconnectFlags int
+
+	for i := 0; i < checkDistance+1; i++ {
+		stb.Idle(0)
+		result := stb.AddLocalInput(handle, inputBytes, 4)
+		if result == nil {
+			vals, result := stb.SyncInput(&disconnectFlags)
+			if result == nil {
+				session.Game.UpdateByInputs(vals)
+				stb.AdvanceFrame(ggpo.DefaultChecksum)
+			}
+		}
+	}
+	stats, err := stb.GetSessionStats()
+	if err != nil {
+		t.Errorf("Error when getting session stats %s", err)
+	}
+	if stats.Rollbacks != 1 {
+		t.Errorf("expected 1 rollback but got %d", stats.Rollbacks)
+	}
+	if len(stats.RollbackDepth) <= checkDistance || stats.RollbackDepth[checkDistance] != 1 {
+		t.Errorf("expected one rollback %d frames deep, got %v", checkDistance, stats.RollbackDepth)
+	}
+	if stats.ResimulatedFrames != checkDistance {
+		t.Errorf("expected %d resimulated frames but got %d", checkDistance, stats.ResimulatedFrames)
+	}
+}
+
+func TestSyncTestBackendGetPlayerStatus(t *testing.T) {
+	session := mocks.NewFakeSessionWithBackend()
+	var stb ggpo.SyncTest
+	session.SetBackend(&stb)
+	stb = ggpo.NewSyncTest(&session, 1, 8, 4, false)
+	player := ggpo.NewLocalPlayer(20, 1)
+	var handle ggpo.PlayerHandle
+	stb.AddPlayer(&player, &handle)
+
+	status, err := stb.GetPlayerStatus(handle)
+	if err != nil {
+		t.Fatalf("Error when getting the player status %s", err)
+	}
+	if !status.Local || status.State != ggpo.PlayerStateSynchronizing {
+		t.Errorf("expected a synchronizing local player before the first idle but got %#v", status)
+	}
+
+	stb.Idle(0)
+	var disconnectFlags int
+	for i := 0; i < 3; i++ {
+		stb.AddLocalInput(handle, []byte{1, 2, 3, 4}, 4)
+		stb.SyncInput(&disconnectFlags)
+		stb.AdvanceFrame(ggpo.DefaultChecksum)
+	}
+	status, _ = stb.GetPlayerStatus(handle)
+	if status.State != ggpo.PlayerStateRunning || status.LastConfirmedFrame != 2 {
+		t.Errorf("expected a running player confirmed up to frame 2 but got %#v", status)
+	}
+	_, err = stb.GetPlayerStatus(1)
+	if err == nil {
+		t.Errorf("Getting the status of an invalid handle should be an error.")
+	}
+}